@@ -0,0 +1,140 @@
+// Package client is a Go client for the DBHub.io API.  It's used by the dio command line tool, and can be used
+// directly by other Go code which needs to work with databases on DBHub.io.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client talks to a DBHub.io server, as a given user.  The zero value isn't usable, so use New to create one
+type Client struct {
+	// BaseURL is the address of the server.  eg https://db4s.dbhub.io
+	BaseURL string
+
+	// HTTPClient is used for all requests.  It needs to present the user's client certificate to the server
+	HTTPClient *http.Client
+
+	// User is the name of the user the client certificate belongs to
+	User string
+
+	// UserAgent is sent with every request
+	UserAgent string
+}
+
+// Error is returned when a request to the server fails.  For failures where the server responded, StatusCode and
+// Message hold the HTTP status and the body of the response.  Otherwise Err holds the reason
+type Error struct {
+	Err        error
+	Message    string
+	Op         string // What was being done.  eg "download database"
+	StatusCode int
+}
+
+// Error returns a description of the failure
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Op, e.Err)
+	}
+	if e.Message != "" {
+		return fmt.Sprintf("%s: HTTP status %d: %s", e.Op, e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("%s: HTTP status %d - '%s'", e.Op, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Unwrap returns the underlying error, for failures where the server didn't respond or doesn't support the request
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New creates a client for the server at baseURL.  The TLS configuration needs to include the user's client
+// certificate
+func New(baseURL string, user string, tlsConfig *tls.Config, userAgent string) *Client {
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}},
+		User:      user,
+		UserAgent: userAgent,
+	}
+}
+
+// IsNotFound returns true if err is an Error for a request the server answered with "404 Not Found"
+func IsNotFound(err error) bool {
+	return StatusCode(err) == http.StatusNotFound
+}
+
+// StatusCode returns the HTTP status of the response for an Error, or 0 for other errors
+func StatusCode(err error) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// Sends a request to the server.  The response is only returned when its status is one of those wanted, with the
+// caller responsible for closing its body.  Other statuses are returned as an Error
+func (c *Client) do(ctx context.Context, op string, method string, path string, params url.Values, body io.Reader,
+	contentType string, header http.Header, wanted ...int) (resp *http.Response, err error) {
+	u := c.BaseURL + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, &Error{Err: err, Op: op}
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+	resp, err = c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, &Error{Err: err, Op: op}
+	}
+	for _, s := range wanted {
+		if resp.StatusCode == s {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	return nil, &Error{Message: strings.TrimSpace(string(b)), Op: op, StatusCode: resp.StatusCode}
+}
+
+// Sends a request to the server, returning the body of the response
+func (c *Client) doBytes(ctx context.Context, op string, method string, path string, params url.Values,
+	wanted ...int) (b []byte, err error) {
+	resp, err := c.do(ctx, op, method, path, params, nil, "", nil, wanted...)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	b, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = &Error{Err: err, Op: op}
+	}
+	return
+}
+
+// Returns the query parameters identifying a database of the user
+func (c *Client) dbParams(db string) url.Values {
+	params := url.Values{}
+	params.Set("dbname", db)
+	params.Set("folder", "/")
+	params.Set("username", c.User)
+	return params
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ChangeEndpoints are the API paths SendChange can use.  They need server support which older DBHub.io servers don't
+// have, in which case the server answers with "404 Not Found" and SendChange returns ErrUnsupported
+var ChangeEndpoints = map[string]struct{}{
+	"branch/create":  {},
+	"branch/remove":  {},
+	"branch/rename":  {},
+	"branch/update":  {},
+	"release/create": {},
+	"release/remove": {},
+	"tag/create":     {},
+	"tag/remove":     {},
+}
+
+// ErrUnsupported is returned, wrapped in an Error, when the server doesn't have the endpoint for a change
+var ErrUnsupported = errors.New("The server doesn't support this change")
+
+// Download requests a database from the server.  Either the head of a branch, or a specific commit, is retrieved.
+// When offset is above zero, only the part of the database after it is requested, for resuming an interrupted
+// download.  Servers which don't support that send the whole database instead, with a status of 200 rather than 206.
+// On success, the database is streamed from the body of the returned response, which the caller needs to close
+func (c *Client) Download(ctx context.Context, db string, branch string, commit string, offset int64) (
+	resp *http.Response, err error) {
+	params := url.Values{}
+	if branch != "" {
+		params.Set("branch", branch)
+	} else {
+		params.Set("commit", commit)
+	}
+	var header http.Header
+	wanted := []int{http.StatusOK}
+	if offset > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+		wanted = append(wanted, http.StatusPartialContent)
+	}
+	return c.do(ctx, "download database", http.MethodGet, c.dbPath(db), params, nil, "", header, wanted...)
+}
+
+// GetMetadata retrieves the branches, commits, releases, and tags of a database.  If the database isn't on the
+// server, an Error with a StatusCode of 404 is returned
+func (c *Client) GetMetadata(ctx context.Context, db string) (meta Metadata, err error) {
+	b, err := c.doBytes(ctx, "retrieve metadata", http.MethodGet, "/metadata/get", c.dbParams(db), http.StatusOK)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &meta)
+	if err != nil {
+		err = &Error{Err: err, Op: "retrieve metadata"}
+	}
+	return
+}
+
+// ListDatabases retrieves the list of the user's databases
+func (c *Client) ListDatabases(ctx context.Context) (list []DatabaseListEntry, err error) {
+	b, err := c.doBytes(ctx, "list databases", http.MethodGet, "/"+url.PathEscape(c.User), nil, http.StatusOK)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &list)
+	if err != nil {
+		err = &Error{Err: err, Op: "list databases"}
+	}
+	return
+}
+
+// SendChange applies a change to a database on the server, such as creating a tag or removing a branch.  The
+// endpoint is the API path for the change (eg "tag/create"), which must be one of ChangeEndpoints, and params holds its
+// details.  Servers without support for the endpoint give an Error wrapping ErrUnsupported
+func (c *Client) SendChange(ctx context.Context, endpoint string, db string, params map[string]string) (err error) {
+	if _, ok := ChangeEndpoints[endpoint]; !ok {
+		return fmt.Errorf("Unknown change endpoint '%s'", endpoint)
+	}
+	p := c.dbParams(db)
+	for name, value := range params {
+		p.Set(name, value)
+	}
+	_, err = c.doBytes(ctx, "send change", http.MethodPost, "/"+endpoint, p, http.StatusOK, http.StatusCreated)
+	if IsNotFound(err) {
+		return &Error{Err: ErrUnsupported, Op: "send change", StatusCode: http.StatusNotFound}
+	}
+	return
+}
+
+// Returns the API path for a database of the user
+func (c *Client) dbPath(db string) string {
+	return fmt.Sprintf("/%s/%s", url.PathEscape(c.User), url.PathEscape(db))
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+// LicenceAdd adds a licence to the server, reading its text from r
+func (c *Client) LicenceAdd(ctx context.Context, l LicenceUpload, r io.Reader) (err error) {
+	params := url.Values{}
+	params.Set("display_order", fmt.Sprintf("%d", l.DisplayOrder))
+	params.Set("licence_id", l.ID)
+	if l.FileFormat != "" {
+		params.Set("file_format", l.FileFormat)
+	}
+	if l.FullName != "" {
+		params.Set("licence_name", l.FullName)
+	}
+	if l.SourceURL != "" {
+		params.Set("source_url", l.SourceURL)
+	}
+
+	// Licence texts are small, so the form is assembled in memory
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file1", l.ID)
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(part, r); err != nil {
+		return
+	}
+	if err = mw.Close(); err != nil {
+		return
+	}
+	resp, err := c.do(ctx, "add licence", http.MethodPost, "/licence/add", params, &body, mw.FormDataContentType(),
+		nil, http.StatusCreated)
+	if err != nil {
+		return
+	}
+	return resp.Body.Close()
+}
+
+// LicenceGet retrieves the text of a licence, along with its content type.  eg "text/plain" or "text/html"
+func (c *Client) LicenceGet(ctx context.Context, id string) (text []byte, contentType string, err error) {
+	params := url.Values{}
+	params.Set("licence", id)
+	resp, err := c.do(ctx, "retrieve licence", http.MethodGet, "/licence/get", params, nil, "", nil, http.StatusOK)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	text, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = &Error{Err: err, Op: "retrieve licence"}
+		return
+	}
+	return text, resp.Header.Get("Content-Type"), nil
+}
+
+// LicenceList retrieves the licences known to the server, keyed by their short names
+func (c *Client) LicenceList(ctx context.Context) (list map[string]LicenceEntry, err error) {
+	b, err := c.doBytes(ctx, "list licences", http.MethodGet, "/licence/list", nil, http.StatusOK)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &list)
+	if err != nil {
+		err = &Error{Err: err, Op: "list licences"}
+	}
+	return
+}
+
+// LicenceRemove removes a licence from the server
+func (c *Client) LicenceRemove(ctx context.Context, id string) (err error) {
+	params := url.Values{}
+	params.Set("licence_id", id)
+	_, err = c.doBytes(ctx, "remove licence", http.MethodPost, "/licence/remove", params, http.StatusOK)
+	return
+}
@@ -0,0 +1,145 @@
+package client
+
+import "time"
+
+// BranchEntry is the head commit and details of a branch
+type BranchEntry struct {
+	Commit      string `json:"commit"`
+	CommitCount int    `json:"commit_count"`
+	Description string `json:"description"`
+}
+
+// CommitEntry is a single commit in the history of a database
+type CommitEntry struct {
+	AuthorEmail    string    `json:"author_email"`
+	AuthorName     string    `json:"author_name"`
+	CommitterEmail string    `json:"committer_email"`
+	CommitterName  string    `json:"committer_name"`
+	ID             string    `json:"id"`
+	Message        string    `json:"message"`
+	OtherParents   []string  `json:"other_parents"`
+	Parent         string    `json:"parent"`
+	Timestamp      time.Time `json:"timestamp"`
+	Tree           DBTree    `json:"tree"`
+}
+
+// CommitUpload holds the details of a new commit, sent along with its database file by UploadCommit
+type CommitUpload struct {
+	AuthorEmail     string
+	AuthorName      string
+	Branch          string
+	CommitterEmail  string
+	CommitterName   string
+	CommitTimestamp time.Time // Left out of the request when zero, so the server uses the current time
+	DBShaSum        string    // The SHA256 of the database file
+	Force           bool      // Replace the branch head even if the new commit doesn't descend from it
+	LastModified    time.Time // The last modified time of the database file
+	Licence         string    // The (short) name of the licence.  Left out of the request when empty
+	Message         string
+	OtherParents    []string
+	Parent          string
+	Public          bool
+}
+
+// DatabaseListEntry is a database in the list returned by ListDatabases
+type DatabaseListEntry struct {
+	CommitID     string `json:"commit_id"`
+	DefBranch    string `json:"default_branch"`
+	LastModified string `json:"last_modified"`
+	Licence      string `json:"licence"`
+	Name         string `json:"name"`
+	OneLineDesc  string `json:"one_line_description"`
+	Public       bool   `json:"public"`
+	RepoModified string `json:"repo_modified"`
+	SHA256       string `json:"sha256"`
+	Size         int64  `json:"size"`
+	Type         string `json:"type"`
+	URL          string `json:"url"`
+}
+
+// DBTreeEntryType is the type of an entry in a commit tree
+type DBTreeEntryType string
+
+// The types of entry in a commit tree
+const (
+	EntryDatabase DBTreeEntryType = "db"
+	EntryLicence  DBTreeEntryType = "licence"
+	EntryTree     DBTreeEntryType = "tree"
+)
+
+// DBTree is the tree of a commit, listing the files it contains
+type DBTree struct {
+	ID      string        `json:"id"`
+	Entries []DBTreeEntry `json:"entries"`
+}
+
+// DBTreeEntry is a file in a commit tree
+type DBTreeEntry struct {
+	EntryType    DBTreeEntryType `json:"entry_type"`
+	LastModified time.Time       `json:"last_modified"`
+	LicenceSHA   string          `json:"licence"`
+	Name         string          `json:"name"`
+	Sha256       string          `json:"sha256"`
+	Size         int64           `json:"size"`
+}
+
+// LicenceEntry is a licence known to the server
+type LicenceEntry struct {
+	FileFormat string `json:"file_format"`
+	FullName   string `json:"full_name"`
+	Order      int    `json:"order"`
+	Sha256     string `json:"sha256"`
+	URL        string `json:"url"`
+}
+
+// LicenceUpload holds the details of a new licence, sent along with its text by LicenceAdd
+type LicenceUpload struct {
+	DisplayOrder int
+	FileFormat   string // Either "text" or "html"
+	FullName     string
+	ID           string // The short name of the licence.  eg CC0-BY-1.0
+	SourceURL    string
+}
+
+// Metadata is the history of a database on the server, with its branches, commits, releases, and tags
+type Metadata struct {
+	ActiveBranch string                  `json:"active_branch"`
+	Branches     map[string]BranchEntry  `json:"branches"`
+	Commits      map[string]CommitEntry  `json:"commits"`
+	DefBranch    string                  `json:"default_branch"`
+	Releases     map[string]ReleaseEntry `json:"releases"`
+	Tags         map[string]TagEntry     `json:"tags"`
+}
+
+// ReleaseEntry is a release of a database
+type ReleaseEntry struct {
+	Commit        string    `json:"commit"`
+	Date          time.Time `json:"date"`
+	Description   string    `json:"description"`
+	ReleaserEmail string    `json:"email"`
+	ReleaserName  string    `json:"name"`
+	Size          int64     `json:"size"`
+}
+
+// TagEntry is a tag on a commit of a database
+type TagEntry struct {
+	Commit      string    `json:"commit"`
+	Date        time.Time `json:"date"`
+	Description string    `json:"description"`
+	TaggerEmail string    `json:"email"`
+	TaggerName  string    `json:"name"`
+}
+
+// UploadResult is the server's response to a successful UploadCommit
+type UploadResult struct {
+	CommitID string `json:"commit_id"`
+	URL      string `json:"url"`
+}
+
+// UploadSession is a chunked upload in progress on the server.  Received lists the chunks the server already has, so
+// an interrupted upload can be resumed without sending them again
+type UploadSession struct {
+	ChunkSize int64  `json:"chunk_size"`
+	ID        string `json:"upload_id"`
+	Received  []int  `json:"received"`
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ChunkAttempts is the number of times sending a chunk is attempted, before giving up on the upload
+const ChunkAttempts = 3
+
+// UploadCommit uploads a database file to the server, along with the details of the commit for it.  When the server
+// supports it, the file is sent in chunks which are each checked as they arrive, and the commit is only created once
+// every chunk has been received.  If an upload is interrupted, the chunks the server already has aren't sent again
+// the next time.  Servers without chunked upload support are sent the file in a single request instead.  Either way,
+// the file is streamed from disk rather than read into memory.  If progress isn't nil, the data sent is also written
+// to it
+func (c *Client) UploadCommit(ctx context.Context, db string, cu CommitUpload, path string, fileName string,
+	progress io.Writer) (res UploadResult, err error) {
+	if progress == nil {
+		progress = ioutil.Discard
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	u, supported, err := c.startUpload(ctx, db, cu.DBShaSum, fi.Size())
+	if err != nil {
+		return
+	}
+	params := commitParams(cu)
+	var resp *http.Response
+	if supported {
+		err = c.sendChunks(ctx, u, path, fi.Size(), progress)
+		if err != nil {
+			return
+		}
+
+		// Every chunk has been sent, so ask the server to assemble them and create the commit
+		params.Set("uploadid", u.ID)
+		resp, err = c.do(ctx, "upload database", http.MethodPost, c.dbPath(db), params, nil, "", nil,
+			http.StatusCreated)
+	} else {
+		resp, err = c.uploadFile(ctx, c.dbPath(db), params, path, fileName, progress)
+	}
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = &Error{Err: err, Op: "upload database"}
+		return
+	}
+	if len(bytes.TrimSpace(b)) > 0 {
+		if err = json.Unmarshal(b, &res); err != nil {
+			err = &Error{Err: fmt.Errorf("can't parse server response: %v", err), Op: "upload database"}
+		}
+	}
+	return
+}
+
+// Returns the length of a chunk of a file.  Every chunk is the same size, except (potentially) the last one
+func chunkLength(index int, chunkSize int64, fileSize int64) int64 {
+	if remaining := fileSize - int64(index)*chunkSize; remaining < chunkSize {
+		return remaining
+	}
+	return chunkSize
+}
+
+// Returns the query parameters describing a new commit
+func commitParams(cu CommitUpload) url.Values {
+	params := url.Values{}
+	params.Set("authoremail", cu.AuthorEmail)
+	params.Set("authorname", cu.AuthorName)
+	params.Set("branch", cu.Branch)
+	params.Set("commit", cu.Parent)
+	params.Set("commitmsg", cu.Message)
+	params.Set("committeremail", cu.CommitterEmail)
+	params.Set("committername", cu.CommitterName)
+	if !cu.CommitTimestamp.IsZero() {
+		params.Set("committimestamp", cu.CommitTimestamp.UTC().Format(time.RFC3339))
+	}
+	params.Set("dbshasum", cu.DBShaSum)
+	params.Set("force", fmt.Sprintf("%v", cu.Force))
+	params.Set("lastmodified", cu.LastModified.UTC().Format(time.RFC3339))
+	if cu.Licence != "" {
+		params.Set("licence", cu.Licence)
+	}
+	params.Set("otherparents", strings.Join(cu.OtherParents, ","))
+	params.Set("public", fmt.Sprintf("%v", cu.Public))
+	return params
+}
+
+// Sends one chunk of an upload to the server, along with its SHA256 so the server can check it arrived intact.
+// Failures are retried a few times, with a short pause between attempts
+func (c *Client) sendChunk(ctx context.Context, uploadID string, index int, chunk []byte) (err error) {
+	s := sha256.Sum256(chunk)
+	params := url.Values{}
+	params.Set("chunkshasum", hex.EncodeToString(s[:]))
+	params.Set("index", fmt.Sprintf("%d", index))
+	params.Set("uploadid", uploadID)
+	for attempt := 1; attempt <= ChunkAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt-1) * 100 * time.Millisecond):
+			}
+		}
+		var resp *http.Response
+		resp, err = c.do(ctx, "upload chunk", http.MethodPost, "/upload/chunk", params, bytes.NewReader(chunk),
+			"application/octet-stream", nil, http.StatusOK)
+		if err == nil {
+			return resp.Body.Close()
+		}
+	}
+	return
+}
+
+// Sends every chunk of a file which the server doesn't already have
+func (c *Client) sendChunks(ctx context.Context, u UploadSession, path string, size int64, progress io.Writer) (
+	err error) {
+	if u.ChunkSize <= 0 {
+		return &Error{Err: fmt.Errorf("invalid chunk size (%d) requested by the server", u.ChunkSize),
+			Op: "upload database"}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	received := make(map[int]struct{})
+	for _, j := range u.Received {
+		received[j] = struct{}{}
+	}
+	numChunks := int((size + u.ChunkSize - 1) / u.ChunkSize)
+	buf := make([]byte, u.ChunkSize)
+	for i := 0; i < numChunks; i++ {
+		chunk := buf[:chunkLength(i, u.ChunkSize, size)]
+		if _, ok := received[i]; ok {
+			// Already on the server, but it still counts towards the progress
+			_, _ = progress.Write(chunk)
+			continue
+		}
+		if _, err = f.ReadAt(chunk, int64(i)*u.ChunkSize); err != nil && err != io.EOF {
+			return
+		}
+		err = c.sendChunk(ctx, u.ID, i, chunk)
+		if err != nil {
+			return
+		}
+		_, _ = progress.Write(chunk)
+	}
+	return nil
+}
+
+// Asks the server to start (or resume) a chunked upload of a database file.  If the server doesn't support chunked
+// uploads, supported is returned as false
+func (c *Client) startUpload(ctx context.Context, db string, shaSum string, size int64) (u UploadSession,
+	supported bool, err error) {
+	params := c.dbParams(db)
+	params.Set("dbshasum", shaSum)
+	params.Set("size", fmt.Sprintf("%d", size))
+	b, err := c.doBytes(ctx, "start upload", http.MethodPost, "/upload/start", params, http.StatusOK)
+	if IsNotFound(err) {
+		return u, false, nil
+	}
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, &u); err != nil {
+		err = &Error{Err: err, Op: "start upload"}
+		return
+	}
+	return u, true, nil
+}
+
+// Uploads a file as a multipart form, in a single request.  The form is written into a pipe by a separate goroutine,
+// while the request reads from the other end, so the file doesn't need to fit in memory
+func (c *Client) uploadFile(ctx context.Context, path string, params url.Values, filePath string, fileName string,
+	progress io.Writer) (resp *http.Response, err error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if fileName == "" {
+		fileName = filepath.Base(filePath)
+	}
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file1", fileName)
+		if err == nil {
+			_, err = io.Copy(part, io.TeeReader(f, progress))
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	resp, err = c.do(ctx, "upload database", http.MethodPost, path, params, pr, mw.FormDataContentType(), nil,
+		http.StatusCreated)
+	if err != nil {
+		pr.Close()
+	}
+	return
+}
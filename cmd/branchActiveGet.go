@@ -42,11 +42,14 @@ func branchActiveGet(args []string) error {
 	}
 
 	// Load the local metadata cache, without retrieving updated metadata from the cloud
-	meta, err = localFetchMetadata(db, false)
+	meta, err = localFetchHeads(db, false)
 	if err != nil {
 		return err
 	}
 
+	if structuredOutput() {
+		return writeOutput(activeBranchOutput{ActiveBranch: meta.ActiveBranch, Database: db})
+	}
 	_, err = fmt.Fprintf(fOut, "Active branch: %s\n", meta.ActiveBranch)
 	return err
 }
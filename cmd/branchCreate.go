@@ -16,12 +16,13 @@ var branchCreateCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return branchCreate(args)
 	},
+	Annotations: locksDatabases,
 }
 
 func init() {
 	branchCmd.AddCommand(branchCreateCmd)
 	branchCreateCmd.Flags().StringVar(&branchCreateBranch, "branch", "", "Name of remote branch to create")
-	branchCreateCmd.Flags().StringVar(&branchCreateCommit, "commit", "", "Commit ID for the new branch head")
+	branchCreateCmd.Flags().StringVar(&branchCreateCommit, "commit", "", "Revision (eg commit ID, tag, or main~2) for the new branch head")
 	branchCreateCmd.Flags().StringVar(&branchCreateMsg, "description", "", "Description of the branch")
 }
 
@@ -29,7 +30,6 @@ func branchCreate(args []string) error {
 	// Ensure a database file was given
 	var db string
 	var err error
-	var meta metaData
 	if len(args) == 0 {
 		db, err = getDefaultDatabase()
 		if err != nil {
@@ -54,42 +54,12 @@ func branchCreate(args []string) error {
 		return errors.New("No commit ID given")
 	}
 
-	// Load the metadata
-	meta, err = loadMetadata(db)
+	// Create the branch locally, queueing its creation on the server for the next push
+	commitID, err := resolveLocalRevision(db, branchCreateCommit)
 	if err != nil {
 		return err
 	}
-
-	// Ensure a branch with the same name doesn't already exist
-	if _, ok := meta.Branches[branchCreateBranch]; ok == true {
-		return errors.New("A branch with that name already exists")
-	}
-
-	// Make sure the target commit exists in our commit list
-	c, ok := meta.Commits[branchCreateCommit]
-	if ok != true {
-		return errors.New("That commit isn't in the database commit list")
-	}
-
-	// Count the number of commits in the new branch
-	numCommits := 1
-	for c.Parent != "" {
-		numCommits++
-		c = meta.Commits[c.Parent]
-	}
-
-	// Generate the new branch info locally
-	newBranch := branchEntry{
-		Commit:      branchCreateCommit,
-		CommitCount: numCommits,
-		Description: branchCreateMsg,
-	}
-
-	// Add the new branch to the local metadata cache
-	meta.Branches[branchCreateBranch] = newBranch
-
-	// Save the updated metadata back to disk
-	err = saveMetadata(db, meta)
+	err = localRepo().CreateBranch(db, branchCreateBranch, commitID, branchCreateMsg)
 	if err != nil {
 		return err
 	}
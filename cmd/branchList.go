@@ -1,11 +1,8 @@
 package cmd
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"path/filepath"
 	"sort"
 
 	"github.com/spf13/cobra"
@@ -47,19 +44,30 @@ func branchList(args []string) error {
 
 	// If there is a local metadata cache for the requested database, use that.  Otherwise, retrieve it from the
 	// server first (without storing it)
-	meta = metaData{}
-	md, err := ioutil.ReadFile(filepath.Join(".dio", db, "metadata.json"))
-	if err == nil {
-		err = json.Unmarshal([]byte(md), &meta)
-		if err != nil {
-			return err
+	meta, err = localFetchHeads(db, true)
+	if err != nil {
+		return err
+	}
+
+	if structuredOutput() {
+		out := branchListOutput{
+			ActiveBranch: meta.ActiveBranch,
+			Branches:     meta.Branches,
+			Database:     db,
 		}
-	} else {
-		// No local cache, so retrieve the info from the server
-		meta, _, err = retrieveMetadata(db)
-		if err != nil {
-			return err
+		for name := range meta.Branches {
+			t, err := trackingInfo(db, meta, name)
+			if err != nil {
+				return err
+			}
+			if t != nil {
+				if out.Tracking == nil {
+					out.Tracking = make(map[string]*branchTracking)
+				}
+				out.Tracking[name] = t
+			}
 		}
+		return writeOutput(out)
 	}
 
 	// Sort the list alphabetically
@@ -75,7 +83,21 @@ func branchList(args []string) error {
 		return err
 	}
 	for _, i := range sortedKeys {
-		_, err = fmt.Fprintf(fOut, "  * '%s' - Commit: %s\n", i, meta.Branches[i].Commit)
+		_, err = fmt.Fprintf(fOut, "  * '%s' - Commit: %s", i, meta.Branches[i].Commit)
+		if err != nil {
+			return err
+		}
+		t, err := trackingText(db, meta, i)
+		if err != nil {
+			return err
+		}
+		if t != "" {
+			_, err = fmt.Fprintf(fOut, " (%s)", t)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintln(fOut)
 		if err != nil {
 			return err
 		}
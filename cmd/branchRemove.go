@@ -16,6 +16,7 @@ var branchRemoveCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return branchRemove(args)
 	},
+	Annotations: locksDatabases,
 }
 
 func init() {
@@ -27,7 +28,6 @@ func branchRemove(args []string) error {
 	// Ensure a database file was given
 	var db string
 	var err error
-	var meta metaData
 	if len(args) == 0 {
 		db, err = getDefaultDatabase()
 		if err != nil {
@@ -49,27 +49,8 @@ func branchRemove(args []string) error {
 		return errors.New("No branch name given")
 	}
 
-	// Load the metadata
-	meta, err = loadMetadata(db)
-	if err != nil {
-		return err
-	}
-
-	// Check if the branch exists
-	if _, ok := meta.Branches[branchRemoveBranch]; ok != true {
-		return errors.New("A branch with that name doesn't exist")
-	}
-
-	// If the branch is the currently active one, then abort
-	if branchRemoveBranch == meta.ActiveBranch {
-		return errors.New("Can't remove the currently active branch.  You need to switch branches first")
-	}
-
-	// Remove the branch
-	delete(meta.Branches, branchRemoveBranch)
-
-	// Save the updated metadata back to disk
-	err = saveMetadata(db, meta)
+	// Remove the branch, and queue its removal from the server for the next push
+	err = localRepo().RemoveBranch(db, branchRemoveBranch)
 	if err != nil {
 		return err
 	}
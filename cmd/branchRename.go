@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var branchRenameBranch, branchRenameNewName string
+
+// Renames a branch of a database
+var branchRenameCmd = &cobra.Command{
+	Use:   "rename [database name] --branch xxx --new yyy",
+	Short: "Rename a branch of a database",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return branchRename(args)
+	},
+	Annotations: locksDatabases,
+}
+
+func init() {
+	branchCmd.AddCommand(branchRenameCmd)
+	branchRenameCmd.Flags().StringVar(&branchRenameBranch, "branch", "", "Name of the branch to rename")
+	branchRenameCmd.Flags().StringVar(&branchRenameNewName, "new", "", "New name for the branch")
+}
+
+func branchRename(args []string) error {
+	// Ensure a database file was given
+	var db string
+	var err error
+	if len(args) == 0 {
+		db, err = getDefaultDatabase()
+		if err != nil {
+			return err
+		}
+		if db == "" {
+			// No database name was given on the command line, and we don't have a default database selected
+			return errors.New("No database file specified")
+		}
+	} else {
+		db = args[0]
+	}
+	if len(args) > 1 {
+		return errors.New("Only one database can be changed at a time (for now)")
+	}
+
+	// Ensure the existing and new branch names were given
+	if branchRenameBranch == "" {
+		return errors.New("No branch name given")
+	}
+	if branchRenameNewName == "" {
+		return errors.New("No new branch name given")
+	}
+
+	// Rename the branch, and queue the rename on the server for the next push
+	err = localRepo().RenameBranch(db, branchRenameBranch, branchRenameNewName)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(fOut, "Branch '%s' renamed to '%s'\n", branchRenameBranch, branchRenameNewName)
+	return err
+}
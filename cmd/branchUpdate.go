@@ -17,6 +17,7 @@ var branchUpdateCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return branchUpdate(args)
 	},
+	Annotations: locksDatabases,
 }
 
 func init() {
@@ -33,7 +34,6 @@ func branchUpdate(args []string) error {
 	// Ensure a database file was given
 	var db string
 	var err error
-	var meta metaData
 	if len(args) == 0 {
 		db, err = getDefaultDatabase()
 		if err != nil {
@@ -58,28 +58,12 @@ func branchUpdate(args []string) error {
 		return errors.New("No description text given")
 	}
 
-	// Load the metadata
-	meta, err = loadMetadata(db)
-	if err != nil {
-		return err
-	}
-
-	// Make sure the branch exists
-	branch, ok := meta.Branches[branchUpdateBranch]
-	if ok == false {
-		return errors.New("That branch doesn't exist")
-	}
-
-	// Update the branch
+	// Update the branch, and queue the change for the server for the next push
+	var desc string
 	if *descDel == false {
-		branch.Description = branchUpdateMsg
-	} else {
-		branch.Description = ""
+		desc = branchUpdateMsg
 	}
-	meta.Branches[branchUpdateBranch] = branch
-
-	// Save the updated metadata back to disk
-	err = saveMetadata(db, meta)
+	err = localRepo().UpdateBranch(db, branchUpdateBranch, desc)
 	if err != nil {
 		return err
 	}
@@ -1,10 +1,7 @@
 package cmd
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -13,30 +10,35 @@ import (
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/sqlitebrowser/dio/repo"
 )
 
 var (
 	commitCmdAuthEmail, commitCmdAuthName, commitCmdBranch, commitCmdCommit string
 	commitCmdLicence, commitCmdMsg, commitCmdTimestamp                      string
+	commitCmdAll                                                            *bool
 )
 
 // Create a commit for the database on the currently active branch
 var (
 	commitCmd = &cobra.Command{
-		Use:   "commit [database file]",
+		Use:   "commit [database file...]",
 		Short: "Creates a new commit for the database",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return commit(args)
 		},
+		Annotations: locksDatabases,
 	}
 )
 
 func init() {
 	RootCmd.AddCommand(commitCmd)
+	commitCmdAll = commitCmd.Flags().Bool("all", false,
+		"Commit every database tracked in the current directory which has changed")
 	commitCmd.Flags().StringVar(&commitCmdBranch, "branch", "",
 		"The branch this commit will be appended to")
 	commitCmd.Flags().StringVar(&commitCmdCommit, "commit", "",
-		"ID of the previous commit, for appending this new database to")
+		"Revision (eg commit ID, or main) of the previous commit, for appending this new database to")
 	commitCmd.Flags().StringVar(&commitCmdAuthEmail, "email", "",
 		"Email address of the commit author")
 	commitCmd.Flags().StringVar(&commitCmdLicence, "licence", "",
@@ -45,33 +47,51 @@ func init() {
 		"Description / commit message")
 	commitCmd.Flags().StringVar(&commitCmdAuthName, "name", "", "Name of the commit author")
 	commitCmd.Flags().StringVar(&commitCmdTimestamp, "timestamp", "", "Timestamp for the commit")
+	addVerifyFlag(commitCmd)
 }
 
 func commit(args []string) error {
 	// Ensure a database file was given
-	var db string
-	var err error
-	var meta metaData
-	if len(args) == 0 {
-		db, err = getDefaultDatabase()
-		if err != nil {
-			return err
+	dbs, err := dbsFromArgs(args, *commitCmdAll)
+	if err != nil {
+		return err
+	}
+
+	// With --all, only the databases which have changed are committed
+	if *commitCmdAll {
+		var changedDBs []string
+		for _, db := range dbs {
+			meta, err := localFetchHeads(db, false)
+			if err != nil {
+				return err
+			}
+			changed, err := localRepo().Changed(db, meta)
+			if err != nil {
+				return err
+			}
+			if changed {
+				changedDBs = append(changedDBs, db)
+			}
 		}
-		if db == "" {
-			// No database name was given on the command line, and we don't have a default database selected
-			return errors.New("No database file specified")
+		if len(changedDBs) == 0 {
+			_, err = fmt.Fprintln(fOut, "None of the tracked databases have changed.  Nothing to commit.")
+			return err
 		}
-	} else {
-		db = args[0]
-	}
-	// TODO: Allow giving multiple database files on the command line.  Hopefully just needs turning this
-	// TODO  into a for loop
-	if len(args) > 1 {
-		return errors.New("Only one database can be uploaded at a time (for now)")
+		dbs = changedDBs
 	}
+	branch, msg := commitCmdBranch, commitCmdMsg
+	return forEachDatabase(dbs, commitDB, func() {
+		commitCmdBranch, commitCmdMsg = branch, msg
+	})
+}
+
+// Creates a new commit for a database
+func commitDB(db string) (err error) {
+	var meta metaData
+	r := localRepo()
 
 	// Ensure the database file exists
-	fi, err := os.Stat(db)
+	_, err = os.Stat(db)
 	if err != nil {
 		return err
 	}
@@ -99,7 +119,7 @@ func commit(args []string) error {
 	}
 
 	// If a timestamp was provided, make sure it parses ok
-	commitTime := time.Now()
+	var commitTime time.Time
 	if commitCmdTimestamp != "" {
 		commitTime, err = time.Parse(time.RFC3339, commitCmdTimestamp)
 		if err != nil {
@@ -127,15 +147,15 @@ func commit(args []string) error {
 
 		// This is a new database, so we generate new metadata
 		newDB = true
-		meta = newMetaStruct(commitCmdBranch)
+		meta = repo.NewMetadata(commitCmdBranch)
 	} else {
 		// We have local metaData
 		localPresent = true
 	}
 
-	// Load the metadata
+	// Load the metadata.  Only the branches are needed, with the commits being looked up in the store as needed
 	if !newDB {
-		meta, err = loadMetadata(db)
+		meta, err = r.LoadHeads(db)
 		if err != nil {
 			return err
 		}
@@ -146,9 +166,28 @@ func commit(args []string) error {
 		commitCmdBranch = meta.ActiveBranch
 	}
 
-	// Check if the database is unchanged from the previous commit, and if so we abort the commit
-	if localPresent {
-		changed, err := dbChanged(db, meta)
+	// If a merge with resolved conflicts is waiting to be committed, this commit completes it
+	var otherParents []string
+	mState, mergePending, err := loadMergeState(db)
+	if err != nil {
+		return err
+	}
+	if mergePending && mState.Into == commitCmdBranch {
+		report := filepath.Join(".dio", db, "conflicts.json")
+		if _, err = os.Stat(report); err == nil {
+			return fmt.Errorf("The conflicts from merging branch '%s' haven't been resolved yet.  Fix them in "+
+				"%s, remove %s, then commit again", mState.From, db, report)
+		}
+		otherParents = []string{mState.FromCommit}
+		if commitCmdMsg == "" {
+			commitCmdMsg = fmt.Sprintf("Merge branch '%s' into '%s'", mState.From, mState.Into)
+		}
+	}
+
+	// Check if the database is unchanged from the previous commit, and if so we abort the commit.  A merge is still
+	// worth committing though, as resolving its conflicts can leave the database the same as the branch head
+	if localPresent && len(otherParents) == 0 {
+		changed, err := r.Changed(db, meta)
 		if err != nil {
 			return err
 		}
@@ -157,11 +196,25 @@ func commit(args []string) error {
 		}
 	}
 
-	// Get the current head commit for the selected branch, as that will be the parent commit for this new one
+	// Make sure the branch exists, as the head commit of it will be the parent of the new commit
 	head, ok := meta.Branches[commitCmdBranch]
 	if !ok {
 		return errors.New(fmt.Sprintf("That branch ('%s') doesn't exist", commitCmdBranch))
 	}
+
+	// If the previous commit was given, make sure it's the head of the branch, as that's where the new commit goes.
+	// Revisions can refer to any commit, so only working them out needs the whole history
+	if commitCmdCommit != "" {
+		prev, err := resolveLocalRevision(db, commitCmdCommit)
+		if err != nil {
+			return err
+		}
+		if prev != head.Commit {
+			return fmt.Errorf("Commit '%s' isn't the head of branch '%s'.  New commits can only be appended to the "+
+				"head of a branch", prev, commitCmdBranch)
+		}
+	}
+
 	var existingLicSHA string
 	if newDB {
 		if commitCmdLicence == "" {
@@ -172,7 +225,10 @@ func commit(args []string) error {
 	} else {
 		if localPresent {
 			// We can only use commit data if local metadata is present
-			headCommit, ok := meta.Commits[head.Commit]
+			headCommit, ok, err := r.FindCommit(db, meta, head.Commit)
+			if err != nil {
+				return err
+			}
 			if !ok {
 				return errors.New("Aborting: info for the head commit isn't found in the local commit cache")
 			}
@@ -235,87 +291,30 @@ func commit(args []string) error {
 		}
 	}
 
-	// * Collect info for the new commit *
-
-	// Get file size and last modified time for the database
-	fileSize := fi.Size()
-	lastModified := fi.ModTime()
-
-	// Verify we've read the file from disk ok
-	b, err := ioutil.ReadFile(db)
-	if err != nil {
-		return err
-	}
-	if int64(len(b)) != fileSize {
-		return errors.New(numFormat.Sprintf("Aborting: # of bytes read (%d) when generating commit don't "+
-			"match database file size (%d)", len(b), fileSize))
-	}
-
-	// Generate sha256
-	s := sha256.Sum256(b)
-	shaSum := hex.EncodeToString(s[:])
-
-	// * Generate the new commit *
-
-	// Create a new dbTree entry for the database file
-	var e dbTreeEntry
-	e.EntryType = DATABASE
-	e.LastModified = lastModified.UTC()
-	e.LicenceSHA = licSHA
-	e.Name = db
-	e.Sha256 = shaSum
-	e.Size = fileSize
-
-	// Create a new dbTree structure for the new database entry
-	var t dbTree
-	t.Entries = append(t.Entries, e)
-	t.ID = createDBTreeID(t.Entries)
-
-	// Create a new commit for the new tree
-	newCom := commitEntry{
-		AuthorName:     authorName,
+	// Generate the new commit
+	newCom, err := r.Commit(db, repo.CommitOptions{
 		AuthorEmail:    authorEmail,
-		CommitterName:  committerName,
+		AuthorName:     authorName,
+		Branch:         commitCmdBranch,
 		CommitterEmail: committerEmail,
+		CommitterName:  committerName,
+		LicenceSHA:     licSHA,
 		Message:        commitCmdMsg,
-		Parent:         head.Commit,
-		Timestamp:      commitTime.UTC(),
-		Tree:           t,
-	}
-
-	// Calculate the new commit ID, which incorporates the updated tree ID (and thus the new licence sha256)
-	newCom.ID = createCommitID(newCom)
-
-	// Add the new commit info to the database commit list
-	meta.Commits[newCom.ID] = newCom
-
-	// Update the branch head info to point at the new commit
-	meta.Branches[commitCmdBranch] = branchEntry{
-		Commit:      newCom.ID,
-		CommitCount: head.CommitCount + 1,
-		Description: head.Description,
+		OtherParents:   otherParents,
+		Timestamp:      commitTime,
+	})
+	if err != nil {
+		return err
 	}
 
-	// If the database file isn't already in the local cache, then copy it there
-	if _, err = os.Stat(filepath.Join(".dio", db, "db", shaSum)); os.IsNotExist(err) {
-		if _, err = os.Stat(filepath.Join(".dio", db)); os.IsNotExist(err) {
-			err = os.MkdirAll(filepath.Join(".dio", db, "db"), 0770)
-			if err != nil {
-				return err
-			}
-		}
-		err = ioutil.WriteFile(filepath.Join(".dio", db, "db", shaSum), b, 0644)
+	// The merge (if any) has been completed
+	if len(otherParents) > 0 {
+		err = removeMergeState(db)
 		if err != nil {
 			return err
 		}
 	}
 
-	// Save the updated metadata back to disk
-	err = saveMetadata(db, meta)
-	if err != nil {
-		return err
-	}
-
 	// Display results to the user
 	_, err = fmt.Fprintf(fOut, "Commit created on '%s'\n", db)
 	if err != nil {
@@ -335,7 +334,7 @@ func commit(args []string) error {
 			return err
 		}
 	}
-	_, err = numFormat.Fprintf(fOut, "    Size: %d bytes\n", e.Size)
+	_, err = numFormat.Fprintf(fOut, "    Size: %d bytes\n", newCom.Tree.Entries[0].Size)
 	if err != nil {
 		return err
 	}
@@ -347,27 +346,3 @@ func commit(args []string) error {
 	}
 	return nil
 }
-
-// Creates a new metadata structure in memory
-func newMetaStruct(branch string) (meta metaData) {
-	b := branchEntry{
-		Commit:      "",
-		CommitCount: 0,
-		Description: "",
-	}
-	var initialBranch string
-	if branch == "" {
-		initialBranch = "main"
-	} else {
-		initialBranch = branch
-	}
-	meta = metaData{
-		ActiveBranch: initialBranch,
-		Branches:     map[string]branchEntry{initialBranch: b},
-		Commits:      map[string]commitEntry{},
-		DefBranch:    initialBranch,
-		Releases:     map[string]releaseEntry{},
-		Tags:         map[string]tagEntry{},
-	}
-	return
-}
@@ -0,0 +1,361 @@
+package cmd
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/sqlitebrowser/dio/repo"
+)
+
+var (
+	diffCmdFrom, diffCmdTo string
+	diffCmdJSON            *bool
+)
+
+// The differences between two versions of a database
+type dbDiff struct {
+	From   string       `json:"from"`
+	Schema []schemaDiff `json:"schema"`
+	Tables []tableDiff  `json:"tables"`
+	To     string       `json:"to"`
+}
+
+// A row which is different between two versions of a database.  The values are in SQL literal form
+type rowDiff struct {
+	Key string            `json:"key"`
+	New map[string]string `json:"new,omitempty"`
+	Old map[string]string `json:"old,omitempty"`
+}
+
+// A schema object which is different between two versions of a database
+type schemaDiff struct {
+	Action string `json:"action"` // One of "added", "deleted", or "modified"
+	Name   string `json:"name"`
+	NewSQL string `json:"new_sql,omitempty"`
+	OldSQL string `json:"old_sql,omitempty"`
+	Type   string `json:"type"`
+}
+
+// The rows of a table which are different between two versions of a database
+type tableDiff struct {
+	Added    []rowDiff `json:"added"`
+	Deleted  []rowDiff `json:"deleted"`
+	Modified []rowDiff `json:"modified"`
+	Name     string    `json:"name"`
+}
+
+// Shows the differences between two versions of a database
+var diffCmd = &cobra.Command{
+	Use:   "diff [database name]",
+	Short: "Show the differences between two versions of a database",
+	Long: `Show the differences between two versions of a database.
+
+Each version can be a commit ID (or a unique prefix of one), or the name of a
+branch, tag, or release, optionally followed by ~N, ^N, or @{date} (eg main~2).
+When --from isn't given, the head commit of the active branch is used.  When
+--to isn't given, the database file in the working directory is used.
+
+Changes to the schema (tables, indexes, views and triggers) are shown, along
+with the rows added, deleted, and modified in each table.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return diff(args)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(diffCmd)
+	diffCmd.Flags().StringVar(&diffCmdFrom, "from", "", "Revision to compare from")
+	diffCmdJSON = diffCmd.Flags().Bool("json", false, "Output the differences as JSON")
+	diffCmd.Flags().StringVar(&diffCmdTo, "to", "", "Revision to compare to")
+}
+
+func diff(args []string) error {
+	// Ensure a database file was given
+	var db string
+	var err error
+	if len(args) == 0 {
+		db, err = getDefaultDatabase()
+		if err != nil {
+			return err
+		}
+		if db == "" {
+			// No database name was given on the command line, and we don't have a default database selected
+			return errors.New("No database file specified")
+		}
+	} else {
+		db = args[0]
+	}
+	if len(args) > 1 {
+		return errors.New("Only one database can be diffed at a time (for now)")
+	}
+
+	// Load the metadata
+	meta, err := localRepo().LoadMetadata(db)
+	if err != nil {
+		return err
+	}
+
+	// Work out the database file to use for each side of the comparison
+	fromRev := diffCmdFrom
+	if fromRev == "" {
+		fromRev = meta.ActiveBranch
+	}
+	fromPath, fromLabel, err := diffSource(db, meta, fromRev)
+	if err != nil {
+		return err
+	}
+	toPath, toLabel := db, "working file"
+	if diffCmdTo != "" {
+		toPath, toLabel, err = diffSource(db, meta, diffCmdTo)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Compare them
+	d, err := diffDatabases(fromPath, toPath)
+	if err != nil {
+		return err
+	}
+	d.From = fromLabel
+	d.To = toLabel
+
+	// Display the results
+	if *diffCmdJSON {
+		var j []byte
+		j, err = json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(fOut, "%s\n", j)
+		return err
+	}
+	return printDiff(d)
+}
+
+// Compares two SQLite databases, returning their schema and row differences
+func diffDatabases(fromPath string, toPath string) (d dbDiff, err error) {
+	var fromDB, toDB *sql.DB
+	if fromDB, err = openSQLite(fromPath, false); err != nil {
+		return
+	}
+	defer fromDB.Close()
+	if toDB, err = openSQLite(toPath, false); err != nil {
+		return
+	}
+	defer toDB.Close()
+	var fromSchema, toSchema map[string]schemaObject
+	if fromSchema, err = readSchema(fromDB); err != nil {
+		return
+	}
+	if toSchema, err = readSchema(toDB); err != nil {
+		return
+	}
+
+	// Compare the schema objects
+	d.Schema = []schemaDiff{}
+	d.Tables = []tableDiff{}
+	for _, objType := range []string{"table", "index", "view", "trigger"} {
+		for _, name := range schemaNames(objType, fromSchema, toSchema) {
+			f, inFrom := fromSchema[name]
+			t, inTo := toSchema[name]
+			switch {
+			case inFrom && !inTo:
+				d.Schema = append(d.Schema, schemaDiff{Action: "deleted", Name: f.Name, OldSQL: f.SQL, Type: objType})
+			case !inFrom && inTo:
+				d.Schema = append(d.Schema, schemaDiff{Action: "added", Name: t.Name, NewSQL: t.SQL, Type: objType})
+			case f.SQL != t.SQL:
+				d.Schema = append(d.Schema, schemaDiff{Action: "modified", Name: t.Name, NewSQL: t.SQL, OldSQL: f.SQL,
+					Type: objType})
+			}
+		}
+	}
+
+	// Compare the rows of each table
+	for _, name := range schemaNames("table", fromSchema, toSchema) {
+		f, inFrom := fromSchema[name]
+		t, inTo := toSchema[name]
+
+		// The content of virtual tables is in their shadow tables, which are compared like any other table
+		if strings.HasPrefix(strings.ToUpper(f.SQL), "CREATE VIRTUAL") ||
+			strings.HasPrefix(strings.ToUpper(t.SQL), "CREATE VIRTUAL") {
+			continue
+		}
+		var fromData, toData tableData
+		tableName := strings.TrimPrefix(name, "table ")
+		if inFrom {
+			if fromData, err = readTable(fromDB, tableName); err != nil {
+				return
+			}
+		}
+		if inTo {
+			if toData, err = readTable(toDB, tableName); err != nil {
+				return
+			}
+		}
+		td := diffTableRows(tableName, fromData, toData)
+		if len(td.Added) > 0 || len(td.Deleted) > 0 || len(td.Modified) > 0 {
+			d.Tables = append(d.Tables, td)
+		}
+	}
+	return
+}
+
+// Returns the database file for a revision, making sure it's in the local cache first
+func diffSource(db string, meta metaData, rev string) (path string, label string, err error) {
+	id, err := repo.ResolveRevision(meta, rev)
+	if err != nil {
+		return
+	}
+	c, ok := meta.Commits[id]
+	if !ok || len(c.Tree.Entries) == 0 {
+		err = fmt.Errorf("Commit '%s' isn't in the local commit list", id)
+		return
+	}
+	shaSum := c.Tree.Entries[0].Sha256
+	err = checkDBCache(db, id, shaSum)
+	if err != nil {
+		return
+	}
+	return localRepo().CachePath(db, shaSum), id, nil
+}
+
+// Compares the rows of a table between two versions of a database
+func diffTableRows(table string, from tableData, to tableData) (td tableDiff) {
+	td = tableDiff{Added: []rowDiff{}, Deleted: []rowDiff{}, Modified: []rowDiff{}, Name: table}
+	keys := make(map[string]struct{})
+	for k := range from.Rows {
+		keys[k] = struct{}{}
+	}
+	for k := range to.Rows {
+		keys[k] = struct{}{}
+	}
+	var sortedKeys []string
+	for k := range keys {
+		sortedKeys = append(sortedKeys, k)
+	}
+	sort.Strings(sortedKeys)
+	for _, k := range sortedKeys {
+		_, inFrom := from.Rows[k]
+		_, inTo := to.Rows[k]
+		switch {
+		case !inFrom:
+			td.Added = append(td.Added, rowDiff{Key: to.keyText(k), New: to.rowMap(k)})
+		case !inTo:
+			td.Deleted = append(td.Deleted, rowDiff{Key: from.keyText(k), Old: from.rowMap(k)})
+		default:
+			// Compare by column name, so rows can be compared even if the table structure has changed
+			old, cur := from.rowMap(k), to.rowMap(k)
+			if !rowMapsEqual(old, cur) {
+				td.Modified = append(td.Modified, rowDiff{Key: to.keyText(k), New: cur, Old: old})
+			}
+		}
+	}
+	return
+}
+
+// Displays the differences between two versions of a database, in a human friendly format
+func printDiff(d dbDiff) (err error) {
+	_, err = fmt.Fprintf(fOut, "Differences from %s to %s:\n", d.From, d.To)
+	if err != nil {
+		return
+	}
+	if len(d.Schema) == 0 && len(d.Tables) == 0 {
+		_, err = fmt.Fprintf(fOut, "\n  No differences\n")
+		return
+	}
+	if len(d.Schema) > 0 {
+		_, err = fmt.Fprintf(fOut, "\nSchema:\n")
+		if err != nil {
+			return
+		}
+		for _, s := range d.Schema {
+			_, err = fmt.Fprintf(fOut, "  %s %s: %s\n", s.Action, s.Type, s.Name)
+			if err != nil {
+				return
+			}
+		}
+	}
+	for _, t := range d.Tables {
+		_, err = numFormat.Fprintf(fOut, "\nTable %s: %d added, %d deleted, %d modified\n", t.Name, len(t.Added),
+			len(t.Deleted), len(t.Modified))
+		if err != nil {
+			return
+		}
+		for _, r := range t.Added {
+			_, err = fmt.Fprintf(fOut, "  + %s: %s\n", r.Key, rowValuesText(r.New))
+			if err != nil {
+				return
+			}
+		}
+		for _, r := range t.Deleted {
+			_, err = fmt.Fprintf(fOut, "  - %s: %s\n", r.Key, rowValuesText(r.Old))
+			if err != nil {
+				return
+			}
+		}
+		for _, r := range t.Modified {
+			var changes []string
+			for _, col := range sortedColumns(r.Old, r.New) {
+				o, inOld := r.Old[col]
+				n, inNew := r.New[col]
+				switch {
+				case !inOld:
+					changes = append(changes, fmt.Sprintf("%s added (%s)", col, n))
+				case !inNew:
+					changes = append(changes, fmt.Sprintf("%s removed (%s)", col, o))
+				case o != n:
+					changes = append(changes, fmt.Sprintf("%s: %s -> %s", col, o, n))
+				}
+			}
+			_, err = fmt.Fprintf(fOut, "  ~ %s: %s\n", r.Key, strings.Join(changes, ", "))
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Returns true if two rows (in column name -> value form) have identical values
+func rowMapsEqual(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for col, val := range a {
+		if other, ok := b[col]; !ok || other != val {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the values of a row as a human friendly string.  eg: id=1, name='Ann'
+func rowValuesText(row map[string]string) string {
+	var s []string
+	for _, col := range sortedColumns(row) {
+		s = append(s, fmt.Sprintf("%s=%s", col, row[col]))
+	}
+	return strings.Join(s, ", ")
+}
+
+// Returns the sorted column names across the given rows
+func sortedColumns(rows ...map[string]string) []string {
+	cols := make(map[string]struct{})
+	for _, r := range rows {
+		for col := range r {
+			cols[col] = struct{}{}
+		}
+	}
+	var sorted []string
+	for col := range cols {
+		sorted = append(sorted, col)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
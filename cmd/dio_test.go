@@ -3,11 +3,14 @@ package cmd
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -22,8 +25,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/sqlitebrowser/dio/client"
+	"github.com/sqlitebrowser/dio/repo"
 	chk "gopkg.in/check.v1"
+	"gopkg.in/yaml.v3"
 )
 
 type DioSuite struct {
@@ -76,9 +83,25 @@ var (
 		Type:         "database",
 		URL:          fmt.Sprintf("%s/default/%s", cloud, "2.5mbv13.sqlite?commit=316b246eda1e1779b21e9ac338cab4a71847c5268c03911ebfed974ffbab03bc&branch=main"),
 	}}
-	mockMetaData = map[string]metaData{}
+	mockBlobs          = map[string][]byte{}
+	mockChunkFailures  = map[int]int{} // Chunk index -> number of times to reject it
+	mockChunkedUploads bool
+	mockChunksReceived int
+	mockLastRange      string
+	mockMetaData       = map[string]metaData{}
+	mockUploads        = map[string]*mockUpload{}
 )
 
+// A chunked upload in progress on the mock server
+type mockUpload struct {
+	chunks map[int][]byte
+	shaSum string
+	size   int64
+}
+
+// The chunk size used by the mock server, kept small so the test databases are sent in several chunks
+const mockChunkSize = 4096
+
 func Test(t *testing.T) {
 	chk.TestingT(t)
 }
@@ -1170,168 +1193,2565 @@ func (s *DioSuite) Test0320_PushOldLocalMetadataDBConflict(c *chk.C) {
 	c.Check(err, chk.Not(chk.IsNil))
 }
 
-// Mocked functions
-func mockGetLicences() (map[string]licenceEntry, error) {
-	return licList, nil
-}
+// Tests merging branches, both with a fast-forward and with a merge commit
+func (s *DioSuite) Test0330_Merge(c *chk.C) {
+	// Create a new database with a single commit on the main branch
+	newDB := "19kBmerge.sqlite"
+	b, err := ioutil.ReadFile(filepath.Join(origDir, "..", "test_data", s.dbName))
+	c.Assert(err, chk.IsNil)
+	err = ioutil.WriteFile(newDB, b, 0644)
+	c.Assert(err, chk.IsNil)
+	err = os.Chtimes(newDB, time.Now(), time.Date(2019, time.March, 15, 18, 20, 0, 0, time.UTC))
+	c.Assert(err, chk.IsNil)
+	commitCmdBranch = "main"
+	commitCmdLicence = "Not specified"
+	commitCmdMsg = "Merge base"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 18, 20, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	meta, err := localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	baseCommit := meta.Branches["main"].Commit
 
-// Returns metadata of a database with a single commit, on the main branch
-func mockRetrieveMetadata(db string) (meta metaData, onCloud bool, err error) {
-	meta.Branches = make(map[string]branchEntry)
-	meta.Commits = make(map[string]commitEntry)
-	meta.Commits["59b72b78cb83bdba371438cb36950fe007265445a63068ae5586c9cc19203941"] = commitEntry{
-		ID:             "59b72b78cb83bdba371438cb36950fe007265445a63068ae5586c9cc19203941",
-		CommitterEmail: "someone@example.org",
-		CommitterName:  "Some One",
-		AuthorEmail:    "testdefault@dbhub.io",
-		AuthorName:     "Default test user",
-		Message:        "The first commit in our test run",
-		Timestamp:      time.Date(2019, time.March, 15, 18, 1, 1, 0, time.UTC),
-		Tree: dbTree{
-			ID: "8983130ceda4a2e39a3ad002945d57748987494907f475539fe766f8893cc278",
-			Entries: []dbTreeEntry{{
-				EntryType:    dbTreeEntryType(DATABASE),
-				LastModified: time.Date(2019, time.March, 15, 18, 1, 0, 0, time.UTC),
-				LicenceSHA:   "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
-				Name:         "19kB.sqlite",
-				Sha256:       "e8cab91dec32b3990b427b28380e4e052288054f99c4894742f07dee0c924efd",
-				Size:         19456},
-			},
-		},
-	}
-	meta.Branches["main"] = branchEntry{
-		Commit:      "59b72b78cb83bdba371438cb36950fe007265445a63068ae5586c9cc19203941",
-		CommitCount: 1,
-		Description: "",
-	}
-	meta.DefBranch = "main"
+	// Create two branches from the initial commit
+	branchCreateCommit = baseCommit
+	branchCreateMsg = ""
+	branchCreateBranch = "feature"
+	err = branchCreate([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	branchCreateBranch = "other"
+	err = branchCreate([]string{newDB})
+	c.Assert(err, chk.IsNil)
 
-	// No need for tags nor releases at this stage
-	meta.Tags = make(map[string]tagEntry)
-	meta.Releases = make(map[string]releaseEntry)
-	return
-}
+	// Add a commit to the main branch, then fast-forward the "feature" branch to it
+	err = os.Chtimes(newDB, time.Now(), time.Date(2019, time.March, 15, 18, 21, 0, 0, time.UTC))
+	c.Assert(err, chk.IsNil)
+	commitCmdLicence = ""
+	commitCmdMsg = "Main branch change"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 18, 21, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	meta, err = localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	mainCommit := meta.Branches["main"].Commit
+	mergeCmdFrom = "main"
+	mergeCmdInto = "feature"
+	err = merge([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	meta, err = localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Branches["feature"].Commit, chk.Equals, mainCommit)
+	c.Check(meta.Branches["feature"].CommitCount, chk.Equals, 2)
+	c.Check(strings.Contains(s.buf.String(), "Branch 'feature' fast-forwarded"), chk.Equals, true)
 
-func mockServer() {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/default", mockServerDatabaseListHandler)
-	mux.HandleFunc("/default/19kBv2.sqlite", mockServerPushPullSwitchHandler)
-	mux.HandleFunc("/default/19kBv3.sqlite", mockServerNewDBPushHandler)
-	mux.HandleFunc("/licence/add", mockServerLicenceAddHandler)
-	mux.HandleFunc("/licence/get", mockServerLicenceGetHandler)
-	mux.HandleFunc("/licence/remove", mockServerLicenceRemoveHandler)
-	mux.HandleFunc("/metadata/get", mockServerMetadataGetHandler)
-	newServer = &http.Server{
-		Addr:         "localhost:5551",
-		Handler:      mux,
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0),
-	}
-	_ = newServer.ListenAndServeTLS(filepath.Join(origDir, "..", "test_data", "docker-dev.dbhub.io.cert.pem"),
-		filepath.Join(origDir, "..", "test_data", "docker-dev.dbhub.io.key.pem"))
-}
+	// Add a commit to the "other" branch, so it diverges from the main branch
+	err = os.Chtimes(newDB, time.Now(), time.Date(2019, time.March, 15, 18, 22, 0, 0, time.UTC))
+	c.Assert(err, chk.IsNil)
+	commitCmdBranch = "other"
+	commitCmdMsg = "Other branch change"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 18, 22, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	meta, err = localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	otherCommit := meta.Branches["other"].Commit
+	base, err := localRepo().MergeBase(newDB, mainCommit, otherCommit)
+	c.Assert(err, chk.IsNil)
+	c.Check(base, chk.Equals, baseCommit)
+
+	// Merge the "other" branch into the active (main) branch, which needs a merge commit
+	mergeCmdFrom = "other"
+	mergeCmdInto = ""
+	mergeCmdMsg = ""
+	mergeCmdStrategy = "file"
+	mergeCmdTimestamp = time.Date(2019, time.March, 15, 18, 23, 0, 0, time.UTC).Format(time.RFC3339)
+	err = merge([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	meta, err = localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	head := meta.Branches["main"]
+	c.Check(head.CommitCount, chk.Equals, 3)
+	com, ok := meta.Commits[head.Commit]
+	c.Assert(ok, chk.Equals, true)
+	c.Check(com.Parent, chk.Equals, mainCommit)
+	c.Check(com.OtherParents, chk.DeepEquals, []string{otherCommit})
+	c.Check(com.Message, chk.Equals, "Merge branch 'other' into 'main'")
+	c.Check(com.ID, chk.Equals, repo.CreateCommitID(com))
 
-func mockServerDatabaseListHandler(w http.ResponseWriter, r *http.Request) {
-	// Convert the database entries to JSON
-	var msg bytes.Buffer
-	enc := json.NewEncoder(&msg)
-	enc.SetEscapeHTML(false)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(mockDBEntries); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	dbList := msg.Bytes()
-	_, _ = fmt.Fprintf(w, "%s", dbList)
+	// Merging the same branch again should have nothing to do
+	err = merge([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	meta, err = localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Branches["main"].Commit, chk.Equals, head.Commit)
+	commitCmdBranch = "main"
 }
 
-func mockServerLicenceAddHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract the form variables
-	licID := r.FormValue("licence_id")
-	licName := r.FormValue("licence_name")
-	do := r.FormValue("display_order")
-	dispOrder, err := strconv.Atoi(do)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	ff := r.FormValue("file_format")
-	su := r.FormValue("source_url")
-	tempFile, _, err := r.FormFile("file1")
-	if err != nil {
-		log.Printf("Uploading licence failed: %v\n", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	defer tempFile.Close()
+func (s *DioSuite) Test0340_MergeRows(c *chk.C) {
+	// Create a small database with a single commit on the main branch
+	newDB := "rowmerge.sqlite"
+	execSQL(c, newDB, `CREATE TABLE people (id INTEGER PRIMARY KEY, name TEXT)`,
+		`INSERT INTO people VALUES (1, 'Ann'), (2, 'Bob'), (3, 'Cat')`)
+	commitCmdBranch = ""
+	commitCmdLicence = "Not specified"
+	commitCmdMsg = "Row merge base"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 18, 30, 0, 0, time.UTC).Format(time.RFC3339)
+	err := commit([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	meta, err := localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	baseCommit := meta.Branches["main"].Commit
+	baseEntry := meta.Commits[baseCommit].Tree.Entries[0]
+
+	// Create a branch from the initial commit, and change some rows on it
+	branchCreateCommit = baseCommit
+	branchCreateMsg = ""
+	branchCreateBranch = "theirs"
+	err = branchCreate([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	execSQL(c, newDB, `UPDATE people SET name = 'Bobby' WHERE id = 2`, `DELETE FROM people WHERE id = 3`)
+	commitCmdBranch = "theirs"
+	commitCmdLicence = ""
+	commitCmdMsg = "Their changes"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 18, 31, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{newDB})
+	c.Assert(err, chk.IsNil)
 
-	// Calculate the SHA256 of the uploaded licence text
-	licText := new(bytes.Buffer)
-	_, err = io.Copy(licText, tempFile)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	tmpSHA := sha256.Sum256(licText.Bytes())
-	licSHA := hex.EncodeToString(tmpSHA[:])
+	// Change different rows on the main branch
+	err = localRepo().RestoreDB(newDB, baseEntry.Sha256, baseEntry.LastModified)
+	c.Assert(err, chk.IsNil)
+	execSQL(c, newDB, `UPDATE people SET name = 'Annie' WHERE id = 1`, `INSERT INTO people VALUES (4, 'Dan')`)
+	commitCmdBranch = "main"
+	commitCmdMsg = "Our changes"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 18, 32, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	meta, err = localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	mainCommit := meta.Branches["main"].Commit
+	theirCommit := meta.Branches["theirs"].Commit
+
+	// Merge the branches.  The changes don't overlap, so they should be merged automatically
+	mergeCmdFrom = "theirs"
+	mergeCmdInto = ""
+	mergeCmdMsg = ""
+	mergeCmdStrategy = "rows"
+	mergeCmdTimestamp = time.Date(2019, time.March, 15, 18, 33, 0, 0, time.UTC).Format(time.RFC3339)
+	err = merge([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	c.Check(readPeople(c, newDB), chk.DeepEquals, map[int]string{1: "Annie", 2: "Bobby", 4: "Dan"})
+	meta, err = localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	head := meta.Branches["main"]
+	com := meta.Commits[head.Commit]
+	c.Check(com.Parent, chk.Equals, mainCommit)
+	c.Check(com.OtherParents, chk.DeepEquals, []string{theirCommit})
+	c.Check(strings.Contains(s.buf.String(), "0 row(s) inserted, 1 updated, 1 deleted"), chk.Equals, true)
+
+	// Change the same row differently on both branches
+	execSQL(c, newDB, `UPDATE people SET name = 'Bobbie' WHERE id = 2`)
+	commitCmdBranch = "theirs"
+	commitCmdMsg = "Conflicting change"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 18, 34, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	mergeEntry := com.Tree.Entries[0]
+	err = localRepo().RestoreDB(newDB, mergeEntry.Sha256, mergeEntry.LastModified)
+	c.Assert(err, chk.IsNil)
+	execSQL(c, newDB, `UPDATE people SET name = 'Robert' WHERE id = 2`)
+	commitCmdBranch = "main"
+	commitCmdMsg = "Another conflicting change"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 18, 35, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	meta, err = localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	mainCommit = meta.Branches["main"].Commit
+	theirCommit = meta.Branches["theirs"].Commit
 
-	// Add the licence to the in memory licence list
-	licList[licID] = licenceEntry{
-		FullName:   licName,
-		FileFormat: ff,
-		Sha256:     licSHA,
-		Order:      dispOrder,
-		URL:        su,
-	}
+	// The merge should stop with a conflict, keeping our version of the row
+	mergeCmdTimestamp = ""
+	err = merge([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	c.Check(readPeople(c, newDB)[2], chk.Equals, "Robert")
+	meta, err = localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Branches["main"].Commit, chk.Equals, mainCommit)
+	report := filepath.Join(".dio", newDB, "conflicts.json")
+	b, err := ioutil.ReadFile(report)
+	c.Assert(err, chk.IsNil)
+	var conflicts []mergeConflict
+	err = json.Unmarshal(b, &conflicts)
+	c.Assert(err, chk.IsNil)
+	c.Assert(conflicts, chk.HasLen, 1)
+	c.Check(conflicts[0].Key, chk.Equals, "id=2")
+	c.Check(conflicts[0].Ours["name"], chk.Equals, "'Robert'")
+	c.Check(conflicts[0].Theirs["name"], chk.Equals, "'Bobbie'")
+
+	// Committing should be refused until the conflict report is removed
+	execSQL(c, newDB, `UPDATE people SET name = 'Bob' WHERE id = 2`)
+	commitCmdBranch = ""
+	commitCmdMsg = ""
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 18, 36, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{newDB})
+	c.Check(err, chk.NotNil)
+	err = os.Remove(report)
+	c.Assert(err, chk.IsNil)
+	err = commit([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	meta, err = localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	com = meta.Commits[meta.Branches["main"].Commit]
+	c.Check(com.Parent, chk.Equals, mainCommit)
+	c.Check(com.OtherParents, chk.DeepEquals, []string{theirCommit})
+	c.Check(com.Message, chk.Equals, "Merge branch 'theirs' into 'main'")
+	_, err = os.Stat(filepath.Join(".dio", newDB, "merge.json"))
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+	commitCmdBranch = "main"
+}
 
-	// Send a success message back to the client
-	w.WriteHeader(http.StatusCreated)
-	_, _ = fmt.Fprintf(w, "Success")
+func (s *DioSuite) Test0350_Diff(c *chk.C) {
+	// Change the working copy of the row merge database
+	newDB := "rowmerge.sqlite"
+	execSQL(c, newDB, `CREATE TABLE pets (name TEXT)`, `INSERT INTO pets VALUES ('Rex')`,
+		`UPDATE people SET name = 'Ann' WHERE id = 1`, `DELETE FROM people WHERE id = 4`)
+
+	// Compare the head of the active branch with the working file
+	*diffCmdJSON = true
+	err := diff([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	var d dbDiff
+	err = json.Unmarshal(s.buf.Bytes(), &d)
+	c.Assert(err, chk.IsNil)
+	meta, err := localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(d.From, chk.Equals, meta.Branches["main"].Commit)
+	c.Check(d.To, chk.Equals, "working file")
+	c.Assert(d.Schema, chk.HasLen, 1)
+	c.Check(d.Schema[0], chk.DeepEquals, schemaDiff{Action: "added", Name: "pets", NewSQL: "CREATE TABLE pets (name TEXT)",
+		Type: "table"})
+	c.Assert(d.Tables, chk.HasLen, 2)
+	c.Check(d.Tables[0].Name, chk.Equals, "people")
+	c.Assert(d.Tables[0].Modified, chk.HasLen, 1)
+	c.Check(d.Tables[0].Modified[0].Key, chk.Equals, "id=1")
+	c.Check(d.Tables[0].Modified[0].Old["name"], chk.Equals, "'Annie'")
+	c.Check(d.Tables[0].Modified[0].New["name"], chk.Equals, "'Ann'")
+	c.Assert(d.Tables[0].Deleted, chk.HasLen, 1)
+	c.Check(d.Tables[0].Deleted[0].Key, chk.Equals, "id=4")
+	c.Check(d.Tables[0].Added, chk.HasLen, 0)
+	c.Check(d.Tables[1].Name, chk.Equals, "pets")
+	c.Check(d.Tables[1].Added, chk.HasLen, 1)
+
+	// Compare two branches, using the human friendly output
+	s.buf.Reset()
+	*diffCmdJSON = false
+	diffCmdFrom = "theirs"
+	diffCmdTo = "main"
+	err = diff([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "Table people: 0 added, 0 deleted, 1 modified"), chk.Equals, true)
+	c.Check(strings.Contains(s.buf.String(), "  ~ id=2: name: 'Bobbie' -> 'Bob'"), chk.Equals, true)
+
+	// Unknown revisions should be rejected
+	diffCmdFrom = "nonexistent"
+	err = diff([]string{newDB})
+	c.Check(err, chk.NotNil)
+	diffCmdFrom = ""
+	diffCmdTo = ""
+
+	// Put the working file back how it was
+	err = localRepo().RestoreDB(newDB, meta.Commits[meta.Branches["main"].Commit].Tree.Entries[0].Sha256,
+		meta.Commits[meta.Branches["main"].Commit].Tree.Entries[0].LastModified)
+	c.Assert(err, chk.IsNil)
 }
 
-func mockServerLicenceGetHandler(w http.ResponseWriter, r *http.Request) {
-	// Make sure the correct licence is being requested
-	if r.FormValue("licence") != "AGPL3" {
-		http.Error(w, "Wrong licence requested", http.StatusNotFound)
-		return
-	}
+func (s *DioSuite) Test0360_Fetch(c *chk.C) {
+	// Start with no local metadata nor cache for a database on the test server
+	db := "19kBv2.sqlite"
+	err := os.RemoveAll(filepath.Join(".dio", db))
+	c.Assert(err, chk.IsNil)
+	_, err = os.Stat(db)
+	c.Assert(os.IsNotExist(err), chk.Equals, true)
 
-	// Send the licence file to the client
-	lic, err := ioutil.ReadFile(licFile)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	w.Header().Set("Content-Disposition", "attachment; filename=AGPL3.txt")
-	w.Header().Set("Content-Type", "text/plain")
-	_, err = fmt.Fprint(w, lic)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	// Fetch the database history
+	*fetchCmdAllBranches = true
+	err = fetch([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "Fetched 1 database version(s)"), chk.Equals, true)
+
+	// The metadata and database should now be in the local cache, but not in the working directory
+	meta, err := localFetchMetadata(db, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.ActiveBranch, chk.Equals, "main")
+	head := meta.Commits[meta.Branches["main"].Commit]
+	b, err := ioutil.ReadFile(filepath.Join(".dio", db, "db", head.Tree.Entries[0].Sha256))
+	c.Assert(err, chk.IsNil)
+	z := sha256.Sum256(b)
+	c.Check(hex.EncodeToString(z[:]), chk.Equals, head.Tree.Entries[0].Sha256)
+	_, err = os.Stat(db)
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+
+	// Fetching again shouldn't need to download anything
+	s.buf.Reset()
+	*fetchCmdAllBranches = false
+	err = fetch([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "already has all 1 commit(s)"), chk.Equals, true)
 }
 
-func mockServerLicenceRemoveHandler(w http.ResponseWriter, r *http.Request) {
-	// Make sure the correct licence is being requested
-	if r.FormValue("licence_id") != "AGPL3" {
-		http.Error(w, "Wrong licence requested", http.StatusNotFound)
-		return
-	}
+func (s *DioSuite) Test0370_PushForce(c *chk.C) {
+	// Create a database with two commits, and push it to the server
+	newDB := "19kBforce.sqlite"
+	execSQL(c, newDB, `CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT)`, `INSERT INTO t VALUES (1, 'a')`)
+	err := os.Chtimes(newDB, time.Now(), time.Date(2019, time.March, 15, 19, 0, 0, 0, time.UTC))
+	c.Assert(err, chk.IsNil)
+	commitCmdBranch = ""
+	commitCmdLicence = "Not specified"
+	commitCmdMsg = "First"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 19, 0, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	meta, err := localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	firstCommit := meta.Branches["main"].Commit
+	execSQL(c, newDB, `INSERT INTO t VALUES (2, 'b')`)
+	err = os.Chtimes(newDB, time.Now(), time.Date(2019, time.March, 15, 19, 1, 0, 0, time.UTC))
+	c.Assert(err, chk.IsNil)
+	commitCmdLicence = ""
+	commitCmdMsg = "Second"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 19, 1, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	meta, err = localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	secondCommit := meta.Branches["main"].Commit
+	pushCmdBranch = ""
+	pushCmdDB = ""
+	pushCmdForce = false
+	pushCmdForceLease = ""
+	pushCmdLicence = ""
+	pushCmdMsg = ""
+	err = push([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	c.Check(mockMetaData[newDB].Branches["main"].Commit, chk.Equals, secondCommit)
+
+	// Rewind the local branch to the first commit, and make a different second commit
+	branchRevertBranch = ""
+	branchRevertCommit = firstCommit
+	branchRevertTag = ""
+	*branchRevertForce = false
+	err = branchRevert([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	execSQL(c, newDB, `INSERT INTO t VALUES (2, 'c')`)
+	err = os.Chtimes(newDB, time.Now(), time.Date(2019, time.March, 15, 19, 2, 0, 0, time.UTC))
+	c.Assert(err, chk.IsNil)
+	commitCmdMsg = "Replacement second"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 19, 2, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	meta, err = localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	newSecondCommit := meta.Branches["main"].Commit
 
-	// Remove the licence
-	delete(licList, "AGPL3")
+	// A normal push should fail, as the branches have diverged
+	pushCmdBranch = ""
+	err = push([]string{newDB})
+	c.Check(err, chk.NotNil)
 
-	// Send a success message back to the client
-	w.WriteHeader(http.StatusOK)
-	_, _ = fmt.Fprintf(w, "Success")
+	// A push with the wrong lease should fail too.  Leases are revisions, worked out using the server's metadata
+	pushCmdForceLease = "main~1"
+	err = push([]string{newDB})
+	c.Check(err, chk.ErrorMatches, ".* is commit "+secondCommit+", not the expected "+firstCommit+".*")
+	c.Check(mockMetaData[newDB].Branches["main"].Commit, chk.Equals, secondCommit)
+
+	// With the right lease, the remote branch should be overwritten
+	s.buf.Reset()
+	pushCmdForceLease = secondCommit[:12]
+	err = push([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	c.Check(mockMetaData[newDB].Branches["main"].Commit, chk.Equals, newSecondCommit)
+	c.Check(mockMetaData[newDB].Branches["main"].CommitCount, chk.Equals, 2)
+	c.Check(strings.Contains(s.buf.String(), "no longer part of the remote branch 'main'"), chk.Equals, true)
+	c.Check(strings.Contains(s.buf.String(), "  * "+secondCommit), chk.Equals, true)
+
+	// Rewinding the remote branch without any new commits isn't supported, so it's refused before anything is sent
+	branchRevertBranch = ""
+	branchRevertCommit = firstCommit
+	err = branchRevert([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	pushCmdBranch = ""
+	pushCmdForce = true
+	pushCmdForceLease = ""
+	s.buf.Reset()
+	err = push([]string{newDB})
+	c.Check(err, chk.ErrorMatches, "The local branch 'main' is behind the remote branch.* it can't be moved back to "+
+		"an earlier commit.*")
+	c.Check(s.buf.String(), chk.Equals, "")
+	c.Check(mockMetaData[newDB].Branches["main"].Commit, chk.Equals, newSecondCommit)
+	pushCmdForce = false
+	branchRevertCommit = ""
 }
 
-func mockServerMetadataGetHandler(w http.ResponseWriter, r *http.Request) {
-	var info struct {
-		Branches  map[string]branchEntry  `json:"branches"`
-		Commits   map[string]commitEntry  `json:"commits"`
-		DefBranch string                  `json:"default_branch"`
-		Releases  map[string]releaseEntry `json:"releases"`
-		Tags      map[string]tagEntry     `json:"tags"`
+func (s *DioSuite) Test0380_PushTags(c *chk.C) {
+	// Create some tags and a release on the commit shared with the server
+	newDB := "19kBforce.sqlite"
+	meta, err := localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	localCommit := meta.Branches["main"].Commit
+	remoteCommit := mockMetaData[newDB].Branches["main"].Commit
+	tagCreateCommit = localCommit
+	tagCreateDate = "2019-03-15T19:05:00Z"
+	tagCreateMsg = ""
+	for _, tag := range []string{"v1", "clash"} {
+		tagCreateTag = tag
+		err = tagCreate([]string{newDB})
+		c.Assert(err, chk.IsNil)
+	}
+	releaseCreateCommit = localCommit
+	releaseCreateRelease = "r1"
+	releaseCreateReleaseDate = "2019-03-15T19:06:00Z"
+	err = releaseCreate([]string{newDB})
+	c.Assert(err, chk.IsNil)
+
+	// A tag with the same name, but on a different commit, is already on the server
+	mockMetaData[newDB].Tags["clash"] = tagEntry{Commit: remoteCommit, Date: time.Now().UTC()}
+
+	// Push the tags and releases.  The non-conflicting ones should be sent, and the conflict reported
+	pushCmdTags = true
+	err = push([]string{newDB})
+	c.Check(err, chk.NotNil)
+	c.Check(mockMetaData[newDB].Tags["v1"].Commit, chk.Equals, localCommit)
+	c.Check(mockMetaData[newDB].Tags["clash"].Commit, chk.Equals, remoteCommit)
+	c.Check(mockMetaData[newDB].Releases["r1"].Commit, chk.Equals, localCommit)
+	c.Check(strings.Contains(s.buf.String(), fmt.Sprintf("Tag 'clash' is on commit %s locally, but commit %s "+
+		"on the server", localCommit, remoteCommit)), chk.Equals, true)
+	pushCmdTags = false
+
+	// Removing a tag locally shouldn't have it come back when merging the server metadata
+	delete(mockMetaData[newDB].Tags, "clash")
+	tagRemoveTag = "v1"
+	err = tagRemove([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	meta, err = updateMetadata(newDB, "pull", true)
+	c.Assert(err, chk.IsNil)
+	_, ok := meta.Tags["v1"]
+	c.Check(ok, chk.Equals, false)
+	_, ok = meta.DeletedTags["v1"]
+	c.Check(ok, chk.Equals, true)
+
+	// Pushing the tags should now send the remaining tag, and remove the deleted one from the server
+	err = tagPush([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	_, ok = mockMetaData[newDB].Tags["v1"]
+	c.Check(ok, chk.Equals, false)
+	c.Check(mockMetaData[newDB].Tags["clash"].Commit, chk.Equals, localCommit)
+	meta, err = localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.DeletedTags, chk.HasLen, 0)
+
+	// Remove the release, and push that too
+	releaseRemoveRelease = "r1"
+	err = releaseRemove([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	err = releasePush([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	_, ok = mockMetaData[newDB].Releases["r1"]
+	c.Check(ok, chk.Equals, false)
+}
+
+func (s *DioSuite) Test0390_PushBranchChanges(c *chk.C) {
+	// Bring the local metadata up to date with the server
+	newDB := "19kBforce.sqlite"
+	_, err := updateMetadata(newDB, "pull", true)
+	c.Assert(err, chk.IsNil)
+	remoteCommit := mockMetaData[newDB].Branches["main"].Commit
+
+	// Create, update, and rename some branches locally
+	branchCreateBranch = "feat"
+	branchCreateCommit = remoteCommit
+	branchCreateMsg = "Feature work"
+	err = branchCreate([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	branchUpdateBranch = "feat"
+	branchUpdateMsg = "Updated description"
+	*descDel = false
+	err = branchUpdate([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	branchCreateBranch = "old"
+	branchCreateMsg = ""
+	err = branchCreate([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	branchRenameBranch = "old"
+	branchRenameNewName = "renamed"
+	err = branchRename([]string{newDB})
+	c.Assert(err, chk.IsNil)
+
+	// Remove a branch which is on the server.  It shouldn't come back when the server metadata is merged
+	mockMetaData[newDB].Branches["stale"] = branchEntry{Commit: remoteCommit, CommitCount: 2}
+	_, err = updateMetadata(newDB, "pull", true)
+	c.Assert(err, chk.IsNil)
+	branchRemoveBranch = "stale"
+	err = branchRemove([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	meta, err := updateMetadata(newDB, "pull", true)
+	c.Assert(err, chk.IsNil)
+	_, ok := meta.Branches["stale"]
+	c.Check(ok, chk.Equals, false)
+	c.Check(meta.BranchOps, chk.HasLen, 5)
+
+	// Push, which should apply the queued branch changes to the server
+	pushCmdBranch = ""
+	pushCmdForce = false
+	pushCmdTags = false
+	err = push([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	branches := mockMetaData[newDB].Branches
+	c.Check(branches["feat"].Commit, chk.Equals, remoteCommit)
+	c.Check(branches["feat"].Description, chk.Equals, "Updated description")
+	c.Check(branches["renamed"].Commit, chk.Equals, remoteCommit)
+	_, ok = branches["old"]
+	c.Check(ok, chk.Equals, false)
+	_, ok = branches["stale"]
+	c.Check(ok, chk.Equals, false)
+	meta, err = localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.BranchOps, chk.HasLen, 0)
+}
+
+func (s *DioSuite) Test0400_RemoteTracking(c *chk.C) {
+	// After the push, the active branch should be the same locally and on the server
+	newDB := "19kBforce.sqlite"
+	err := status([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "Branch main: up to date with the server"), chk.Equals, true)
+
+	// Add a commit locally
+	execSQL(c, newDB, `INSERT INTO t VALUES (3, 'local')`)
+	err = os.Chtimes(newDB, time.Now(), time.Date(2019, time.March, 15, 19, 10, 0, 0, time.UTC))
+	c.Assert(err, chk.IsNil)
+	commitCmdBranch = ""
+	commitCmdMsg = "Local change"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 19, 10, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{newDB})
+	c.Assert(err, chk.IsNil)
+
+	// Add a different commit to the same branch on the server
+	remoteMeta := mockMetaData[newDB]
+	parent := remoteMeta.Commits[remoteMeta.Branches["main"].Commit]
+	remoteCom := commitEntry{
+		AuthorEmail: "someoneelse@example.org",
+		AuthorName:  "Someone Else",
+		Message:     "Remote change",
+		Parent:      parent.ID,
+		Timestamp:   time.Date(2019, time.March, 15, 19, 11, 0, 0, time.UTC),
+		Tree:        parent.Tree,
+	}
+	remoteCom.ID = repo.CreateCommitID(remoteCom)
+	remoteMeta.Commits[remoteCom.ID] = remoteCom
+	remoteMeta.Branches["main"] = branchEntry{Commit: remoteCom.ID, CommitCount: 3}
+
+	// Once the metadata is updated, the branch should show as both ahead of and behind the server
+	_, err = updateMetadata(newDB, "pull", true)
+	c.Assert(err, chk.IsNil)
+	meta, err := localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.RemoteBranches["main"].Commit, chk.Equals, remoteCom.ID)
+	_, ok := meta.Commits[remoteCom.ID]
+	c.Check(ok, chk.Equals, true)
+	s.buf.Reset()
+	err = status([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "Branch main: ahead 1, behind 1"), chk.Equals, true)
+	s.buf.Reset()
+	err = branchList([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "(ahead 1, behind 1)"), chk.Equals, true)
+	c.Check(strings.Contains(s.buf.String(), "'feat' - Commit: "+parent.ID+" (up to date with the server)"),
+		chk.Equals, true)
+}
+
+func (s *DioSuite) Test0410_MultipleDatabases(c *chk.C) {
+	// Change two of the tracked databases
+	execSQL(c, "rowmerge.sqlite", `INSERT INTO people VALUES (5, 'Eve')`)
+	err := os.Chtimes("19kBmerge.sqlite", time.Now(), time.Date(2019, time.March, 15, 19, 20, 0, 0, time.UTC))
+	c.Assert(err, chk.IsNil)
+	before := make(map[string]string)
+	for _, db := range []string{"rowmerge.sqlite", "19kBmerge.sqlite"} {
+		meta, err := localFetchMetadata(db, false)
+		c.Assert(err, chk.IsNil)
+		before[db] = meta.Branches[meta.ActiveBranch].Commit
+	}
+
+	// Commit every changed database at once
+	*commitCmdAll = true
+	commitCmdBranch = ""
+	commitCmdLicence = ""
+	commitCmdMsg = "Multiple database commit"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 19, 20, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{})
+	*commitCmdAll = false
+	c.Assert(err, chk.IsNil)
+	for _, db := range []string{"rowmerge.sqlite", "19kBmerge.sqlite"} {
+		meta, err := localFetchMetadata(db, false)
+		c.Assert(err, chk.IsNil)
+		head := meta.Commits[meta.Branches[meta.ActiveBranch].Commit]
+		c.Check(head.Parent, chk.Equals, before[db])
+		c.Check(head.Message, chk.Equals, "Multiple database commit")
+		c.Check(strings.Contains(s.buf.String(), fmt.Sprintf("  * '%s': ok", db)), chk.Equals, true)
+	}
+	c.Check(strings.Contains(s.buf.String(), "'19kBforce.sqlite'"), chk.Equals, false)
+
+	// A failure for one database shouldn't stop the others, but should be reported
+	s.buf.Reset()
+	err = status([]string{"rowmerge.sqlite", "nonexistent.sqlite", "19kBmerge.sqlite"})
+	c.Check(err, chk.ErrorMatches, "1 of 3 databases failed")
+	c.Check(strings.Contains(s.buf.String(), "  * 'rowmerge.sqlite': ok"), chk.Equals, true)
+	c.Check(strings.Contains(s.buf.String(), "  * 'nonexistent.sqlite': failed"), chk.Equals, true)
+	c.Check(strings.Contains(s.buf.String(), "  * '19kBmerge.sqlite': ok"), chk.Equals, true)
+
+	// Names and --all can't be given together
+	*statusCmdAll = true
+	err = status([]string{"rowmerge.sqlite"})
+	*statusCmdAll = false
+	c.Check(err, chk.NotNil)
+}
+
+func (s *DioSuite) Test0420_StatusSummary(c *chk.C) {
+	// Add an untracked database, and a file which isn't a database at all
+	execSQL(c, "untracked.sqlite", `CREATE TABLE stuff (id INTEGER PRIMARY KEY)`)
+	err := ioutil.WriteFile("notes.txt", []byte("Not a database"), 0644)
+	c.Assert(err, chk.IsNil)
+
+	// Change one tracked database, and move another out of the way
+	execSQL(c, "rowmerge.sqlite", `INSERT INTO people VALUES (6, 'Frank')`)
+	err = os.Rename("19kBmerge.sqlite", "19kBmerge.sqlite.moved")
+	c.Assert(err, chk.IsNil)
+
+	// With no database name given, every tracked database should be summarised
+	s.buf.Reset()
+	err = status([]string{})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "  * '19kBforce.sqlite' on branch 'main': unchanged\n"), chk.Equals, true)
+	c.Check(strings.Contains(s.buf.String(), "  * '19kBmerge.sqlite' on branch 'main': missing\n"), chk.Equals, true)
+	c.Check(strings.Contains(s.buf.String(), "  * 'rowmerge.sqlite' on branch 'main': has been changed\n"),
+		chk.Equals, true)
+	c.Check(strings.Contains(s.buf.String(), "Untracked databases:\n"), chk.Equals, true)
+	c.Check(strings.Contains(s.buf.String(), "  * 'untracked.sqlite'\n"), chk.Equals, true)
+	c.Check(strings.Contains(s.buf.String(), "notes.txt"), chk.Equals, false)
+
+	err = os.Rename("19kBmerge.sqlite.moved", "19kBmerge.sqlite")
+	c.Assert(err, chk.IsNil)
+}
+
+func (s *DioSuite) Test0430_FsckGC(c *chk.C) {
+	// The metadata and cache built up by the earlier tests should have no problems
+	db := "rowmerge.sqlite"
+	s.buf.Reset()
+	err := fsck([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "No problems found in 'rowmerge.sqlite'"), chk.Equals, true)
+
+	// Add a cached database nothing refers to, a corrupted one, and a tag pointing at an unknown commit
+	orphan := []byte("An orphaned database")
+	orphanSum := sha256.Sum256(orphan)
+	orphanName := hex.EncodeToString(orphanSum[:])
+	err = ioutil.WriteFile(filepath.Join(".dio", db, "db", orphanName), orphan, 0644)
+	c.Assert(err, chk.IsNil)
+	badName := strings.Repeat("0", 64)
+	err = ioutil.WriteFile(filepath.Join(".dio", db, "db", badName), []byte("Corrupted"), 0644)
+	c.Assert(err, chk.IsNil)
+	meta, err := localFetchMetadata(db, false)
+	c.Assert(err, chk.IsNil)
+	meta.Tags["broken"] = tagEntry{Commit: strings.Repeat("1", 64)}
+	err = localRepo().SaveMetadata(db, meta, "tag create")
+	c.Assert(err, chk.IsNil)
+
+	// Check fsck notices the problems
+	s.buf.Reset()
+	err = fsck([]string{db})
+	c.Check(err, chk.ErrorMatches, "2 problem.* found in 'rowmerge.sqlite'")
+	c.Check(strings.Contains(s.buf.String(), fmt.Sprintf("Cached database '%s' has a SHA256 of", badName)),
+		chk.Equals, true)
+	c.Check(strings.Contains(s.buf.String(), fmt.Sprintf("Tag 'broken' points at unknown commit %s",
+		strings.Repeat("1", 64))), chk.Equals, true)
+	delete(meta.Tags, "broken")
+	err = localRepo().SaveMetadata(db, meta, "tag remove")
+	c.Assert(err, chk.IsNil)
+
+	// A dry run of gc should report the unreachable files, without removing them
+	s.buf.Reset()
+	*gcCmdDryRun = true
+	err = gc([]string{db})
+	*gcCmdDryRun = false
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "Would remove 2 cached version(s) of 'rowmerge.sqlite', reclaiming 29 bytes"),
+		chk.Equals, true)
+	_, err = os.Stat(filepath.Join(".dio", db, "db", orphanName))
+	c.Check(err, chk.IsNil)
+
+	// A real run should remove them, and leave everything else alone, including the commits in the metadata
+	s.buf.Reset()
+	err = gc([]string{db})
+	c.Assert(err, chk.IsNil)
+	after, err := localFetchMetadata(db, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(after.Commits, chk.HasLen, len(meta.Commits))
+
+	c.Check(strings.Contains(s.buf.String(), "Removed 2 cached version(s) of 'rowmerge.sqlite', reclaiming 29 bytes"),
+		chk.Equals, true)
+	_, err = os.Stat(filepath.Join(".dio", db, "db", orphanName))
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+	_, err = os.Stat(filepath.Join(".dio", db, "db", badName))
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+	s.buf.Reset()
+	err = fsck([]string{db})
+	c.Check(err, chk.IsNil)
+
+	// Commits nothing refers to are only removed with --prune-commits
+	head := after.Commits[after.Branches[after.ActiveBranch].Commit]
+	unneeded := commitEntry{Message: "Unneeded", Parent: head.ID, Tree: head.Tree, Timestamp: head.Timestamp}
+	unneeded.ID = repo.CreateCommitID(unneeded)
+	after.Commits[unneeded.ID] = unneeded
+	err = localRepo().SaveMetadata(db, after, "test")
+	c.Assert(err, chk.IsNil)
+	err = gc([]string{db})
+	c.Assert(err, chk.IsNil)
+	after, err = localFetchMetadata(db, false)
+	c.Assert(err, chk.IsNil)
+	_, ok := after.Commits[unneeded.ID]
+	c.Check(ok, chk.Equals, true)
+	s.buf.Reset()
+	*gcCmdPruneCommits = true
+	err = gc([]string{db})
+	*gcCmdPruneCommits = false
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "Removed 1 unneeded commit(s) from the metadata for 'rowmerge.sqlite'"),
+		chk.Equals, true)
+	after, err = localFetchMetadata(db, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(after.Commits, chk.HasLen, len(meta.Commits))
+}
+
+func (s *DioSuite) Test0440_SaveDBCacheChecksum(c *chk.C) {
+	// Data which doesn't match the expected checksum shouldn't end up in the cache, not even partially
+	db := "rowmerge.sqlite"
+	data := []byte("Some database data")
+	wrongSum := strings.Repeat("2", 64)
+	err := localRepo().SaveDB(db, wrongSum, bytes.NewReader(data))
+	c.Check(err, chk.ErrorMatches, "(?s)Aborting: database file should have checksum.*")
+	_, err = os.Stat(filepath.Join(".dio", db, "db", wrongSum))
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+	for _, dir := range []string{"db", "tmp"} {
+		tmpFiles, err := filepath.Glob(filepath.Join(".dio", db, dir, ".dio-tmp-*"))
+		c.Assert(err, chk.IsNil)
+		c.Check(tmpFiles, chk.HasLen, 0)
+	}
+
+	// Data with the right checksum should be written to the cache
+	rightSum := sha256.Sum256(data)
+	shaSum := hex.EncodeToString(rightSum[:])
+	err = localRepo().SaveDB(db, shaSum, bytes.NewReader(data))
+	c.Assert(err, chk.IsNil)
+	b, err := ioutil.ReadFile(filepath.Join(".dio", db, "db", shaSum))
+	c.Assert(err, chk.IsNil)
+	c.Check(b, chk.DeepEquals, data)
+	err = os.Remove(filepath.Join(".dio", db, "db", shaSum))
+	c.Assert(err, chk.IsNil)
+
+	// A file left behind while saving (eg by a crash) is in the tmp directory, so fsck doesn't see it as a damaged
+	// cached version
+	leftover := filepath.Join(".dio", db, "tmp", ".dio-tmp-leftover")
+	err = ioutil.WriteFile(leftover, data, 0644)
+	c.Assert(err, chk.IsNil)
+	s.buf.Reset()
+	err = fsck([]string{db})
+	c.Check(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "leftover"), chk.Equals, false)
+	err = os.Remove(leftover)
+	c.Assert(err, chk.IsNil)
+}
+
+func (s *DioSuite) Test0450_StatIndex(c *chk.C) {
+	// Checking the status of a database should record its SHA256 in the stat index
+	db := "19kBforce.sqlite"
+	err := localRepo().RemoveStatIndex(db)
+	c.Assert(err, chk.IsNil)
+	s.buf.Reset()
+	err = status([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "unchanged"), chk.Equals, true)
+	meta, err := localFetchMetadata(db, false)
+	c.Assert(err, chk.IsNil)
+	headEntry := meta.Commits[meta.Branches[meta.ActiveBranch].Commit].Tree.Entries[0]
+	headSHA := headEntry.Sha256
+	idx, err := localRepo().LoadStatIndex(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(idx.Sha256, chk.Equals, headSHA)
+	c.Check(idx.Size, chk.Equals, headEntry.Size)
+
+	// While the file info matches, the SHA256 in the index is trusted rather than hashing the file again
+	idx.Sha256 = strings.Repeat("3", 64)
+	err = localRepo().SaveStatIndex(db, idx)
+	c.Assert(err, chk.IsNil)
+	changed, err := localRepo().Changed(db, meta)
+	c.Assert(err, chk.IsNil)
+	c.Check(changed, chk.Equals, true)
+
+	// With --verify, the file is hashed anyway, and the index corrected
+	verifyHashes = true
+	changed, err = localRepo().Changed(db, meta)
+	verifyHashes = false
+	c.Assert(err, chk.IsNil)
+	c.Check(changed, chk.Equals, false)
+	idx, err = localRepo().LoadStatIndex(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(idx.Sha256, chk.Equals, headSHA)
+}
+
+func (s *DioSuite) Test0460_ResumeDownload(c *chk.C) {
+	// Pick a version of a database which is on the server
+	db := "19kBforce.sqlite"
+	meta := mockMetaData[db]
+	comID := meta.Branches[meta.DefBranch].Commit
+	shaSum := meta.Commits[comID].Tree.Entries[0].Sha256
+	blob := mockBlobs[shaSum]
+	c.Assert(len(blob) > 1000, chk.Equals, true)
+	cacheFile := filepath.Join(".dio", db, "db", shaSum)
+	partFile := filepath.Join(".dio", db, "tmp", shaSum+".part")
+	err := os.Remove(cacheFile)
+	c.Assert(err == nil || os.IsNotExist(err), chk.Equals, true)
+
+	// Simulate an interrupted download, by leaving the first part of the database in a partial file
+	err = os.MkdirAll(filepath.Dir(partFile), 0770)
+	c.Assert(err, chk.IsNil)
+	err = ioutil.WriteFile(partFile, blob[:1000], 0644)
+	c.Assert(err, chk.IsNil)
+
+	// The download should only request the remainder of the database, then move the completed file into the cache
+	err = checkDBCache(db, comID, shaSum)
+	c.Assert(err, chk.IsNil)
+	c.Check(mockLastRange, chk.Equals, "bytes=1000-")
+	b, err := ioutil.ReadFile(cacheFile)
+	c.Assert(err, chk.IsNil)
+	c.Check(b, chk.DeepEquals, blob)
+	_, err = os.Stat(partFile)
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+
+	// A partial file with the wrong data in it should be caught by the checksum, and thrown away
+	err = os.Remove(cacheFile)
+	c.Assert(err, chk.IsNil)
+	err = ioutil.WriteFile(partFile, bytes.Repeat([]byte("x"), 1000), 0644)
+	c.Assert(err, chk.IsNil)
+	err = checkDBCache(db, comID, shaSum)
+	c.Check(err, chk.ErrorMatches, "Aborting: newly downloaded database file should have checksum.*")
+	_, err = os.Stat(partFile)
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+
+	// The next attempt starts from scratch
+	err = checkDBCache(db, comID, shaSum)
+	c.Assert(err, chk.IsNil)
+	c.Check(mockLastRange, chk.Equals, "")
+	c.Check(byteSize(int64(len(blob))), chk.Equals, fmt.Sprintf("%.1f kB", float64(len(blob))/1000))
+}
+
+func (s *DioSuite) Test0470_ChunkedUpload(c *chk.C) {
+	// Create a new database to push, big enough to need several chunks
+	db := "chunked.sqlite"
+	execSQL(c, db, `CREATE TABLE chunked (id INTEGER PRIMARY KEY, val TEXT)`,
+		`INSERT INTO chunked (val) VALUES (hex(randomblob(10000)))`)
+	err := os.Chtimes(db, time.Now(), time.Date(2019, time.March, 15, 19, 30, 0, 0, time.UTC))
+	c.Assert(err, chk.IsNil)
+	commitCmdBranch = ""
+	commitCmdLicence = "Not specified"
+	commitCmdMsg = "Commit for chunked upload"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 19, 30, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{db})
+	c.Assert(err, chk.IsNil)
+	meta, err := localFetchMetadata(db, false)
+	c.Assert(err, chk.IsNil)
+	head := meta.Branches[meta.ActiveBranch].Commit
+	fi, err := os.Stat(db)
+	c.Assert(err, chk.IsNil)
+	numChunks := int((fi.Size() + mockChunkSize - 1) / mockChunkSize)
+	c.Assert(numChunks > 3, chk.Equals, true)
+
+	// Have the server keep rejecting the third chunk, so the upload fails part way through
+	mockChunkedUploads = true
+	mockChunkFailures[2] = client.ChunkAttempts
+	mockChunksReceived = 0
+	pushCmdBranch = ""
+	pushCmdDB = ""
+	pushCmdForce = false
+	pushCmdForceLease = ""
+	pushCmdLicence = ""
+	pushCmdMsg = ""
+	err = push([]string{db})
+	c.Check(err, chk.ErrorMatches, "(?s).*Upload of 'chunked.sqlite' interrupted.*")
+	c.Check(mockChunksReceived, chk.Equals, 2)
+	_, ok := mockMetaData[db]
+	c.Check(ok, chk.Equals, false)
+
+	// Pushing again should only send the chunks the server doesn't have yet, then create the commit
+	mockChunksReceived = 0
+	pushCmdBranch = ""
+	err = push([]string{db})
+	mockChunkedUploads = false
+	c.Assert(err, chk.IsNil)
+	c.Check(mockChunksReceived, chk.Equals, numChunks-2)
+	c.Check(mockMetaData[db].Branches["main"].Commit, chk.Equals, head)
+	b, err := ioutil.ReadFile(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(mockBlobs[meta.Commits[head].Tree.Entries[0].Sha256], chk.DeepEquals, b)
+}
+
+func (s *DioSuite) Test0480_APIClient(c *chk.C) {
+	// Use the API client directly, the way other Go code would
+	api := client.New(cloud, certUser, &TLSConfig, "dio tests")
+	ctx := context.Background()
+	db := "chunked.sqlite"
+	meta, err := api.GetMetadata(ctx, db)
+	c.Assert(err, chk.IsNil)
+	head := meta.Branches["main"].Commit
+	c.Check(head, chk.Equals, mockMetaData[db].Branches["main"].Commit)
+	c.Check(meta.Commits[head].Message, chk.Equals, "Commit for chunked upload")
+
+	// Download the database, first in full then just the end of it
+	b, err := ioutil.ReadFile(db)
+	c.Assert(err, chk.IsNil)
+	resp, err := api.Download(ctx, db, "", head, 0)
+	c.Assert(err, chk.IsNil)
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, chk.IsNil)
+	c.Check(resp.StatusCode, chk.Equals, http.StatusOK)
+	c.Check(data, chk.DeepEquals, b)
+	resp, err = api.Download(ctx, db, "", head, 1000)
+	c.Assert(err, chk.IsNil)
+	data, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, chk.IsNil)
+	c.Check(resp.StatusCode, chk.Equals, http.StatusPartialContent)
+	c.Check(data, chk.DeepEquals, b[1000:])
+
+	// Failures come back as structured errors
+	_, err = api.GetMetadata(ctx, "missing.sqlite")
+	c.Check(client.IsNotFound(err), chk.Equals, true)
+	c.Check(client.StatusCode(err), chk.Equals, http.StatusNotFound)
+	_, _, err = api.LicenceGet(ctx, "no-such-licence")
+	var e *client.Error
+	c.Assert(errors.As(err, &e), chk.Equals, true)
+	c.Check(e.Op, chk.Equals, "retrieve licence")
+	c.Check(e.Message, chk.Equals, "Wrong licence requested")
+
+	// The commands share one client, so its connections to the server are reused
+	c.Check(apiClient(), chk.Equals, apiClient())
+	c.Check(apiClient().HTTPClient.Transport, chk.Equals, apiClient().HTTPClient.Transport)
+
+	// Servers without the endpoints for changes are reported as not supporting them
+	old := client.New(cloud+"/old", certUser, &TLSConfig, "dio tests")
+	err = old.SendChange(ctx, "tag/create", db, map[string]string{"commit": head, "tag": "unsupported"})
+	c.Check(errors.Is(err, client.ErrUnsupported), chk.Equals, true)
+	c.Check(client.IsNotFound(err), chk.Equals, true)
+	err = api.SendChange(ctx, "tag/rename", db, nil)
+	c.Check(err, chk.ErrorMatches, "Unknown change endpoint 'tag/rename'")
+}
+
+func (s *DioSuite) Test0490_RepoPackage(c *chk.C) {
+	// Use the repo package directly, in a directory other than the current one
+	r := repo.Open(c.MkDir())
+	db := "library.sqlite"
+	_, err := r.LoadMetadata(db)
+	c.Check(err, chk.Equals, repo.ErrNoMetadata)
+	execSQL(c, r.DBPath(db), `CREATE TABLE t (a INTEGER)`)
+	opts := repo.CommitOptions{AuthorEmail: "someone@example.org", AuthorName: "Some One", Message: "First"}
+	first, err := r.Commit(db, opts)
+	c.Assert(err, chk.IsNil)
+	c.Check(r.HasMetadata(db), chk.Equals, true)
+	c.Check(r.HasCached(db, first.Tree.Entries[0].Sha256), chk.Equals, true)
+	execSQL(c, r.DBPath(db), `INSERT INTO t VALUES (1)`)
+	meta, err := r.LoadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	changed, err := r.Changed(db, meta)
+	c.Assert(err, chk.IsNil)
+	c.Check(changed, chk.Equals, true)
+	opts.Message = "Second"
+	second, err := r.Commit(db, opts)
+	c.Assert(err, chk.IsNil)
+	c.Check(second.Parent, chk.Equals, first.ID)
+	tracked, err := r.Tracked()
+	c.Assert(err, chk.IsNil)
+	c.Check(tracked, chk.DeepEquals, []string{db})
+
+	// Branch, tag, and read the history
+	err = r.CreateBranch(db, "other", first.ID, "Starts at the first commit")
+	c.Assert(err, chk.IsNil)
+	err = r.CreateTag(db, "v1", client.TagEntry{Commit: first.ID, TaggerName: "Some One"})
+	c.Assert(err, chk.IsNil)
+	commits, err := r.Log(db, "main")
+	c.Assert(err, chk.IsNil)
+	c.Assert(commits, chk.HasLen, 2)
+	c.Check(commits[0].ID, chk.Equals, second.ID)
+	c.Check(commits[1].ID, chk.Equals, first.ID)
+
+	// Revert needs forcing while the file has uncommitted changes
+	execSQL(c, r.DBPath(db), `INSERT INTO t VALUES (2)`)
+	err = r.Revert(db, "main", first.ID, false)
+	c.Check(err, chk.Equals, repo.ErrChanged)
+	err = r.Revert(db, "main", first.ID, true)
+	c.Assert(err, chk.IsNil)
+	meta, err = r.LoadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Branches["main"].Commit, chk.Equals, first.ID)
+	changed, err = r.Changed(db, meta)
+	c.Assert(err, chk.IsNil)
+	c.Check(changed, chk.Equals, false)
+}
+
+func (s *DioSuite) Test0500_OutputFormats(c *chk.C) {
+	// Read commands should write their results as JSON when asked
+	outputFormat = outputJSON
+	defer func() { outputFormat = outputText }()
+	err := branchActiveGet([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	var active activeBranchOutput
+	err = json.Unmarshal(s.buf.Bytes(), &active)
+	c.Assert(err, chk.IsNil)
+	c.Check(active, chk.Equals, activeBranchOutput{ActiveBranch: "main", Database: s.dbName})
+
+	s.buf.Reset()
+	logBranch = ""
+	err = branchLog([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	var hist logOutput
+	err = json.Unmarshal(s.buf.Bytes(), &hist)
+	c.Assert(err, chk.IsNil)
+	meta, err := localRepo().LoadMetadata(s.dbName)
+	c.Assert(err, chk.IsNil)
+	c.Check(hist.Branch, chk.Equals, "main")
+	c.Assert(len(hist.Commits) > 0, chk.Equals, true)
+	c.Check(hist.Commits[0].ID, chk.Equals, meta.Branches["main"].Commit)
+
+	s.buf.Reset()
+	err = tagList([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	var tags tagListOutput
+	err = json.Unmarshal(s.buf.Bytes(), &tags)
+	c.Assert(err, chk.IsNil)
+	c.Check(tags.Tags, chk.DeepEquals, meta.Tags)
+
+	s.buf.Reset()
+	err = status([]string{})
+	c.Assert(err, chk.IsNil)
+	var st statusOutput
+	err = json.Unmarshal(s.buf.Bytes(), &st)
+	c.Assert(err, chk.IsNil)
+	c.Check(st.Untracked, chk.DeepEquals, []string{"19kBv2.sqlite-renamed", "untracked.sqlite"})
+	states := make(map[string]string)
+	for _, e := range st.Tracked {
+		states[e.Database] = e.State
+	}
+	c.Check(states["rowmerge.sqlite"], chk.Equals, "changed")
+
+	// YAML uses the same field names as JSON
+	outputFormat = outputYAML
+	s.buf.Reset()
+	err = branchList([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	var branches map[string]interface{}
+	err = yaml.Unmarshal(s.buf.Bytes(), &branches)
+	c.Assert(err, chk.IsNil)
+	c.Check(branches["active_branch"], chk.Equals, "main")
+	c.Check(branches["database"], chk.Equals, s.dbName)
+
+	// Unknown formats are refused
+	outputFormat = "xml"
+	c.Check(checkOutputFormat(), chk.NotNil)
+}
+
+func (s *DioSuite) Test0510_LogOptions(c *chk.C) {
+	db := "19kBmerge.sqlite"
+	defer func() {
+		logAll, logGraph, logOneline = false, false, false
+		logAuthor, logBranch, logFormat, logGrep, logSince, logUntil = "", "", "", "", "", ""
+		logMaxCount = 0
+	}()
+	meta, err := localFetchMetadata(db, false)
+	c.Assert(err, chk.IsNil)
+	history := repo.Ancestry(meta, meta.Branches["main"].Commit)
+	c.Assert(history, chk.HasLen, 5)
+	short := make(map[string]string)
+	for _, com := range history {
+		short[com.Message] = com.ID[:8]
+	}
+
+	// Tags and releases are shown next to the commits they point at
+	err = localRepo().CreateTag(db, "base-tag", tagEntry{Commit: history[4].ID, Date: time.Now()})
+	c.Assert(err, chk.IsNil)
+
+	// The graph follows the merged in branch too
+	logGraph, logOneline = true, true
+	err = branchLog([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(s.buf.String(), chk.Equals, fmt.Sprintf("* %s Multiple database commit\n"+
+		"* %s Merge branch 'other' into 'main'\n"+
+		"|\\\n"+
+		"| * %s Other branch change\n"+
+		"* | %s Main branch change\n"+
+		"|/\n"+
+		"* %s (tag: base-tag) Merge base\n",
+		short["Multiple database commit"], short["Merge branch 'other' into 'main'"], short["Other branch change"],
+		short["Main branch change"], short["Merge base"]))
+
+	// With a limit, the graph stops after the last commit shown
+	s.buf.Reset()
+	logMaxCount = 3
+	err = branchLog([]string{db})
+	logMaxCount = 0
+	c.Assert(err, chk.IsNil)
+	c.Check(s.buf.String(), chk.Equals, fmt.Sprintf("* %s Multiple database commit\n"+
+		"* %s Merge branch 'other' into 'main'\n"+
+		"|\\\n"+
+		"| * %s Other branch change\n",
+		short["Multiple database commit"], short["Merge branch 'other' into 'main'"], short["Other branch change"]))
+
+	// Without the graph, only the first parents are followed
+	s.buf.Reset()
+	logGraph = false
+	err = branchLog([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "Other branch change"), chk.Equals, false)
+	c.Check(strings.Count(s.buf.String(), "\n"), chk.Equals, 4)
+
+	// The filters and the limit
+	s.buf.Reset()
+	logAll, logGrep = true, "branch change$"
+	err = branchLog([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(s.buf.String(), chk.Equals, fmt.Sprintf("%s Other branch change\n%s Main branch change\n",
+		short["Other branch change"], short["Main branch change"]))
+	s.buf.Reset()
+	logMaxCount = 1
+	err = branchLog([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(s.buf.String(), chk.Equals, fmt.Sprintf("%s Other branch change\n", short["Other branch change"]))
+	s.buf.Reset()
+	logAll, logGrep, logMaxCount = false, "", 0
+	logSince, logUntil = "2019-03-15T18:21:00Z", "2019-03-15T18:23:00Z"
+	err = branchLog([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(s.buf.String(), chk.Equals, fmt.Sprintf("%s Merge branch 'other' into 'main'\n%s Main branch change\n",
+		short["Merge branch 'other' into 'main'"], short["Main branch change"]))
+	s.buf.Reset()
+	logSince, logUntil, logAuthor = "", "", "^Nobody"
+	err = branchLog([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(s.buf.String(), chk.Equals, "")
+	logAuthor, logSince = "", "yesterday"
+	err = branchLog([]string{db})
+	c.Check(err, chk.ErrorMatches, "Invalid --since date.*")
+	logSince = ""
+
+	// A custom format
+	s.buf.Reset()
+	logOneline, logFormat, logMaxCount = false, "{{.Message}}, {{len .OtherParents}} other parents", 2
+	err = branchLog([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(s.buf.String(), chk.Equals, "Multiple database commit, 0 other parents\n"+
+		"Merge branch 'other' into 'main', 1 other parents\n")
+
+	// The full text lists the tags
+	s.buf.Reset()
+	logFormat, logMaxCount = "", 0
+	err = branchLog([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "    Tags: base-tag\n"), chk.Equals, true)
+	err = localRepo().RemoveTag(db, "base-tag")
+	c.Assert(err, chk.IsNil)
+}
+
+func (s *DioSuite) Test0520_Show(c *chk.C) {
+	// Show the first commit of a database, by a prefix of its ID
+	db := "19kBmerge.sqlite"
+	meta, err := localFetchMetadata(db, false)
+	c.Assert(err, chk.IsNil)
+	history, err := repo.History(meta, "main")
+	c.Assert(err, chk.IsNil)
+	first := history[len(history)-1]
+	err = show([]string{db, first.ID[:10]})
+	c.Assert(err, chk.IsNil)
+	out := s.buf.String()
+	c.Check(strings.HasPrefix(out, fmt.Sprintf("Commit: %s\n", first.ID)), chk.Equals, true)
+	c.Check(strings.Contains(out, "Parent: none (initial commit)\n"), chk.Equals, true)
+	c.Check(strings.Contains(out, fmt.Sprintf("      SHA256: %s\n", first.Tree.Entries[0].Sha256)), chk.Equals, true)
+	c.Check(strings.Contains(out, "Contained in branches: feature, main, other\n"), chk.Equals, true)
+
+	// The merge commit lists both parents, and only the main branch contains it
+	s.buf.Reset()
+	merged := history[len(history)-3]
+	err = show([]string{db, merged.ID})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), fmt.Sprintf("Merged parent: %s\n", merged.OtherParents[0])),
+		chk.Equals, true)
+	c.Check(strings.Contains(s.buf.String(), "Contained in branches: main\n"), chk.Equals, true)
+
+	// Cached versions have their tables summarised
+	outputFormat = outputJSON
+	defer func() { outputFormat = outputText }()
+	s.buf.Reset()
+	db = "rowmerge.sqlite"
+	err = show([]string{db, "main"})
+	c.Assert(err, chk.IsNil)
+	var so showOutput
+	err = json.Unmarshal(s.buf.Bytes(), &so)
+	c.Assert(err, chk.IsNil)
+	people := readPeople(c, localRepo().CachePath(db, so.Commit.Tree.Entries[0].Sha256))
+	c.Check(so.Tables, chk.DeepEquals, []tableSummary{{Name: "people", Rows: int64(len(people))}})
+	c.Check(so.Branches, chk.DeepEquals, []string{"main"})
+
+	// Unknown revisions are refused
+	err = show([]string{db, "no-such-revision"})
+	c.Check(err, chk.ErrorMatches, "Unknown revision 'no-such-revision'")
+}
+
+func (s *DioSuite) Test0530_Revisions(c *chk.C) {
+	db := "19kBmerge.sqlite"
+	meta, err := localRepo().LoadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	history, err := repo.History(meta, "main")
+	c.Assert(err, chk.IsNil)
+	c.Assert(history, chk.HasLen, 4)
+	merge, base := history[1], history[3]
+	other := merge.OtherParents[0]
+
+	// Parents, merged in parents, and prefixes
+	for rev, want := range map[string]string{
+		"main":                             history[0].ID,
+		history[0].ID[:6]:                  history[0].ID,
+		"main~":                            merge.ID,
+		"main~1":                           merge.ID,
+		"main~3":                           base.ID,
+		"main^":                            merge.ID,
+		"main^0":                           history[0].ID,
+		"main~1^2":                         other,
+		"main^^2":                          other,
+		"main~1^2~1":                       base.ID,
+		"main@{2019-03-15T18:22:30Z}":      history[2].ID,
+		"main@{2019-03-15T18:22:30Z}~1":    base.ID,
+		"@{2019-03-15T18:20:00Z}":          base.ID,
+		merge.ID[:12] + "^2":               other,
+		"feature@{2019-03-15T18:21:00Z}^1": base.ID,
+	} {
+		id, err := repo.ResolveRevision(meta, rev)
+		if c.Check(err, chk.IsNil, chk.Commentf("revision %s", rev)) {
+			c.Check(id, chk.Equals, want, chk.Commentf("revision %s", rev))
+		}
+	}
+
+	// Revisions which go nowhere
+	_, err = repo.ResolveRevision(meta, "main~4")
+	c.Check(err, chk.ErrorMatches, "Commit '.*' has no parents")
+	_, err = repo.ResolveRevision(meta, "main~1^3")
+	c.Check(err, chk.ErrorMatches, "Commit '.*' has no parent number 3")
+	_, err = repo.ResolveRevision(meta, "main@{2000-01-01}")
+	c.Check(err, chk.ErrorMatches, "Branch 'main' has no commits as of 2000-01-01")
+	_, err = repo.ResolveRevision(meta, "main@{yesterday}")
+	c.Check(err, chk.ErrorMatches, "Invalid date 'yesterday'.*")
+
+	// Ambiguous prefixes list the candidates
+	amb := repo.NewMetadata("")
+	amb.Commits["abc1"] = commitEntry{ID: "abc1"}
+	amb.Commits["abc2"] = commitEntry{ID: "abc2"}
+	_, err = repo.ResolveRevision(amb, "abc")
+	c.Check(err, chk.ErrorMatches, "Revision 'abc' is ambiguous.  It matches these commits:\n  \\* abc1\n  \\* abc2")
+
+	// The commands take revisions too
+	tagCreateTag, tagCreateCommit, tagCreateMsg = "revtag", "main~3", ""
+	err = tagCreate([]string{db})
+	c.Assert(err, chk.IsNil)
+	meta, err = localRepo().LoadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Tags["revtag"].Commit, chk.Equals, base.ID)
+	tagRemoveTag = "revtag"
+	err = tagRemove([]string{db})
+	c.Assert(err, chk.IsNil)
+}
+
+func (s *DioSuite) Test0540_Reflog(c *chk.C) {
+	// Commits, reverts, and branch changes are recorded in the reflog, newest first
+	r := repo.Open(c.MkDir())
+	db := "reflog.sqlite"
+	execSQL(c, r.DBPath(db), `CREATE TABLE t (a INTEGER)`)
+	opts := repo.CommitOptions{AuthorEmail: "someone@example.org", AuthorName: "Some One", Message: "First"}
+	first, err := r.Commit(db, opts)
+	c.Assert(err, chk.IsNil)
+	execSQL(c, r.DBPath(db), `INSERT INTO t VALUES (1)`)
+	opts.Message = "Second"
+	second, err := r.Commit(db, opts)
+	c.Assert(err, chk.IsNil)
+	err = r.Revert(db, "main", first.ID, false)
+	c.Assert(err, chk.IsNil)
+	err = r.CreateBranch(db, "other", first.ID, "")
+	c.Assert(err, chk.IsNil)
+	err = r.SetActiveBranch(db, "other", false)
+	c.Assert(err, chk.IsNil)
+	entries, err := r.Reflog(db)
+	c.Assert(err, chk.IsNil)
+	c.Assert(entries, chk.HasLen, 5)
+	c.Check(entries[0].Action, chk.Equals, "branch active set")
+	c.Check(entries[0].PrevActive, chk.Equals, "main")
+	c.Check(entries[0].Branch, chk.Equals, "other")
+	c.Check(entries[1].Action, chk.Equals, "branch create")
+	c.Check(entries[1].From, chk.Equals, "")
+	c.Check(entries[2].Action, chk.Equals, "branch revert")
+	c.Check(entries[2].From, chk.Equals, second.ID)
+	c.Check(entries[2].To, chk.Equals, first.ID)
+	c.Check(entries[3].From, chk.Equals, first.ID)
+	c.Check(entries[4].From, chk.Equals, "")
+
+	// Entries which didn't move an existing branch can't be undone
+	err = r.UndoReflog(db, 0, false)
+	c.Check(err, chk.ErrorMatches, "Reflog entry 0 changed the active branch.*")
+	err = r.UndoReflog(db, 1, false)
+	c.Check(err, chk.ErrorMatches, "Reflog entry 1 created branch 'other'.*")
+	err = r.UndoReflog(db, 5, false)
+	c.Check(err, chk.ErrorMatches, "There's no reflog entry 5.*")
+
+	// Undoing the revert puts main back on the second commit, without touching the file of the active branch
+	err = r.UndoReflog(db, 2, false)
+	c.Assert(err, chk.IsNil)
+	meta, err := r.LoadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Branches["main"].Commit, chk.Equals, second.ID)
+	c.Check(meta.Branches["main"].CommitCount, chk.Equals, 2)
+	changed, err := r.Changed(db, meta)
+	c.Assert(err, chk.IsNil)
+	c.Check(changed, chk.Equals, false)
+	entries, err = r.Reflog(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(entries[0].Action, chk.Equals, "reflog undo")
+	c.Check(entries[0].To, chk.Equals, second.ID)
+
+	// The commands show the reflog, and refuse to undo entries which can't be
+	dbName := "19kBmerge.sqlite"
+	branchCreateBranch, branchCreateCommit, branchCreateMsg = "reflogtest", "main~3", ""
+	err = branchCreate([]string{dbName})
+	c.Assert(err, chk.IsNil)
+	s.buf.Reset()
+	err = reflog([]string{dbName})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "  0: "), chk.Equals, true)
+	c.Check(strings.Contains(s.buf.String(), "branch create: reflogtest created at "), chk.Equals, true)
+	branchRevertToReflog = 0
+	err = branchRevert([]string{dbName})
+	branchRevertToReflog = -1
+	c.Check(err, chk.ErrorMatches, "Reflog entry 0 created branch 'reflogtest'.*")
+	branchRemoveBranch = "reflogtest"
+	err = branchRemove([]string{dbName})
+	c.Assert(err, chk.IsNil)
+	s.buf.Reset()
+	outputFormat = outputJSON
+	err = reflog([]string{dbName})
+	outputFormat = outputText
+	c.Assert(err, chk.IsNil)
+	var out reflogOutput
+	err = json.Unmarshal(s.buf.Bytes(), &out)
+	c.Assert(err, chk.IsNil)
+	c.Assert(len(out.Entries) >= 2, chk.Equals, true)
+	c.Check(out.Entries[0].Action, chk.Equals, "branch remove")
+	c.Check(out.Entries[0].To, chk.Equals, "")
+	c.Check(reflogText(out.Entries[0]), chk.Matches, "reflogtest removed \\(was at [0-9a-f]{8}\\)")
+
+	// Undoing the removal creates the branch again where it was, and drops the removal queued for the server
+	branchRevertToReflog = 0
+	err = branchRevert([]string{dbName})
+	branchRevertToReflog = -1
+	c.Assert(err, chk.IsNil)
+	meta, err = localRepo().LoadHeads(dbName)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Branches["reflogtest"].Commit, chk.Equals, out.Entries[0].From)
+	for _, op := range meta.BranchOps {
+		c.Check(op.Action == "remove" && op.Branch == "reflogtest", chk.Equals, false)
+	}
+	entries, err = localRepo().Reflog(dbName)
+	c.Assert(err, chk.IsNil)
+	c.Check(entries[0].Action, chk.Equals, "reflog undo")
+	c.Check(entries[0].To, chk.Equals, out.Entries[0].From)
+	err = localRepo().UndoReflog(dbName, 1, false)
+	c.Check(err, chk.ErrorMatches, "Branch 'reflogtest' has been created again since it was removed")
+	err = branchRemove([]string{dbName})
+	c.Assert(err, chk.IsNil)
+}
+
+func (s *DioSuite) Test0550_LocksAndRecovery(c *chk.C) {
+	// Databases with nothing in .dio aren't locked, so a mistyped name doesn't leave a directory behind
+	dir := c.MkDir()
+	r := repo.Open(dir)
+	db := "locked.sqlite"
+	_, err := r.TryLock(db)
+	c.Check(err, chk.Equals, repo.ErrNoMetadata)
+	_, err = os.Stat(filepath.Join(dir, ".dio", db))
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+
+	// Only one holder of a database lock at a time
+	err = os.MkdirAll(filepath.Join(dir, ".dio", db), 0770)
+	c.Assert(err, chk.IsNil)
+	l, err := r.TryLock(db)
+	c.Assert(err, chk.IsNil)
+	_, err = repo.Open(dir).TryLock(db)
+	c.Check(err, chk.Equals, repo.ErrLocked)
+	c.Assert(l.Unlock(), chk.IsNil)
+	l, err = repo.Open(dir).TryLock(db)
+	c.Assert(err, chk.IsNil)
+	c.Assert(l.Unlock(), chk.IsNil)
+
+	// Commands which change databases hold their locks until they finish
+	err = lockDatabases(tagCreateCmd, []string{"19kBmerge.sqlite"})
+	c.Assert(err, chk.IsNil)
+	_, err = localRepo().TryLock("19kBmerge.sqlite")
+	c.Check(err, chk.Equals, repo.ErrLocked)
+	unlockDatabases()
+	l, err = localRepo().TryLock("19kBmerge.sqlite")
+	c.Assert(err, chk.IsNil)
+	c.Assert(l.Unlock(), chk.IsNil)
+	err = lockDatabases(tagListCmd, []string{"19kBmerge.sqlite"})
+	c.Assert(err, chk.IsNil)
+	c.Check(heldLocks, chk.HasLen, 0)
+
+	// When the databases can't be worked out, the command doesn't run unlocked
+	err = statusCmd.Flags().Set("all", "true")
+	c.Assert(err, chk.IsNil)
+	err = lockDatabases(statusCmd, []string{"19kBmerge.sqlite"})
+	*statusCmdAll = false
+	c.Check(err, chk.ErrorMatches, "Either database names or --all can be given.*")
+	c.Check(heldLocks, chk.HasLen, 0)
+
+	// Untracked databases are skipped
+	err = lockDatabases(tagCreateCmd, []string{"typo.sqlite"})
+	c.Assert(err, chk.IsNil)
+	c.Check(heldLocks, chk.HasLen, 0)
+	_, err = os.Stat(filepath.Join(".dio", "typo.sqlite"))
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+
+	// Status and gc lock every tracked database when no database names are given, and select only locks the one
+	// being selected
+	tracked, err := localRepo().Tracked()
+	c.Assert(err, chk.IsNil)
+	for _, cmd := range []*cobra.Command{statusCmd, gcCmd} {
+		err = lockDatabases(cmd, nil)
+		c.Assert(err, chk.IsNil)
+		c.Check(heldLocks, chk.HasLen, len(tracked))
+		unlockDatabases()
+	}
+	err = lockDatabases(selectCmd, nil)
+	c.Assert(err, chk.IsNil)
+	c.Check(heldLocks, chk.HasLen, 0)
+	err = lockDatabases(selectCmd, []string{"19kBmerge.sqlite"})
+	c.Assert(err, chk.IsNil)
+	c.Check(heldLocks, chk.HasLen, 1)
+	unlockDatabases()
+
+	// Damaged metadata from older versions of dio is recovered from the backup of the previous version, when it's
+	// imported into the store
+	db = "legacy.sqlite"
+	mdFile := filepath.Join(dir, ".dio", db, "metadata.json")
+	err = os.MkdirAll(filepath.Dir(mdFile), 0770)
+	c.Assert(err, chk.IsNil)
+	err = ioutil.WriteFile(mdFile, []byte(`{"active_branch": "ma`), 0644)
+	c.Assert(err, chk.IsNil)
+	err = ioutil.WriteFile(mdFile+".bak", []byte(`{"active_branch": "main", "branches": {"main": {}}, `+
+		`"commits": {}, "default_branch": "main", "format_version": 1, "releases": {}, "tags": {}}`), 0644)
+	c.Assert(err, chk.IsNil)
+	var warning string
+	r.Warn = func(msg string) { warning = msg }
+	meta, err := r.LoadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.ActiveBranch, chk.Equals, "main")
+	c.Check(warning, chk.Matches, "The metadata for 'legacy.sqlite' was damaged.*")
+
+	// With the backup damaged too, there's nothing to recover
+	db = "broken.sqlite"
+	mdFile = filepath.Join(dir, ".dio", db, "metadata.json")
+	err = os.MkdirAll(filepath.Dir(mdFile), 0770)
+	c.Assert(err, chk.IsNil)
+	err = ioutil.WriteFile(mdFile, []byte("{"), 0644)
+	c.Assert(err, chk.IsNil)
+	err = ioutil.WriteFile(mdFile+".bak", []byte("{"), 0644)
+	c.Assert(err, chk.IsNil)
+	_, err = r.LoadMetadata(db)
+	c.Check(err, chk.ErrorMatches, "The metadata for 'broken.sqlite' and its backup are both damaged.*")
+}
+
+func (s *DioSuite) Test0560_MetadataFormat(c *chk.C) {
+	// Metadata from before the format version was added is upgraded and moved into the store when it's loaded
+	dir := c.MkDir()
+	r := repo.Open(dir)
+	db := "old.sqlite"
+	mdFile := filepath.Join(dir, ".dio", db, "metadata.json")
+	err := os.MkdirAll(filepath.Dir(mdFile), 0770)
+	c.Assert(err, chk.IsNil)
+	err = ioutil.WriteFile(mdFile, []byte(`{"active_branch": "main", "branches": {"main": {}}, "commits": {}, `+
+		`"default_branch": "main", "tags": null}`), 0644)
+	c.Assert(err, chk.IsNil)
+	meta, err := r.LoadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.FormatVersion, chk.Equals, repo.MetadataFormatVersion)
+	c.Check(meta.Tags, chk.NotNil)
+	c.Check(meta.Releases, chk.NotNil)
+	_, err = os.Stat(filepath.Join(dir, ".dio", db, "metadata.db"))
+	c.Check(err, chk.IsNil)
+	_, err = os.Stat(mdFile + ".imported")
+	c.Check(err, chk.IsNil)
+	_, err = os.Stat(mdFile)
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+	tracked, err := r.Tracked()
+	c.Assert(err, chk.IsNil)
+	c.Check(tracked, chk.DeepEquals, []string{db})
+
+	// Metadata from a newer dio is refused, rather than being recovered from a backup
+	execSQL(c, filepath.Join(dir, ".dio", db, "metadata.db"), `PRAGMA user_version = 99`)
+	_, err = r.LoadMetadata(db)
+	c.Check(err, chk.FitsTypeOf, &repo.FormatError{})
+	c.Check(err, chk.ErrorMatches, "The metadata for 'old.sqlite' is in format version 99, but this version of dio "+
+		"only understands up to version 3.*")
+	db = "newer.sqlite"
+	mdFile = filepath.Join(dir, ".dio", db, "metadata.json")
+	err = os.MkdirAll(filepath.Dir(mdFile), 0770)
+	c.Assert(err, chk.IsNil)
+	err = ioutil.WriteFile(mdFile, []byte(`{"format_version": 99, "branches": {}}`), 0644)
+	c.Assert(err, chk.IsNil)
+	_, err = r.LoadMetadata(db)
+	c.Check(err, chk.FitsTypeOf, &repo.FormatError{})
+	md, err := ioutil.ReadFile(mdFile)
+	c.Assert(err, chk.IsNil)
+	c.Check(string(md), chk.Equals, `{"format_version": 99, "branches": {}}`)
+}
+
+func (s *DioSuite) Test0570_MetadataStore(c *chk.C) {
+	// Build a history with a second branch merged back in
+	r := repo.Open(c.MkDir())
+	db := "store.sqlite"
+	execSQL(c, r.DBPath(db), `CREATE TABLE t (a INTEGER)`)
+	opts := repo.CommitOptions{AuthorEmail: "someone@example.org", AuthorName: "Some One", Message: "First"}
+	first, err := r.Commit(db, opts)
+	c.Assert(err, chk.IsNil)
+	execSQL(c, r.DBPath(db), `INSERT INTO t VALUES (1)`)
+	opts.Message = "Second"
+	second, err := r.Commit(db, opts)
+	c.Assert(err, chk.IsNil)
+	err = r.CreateBranch(db, "other", first.ID, "")
+	c.Assert(err, chk.IsNil)
+	execSQL(c, r.DBPath(db), `INSERT INTO t VALUES (2)`)
+	opts.Branch, opts.Message = "other", "Third"
+	third, err := r.Commit(db, opts)
+	c.Assert(err, chk.IsNil)
+	execSQL(c, r.DBPath(db), `INSERT INTO t VALUES (3)`)
+	opts.Branch, opts.Message, opts.OtherParents = "main", "Merge", []string{third.ID}
+	merge, err := r.Commit(db, opts)
+	c.Assert(err, chk.IsNil)
+
+	// Commit counts come from the first parent history
+	for id, want := range map[string]int{first.ID: 1, second.ID: 2, third.ID: 2, merge.ID: 3} {
+		count, err := r.CommitCount(db, id)
+		c.Assert(err, chk.IsNil)
+		c.Check(count, chk.Equals, want)
+	}
+	meta, err := r.LoadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Branches["main"].CommitCount, chk.Equals, 3)
+	c.Check(meta.Branches["other"].CommitCount, chk.Equals, 2)
+	c.Check(meta.Commits, chk.HasLen, 4)
+	_, err = r.CommitCount(db, "unknown")
+	c.Check(err, chk.ErrorMatches, "Commit 'unknown' isn't in the local commit list")
+
+	// Ancestry follows merged in parents too
+	for _, j := range []struct {
+		ancestor, commit string
+		want             bool
+	}{
+		{first.ID, first.ID, true},
+		{first.ID, merge.ID, true},
+		{third.ID, merge.ID, true},
+		{second.ID, third.ID, false},
+		{merge.ID, first.ID, false},
+	} {
+		found, err := r.IsAncestor(db, j.ancestor, j.commit)
+		c.Assert(err, chk.IsNil)
+		c.Check(found, chk.Equals, j.want, chk.Commentf("%s -> %s", j.ancestor, j.commit))
+	}
+
+	// Histories are compared using the store, back to where they meet
+	for _, j := range []struct {
+		a, b          string
+		ahead, behind int
+		base          string
+	}{
+		{second.ID, third.ID, 1, 1, first.ID},
+		{merge.ID, third.ID, 2, 0, third.ID},
+		{first.ID, merge.ID, 0, 3, first.ID},
+		{merge.ID, merge.ID, 0, 0, merge.ID},
+	} {
+		ahead, behind, err := r.AheadBehind(db, j.a, j.b)
+		c.Assert(err, chk.IsNil)
+		c.Check([]int{ahead, behind}, chk.DeepEquals, []int{j.ahead, j.behind}, chk.Commentf("%s, %s", j.a, j.b))
+		base, err := r.MergeBase(db, j.a, j.b)
+		c.Assert(err, chk.IsNil)
+		c.Check(base, chk.Equals, j.base, chk.Commentf("%s, %s", j.a, j.b))
+	}
+	_, err = r.MergeBase(db, "unknown", first.ID)
+	c.Check(err, chk.ErrorMatches, "Commit 'unknown' isn't in the local commit list")
+	reachable, err := r.ReachableCommits(db, second.ID, third.ID)
+	c.Assert(err, chk.IsNil)
+	c.Check(reachable, chk.HasLen, 3)
+
+	// The branches, tags, etc can be loaded without the commits, which are then looked up as needed
+	heads, err := r.LoadHeads(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(heads.Commits, chk.HasLen, 0)
+	c.Check(heads.Branches, chk.DeepEquals, meta.Branches)
+	found, ok, err := r.FindCommit(db, heads, merge.ID)
+	c.Assert(err, chk.IsNil)
+	c.Check(ok, chk.Equals, true)
+	c.Check(found.Message, chk.Equals, "Merge")
+	commits, err := r.LoadCommits(db, first.ID, "unknown")
+	c.Assert(err, chk.IsNil)
+	c.Check(commits, chk.HasLen, 1)
+
+	// Only commits which aren't stored yet are missing, with the walk stopping at stored ones
+	orphan := commitEntry{Message: "Orphan", Parent: second.ID, Tree: second.Tree, Timestamp: second.Timestamp}
+	orphan.ID = repo.CreateCommitID(orphan)
+	remote := metaData{Commits: map[string]commitEntry{orphan.ID: orphan, second.ID: second, first.ID: first}}
+	missing, err := r.MissingCommits(db, remote, orphan.ID)
+	c.Assert(err, chk.IsNil)
+	c.Check(missing, chk.DeepEquals, map[string]struct{}{orphan.ID: {}})
+
+	// Saving metadata without its commits, or with some left out, keeps them in the store
+	heads.Branches["main"] = branchEntry{Commit: second.ID}
+	err = r.SaveMetadata(db, heads, "test")
+	c.Assert(err, chk.IsNil)
+	meta, err = r.LoadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Commits, chk.HasLen, 4)
+	c.Check(meta.Branches["main"].CommitCount, chk.Equals, 2)
+
+	// Pruning removes the commits nothing refers to.  The merge commit is kept, as the reflog refers to it
+	meta.Commits[orphan.ID] = orphan
+	err = r.SaveMetadata(db, meta, "test")
+	c.Assert(err, chk.IsNil)
+	pruned, err := r.PruneCommits(db, true)
+	c.Assert(err, chk.IsNil)
+	c.Check(pruned, chk.Equals, 1)
+	pruned, err = r.PruneCommits(db, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(pruned, chk.Equals, 1)
+	meta, err = r.LoadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Commits, chk.HasLen, 4)
+	_, err = r.IsAncestor(db, orphan.ID, second.ID)
+	c.Check(err, chk.ErrorMatches, "Commit '.*' isn't in the local commit list")
+}
+
+func (s *DioSuite) Test0580_PushMerge(c *chk.C) {
+	// Build a history where the main branch merges in a commit only made on another branch
+	db := "pushmerge.sqlite"
+	r := localRepo()
+	execSQL(c, db, `CREATE TABLE t (a INTEGER)`)
+	opts := repo.CommitOptions{
+		AuthorEmail: "someone@example.org",
+		AuthorName:  "Some One",
+		LicenceSHA:  licList["Not specified"].Sha256,
+		Message:     "Base",
+		Timestamp:   time.Date(2019, time.March, 15, 19, 40, 0, 0, time.UTC),
+	}
+	base, err := r.Commit(db, opts)
+	c.Assert(err, chk.IsNil)
+	err = r.CreateBranch(db, "side", base.ID, "")
+	c.Assert(err, chk.IsNil)
+	execSQL(c, db, `INSERT INTO t VALUES (1)`)
+	opts.Branch, opts.Message = "side", "Side change"
+	opts.Timestamp = time.Date(2019, time.March, 15, 19, 41, 0, 0, time.UTC)
+	side, err := r.Commit(db, opts)
+	c.Assert(err, chk.IsNil)
+	execSQL(c, db, `INSERT INTO t VALUES (2)`)
+	opts.Branch, opts.Message, opts.OtherParents = "main", "Merge", []string{side.ID}
+	opts.Timestamp = time.Date(2019, time.March, 15, 19, 42, 0, 0, time.UTC)
+	merged, err := r.Commit(db, opts)
+	c.Assert(err, chk.IsNil)
+
+	// The main branch can't be pushed until the merged in commit is on the server, and other branches aren't moved
+	pushCmdBranch = ""
+	pushCmdDB = ""
+	pushCmdForce = false
+	pushCmdForceLease = ""
+	pushCmdLicence = ""
+	pushCmdMsg = ""
+	err = push([]string{db})
+	c.Check(err, chk.ErrorMatches, "Commit '"+side.ID+"' merged into branch 'main' isn't on .* yet.  Push the "+
+		"branch it came from \\('side'\\) first")
+	remoteMeta := mockMetaData[db]
+	c.Check(remoteMeta.Branches["main"].Commit, chk.Equals, base.ID)
+	c.Check(remoteMeta.Branches["side"].Commit, chk.Equals, base.ID)
+
+	// Once the side branch has been pushed, the main branch can be too
+	pushCmdBranch = "side"
+	err = push([]string{db})
+	c.Assert(err, chk.IsNil)
+	pushCmdBranch = ""
+	err = push([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(remoteMeta.Branches["main"].Commit, chk.Equals, merged.ID)
+	c.Check(remoteMeta.Branches["side"].Commit, chk.Equals, side.ID)
+	_, ok := remoteMeta.Commits[side.ID]
+	c.Check(ok, chk.Equals, true)
+
+	// Once the other branch is gone, updating the metadata still keeps the merged in commit
+	err = r.RemoveBranch(db, "side")
+	c.Assert(err, chk.IsNil)
+	delete(remoteMeta.Branches, "side")
+	_, err = updateMetadata(db, "pull", true)
+	c.Assert(err, chk.IsNil)
+	meta, err := r.LoadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	_, ok = meta.Commits[side.ID]
+	c.Check(ok, chk.Equals, true)
+
+	// Reverting past the merge would leave a tag on the merged in commit unreachable, unless another branch has it
+	err = r.CreateTag(db, "sidetag", client.TagEntry{Commit: side.ID, Date: opts.Timestamp})
+	c.Assert(err, chk.IsNil)
+	err = r.Revert(db, "main", base.ID, false)
+	c.Check(err, chk.ErrorMatches, "(?s).*tag 'sidetag'.*")
+	err = r.CreateBranch(db, "keep", merged.ID, "")
+	c.Assert(err, chk.IsNil)
+	err = r.Revert(db, "main", base.ID, false)
+	c.Assert(err, chk.IsNil)
+}
+
+func (s *DioSuite) Test0590_FetchKeepsBranches(c *chk.C) {
+	// The main branch was reverted locally, so is behind the server.  The server also has a branch not known locally
+	db := "pushmerge.sqlite"
+	meta, err := localFetchMetadata(db, false)
+	c.Assert(err, chk.IsNil)
+	localHead := meta.Branches["main"].Commit
+	remoteHead := mockMetaData[db].Branches["main"].Commit
+	c.Assert(localHead, chk.Not(chk.Equals), remoteHead)
+	mockMetaData[db].Branches["extra"] = branchEntry{Commit: remoteHead, CommitCount: 2}
+
+	// Fetching brings in the commits and where the branches are on the server, without moving or adding branches
+	s.buf.Reset()
+	*fetchCmdAllBranches = false
+	err = fetch([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "Remote branch 'main' has 2 new commit(s)... fetched"), chk.Equals,
+		true)
+	c.Check(strings.Contains(s.buf.String(), "New remote branch 'extra' fetched"), chk.Equals, true)
+	meta, err = localFetchMetadata(db, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Branches["main"].Commit, chk.Equals, localHead)
+	c.Check(meta.RemoteBranches["main"].Commit, chk.Equals, remoteHead)
+	c.Check(meta.RemoteBranches["extra"].Commit, chk.Equals, remoteHead)
+	_, ok := meta.Branches["extra"]
+	c.Check(ok, chk.Equals, false)
+	_, ok = meta.Commits[remoteHead]
+	c.Check(ok, chk.Equals, true)
+	delete(mockMetaData[db].Branches, "extra")
+
+	// A local branch whose head the server branch only reaches through a merged in parent is behind the server, not
+	// ahead of it
+	sideCommit := mockMetaData[db].Commits[remoteHead].OtherParents[0]
+	err = localRepo().CreateBranch(db, "merged", sideCommit, "")
+	c.Assert(err, chk.IsNil)
+	mockMetaData[db].Branches["merged"] = branchEntry{Commit: remoteHead, CommitCount: 2}
+	s.buf.Reset()
+	err = fetch([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "Remote branch 'merged' has 1 new commit(s)... fetched"), chk.Equals,
+		true)
+	c.Check(strings.Contains(s.buf.String(), "Branch 'merged' has local changes"), chk.Equals, false)
+	delete(mockMetaData[db].Branches, "merged")
+	err = localRepo().RemoveBranch(db, "merged")
+	c.Assert(err, chk.IsNil)
+
+	// Fetching a database the server doesn't have fails, without leaving any local metadata behind
+	err = fetch([]string{"notonserver.sqlite"})
+	c.Check(err, chk.ErrorMatches, "Database 'notonserver.sqlite' wasn't found on .*")
+	c.Check(localRepo().HasMetadata("notonserver.sqlite"), chk.Equals, false)
+	_, err = os.Stat(filepath.Join(".dio", "notonserver.sqlite"))
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+}
+
+func (s *DioSuite) Test0600_FirstPullTracking(c *chk.C) {
+	// Start with no local metadata nor file for a database on the test server
+	db := "chunked.sqlite"
+	err := os.RemoveAll(filepath.Join(".dio", db))
+	c.Assert(err, chk.IsNil)
+	err = os.Remove(db)
+	c.Assert(err, chk.IsNil)
+
+	// Right after the first pull, the branches should be known to match the server
+	pullCmdBranch = ""
+	pullCmdCommit = ""
+	err = pull([]string{db})
+	c.Assert(err, chk.IsNil)
+	meta, err := localFetchMetadata(db, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.RemoteBranches["main"].Commit, chk.Equals, meta.Branches["main"].Commit)
+	t, err := trackingInfo(db, meta, "main")
+	c.Assert(err, chk.IsNil)
+	c.Assert(t, chk.NotNil)
+	c.Check(*t, chk.Equals, branchTracking{OnServer: true})
+	s.buf.Reset()
+	err = status([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "Branch main: up to date with the server"), chk.Equals, true)
+}
+
+func (s *DioSuite) Test0610_ReflogUndoAfterPullAndGC(c *chk.C) {
+	// Add a commit to the main branch which is never pushed, then revert it away
+	db := "pushmerge.sqlite"
+	r := localRepo()
+	meta, err := r.LoadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Assert(meta.ActiveBranch, chk.Equals, "main")
+	base := meta.Branches["main"].Commit
+	execSQL(c, db, `INSERT INTO t VALUES (4)`)
+	opts := repo.CommitOptions{
+		AuthorEmail: "someone@example.org",
+		AuthorName:  "Some One",
+		LicenceSHA:  licList["Not specified"].Sha256,
+		Message:     "Local only",
+		Timestamp:   time.Date(2019, time.March, 15, 19, 43, 0, 0, time.UTC),
+	}
+	local, err := r.Commit(db, opts)
+	c.Assert(err, chk.IsNil)
+	err = r.Revert(db, "main", base, false)
+	c.Assert(err, chk.IsNil)
+
+	// Pull the branch from the server, then clean up the cache
+	pullCmdBranch = ""
+	pullCmdCommit = ""
+	*pullForce = true
+	err = pull([]string{db})
+	*pullForce = false
+	c.Assert(err, chk.IsNil)
+	meta, err = r.LoadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Branches["main"].Commit, chk.Equals, mockMetaData[db].Branches["main"].Commit)
+	_, ok := meta.Commits[local.ID]
+	c.Check(ok, chk.Equals, true)
+	*gcCmdDryRun = false
+	err = gc([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(r.HasCached(db, local.Tree.Entries[0].Sha256), chk.Equals, true)
+
+	// The revert can still be undone
+	entries, err := r.Reflog(db)
+	c.Assert(err, chk.IsNil)
+	n := -1
+	for i, e := range entries {
+		if e.Action == "branch revert" && e.From == local.ID {
+			n = i
+			break
+		}
+	}
+	c.Assert(n, chk.Not(chk.Equals), -1)
+	err = r.UndoReflog(db, n, false)
+	c.Assert(err, chk.IsNil)
+	meta, err = r.LoadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Branches["main"].Commit, chk.Equals, local.ID)
+}
+
+func (s *DioSuite) Test0620_StoreMigration(c *chk.C) {
+	// Build a store, then turn it back into a version 1 store, without commit parents, generation numbers, or depths
+	dir := c.MkDir()
+	r := repo.Open(dir)
+	db := "migrate.sqlite"
+	execSQL(c, r.DBPath(db), `CREATE TABLE t (a INTEGER)`)
+	opts := repo.CommitOptions{AuthorEmail: "someone@example.org", AuthorName: "Some One", Message: "First"}
+	first, err := r.Commit(db, opts)
+	c.Assert(err, chk.IsNil)
+	execSQL(c, r.DBPath(db), `INSERT INTO t VALUES (1)`)
+	opts.Message = "Second"
+	second, err := r.Commit(db, opts)
+	c.Assert(err, chk.IsNil)
+	store := filepath.Join(dir, ".dio", db, "metadata.db")
+	execSQL(c, store, `DELETE FROM commit_parents`, `UPDATE commits SET generation = 0, depth = 0`,
+		`UPDATE branches SET commit_count = 0`, `PRAGMA user_version = 1`)
+
+	// Opening it upgrades it to the current format, working them out again
+	meta, err := r.LoadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.FormatVersion, chk.Equals, repo.MetadataFormatVersion)
+	c.Check(meta.Commits, chk.HasLen, 2)
+	c.Check(meta.Branches["main"].CommitCount, chk.Equals, 2)
+	count, err := r.CommitCount(db, second.ID)
+	c.Assert(err, chk.IsNil)
+	c.Check(count, chk.Equals, 2)
+	found, err := r.IsAncestor(db, first.ID, second.ID)
+	c.Assert(err, chk.IsNil)
+	c.Check(found, chk.Equals, true)
+
+	// Stores at a version which can't be upgraded are damaged
+	execSQL(c, store, `PRAGMA user_version = 0`)
+	_, err = r.LoadMetadata(db)
+	c.Check(err, chk.ErrorMatches, "The metadata store for 'migrate.sqlite' is damaged.  It has format version 0")
+}
+
+func (s *DioSuite) Test0630_ParentsAddedAfterChildren(c *chk.C) {
+	// Store a merge commit, and a commit on top of another branch, before the commits from that branch
+	dir := c.MkDir()
+	r := repo.Open(dir)
+	db := "late.sqlite"
+	execSQL(c, r.DBPath(db), `CREATE TABLE t (a INTEGER)`)
+	opts := repo.CommitOptions{AuthorEmail: "someone@example.org", AuthorName: "Some One", Message: "First"}
+	first, err := r.Commit(db, opts)
+	c.Assert(err, chk.IsNil)
+	newCommit := func(msg string, parent string, otherParents ...string) commitEntry {
+		e := commitEntry{Message: msg, OtherParents: otherParents, Parent: parent, Timestamp: first.Timestamp,
+			Tree: first.Tree}
+		e.ID = repo.CreateCommitID(e)
+		return e
+	}
+	side1 := newCommit("Side 1", first.ID)
+	side2 := newCommit("Side 2", side1.ID)
+	side3 := newCommit("Side 3", side2.ID)
+	merge := newCommit("Merge", first.ID, side2.ID)
+	top := newCommit("Top", side3.ID)
+	meta, err := r.LoadHeads(db)
+	c.Assert(err, chk.IsNil)
+	meta.Commits[merge.ID] = merge
+	meta.Commits[top.ID] = top
+	meta.Branches["main"] = branchEntry{Commit: merge.ID}
+	meta.Branches["top"] = branchEntry{Commit: top.ID}
+	err = r.SaveMetadata(db, meta, "test")
+	c.Assert(err, chk.IsNil)
+
+	// Once the missing commits are added, the later ones are linked up to them
+	meta, err = r.LoadHeads(db)
+	c.Assert(err, chk.IsNil)
+	for _, e := range []commitEntry{side1, side2, side3} {
+		meta.Commits[e.ID] = e
+	}
+	err = r.SaveMetadata(db, meta, "test")
+	c.Assert(err, chk.IsNil)
+	check := func() {
+		found, err := r.IsAncestor(db, side2.ID, merge.ID)
+		c.Assert(err, chk.IsNil)
+		c.Check(found, chk.Equals, true)
+		found, err = r.IsAncestor(db, side1.ID, top.ID)
+		c.Assert(err, chk.IsNil)
+		c.Check(found, chk.Equals, true)
+		ahead, behind, err := r.AheadBehind(db, merge.ID, top.ID)
+		c.Assert(err, chk.IsNil)
+		c.Check([]int{ahead, behind}, chk.DeepEquals, []int{1, 2})
+		count, err := r.CommitCount(db, top.ID)
+		c.Assert(err, chk.IsNil)
+		c.Check(count, chk.Equals, 5)
+		meta, err := r.LoadHeads(db)
+		c.Assert(err, chk.IsNil)
+		c.Check(meta.Branches["top"].CommitCount, chk.Equals, 5)
+	}
+	check()
+
+	// Version 2 stores, which left out parents not stored yet, are repaired when they're upgraded
+	store := filepath.Join(dir, ".dio", db, "metadata.db")
+	execSQL(c, store, `DELETE FROM commit_parents WHERE parent IN ('`+side2.ID+`', '`+side3.ID+`')`,
+		`UPDATE commits SET generation = 2, depth = 1 WHERE id IN ('`+merge.ID+`', '`+top.ID+`')`,
+		`PRAGMA user_version = 2`)
+	check()
+}
+
+func (s *DioSuite) Test0640_CommitMergeKeepingOurs(c *chk.C) {
+	// Change the same row differently on two branches
+	db := "keepours.sqlite"
+	execSQL(c, db, `CREATE TABLE people (id INTEGER PRIMARY KEY, name TEXT)`, `INSERT INTO people VALUES (1, 'Ann')`)
+	commitCmdBranch = ""
+	commitCmdLicence = "Not specified"
+	commitCmdMsg = "Base"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 20, 0, 0, 0, time.UTC).Format(time.RFC3339)
+	err := commit([]string{db})
+	c.Assert(err, chk.IsNil)
+	meta, err := localFetchMetadata(db, false)
+	c.Assert(err, chk.IsNil)
+	baseEntry := meta.Commits[meta.Branches["main"].Commit].Tree.Entries[0]
+	branchCreateCommit = meta.Branches["main"].Commit
+	branchCreateMsg = ""
+	branchCreateBranch = "theirs"
+	err = branchCreate([]string{db})
+	c.Assert(err, chk.IsNil)
+	execSQL(c, db, `UPDATE people SET name = 'Annie' WHERE id = 1`)
+	commitCmdBranch = "theirs"
+	commitCmdLicence = ""
+	commitCmdMsg = "Their change"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 20, 1, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{db})
+	c.Assert(err, chk.IsNil)
+	err = localRepo().RestoreDB(db, baseEntry.Sha256, baseEntry.LastModified)
+	c.Assert(err, chk.IsNil)
+	execSQL(c, db, `UPDATE people SET name = 'Anna' WHERE id = 1`)
+	commitCmdBranch = "main"
+	commitCmdMsg = "Our change"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 20, 2, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{db})
+	c.Assert(err, chk.IsNil)
+	meta, err = localFetchMetadata(db, false)
+	c.Assert(err, chk.IsNil)
+	mainCommit := meta.Branches["main"].Commit
+	theirCommit := meta.Branches["theirs"].Commit
+
+	// Resolve the conflict by keeping our version, which leaves the database the same as the head of the main branch.
+	// Committing it still finishes the merge
+	mergeCmdFrom = "theirs"
+	mergeCmdInto = ""
+	mergeCmdMsg = ""
+	mergeCmdStrategy = "rows"
+	mergeCmdTimestamp = ""
+	err = merge([]string{db})
+	c.Assert(err, chk.IsNil)
+	err = os.Remove(filepath.Join(".dio", db, "conflicts.json"))
+	c.Assert(err, chk.IsNil)
+	oursEntry := meta.Commits[mainCommit].Tree.Entries[0]
+	err = localRepo().RestoreDB(db, oursEntry.Sha256, oursEntry.LastModified)
+	c.Assert(err, chk.IsNil)
+	commitCmdBranch = ""
+	commitCmdMsg = ""
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 20, 3, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{db})
+	c.Assert(err, chk.IsNil)
+	meta, err = localFetchMetadata(db, false)
+	c.Assert(err, chk.IsNil)
+	com := meta.Commits[meta.Branches["main"].Commit]
+	c.Check(com.Parent, chk.Equals, mainCommit)
+	c.Check(com.OtherParents, chk.DeepEquals, []string{theirCommit})
+	c.Check(readPeople(c, db), chk.DeepEquals, map[int]string{1: "Anna"})
+
+	// Without a merge waiting, committing the unchanged database is refused as before
+	err = commit([]string{db})
+	c.Check(err, chk.ErrorMatches, "Database is unchanged from last commit.*")
+	commitCmdBranch = "main"
+}
+
+func (s *DioSuite) Test0650_RenameTrackedBranch(c *chk.C) {
+	// A renamed branch keeps tracking its branch on the server, including after the metadata is updated
+	db := "19kBforce.sqlite"
+	branchRenameBranch = "feat"
+	branchRenameNewName = "feature"
+	err := branchRename([]string{db})
+	c.Assert(err, chk.IsNil)
+	for i := 0; i < 2; i++ {
+		meta, err := localFetchMetadata(db, false)
+		c.Assert(err, chk.IsNil)
+		c.Check(meta.RemoteBranches["feature"].Commit, chk.Equals, meta.Branches["feature"].Commit)
+		_, ok := meta.RemoteBranches["feat"]
+		c.Check(ok, chk.Equals, false)
+		s.buf.Reset()
+		err = branchList([]string{db})
+		c.Assert(err, chk.IsNil)
+		c.Check(strings.Contains(s.buf.String(), "'feature' - Commit: "+meta.Branches["feature"].Commit+
+			" (up to date with the server)"), chk.Equals, true)
+		_, err = updateMetadata(db, "pull", true)
+		c.Assert(err, chk.IsNil)
+	}
+
+	// Put the branch back how it was
+	branchRenameBranch = "feature"
+	branchRenameNewName = "feat"
+	err = branchRename([]string{db})
+	c.Assert(err, chk.IsNil)
+	meta, err := localFetchMetadata(db, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.RemoteBranches["feat"].Commit, chk.Equals, meta.Branches["feat"].Commit)
+}
+
+func (s *DioSuite) Test0660_MergeVirtualAndRowidTables(c *chk.C) {
+	// The base version has a table with keys of mixed types, one whose column called rowid hides the real rowid, and
+	// one keyed by rowid
+	db := "virtualmerge.sqlite"
+	execSQL(c, db, `CREATE TABLE kv (k PRIMARY KEY, v)`,
+		`INSERT INTO kv VALUES (2, 'two'), (10, 'ten'), (1.5, 'one and a half'), ('a', 'A'), (x'00', 'blob')`,
+		`CREATE TABLE notes (rowid TEXT, body TEXT)`, `INSERT INTO notes VALUES ('first', 'Hello')`,
+		`CREATE TABLE log (msg TEXT)`, `INSERT INTO log VALUES ('created')`)
+	commitCmdBranch = ""
+	commitCmdLicence = "Not specified"
+	commitCmdMsg = "Base"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 21, 0, 0, 0, time.UTC).Format(time.RFC3339)
+	err := commit([]string{db})
+	c.Assert(err, chk.IsNil)
+	meta, err := localFetchMetadata(db, false)
+	c.Assert(err, chk.IsNil)
+	baseEntry := meta.Commits[meta.Branches["main"].Commit].Tree.Entries[0]
+
+	// Their side adds a full text search table, and changes rows in the other tables
+	branchCreateCommit = meta.Branches["main"].Commit
+	branchCreateMsg = ""
+	branchCreateBranch = "theirs"
+	err = branchCreate([]string{db})
+	c.Assert(err, chk.IsNil)
+	execSQL(c, db, `CREATE VIRTUAL TABLE docs USING fts4(body)`, `INSERT INTO docs VALUES ('hello world')`,
+		`UPDATE kv SET v = 'TEN' WHERE k = 10`, `DELETE FROM kv WHERE k = x'00'`,
+		`UPDATE notes SET body = 'Hello there'`, `INSERT INTO log VALUES ('theirs')`)
+	commitCmdBranch = "theirs"
+	commitCmdLicence = ""
+	commitCmdMsg = "Their change"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 21, 1, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{db})
+	c.Assert(err, chk.IsNil)
+
+	// Our side changes other rows, and also adds a row to the table keyed by rowid
+	err = localRepo().RestoreDB(db, baseEntry.Sha256, baseEntry.LastModified)
+	c.Assert(err, chk.IsNil)
+	execSQL(c, db, `UPDATE kv SET v = 'TWO' WHERE k = 2`, `INSERT INTO kv VALUES ('b', 'B')`,
+		`INSERT INTO log VALUES ('ours')`)
+	commitCmdBranch = "main"
+	commitCmdMsg = "Our change"
+	commitCmdTimestamp = time.Date(2019, time.March, 15, 21, 2, 0, 0, time.UTC).Format(time.RFC3339)
+	err = commit([]string{db})
+	c.Assert(err, chk.IsNil)
+
+	// The virtual table comes across along with its content, and the other changes are merged.  Both sides adding a
+	// row to the rowid keyed table gives them the same rowid, which is reported as a conflict
+	mergeCmdFrom = "theirs"
+	mergeCmdInto = ""
+	mergeCmdMsg = ""
+	mergeCmdStrategy = "rows"
+	mergeCmdTimestamp = ""
+	err = merge([]string{db})
+	c.Assert(err, chk.IsNil)
+	sdb, err := sql.Open("sqlite3", db)
+	c.Assert(err, chk.IsNil)
+	defer sdb.Close()
+	var n int
+	err = sdb.QueryRow(`SELECT count(*) FROM docs WHERE docs MATCH 'hello'`).Scan(&n)
+	c.Assert(err, chk.IsNil)
+	c.Check(n, chk.Equals, 1)
+	_, err = sdb.Exec(`INSERT INTO docs(docs) VALUES ('integrity-check')`)
+	c.Check(err, chk.IsNil)
+	rows, err := sdb.Query(`SELECT quote(k), v FROM kv ORDER BY k`)
+	c.Assert(err, chk.IsNil)
+	var kv []string
+	for rows.Next() {
+		var k, v string
+		err = rows.Scan(&k, &v)
+		c.Assert(err, chk.IsNil)
+		kv = append(kv, k+"="+v)
+	}
+	c.Assert(rows.Err(), chk.IsNil)
+	rows.Close()
+	c.Check(kv, chk.DeepEquals, []string{"1.5=one and a half", "2=TWO", "10=TEN", "'a'=A", "'b'=B"})
+	var body string
+	err = sdb.QueryRow(`SELECT body FROM notes WHERE "rowid" = 'first'`).Scan(&body)
+	c.Assert(err, chk.IsNil)
+	c.Check(body, chk.Equals, "Hello there")
+	b, err := ioutil.ReadFile(filepath.Join(".dio", db, "conflicts.json"))
+	c.Assert(err, chk.IsNil)
+	var conflicts []mergeConflict
+	err = json.Unmarshal(b, &conflicts)
+	c.Assert(err, chk.IsNil)
+	c.Assert(conflicts, chk.HasLen, 1)
+	c.Check(conflicts[0].Object, chk.Equals, "table log")
+	c.Check(conflicts[0].Key, chk.Equals, "rowid=2")
+	c.Check(conflicts[0].Ours["msg"], chk.Equals, "'ours'")
+	c.Check(conflicts[0].Theirs["msg"], chk.Equals, "'theirs'")
+}
+
+// Runs SQL statements against a database file, creating it if needed
+func execSQL(c *chk.C, path string, stmts ...string) {
+	sdb, err := sql.Open("sqlite3", path)
+	c.Assert(err, chk.IsNil)
+	defer sdb.Close()
+	for _, stmt := range stmts {
+		_, err = sdb.Exec(stmt)
+		c.Assert(err, chk.IsNil)
+	}
+}
+
+// Returns the rows of the "people" table used by the row merge tests
+func readPeople(c *chk.C, path string) map[int]string {
+	sdb, err := sql.Open("sqlite3", path)
+	c.Assert(err, chk.IsNil)
+	defer sdb.Close()
+	rows, err := sdb.Query(`SELECT id, name FROM people`)
+	c.Assert(err, chk.IsNil)
+	defer rows.Close()
+	people := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var name string
+		err = rows.Scan(&id, &name)
+		c.Assert(err, chk.IsNil)
+		people[id] = name
+	}
+	c.Assert(rows.Err(), chk.IsNil)
+	return people
+}
+
+// Mocked functions
+func mockGetLicences() (map[string]licenceEntry, error) {
+	return licList, nil
+}
+
+// Returns metadata of a database with a single commit, on the main branch
+func mockRetrieveMetadata(db string) (meta metaData, onCloud bool, err error) {
+	meta.Branches = make(map[string]branchEntry)
+	meta.Commits = make(map[string]commitEntry)
+	meta.Commits["59b72b78cb83bdba371438cb36950fe007265445a63068ae5586c9cc19203941"] = commitEntry{
+		ID:             "59b72b78cb83bdba371438cb36950fe007265445a63068ae5586c9cc19203941",
+		CommitterEmail: "someone@example.org",
+		CommitterName:  "Some One",
+		AuthorEmail:    "testdefault@dbhub.io",
+		AuthorName:     "Default test user",
+		Message:        "The first commit in our test run",
+		Timestamp:      time.Date(2019, time.March, 15, 18, 1, 1, 0, time.UTC),
+		Tree: dbTree{
+			ID: "8983130ceda4a2e39a3ad002945d57748987494907f475539fe766f8893cc278",
+			Entries: []dbTreeEntry{{
+				EntryType:    dbTreeEntryType(DATABASE),
+				LastModified: time.Date(2019, time.March, 15, 18, 1, 0, 0, time.UTC),
+				LicenceSHA:   "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+				Name:         "19kB.sqlite",
+				Sha256:       "e8cab91dec32b3990b427b28380e4e052288054f99c4894742f07dee0c924efd",
+				Size:         19456},
+			},
+		},
+	}
+	meta.Branches["main"] = branchEntry{
+		Commit:      "59b72b78cb83bdba371438cb36950fe007265445a63068ae5586c9cc19203941",
+		CommitCount: 1,
+		Description: "",
+	}
+	meta.DefBranch = "main"
+
+	// No need for tags nor releases at this stage
+	meta.Tags = make(map[string]tagEntry)
+	meta.Releases = make(map[string]releaseEntry)
+	return
+}
+
+func mockServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/branch/create", mockServerBranchHandler)
+	mux.HandleFunc("/branch/remove", mockServerBranchHandler)
+	mux.HandleFunc("/branch/rename", mockServerBranchHandler)
+	mux.HandleFunc("/branch/update", mockServerBranchHandler)
+	mux.HandleFunc("/default", mockServerDatabaseListHandler)
+	mux.HandleFunc("/default/", mockServerGenericDBHandler)
+	mux.HandleFunc("/default/19kBv2.sqlite", mockServerPushPullSwitchHandler)
+	mux.HandleFunc("/default/19kBv3.sqlite", mockServerNewDBPushHandler)
+	mux.HandleFunc("/licence/add", mockServerLicenceAddHandler)
+	mux.HandleFunc("/licence/get", mockServerLicenceGetHandler)
+	mux.HandleFunc("/licence/remove", mockServerLicenceRemoveHandler)
+	mux.HandleFunc("/metadata/get", mockServerMetadataGetHandler)
+	mux.HandleFunc("/release/create", mockServerReleaseCreateHandler)
+	mux.HandleFunc("/release/remove", mockServerReleaseRemoveHandler)
+	mux.HandleFunc("/tag/create", mockServerTagCreateHandler)
+	mux.HandleFunc("/tag/remove", mockServerTagRemoveHandler)
+	mux.HandleFunc("/upload/chunk", mockServerUploadChunkHandler)
+	mux.HandleFunc("/upload/start", mockServerUploadStartHandler)
+	newServer = &http.Server{
+		Addr:         "localhost:5551",
+		Handler:      mux,
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0),
+	}
+	_ = newServer.ListenAndServeTLS(filepath.Join(origDir, "..", "test_data", "docker-dev.dbhub.io.cert.pem"),
+		filepath.Join(origDir, "..", "test_data", "docker-dev.dbhub.io.key.pem"))
+}
+
+func mockServerBranchHandler(w http.ResponseWriter, r *http.Request) {
+	meta, ok := mockMetaData[r.FormValue("dbname")]
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	name := r.FormValue("branch")
+	br, exists := meta.Branches[name]
+	switch strings.TrimPrefix(r.URL.Path, "/branch/") {
+	case "create":
+		if exists {
+			http.Error(w, "A branch with that name already exists", http.StatusConflict)
+			return
+		}
+		c, ok := meta.Commits[r.FormValue("commit")]
+		if !ok {
+			http.Error(w, "Unknown commit", http.StatusBadRequest)
+			return
+		}
+		count := 1
+		for ; c.Parent != ""; c = meta.Commits[c.Parent] {
+			count++
+		}
+		meta.Branches[name] = branchEntry{Commit: r.FormValue("commit"), CommitCount: count,
+			Description: r.FormValue("description")}
+	case "remove":
+		if !exists {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		delete(meta.Branches, name)
+	case "rename":
+		newName := r.FormValue("new_name")
+		if _, taken := meta.Branches[newName]; !exists || taken {
+			http.Error(w, "Can't rename that branch", http.StatusConflict)
+			return
+		}
+		meta.Branches[newName] = br
+		delete(meta.Branches, name)
+	case "update":
+		if !exists {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		br.Description = r.FormValue("description")
+		meta.Branches[name] = br
+	}
+}
+
+func mockServerDatabaseListHandler(w http.ResponseWriter, r *http.Request) {
+	// Convert the database entries to JSON
+	var msg bytes.Buffer
+	enc := json.NewEncoder(&msg)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(mockDBEntries); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dbList := msg.Bytes()
+	_, _ = fmt.Fprintf(w, "%s", dbList)
+}
+
+// Handles uploads and downloads for databases without test specific expectations.  Commits are accepted if their
+// parent is the head of the branch (or when forced), and downloads are served from the uploaded files
+func mockServerGenericDBHandler(w http.ResponseWriter, r *http.Request) {
+	db := strings.TrimPrefix(r.URL.Path, "/default/")
+	if r.Method == "GET" {
+		meta, ok := mockMetaData[db]
+		if !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		comID := r.FormValue("commit")
+		if br := r.FormValue("branch"); br != "" {
+			comID = meta.Branches[br].Commit
+		}
+		com, ok := meta.Commits[comID]
+		if !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Commit-ID", comID)
+		mockLastRange = r.Header.Get("Range")
+		http.ServeContent(w, r, db, time.Time{}, bytes.NewReader(mockBlobs[com.Tree.Entries[0].Sha256]))
+		return
+	}
+
+	// Read the uploaded database, either from the form or by assembling the chunks of a chunked upload
+	var b []byte
+	if id := r.FormValue("uploadid"); id != "" {
+		u, ok := mockUploads[id]
+		if !ok {
+			http.Error(w, "Unknown upload", http.StatusBadRequest)
+			return
+		}
+		numChunks := int((u.size + mockChunkSize - 1) / mockChunkSize)
+		for i := 0; i < numChunks; i++ {
+			chunk, ok := u.chunks[i]
+			if !ok {
+				http.Error(w, fmt.Sprintf("Chunk %d hasn't been received", i), http.StatusBadRequest)
+				return
+			}
+			b = append(b, chunk...)
+		}
+		delete(mockUploads, id)
+	} else {
+		tempFile, _, err := r.FormFile("file1")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer tempFile.Close()
+		b, err = ioutil.ReadAll(tempFile)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	z := sha256.Sum256(b)
+	shaSum := hex.EncodeToString(z[:])
+	if r.FormValue("dbshasum") != shaSum {
+		http.Error(w, "SHA256 of uploaded database doesn't match expected SHA256", http.StatusBadRequest)
+		return
+	}
+	lastMod, err := time.Parse(time.RFC3339, r.FormValue("lastmodified"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	commitTime, err := time.Parse(time.RFC3339, r.FormValue("committimestamp"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Generate the commit
+	licSHA := licList["Not specified"].Sha256
+	if lic, ok := licList[r.FormValue("licence")]; ok {
+		licSHA = lic.Sha256
+	}
+	var t dbTree
+	t.Entries = append(t.Entries, dbTreeEntry{
+		EntryType:    DATABASE,
+		LastModified: lastMod.UTC(),
+		LicenceSHA:   licSHA,
+		Name:         db,
+		Sha256:       shaSum,
+		Size:         int64(len(b)),
+	})
+	t.ID = repo.CreateDBTreeID(t.Entries)
+	newCom := commitEntry{
+		AuthorEmail:    r.FormValue("authoremail"),
+		AuthorName:     r.FormValue("authorname"),
+		CommitterEmail: r.FormValue("committeremail"),
+		CommitterName:  r.FormValue("committername"),
+		Message:        r.FormValue("commitmsg"),
+		Parent:         r.FormValue("commit"),
+		Timestamp:      commitTime.UTC(),
+		Tree:           t,
+	}
+	if op := r.FormValue("otherparents"); op != "" {
+		newCom.OtherParents = strings.Split(op, ",")
+	}
+	newCom.ID = repo.CreateCommitID(newCom)
+
+	// Unless forced, the new commit has to follow on from the head of the branch
+	meta, ok := mockMetaData[db]
+	if !ok {
+		meta = metaData{
+			Branches: make(map[string]branchEntry),
+			Commits:  make(map[string]commitEntry),
+			Releases: make(map[string]releaseEntry),
+			Tags:     make(map[string]tagEntry),
+		}
+	}
+	branch := r.FormValue("branch")
+	head, ok := meta.Branches[branch]
+	if ok && head.Commit != newCom.Parent && r.FormValue("force") != "true" {
+		http.Error(w, "The branch head has changed.  Use force to overwrite it", http.StatusConflict)
+		return
+	}
+	if _, ok = meta.Commits[newCom.Parent]; newCom.Parent != "" && !ok {
+		http.Error(w, "Unknown parent commit", http.StatusBadRequest)
+		return
+	}
+	for _, p := range newCom.OtherParents {
+		if _, ok = meta.Commits[p]; !ok {
+			http.Error(w, "Unknown merged in parent commit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Add the commit to the mock server metadata
+	mockBlobs[shaSum] = b
+	meta.Commits[newCom.ID] = newCom
+	commitCount := 1
+	for c := newCom; c.Parent != ""; c = meta.Commits[c.Parent] {
+		commitCount++
+	}
+	meta.Branches[branch] = branchEntry{Commit: newCom.ID, CommitCount: commitCount, Description: head.Description}
+	if meta.DefBranch == "" {
+		meta.DefBranch = branch
+	}
+	mockMetaData[db] = meta
+	w.WriteHeader(http.StatusCreated)
+	_, _ = fmt.Fprintf(w, `{"commit_id": "%s"}`, newCom.ID)
+}
+
+func mockServerLicenceAddHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the form variables
+	licID := r.FormValue("licence_id")
+	licName := r.FormValue("licence_name")
+	do := r.FormValue("display_order")
+	dispOrder, err := strconv.Atoi(do)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ff := r.FormValue("file_format")
+	su := r.FormValue("source_url")
+	tempFile, _, err := r.FormFile("file1")
+	if err != nil {
+		log.Printf("Uploading licence failed: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer tempFile.Close()
+
+	// Calculate the SHA256 of the uploaded licence text
+	licText := new(bytes.Buffer)
+	_, err = io.Copy(licText, tempFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpSHA := sha256.Sum256(licText.Bytes())
+	licSHA := hex.EncodeToString(tmpSHA[:])
+
+	// Add the licence to the in memory licence list
+	licList[licID] = licenceEntry{
+		FullName:   licName,
+		FileFormat: ff,
+		Sha256:     licSHA,
+		Order:      dispOrder,
+		URL:        su,
+	}
+
+	// Send a success message back to the client
+	w.WriteHeader(http.StatusCreated)
+	_, _ = fmt.Fprintf(w, "Success")
+}
+
+func mockServerLicenceGetHandler(w http.ResponseWriter, r *http.Request) {
+	// Make sure the correct licence is being requested
+	if r.FormValue("licence") != "AGPL3" {
+		http.Error(w, "Wrong licence requested", http.StatusNotFound)
+		return
+	}
+
+	// Send the licence file to the client
+	lic, err := ioutil.ReadFile(licFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=AGPL3.txt")
+	w.Header().Set("Content-Type", "text/plain")
+	_, err = fmt.Fprint(w, lic)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func mockServerLicenceRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	// Make sure the correct licence is being requested
+	if r.FormValue("licence_id") != "AGPL3" {
+		http.Error(w, "Wrong licence requested", http.StatusNotFound)
+		return
+	}
+
+	// Remove the licence
+	delete(licList, "AGPL3")
+
+	// Send a success message back to the client
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(w, "Success")
+}
+
+func mockServerMetadataGetHandler(w http.ResponseWriter, r *http.Request) {
+	var info struct {
+		Branches  map[string]branchEntry  `json:"branches"`
+		Commits   map[string]commitEntry  `json:"commits"`
+		DefBranch string                  `json:"default_branch"`
+		Releases  map[string]releaseEntry `json:"releases"`
+		Tags      map[string]tagEntry     `json:"tags"`
 	}
 
 	// Return the metadata for the requested database
@@ -1357,6 +3777,137 @@ func mockServerMetadataGetHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, string(jsonList))
 }
 
+func mockServerReleaseCreateHandler(w http.ResponseWriter, r *http.Request) {
+	meta, ok := mockMetaData[r.FormValue("dbname")]
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	date, err := time.Parse(time.RFC3339, r.FormValue("date"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("release")
+	if _, ok = meta.Releases[name]; ok {
+		http.Error(w, "A release with that name already exists", http.StatusConflict)
+		return
+	}
+	meta.Releases[name] = releaseEntry{
+		Commit:        r.FormValue("commit"),
+		Date:          date,
+		Description:   r.FormValue("msg"),
+		ReleaserEmail: r.FormValue("releaseremail"),
+		ReleaserName:  r.FormValue("releasername"),
+		Size:          size,
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func mockServerReleaseRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	meta, ok := mockMetaData[r.FormValue("dbname")]
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	delete(meta.Releases, r.FormValue("release"))
+}
+
+func mockServerTagCreateHandler(w http.ResponseWriter, r *http.Request) {
+	meta, ok := mockMetaData[r.FormValue("dbname")]
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	date, err := time.Parse(time.RFC3339, r.FormValue("date"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("tag")
+	if _, ok = meta.Tags[name]; ok {
+		http.Error(w, "A tag with that name already exists", http.StatusConflict)
+		return
+	}
+	meta.Tags[name] = tagEntry{
+		Commit:      r.FormValue("commit"),
+		Date:        date,
+		Description: r.FormValue("msg"),
+		TaggerEmail: r.FormValue("taggeremail"),
+		TaggerName:  r.FormValue("taggername"),
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func mockServerTagRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	meta, ok := mockMetaData[r.FormValue("dbname")]
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	delete(meta.Tags, r.FormValue("tag"))
+}
+
+// Receives a chunk of a chunked upload, checking it against the SHA256 sent with it
+func mockServerUploadChunkHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := mockUploads[r.FormValue("uploadid")]
+	if !ok {
+		http.Error(w, "Unknown upload", http.StatusNotFound)
+		return
+	}
+	index, err := strconv.Atoi(r.FormValue("index"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if mockChunkFailures[index] > 0 {
+		mockChunkFailures[index]--
+		http.Error(w, "Simulated failure", http.StatusServiceUnavailable)
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	z := sha256.Sum256(b)
+	if hex.EncodeToString(z[:]) != r.FormValue("chunkshasum") {
+		http.Error(w, "SHA256 of chunk doesn't match expected SHA256", http.StatusBadRequest)
+		return
+	}
+	u.chunks[index] = b
+	mockChunksReceived++
+}
+
+// Starts a chunked upload, or returns the details of an unfinished one for the same database file so it can be resumed
+func mockServerUploadStartHandler(w http.ResponseWriter, r *http.Request) {
+	if !mockChunkedUploads {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := r.FormValue("dbname") + "-" + r.FormValue("dbshasum")
+	u, ok := mockUploads[id]
+	if !ok {
+		u = &mockUpload{chunks: make(map[int][]byte), shaSum: r.FormValue("dbshasum"), size: size}
+		mockUploads[id] = u
+	}
+	sess := client.UploadSession{ChunkSize: mockChunkSize, ID: id, Received: []int{}}
+	for i := range u.chunks {
+		sess.Received = append(sess.Received, i)
+	}
+	_ = json.NewEncoder(w).Encode(sess)
+}
+
 func mockServerNewDBPushHandler(w http.ResponseWriter, r *http.Request) {
 	expected := map[string]string{
 		"authoremail":    "testdefault@dbhub.io",
@@ -1458,7 +4009,7 @@ func mockServerNewDBPushHandler(w http.ResponseWriter, r *http.Request) {
 	e.Size = numBytes
 	var t dbTree
 	t.Entries = append(t.Entries, e)
-	t.ID = createDBTreeID(t.Entries)
+	t.ID = repo.CreateDBTreeID(t.Entries)
 	newCom := commitEntry{
 		AuthorName:     expected["authorname"],
 		AuthorEmail:    expected["authoremail"],
@@ -1469,7 +4020,7 @@ func mockServerNewDBPushHandler(w http.ResponseWriter, r *http.Request) {
 		Timestamp:      commitTime,
 		Tree:           t,
 	}
-	newCom.ID = createCommitID(newCom)
+	newCom.ID = repo.CreateCommitID(newCom)
 
 	// Add the new database to the internal mock server database list
 	entry := dbListEntry{
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+var fetchCmdAllBranches *bool
+
+// Downloads the latest metadata, and any database versions missing from the local cache
+var fetchCmd = &cobra.Command{
+	Use:   "fetch [database name...]",
+	Short: "Download the latest metadata and database history from DBHub.io, without changing the local database",
+	Long: `Download the latest metadata and database history from DBHub.io, without changing the local database.
+
+The new commits from DBHub.io are added to the local metadata, along with where
+each branch is on DBHub.io, then every version of the database in the history of
+the active branch which isn't already in the local cache is downloaded.  With
+--all-branches, the history of every branch, tag, and release is downloaded.
+
+Local branches aren't moved, and the database file in the working directory
+isn't changed, so afterwards things like reverting, viewing logs, and diffing
+can be done without a network connection.  Use "dio pull" to bring a branch up
+to date with DBHub.io.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fetch(args)
+	},
+	Annotations: locksDatabases,
+}
+
+func init() {
+	RootCmd.AddCommand(fetchCmd)
+	fetchCmdAllBranches = fetchCmd.Flags().Bool("all-branches", false,
+		"Download the history of all branches, tags, and releases, not just the active branch")
+}
+
+func fetch(args []string) error {
+	// Ensure a database file was given
+	dbs, err := dbsFromArgs(args, false)
+	if err != nil {
+		return err
+	}
+	return forEachDatabase(dbs, fetchDB, nil)
+}
+
+// Fetches the latest metadata for a database, and the database versions missing from the local cache
+func fetchDB(db string) error {
+	// Add the latest commits from DBHub.io to the local metadata, and save it
+	meta, err := updateMetadata(db, "fetch", false)
+	if err != nil {
+		return err
+	}
+
+	// Work out which commits to retrieve the database for
+	var heads []string
+	if *fetchCmdAllBranches {
+		for _, b := range meta.Branches {
+			heads = append(heads, b.Commit)
+		}
+		for _, b := range meta.RemoteBranches {
+			heads = append(heads, b.Commit)
+		}
+		for _, t := range meta.Tags {
+			heads = append(heads, t.Commit)
+		}
+		for _, r := range meta.Releases {
+			heads = append(heads, r.Commit)
+		}
+	} else {
+		b, ok := meta.Branches[meta.ActiveBranch]
+		if !ok {
+			return errors.New("Aborting: info for the active branch isn't found in the local branch cache")
+		}
+		heads = append(heads, b.Commit)
+		if rb, ok := meta.RemoteBranches[meta.ActiveBranch]; ok {
+			heads = append(heads, rb.Commit)
+		}
+	}
+	commits, err := localRepo().ReachableCommits(db, heads...)
+	if err != nil {
+		return err
+	}
+
+	// Many commits can have the same database file, so only one of them is needed for each file not already cached
+	missing := make(map[string]string)
+	for id, c := range commits {
+		if len(c.Tree.Entries) == 0 {
+			continue
+		}
+		shaSum := c.Tree.Entries[0].Sha256
+		if localRepo().HasCached(db, shaSum) {
+			continue
+		}
+		if other, ok := missing[shaSum]; !ok || id < other {
+			missing[shaSum] = id
+		}
+	}
+	if len(missing) == 0 {
+		_, err = fmt.Fprintf(fOut, "The local cache for '%s' already has all %d commit(s)\n", db, len(commits))
+		return err
+	}
+
+	// Download them, in a consistent order
+	var sortedSums []string
+	for shaSum := range missing {
+		sortedSums = append(sortedSums, shaSum)
+	}
+	sort.Strings(sortedSums)
+	var totalSize int64
+	for _, shaSum := range sortedSums {
+		id := missing[shaSum]
+		_, err = fmt.Fprintf(fOut, "Downloading database for commit %s\n", id)
+		if err != nil {
+			return err
+		}
+		err = checkDBCache(db, id, shaSum)
+		if err != nil {
+			return err
+		}
+		totalSize += commits[id].Tree.Entries[0].Size
+	}
+	_, err = numFormat.Fprintf(fOut, "Fetched %d database version(s) for '%s', %d bytes in total\n", len(missing), db,
+		totalSize)
+	return err
+}
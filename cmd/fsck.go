@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"github.com/sqlitebrowser/dio/repo"
+)
+
+// Checks the local metadata and database cache for problems
+var fsckCmd = &cobra.Command{
+	Use:   "fsck [database name...]",
+	Short: "Check the local metadata and cached database versions for problems",
+	Long: `Check the local metadata and cached database versions for problems.
+
+The tree and commit IDs of every commit are recalculated and compared with the
+ones stored, the parents of each commit are checked to be known, and branches,
+tags, and releases are checked to point at known commits.  Each database file
+in the local cache is checked to still match the SHA256 it is named after.
+
+Nothing is changed, and nothing is retrieved from DBHub.io.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fsck(args)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(fsckCmd)
+}
+
+func fsck(args []string) error {
+	// Ensure a database file was given
+	dbs, err := dbsFromArgs(args, false)
+	if err != nil {
+		return err
+	}
+	return forEachDatabase(dbs, fsckDB, nil)
+}
+
+// Checks the local metadata and database cache of a database for problems
+func fsckDB(db string) (err error) {
+	if !localRepo().HasMetadata(db) {
+		return fmt.Errorf("There's no local metadata for '%s'", db)
+	}
+	meta, err := localFetchMetadata(db, false)
+	if err != nil {
+		return
+	}
+	problems := fsckMetadata(meta)
+
+	// Check the cached database files still match their SHA256
+	files, err := ioutil.ReadDir(filepath.Join(".dio", db, "db"))
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	for _, f := range files {
+		var shaSum string
+		shaSum, _, err = repo.FileSHA256(localRepo().CachePath(db, f.Name()))
+		if err != nil {
+			return
+		}
+		if shaSum != f.Name() {
+			problems = append(problems, fmt.Sprintf("Cached database '%s' has a SHA256 of %s", f.Name(), shaSum))
+		}
+	}
+
+	// Let the user know the results
+	if len(problems) == 0 {
+		_, err = numFormat.Fprintf(fOut, "No problems found in '%s' (%d commits, %d cached database files)\n", db,
+			len(meta.Commits), len(files))
+		return
+	}
+	_, err = fmt.Fprintf(fOut, "Problems found in '%s':\n", db)
+	if err != nil {
+		return
+	}
+	for _, p := range problems {
+		_, err = fmt.Fprintf(fOut, "  * %s\n", p)
+		if err != nil {
+			return
+		}
+	}
+	return fmt.Errorf("%d problem(s) found in '%s'", len(problems), db)
+}
+
+// Returns a description of each problem found in the commits, branches, tags and releases of a database's metadata
+func fsckMetadata(meta metaData) (problems []string) {
+	var ids []string
+	for id := range meta.Commits {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		c := meta.Commits[id]
+		if c.ID != id {
+			problems = append(problems, fmt.Sprintf("Commit %s is stored with the ID %s", id, c.ID))
+		}
+		if t := repo.CreateDBTreeID(c.Tree.Entries); t != c.Tree.ID {
+			problems = append(problems, fmt.Sprintf("Commit %s has tree ID %s, but its entries give %s", id,
+				c.Tree.ID, t))
+		}
+		if newID := repo.CreateCommitID(c); newID != id {
+			problems = append(problems, fmt.Sprintf("Commit %s has contents which give the ID %s", id, newID))
+		}
+		for _, p := range append([]string{c.Parent}, c.OtherParents...) {
+			if _, ok := meta.Commits[p]; p != "" && !ok {
+				problems = append(problems, fmt.Sprintf("Commit %s has unknown parent %s", id, p))
+			}
+		}
+	}
+
+	// Check the branches, tags, and releases all point at known commits
+	var refs []string
+	for name, b := range meta.Branches {
+		if _, ok := meta.Commits[b.Commit]; !ok {
+			refs = append(refs, fmt.Sprintf("Branch '%s' points at unknown commit %s", name, b.Commit))
+		}
+	}
+	for name, r := range meta.Releases {
+		if _, ok := meta.Commits[r.Commit]; !ok {
+			refs = append(refs, fmt.Sprintf("Release '%s' points at unknown commit %s", name, r.Commit))
+		}
+	}
+	for name, t := range meta.Tags {
+		if _, ok := meta.Commits[t.Commit]; !ok {
+			refs = append(refs, fmt.Sprintf("Tag '%s' points at unknown commit %s", name, t.Commit))
+		}
+	}
+	sort.Strings(refs)
+	problems = append(problems, refs...)
+	if _, ok := meta.Branches[meta.ActiveBranch]; !ok {
+		problems = append(problems, fmt.Sprintf("The active branch '%s' doesn't exist", meta.ActiveBranch))
+	}
+	return
+}
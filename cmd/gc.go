@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+var gcCmdDryRun, gcCmdPruneCommits *bool
+
+// Removes cached database versions which aren't needed any more
+var gcCmd = &cobra.Command{
+	Use:   "gc [database name...]",
+	Short: "Remove cached database versions which no branch, tag, or release can reach",
+	Long: `Remove cached database versions which no branch, tag, or release can reach.
+
+Every version of a database which has been committed, pulled, or fetched is
+kept in the local cache.  Versions which aren't in the history of any branch,
+either local or as last seen on DBHub.io, tag, release, or reflog entry (eg
+after a branch has been removed) are removed.  With --dry-run, the versions
+which would be removed are listed, but nothing is changed.
+
+With --prune-commits, the commits for the removed versions are removed from
+the local metadata too.  They can't be brought back, except by fetching them
+again from DBHub.io if they were pushed.
+
+When no database name is given, every database tracked in the current
+directory is cleaned up.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return gc(args)
+	},
+	Annotations: locksAllDatabases,
+}
+
+func init() {
+	RootCmd.AddCommand(gcCmd)
+	gcCmdDryRun = gcCmd.Flags().Bool("dry-run", false,
+		"Show what would be removed, and the space reclaimed, without removing anything")
+	gcCmdPruneCommits = gcCmd.Flags().Bool("prune-commits", false,
+		"Also remove the commits for the removed versions from the local metadata")
+}
+
+func gc(args []string) error {
+	// With no database names given, clean up every tracked database
+	dbs, err := dbsFromArgs(args, len(args) == 0)
+	if err != nil {
+		return err
+	}
+	return forEachDatabase(dbs, gcDB, nil)
+}
+
+// Removes the cached versions of a database which aren't reachable from any of its branches, local or on the server,
+// tags, releases, or reflog entries.  With --prune-commits, the commits for them are removed from the metadata too
+func gcDB(db string) (err error) {
+	r := localRepo()
+	if !r.HasMetadata(db) {
+		return fmt.Errorf("There's no local metadata for '%s'", db)
+	}
+
+	// Work out which database files are still needed
+	kept, err := r.KeptCommits(db)
+	if err != nil {
+		return
+	}
+	needed := make(map[string]struct{})
+	for _, c := range kept {
+		if len(c.Tree.Entries) > 0 {
+			needed[c.Tree.Entries[0].Sha256] = struct{}{}
+		}
+	}
+
+	// Remove the others
+	files, err := ioutil.ReadDir(filepath.Join(".dio", db, "db"))
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	var count int
+	var reclaimed int64
+	for _, f := range files {
+		if _, ok := needed[f.Name()]; ok {
+			continue
+		}
+		_, err = numFormat.Fprintf(fOut, "  * %s: %d bytes\n", f.Name(), f.Size())
+		if err != nil {
+			return
+		}
+		if !*gcCmdDryRun {
+			err = os.Remove(r.CachePath(db, f.Name()))
+			if err != nil {
+				return
+			}
+		}
+		count++
+		reclaimed += f.Size()
+	}
+
+	// Only remove the commits which aren't needed either when asked to, as they can't be got back
+	if *gcCmdPruneCommits {
+		var pruned int
+		pruned, err = r.PruneCommits(db, *gcCmdDryRun)
+		if err != nil {
+			return
+		}
+		switch {
+		case pruned > 0 && *gcCmdDryRun:
+			_, err = numFormat.Fprintf(fOut, "Would remove %d unneeded commit(s) from the metadata for '%s'\n",
+				pruned, db)
+		case pruned > 0:
+			_, err = numFormat.Fprintf(fOut, "Removed %d unneeded commit(s) from the metadata for '%s'\n", pruned,
+				db)
+		}
+		if err != nil {
+			return
+		}
+	}
+	switch {
+	case count == 0:
+		_, err = fmt.Fprintf(fOut, "Every cached version of '%s' is still needed.  Nothing to remove\n", db)
+	case *gcCmdDryRun:
+		_, err = numFormat.Fprintf(fOut, "Would remove %d cached version(s) of '%s', reclaiming %d bytes\n", count,
+			db, reclaimed)
+	default:
+		_, err = numFormat.Fprintf(fOut, "Removed %d cached version(s) of '%s', reclaiming %d bytes\n", count, db,
+			reclaimed)
+	}
+	return
+}
@@ -12,6 +12,18 @@ var infoCmd = &cobra.Command{
 	Use:   "info",
 	Short: "Displays useful information about the dio installation",
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if structuredOutput() {
+			return writeOutput(infoOutput{
+				CAChain:    viper.GetString("certs.cachain"),
+				Cert:       viper.GetString("certs.cert"),
+				Cloud:      cloud,
+				ConfigFile: viper.ConfigFileUsed(),
+				UserEmail:  viper.GetString("user.email"),
+				UserName:   viper.GetString("user.name"),
+				Version:    DIO_VERSION,
+			})
+		}
+
 		fmt.Printf("Dio version %s\n", DIO_VERSION)
 
 		// Display the path to the dio configuration file
@@ -1,14 +1,14 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
-	"net/url"
 	"os"
 
-	rq "github.com/parnurzeal/gorequest"
 	"github.com/spf13/cobra"
+	"github.com/sqlitebrowser/dio/client"
 )
 
 var licenceAddFile, licenceAddFileFormat, licenceAddFullName, licenceAddURL string
@@ -55,51 +55,42 @@ func licenceAdd(args []string) error {
 	if licenceAddFile == "" {
 		return errors.New("A file containing the licence text is required")
 	}
-	_, err := os.Stat(licenceAddFile)
+	f, err := os.Open(licenceAddFile)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
 	// Send the licence info to the API server
 	name := args[0]
-	req := rq.New().TLSClientConfig(&TLSConfig).Post(fmt.Sprintf("%s/licence/add", cloud)).
-		Type("multipart").
-		Query(fmt.Sprintf("licence_id=%s", url.QueryEscape(name))).
-		Query(fmt.Sprintf("display_order=%d", licenceAddDisplayOrder)).
-		Set("User-Agent", fmt.Sprintf("Dio %s", DIO_VERSION)).
-		SendFile(licenceAddFile, "", "file1")
-	if licenceAddFileFormat != "" {
-		req.Query(fmt.Sprintf("file_format=%s", url.QueryEscape(licenceAddFileFormat)))
+	l := client.LicenceUpload{
+		DisplayOrder: licenceAddDisplayOrder,
+		FileFormat:   licenceAddFileFormat,
+		FullName:     licenceAddFullName,
+		ID:           name,
+		SourceURL:    licenceAddURL,
 	}
-	if licenceAddFullName != "" {
-		req.Query(fmt.Sprintf("licence_name=%s", url.QueryEscape(licenceAddFullName)))
-	}
-	if licenceAddURL != "" {
-		req.Query(fmt.Sprintf("source_url=%s", url.QueryEscape(licenceAddURL)))
+	err = apiClient().LicenceAdd(context.Background(), l, f)
+	var e *client.Error
+	if errors.As(err, &e) && e.StatusCode != 0 {
+		if e.StatusCode == http.StatusConflict {
+			return errors.New(e.Message)
+		}
+
+		return errors.New(fmt.Sprintf("Adding licence failed with an error: HTTP status %d - '%v'\n",
+			e.StatusCode, http.StatusText(e.StatusCode)))
 	}
-	resp, body, errs := req.End()
-	if errs != nil {
-		_, err = fmt.Fprint(fOut, "Errors when adding licence:")
-		if err != nil {
-			return err
+	if err != nil {
+		_, errInner := fmt.Fprint(fOut, "Errors when adding licence:")
+		if errInner != nil {
+			return errInner
 		}
-		for _, errInner := range errs {
-			errTxt := errInner.Error()
-			_, errInnerInner := fmt.Fprint(fOut, errTxt)
-			if errInnerInner != nil {
-				return errInnerInner
-			}
+		_, errInner = fmt.Fprint(fOut, err.Error())
+		if errInner != nil {
+			return errInner
 		}
 		return errors.New("Error when adding licence")
 	}
-	if resp.StatusCode != http.StatusCreated {
-		if resp.StatusCode == http.StatusConflict {
-			return errors.New(body)
-		}
-
-		return errors.New(fmt.Sprintf("Adding licence failed with an error: HTTP status %d - '%v'\n",
-			resp.StatusCode, resp.Status))
-	}
 
 	_, err = fmt.Fprintf(fOut, "Licence '%s' added\n", name)
 	return err
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -8,8 +9,8 @@ import (
 	"net/http"
 	"strings"
 
-	rq "github.com/parnurzeal/gorequest"
 	"github.com/spf13/cobra"
+	"github.com/sqlitebrowser/dio/client"
 )
 
 // Downloads a licence from a DBHub.io cloud.
@@ -57,35 +58,30 @@ func licenceGet(args []string) error {
 	// Download the licence text
 	dlStatus := make(map[string]string)
 	for _, lic := range licenceList {
-		resp, body, errs := rq.New().TLSClientConfig(&TLSConfig).Get(cloud+"/licence/get").
-			Query(fmt.Sprintf("licence=%s", lic)).
-			Set("User-Agent", fmt.Sprintf("Dio %s", DIO_VERSION)).
-			End()
-		if errs != nil {
-			for _, err := range errs {
-				log.Print(err.Error())
-			}
-			dlStatus[lic] = "Error when downloading licence text"
+		body, contentType, err := apiClient().LicenceGet(context.Background(), lic)
+		if client.IsNotFound(err) {
+			dlStatus[lic] = "Requested licence not found"
+			continue
+		}
+		if code := client.StatusCode(err); code != 0 {
+			dlStatus[lic] = fmt.Sprintf("Download failed with an error: HTTP status %d - '%v'", code,
+				http.StatusText(code))
 			continue
 		}
-		if resp.StatusCode != http.StatusOK {
-			if resp.StatusCode == http.StatusNotFound {
-				dlStatus[lic] = "Requested licence not found"
-				continue
-			}
-			dlStatus[lic] = fmt.Sprintf("Download failed with an error: HTTP status %d - '%v'",
-				resp.StatusCode, resp.Status)
+		if err != nil {
+			log.Print(err.Error())
+			dlStatus[lic] = "Error when downloading licence text"
 			continue
 		}
 
 		// Write the licence to disk
 		var ext string
-		if resp.Header.Get("Content-Type") == "text/html" {
+		if contentType == "text/html" {
 			ext = "html"
 		} else {
 			ext = "txt"
 		}
-		err := ioutil.WriteFile(fmt.Sprintf("%s.%s", lic, ext), []byte(body), 0644)
+		err = ioutil.WriteFile(fmt.Sprintf("%s.%s", lic, ext), body, 0644)
 		if err != nil {
 			dlStatus[lic] = err.Error()
 		}
@@ -55,6 +55,13 @@ func licenceList() error {
 		return err
 	}
 
+	if structuredOutput() {
+		if licList == nil {
+			licList = make(map[string]licenceEntry)
+		}
+		return writeOutput(licList)
+	}
+
 	// Display the list of licences
 	if len(licList) == 0 {
 		_, err = fmt.Fprintf(fOut, "Cloud '%s' knows no licences\n", cloud)
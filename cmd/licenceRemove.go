@@ -1,13 +1,12 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"net/http"
-	"net/url"
 
-	rq "github.com/parnurzeal/gorequest"
 	"github.com/spf13/cobra"
+	"github.com/sqlitebrowser/dio/client"
 )
 
 // Removes a licence from the system.
@@ -34,27 +33,23 @@ func licenceRemove(args []string) error {
 
 	// Remove the licence
 	name := args[0]
-	resp, body, errs := rq.New().TLSClientConfig(&TLSConfig).Post(fmt.Sprintf("%s/licence/remove", cloud)).
-		Query(fmt.Sprintf("licence_id=%s", url.QueryEscape(name))).
-		Set("User-Agent", fmt.Sprintf("Dio %s", DIO_VERSION)).
-		End()
-	if errs != nil {
-		_, err := fmt.Fprint(fOut, "Errors when removing licence:")
-		if err != nil {
-			return err
+	err := apiClient().LicenceRemove(context.Background(), name)
+	var e *client.Error
+	if errors.As(err, &e) && e.StatusCode != 0 {
+		return errors.New(e.Message)
+	}
+	if err != nil {
+		_, errInner := fmt.Fprint(fOut, "Errors when removing licence:")
+		if errInner != nil {
+			return errInner
 		}
-		for _, err := range errs {
-			_, errInner := fmt.Fprint(fOut, err.Error())
-			if errInner != nil {
-				return errInner
-			}
+		_, errInner = fmt.Fprint(fOut, err.Error())
+		if errInner != nil {
+			return errInner
 		}
 		return errors.New("Error when removing licence")
 	}
-	if resp.StatusCode != http.StatusOK {
-		return errors.New(body)
-	}
 
-	_, err := fmt.Fprintf(fOut, "Licence '%s' removed\n", name)
+	_, err = fmt.Fprintf(fOut, "Licence '%s' removed\n", name)
 	return err
 }
@@ -30,6 +30,13 @@ func list(args []string) error {
 		return err
 	}
 
+	if structuredOutput() {
+		if dbList == nil {
+			dbList = []dbListEntry{}
+		}
+		return writeOutput(dbList)
+	}
+
 	// Display the list of databases
 	if len(dbList) == 0 {
 		_, err = fmt.Fprintf(fOut, "Cloud '%s' has no databases\n", cloud)
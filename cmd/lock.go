@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"github.com/sqlitebrowser/dio/repo"
+)
+
+// Commands with this annotation change the local metadata of the databases they're given, so they hold the lock for
+// each of those databases while they run.  Commands which only read don't need it, as metadata writes are atomic
+var locksDatabases = map[string]string{"locks": "databases"}
+
+// Like locksDatabases, for commands which work on every tracked database when no database names are given
+var locksAllDatabases = map[string]string{"locks": "all databases"}
+
+// Like locksDatabases, for commands which only change something when database names are given
+var locksNamedDatabases = map[string]string{"locks": "named databases"}
+
+// The database locks held by the running command
+var heldLocks []*repo.Lock
+
+// Takes the locks for the databases a command will change, waiting for any other dio process working on them to
+// finish first.  Databases with nothing in the .dio directory yet have no metadata to protect, so aren't locked
+func lockDatabases(cmd *cobra.Command, args []string) error {
+	all, _ := cmd.Flags().GetBool("all")
+	switch cmd.Annotations["locks"] {
+	case locksDatabases["locks"]:
+	case locksAllDatabases["locks"]:
+		all = all || len(args) == 0
+	case locksNamedDatabases["locks"]:
+		if len(args) == 0 {
+			return nil
+		}
+	default:
+		return nil
+	}
+	var dbs []string
+	var err error
+	if all && len(args) == 0 {
+		if dbs, err = localRepo().Tracked(); err != nil {
+			return err
+		}
+	} else if dbs, err = dbsFromArgs(args, all); err != nil {
+		return err
+	}
+
+	// The locks are always taken in the same order, so two commands can't each end up waiting on the other
+	dbs = append([]string(nil), dbs...)
+	sort.Strings(dbs)
+	r := localRepo()
+	for i, db := range dbs {
+		if i > 0 && db == dbs[i-1] {
+			continue
+		}
+		l, err := r.TryLock(db)
+		if err == repo.ErrNoMetadata {
+			continue
+		}
+		if err == repo.ErrLocked {
+			fmt.Fprintf(os.Stderr, "Waiting for another dio process to finish with %s\n", db)
+			l, err = r.Lock(db)
+		}
+		if err != nil {
+			unlockDatabases()
+			return err
+		}
+		heldLocks = append(heldLocks, l)
+	}
+	return nil
+}
+
+// Releases the database locks held by the running command
+func unlockDatabases() {
+	for _, l := range heldLocks {
+		_ = l.Unlock()
+	}
+	heldLocks = nil
+}
@@ -3,17 +3,34 @@ package cmd
 import (
 	"errors"
 	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/sqlitebrowser/dio/repo"
 )
 
-var logBranch string
+var (
+	logAll, logGraph, logOneline                                 bool
+	logAuthor, logBranch, logFormat, logGrep, logSince, logUntil string
+	logMaxCount                                                  int
+)
 
 // Retrieves the commit history for a database branch
 var branchLogCmd = &cobra.Command{
 	Use:   "log [database name]",
 	Short: "Displays the history for a database branch",
+	Long: `Displays the history for a database branch.
+
+By default only the first parent of each commit is followed, giving the
+commits made on the branch itself.  With --all or --graph, the commits
+brought in by merges are included too.
+
+The --format option takes a Go template, which is given each commit in turn.
+eg --format '{{.ID}} {{.AuthorName}} {{.Message}}'`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return branchLog(args)
 	},
@@ -21,8 +38,37 @@ var branchLogCmd = &cobra.Command{
 
 func init() {
 	RootCmd.AddCommand(branchLogCmd)
+	branchLogCmd.Flags().BoolVar(&logAll, "all", false, "Show the history of every branch")
+	branchLogCmd.Flags().StringVar(&logAuthor, "author", "",
+		"Only show commits whose author name or email matches this regular expression")
 	branchLogCmd.Flags().StringVar(&logBranch, "branch", "", "Remote branch to retrieve the "+
 		"history of")
+	branchLogCmd.Flags().StringVar(&logFormat, "format", "",
+		"Display each commit using this Go template, instead of the default text")
+	branchLogCmd.Flags().BoolVar(&logGraph, "graph", false,
+		"Draw a text based graph of the commits, showing where branches were merged")
+	branchLogCmd.Flags().StringVar(&logGrep, "grep", "",
+		"Only show commits whose message matches this regular expression")
+	branchLogCmd.Flags().IntVarP(&logMaxCount, "max-count", "n", 0, "Show at most this many commits")
+	branchLogCmd.Flags().BoolVar(&logOneline, "oneline", false, "Show each commit on a single line")
+	branchLogCmd.Flags().StringVar(&logSince, "since", "",
+		"Only show commits made at or after this date.  eg 2006-01-02 or 2006-01-02T15:04:05Z")
+	branchLogCmd.Flags().StringVar(&logUntil, "until", "",
+		"Only show commits made at or before this date.  eg 2006-01-02 or 2006-01-02T15:04:05Z")
+}
+
+// The conditions a commit needs to meet for it to be shown
+type logFilter struct {
+	author *regexp.Regexp
+	grep   *regexp.Regexp
+	since  time.Time
+	until  time.Time
+}
+
+// The tags and releases pointing at a commit
+type commitRefs struct {
+	releases []string
+	tags     []string
 }
 
 func branchLog(args []string) error {
@@ -44,6 +90,17 @@ func branchLog(args []string) error {
 	if len(args) > 1 {
 		return errors.New("only one database can be worked with at a time (for now)")
 	}
+	filter, err := newLogFilter()
+	if err != nil {
+		return err
+	}
+	var tmpl *template.Template
+	if logFormat != "" {
+		tmpl, err = template.New("format").Parse(logFormat)
+		if err != nil {
+			return fmt.Errorf("Invalid --format template: %v", err)
+		}
+	}
 
 	// If there is a local metadata cache for the requested database, use that.  Otherwise, retrieve it from the
 	// server first (without storing it)
@@ -53,13 +110,53 @@ func branchLog(args []string) error {
 		return err
 	}
 
-	// If a branch name was given by the user, check if it exists
-	if logBranch != "" {
-		if _, ok := meta.Branches[logBranch]; ok == false {
+	// If no branch name was given by the user, use the active branch
+	if logBranch == "" {
+		logBranch = meta.ActiveBranch
+	}
+
+	// Gather the commits to show.  The graph needs every commit brought in by merges, not just the first parents
+	var history []commitEntry
+	switch {
+	case logAll:
+		var heads []string
+		for _, b := range meta.Branches {
+			heads = append(heads, b.Commit)
+		}
+		history = repo.Ancestry(meta, heads...)
+	case logGraph:
+		head, ok := meta.Branches[logBranch]
+		if !ok {
 			return errors.New("That branch doesn't exist for the database")
 		}
-	} else {
-		logBranch = meta.ActiveBranch
+		history = repo.Ancestry(meta, head.Commit)
+	default:
+		history, err = repo.History(meta, logBranch)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Apply the filters.  The graph keeps the hidden commits, so it can still draw the lines through them, but stops
+	// after the last commit shown when the number of commits is limited
+	var shown []commitEntry
+	visible := make(map[string]bool)
+	for i, c := range history {
+		if logMaxCount > 0 && len(shown) >= logMaxCount {
+			history = history[:i]
+			break
+		}
+		if filter.matches(c) {
+			shown = append(shown, c)
+			visible[c.ID] = true
+		}
+	}
+
+	if structuredOutput() {
+		if shown == nil {
+			shown = []commitEntry{}
+		}
+		return writeOutput(logOutput{Branch: logBranch, Commits: shown, Database: db})
 	}
 
 	// Retrieve the list of known licences
@@ -74,20 +171,53 @@ func branchLog(args []string) error {
 		licList[j.Sha256] = j.FullName
 	}
 
-	// Display the commits for the branch
-	headID := meta.Branches[logBranch].Commit
-	localCommit := meta.Commits[headID]
-	_, err = fmt.Fprintf(fOut, "Branch \"%s\" history for %s:\n\n", logBranch, db)
-	if err != nil {
-		return err
+	// Work out the text for each commit
+	refs := refsByCommit(meta)
+	text := func(c commitEntry) (string, error) {
+		switch {
+		case tmpl != nil:
+			var b strings.Builder
+			if err := tmpl.Execute(&b, c); err != nil {
+				return "", err
+			}
+			return b.String() + "\n", nil
+		case logOneline:
+			return onelineCommitText(c, refs[c.ID]), nil
+		case logGraph:
+			return formatCommitText(c, licList, refs[c.ID], "", ""), nil
+		}
+		return formatCommitText(c, licList, refs[c.ID], "  * ", "    "), nil
 	}
-	_, err = fmt.Fprint(fOut, createCommitText(meta.Commits[localCommit.ID], licList))
-	if err != nil {
+
+	// The header is only shown with the default text, so the other formats are easy to use from scripts
+	if tmpl == nil && !logOneline {
+		if logAll {
+			_, err = fmt.Fprintf(fOut, "History of all branches for %s:\n\n", db)
+		} else {
+			_, err = fmt.Fprintf(fOut, "Branch \"%s\" history for %s:\n\n", logBranch, db)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Display the commits
+	if logGraph {
+		var s string
+		s, err = commitGraph(history, visible, text)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprint(fOut, s)
 		return err
 	}
-	for localCommit.Parent != "" {
-		localCommit = meta.Commits[localCommit.Parent]
-		_, err = fmt.Fprintf(fOut, createCommitText(meta.Commits[localCommit.ID], licList))
+	for _, c := range shown {
+		var s string
+		s, err = text(c)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprint(fOut, s)
 		if err != nil {
 			return err
 		}
@@ -95,18 +225,248 @@ func branchLog(args []string) error {
 	return nil
 }
 
-// Creates the user visible commit text for a commit.
-func createCommitText(c commitEntry, licList map[string]string) string {
-	s := fmt.Sprintf("  * Commit: %s\n", c.ID)
-	s += fmt.Sprintf("    Author: %s <%s>\n", c.AuthorName, c.AuthorEmail)
-	s += fmt.Sprintf("    Date: %v\n", c.Timestamp.Local().Format(time.RFC1123))
+// Draws a text based graph of the commits, with the text for each visible commit beside it.  The commits need to be
+// ordered with children before their parents.  Hidden commits still take part in the graph, so the visible ones stay
+// in the right columns
+func commitGraph(commits []commitEntry, visible map[string]bool, text func(c commitEntry) (string, error)) (
+	string, error) {
+	var b strings.Builder
+	var lanes []string // The commit each column of the graph is heading towards
+	for _, c := range commits {
+		show := visible[c.ID]
+
+		// Find the column for the commit.  When several children lead to it, their columns join up here
+		col := -1
+		var joining []int
+		for i, id := range lanes {
+			if id != c.ID {
+				continue
+			}
+			if col == -1 {
+				col = i
+			} else {
+				joining = append(joining, i)
+			}
+		}
+		if col == -1 {
+			lanes = append(lanes, c.ID)
+			col = len(lanes) - 1
+		}
+		if len(joining) > 0 {
+			moves, remaining := make([]int, len(lanes)), lanes[:0:0]
+			for i, id := range lanes {
+				if i != col && id == c.ID {
+					moves[i] = col
+					continue
+				}
+				moves[i] = len(remaining)
+				remaining = append(remaining, id)
+			}
+			if show {
+				b.WriteString(graphMoves(moves, -1))
+			}
+			lanes = remaining
+		}
+
+		// Draw the commit, with any further lines of its text beside the columns carrying on below it
+		var parents []string
+		if c.Parent != "" {
+			parents = append(parents, c.Parent)
+		}
+		parents = append(parents, c.OtherParents...)
+		if show {
+			s, err := text(c)
+			if err != nil {
+				return "", err
+			}
+			lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+			row, cont := make([]string, len(lanes)), make([]string, len(lanes))
+			for i := range lanes {
+				row[i], cont[i] = "|", "|"
+			}
+			row[col] = "*"
+			if len(parents) == 0 {
+				cont[col] = " "
+			}
+			for i, l := range lines {
+				prefix := strings.Join(cont, " ")
+				if i == 0 {
+					prefix = strings.Join(row, " ")
+				}
+				b.WriteString(strings.TrimRight(prefix+" "+l, " ") + "\n")
+			}
+		}
+
+		// The column carries on to the first parent, with new columns opening to the right for any other parents
+		moves := make([]int, len(lanes))
+		switch len(parents) {
+		case 0:
+			for i := range lanes {
+				moves[i] = i
+				if i > col {
+					moves[i] = i - 1
+				}
+			}
+			lanes = append(lanes[:col], lanes[col+1:]...)
+			if show && col < len(moves)-1 {
+				b.WriteString(graphMoves(moves, -1))
+			}
+		default:
+			extra := len(parents) - 1
+			for i := range lanes {
+				moves[i] = i
+				if i > col {
+					moves[i] = i + extra
+				}
+			}
+			newLanes := append([]string{}, lanes[:col]...)
+			newLanes = append(newLanes, parents...)
+			lanes = append(newLanes, lanes[col+1:]...)
+			if show && extra > 0 {
+				b.WriteString(graphMoves(moves, col))
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// Returns a row of the graph showing columns moving to new positions, where moves holds the new position of each
+// column.  When opened isn't -1, a new column is shown splitting off to the right of that one
+func graphMoves(moves []int, opened int) string {
+	row := []byte(strings.Repeat(" ", 2*len(moves)+1))
+	for i, j := range moves {
+		switch {
+		case j == i:
+			row[2*i] = '|'
+		case j < i:
+			row[2*i-1] = '/'
+		default:
+			row[2*i+1] = '\\'
+		}
+	}
+	if opened != -1 {
+		row[2*opened+1] = '\\'
+	}
+	return strings.TrimRight(string(row), " ") + "\n"
+}
+
+// Creates the multi-line text for a commit, with the first line starting with bullet and the others indented.  Any
+// tags or releases pointing at the commit are listed too
+func formatCommitText(c commitEntry, licList map[string]string, refs *commitRefs, bullet string,
+	indent string) string {
+	s := fmt.Sprintf("%sCommit: %s\n", bullet, c.ID)
+	s += fmt.Sprintf("%sAuthor: %s <%s>\n", indent, c.AuthorName, c.AuthorEmail)
+	s += fmt.Sprintf("%sDate: %v\n", indent, c.Timestamp.Local().Format(time.RFC1123))
+	if refs != nil && len(refs.tags) > 0 {
+		s += fmt.Sprintf("%sTags: %s\n", indent, strings.Join(refs.tags, ", "))
+	}
+	if refs != nil && len(refs.releases) > 0 {
+		s += fmt.Sprintf("%sReleases: %s\n", indent, strings.Join(refs.releases, ", "))
+	}
 	if c.Tree.Entries[0].LicenceSHA != "" {
-		s += fmt.Sprintf("    Licence: %s\n\n", licList[c.Tree.Entries[0].LicenceSHA])
+		s += fmt.Sprintf("%sLicence: %s\n\n", indent, licList[c.Tree.Entries[0].LicenceSHA])
 	} else {
 		s += fmt.Sprintf("\n")
 	}
 	if c.Message != "" {
-		s += fmt.Sprintf("      %s\n\n", c.Message)
+		s += fmt.Sprintf("%s  %s\n\n", indent, c.Message)
 	}
 	return s
 }
+
+// Creates the single line text for a commit.  eg "0123abcd (tag: v1) Some message"
+func onelineCommitText(c commitEntry, refs *commitRefs) string {
+	s := shortID(c.ID)
+	if refs != nil {
+		var names []string
+		for _, t := range refs.tags {
+			names = append(names, "tag: "+t)
+		}
+		for _, r := range refs.releases {
+			names = append(names, "release: "+r)
+		}
+		s += " (" + strings.Join(names, ", ") + ")"
+	}
+	msg := strings.SplitN(c.Message, "\n", 2)[0]
+	return strings.TrimRight(s+" "+msg, " ") + "\n"
+}
+
+// Returns the tags and releases of a database, grouped by the commit they point at
+func refsByCommit(meta metaData) map[string]*commitRefs {
+	refs := make(map[string]*commitRefs)
+	get := func(id string) *commitRefs {
+		if refs[id] == nil {
+			refs[id] = &commitRefs{}
+		}
+		return refs[id]
+	}
+	for name, t := range meta.Tags {
+		r := get(t.Commit)
+		r.tags = append(r.tags, name)
+	}
+	for name, rel := range meta.Releases {
+		r := get(rel.Commit)
+		r.releases = append(r.releases, name)
+	}
+	for _, r := range refs {
+		sort.Strings(r.tags)
+		sort.Strings(r.releases)
+	}
+	return refs
+}
+
+// Creates the filter for the commits to show, from the command line options
+func newLogFilter() (f logFilter, err error) {
+	if logAuthor != "" {
+		f.author, err = regexp.Compile(logAuthor)
+		if err != nil {
+			return f, fmt.Errorf("Invalid --author pattern: %v", err)
+		}
+	}
+	if logGrep != "" {
+		f.grep, err = regexp.Compile(logGrep)
+		if err != nil {
+			return f, fmt.Errorf("Invalid --grep pattern: %v", err)
+		}
+	}
+	if f.since, err = parseLogDate("since", logSince); err != nil {
+		return
+	}
+	f.until, err = parseLogDate("until", logUntil)
+	return
+}
+
+// Returns true if a commit meets the conditions of the filter
+func (f logFilter) matches(c commitEntry) bool {
+	if f.author != nil && !f.author.MatchString(fmt.Sprintf("%s <%s>", c.AuthorName, c.AuthorEmail)) {
+		return false
+	}
+	if f.grep != nil && !f.grep.MatchString(c.Message) {
+		return false
+	}
+	if !f.since.IsZero() && c.Timestamp.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && c.Timestamp.After(f.until) {
+		return false
+	}
+	return true
+}
+
+// Parses a date given to one of the log date options.  Dates without a time are taken to be the start of that day, in
+// local time
+func parseLogDate(option string, value string) (t time.Time, err error) {
+	if value == "" {
+		return
+	}
+	t, err = time.Parse(time.RFC3339, value)
+	if err == nil {
+		return
+	}
+	t, err = time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		err = fmt.Errorf("Invalid --%s date '%s'.  Use a date like 2006-01-02 or 2006-01-02T15:04:05Z", option,
+			value)
+	}
+	return
+}
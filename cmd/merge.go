@@ -0,0 +1,506 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/sqlitebrowser/dio/repo"
+)
+
+var (
+	mergeCmdAuthEmail, mergeCmdAuthName, mergeCmdFrom, mergeCmdInto string
+	mergeCmdMsg, mergeCmdStrategy, mergeCmdTimestamp                string
+	mergeCmdAbort, mergeCmdForce                                    *bool
+)
+
+// Merges the commits from one branch into another
+var mergeCmd = &cobra.Command{
+	Use:   "merge [database name] --from xxx",
+	Short: "Merge the changes from one branch into another",
+	Long: `Merge the changes from one branch into another.
+
+If the target branch hasn't changed since the branches diverged, it is simply
+fast-forwarded to the head of the source branch.  Otherwise a merge commit is
+created with both branch heads as its parents.
+
+With the (default) "rows" strategy, the changes made on each branch since they
+diverged are merged at the row level, matching rows by their primary key.  If
+both branches changed the same row (or table structure) in different ways, the
+conflicts are written to a report and the merge is committed by 'dio commit'
+once they've been resolved.
+
+Tables without a primary key have their rows matched by rowid.  When both
+branches add rows to such a table, the new rows usually get the same rowids on
+each side, so they're reported as conflicts rather than both being kept.
+
+With the "file" strategy, the database file in the working directory is used
+as the merged content as-is.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return merge(args)
+	},
+	Annotations: locksDatabases,
+}
+
+func init() {
+	RootCmd.AddCommand(mergeCmd)
+	mergeCmdAbort = mergeCmd.Flags().Bool("abort", false,
+		"Abandon a merge waiting on conflicts to be resolved, restoring the database to its previous state")
+	mergeCmd.Flags().StringVar(&mergeCmdAuthEmail, "email", "", "Email address of the merge commit author")
+	mergeCmdForce = mergeCmd.Flags().BoolP("force", "f", false,
+		"Overwrite unsaved changes to the database when fast-forwarding?")
+	mergeCmd.Flags().StringVar(&mergeCmdFrom, "from", "", "Name of the branch to merge changes from")
+	mergeCmd.Flags().StringVar(&mergeCmdInto, "into", "",
+		"Name of the branch to merge changes into.  Defaults to the active branch")
+	mergeCmd.Flags().StringVar(&mergeCmdMsg, "message", "", "Commit message for the merge commit")
+	mergeCmd.Flags().StringVar(&mergeCmdAuthName, "name", "", "Name of the merge commit author")
+	mergeCmd.Flags().StringVar(&mergeCmdStrategy, "strategy", "rows",
+		"How to merge diverged branches.  Either rows or file")
+	mergeCmd.Flags().StringVar(&mergeCmdTimestamp, "timestamp", "", "Timestamp for the merge commit")
+}
+
+func merge(args []string) error {
+	// Ensure a database file was given
+	var db string
+	var err error
+	var meta metaData
+	if len(args) == 0 {
+		db, err = getDefaultDatabase()
+		if err != nil {
+			return err
+		}
+		if db == "" {
+			// No database name was given on the command line, and we don't have a default database selected
+			return errors.New("No database file specified")
+		}
+	} else {
+		db = args[0]
+	}
+	if len(args) > 1 {
+		return errors.New("Only one database can be changed at a time (for now)")
+	}
+
+	// If requested, abandon a merge waiting on conflicts to be resolved
+	if *mergeCmdAbort {
+		return mergeAbort(db)
+	}
+
+	// Don't start a new merge while another is still waiting to be committed
+	if _, pending, err := loadMergeState(db); err != nil {
+		return err
+	} else if pending {
+		return errors.New("A merge is waiting on conflicts to be resolved.  Commit the resolved database, or " +
+			"use --abort to abandon it")
+	}
+
+	// Ensure the name of the branch to merge from was given
+	if mergeCmdFrom == "" {
+		return errors.New("No branch name to merge from given")
+	}
+
+	// Load the metadata.  Only the commits needed for the merge are read from the local store, as they're all that's
+	// looked at
+	r := localRepo()
+	meta, err = r.LoadHeads(db)
+	if err != nil {
+		return err
+	}
+
+	// If no target branch name was passed, use the active branch
+	into := mergeCmdInto
+	if into == "" {
+		into = meta.ActiveBranch
+	}
+	if into == mergeCmdFrom {
+		return errors.New("Can't merge a branch into itself")
+	}
+	if mergeCmdStrategy != "rows" && mergeCmdStrategy != "file" {
+		return fmt.Errorf("Unknown merge strategy '%s'.  Either rows or file can be used", mergeCmdStrategy)
+	}
+
+	// Make sure both branches exist
+	fromBranch, ok := meta.Branches[mergeCmdFrom]
+	if !ok {
+		return fmt.Errorf("That branch ('%s') doesn't exist", mergeCmdFrom)
+	}
+	intoBranch, ok := meta.Branches[into]
+	if !ok {
+		return fmt.Errorf("That branch ('%s') doesn't exist", into)
+	}
+	meta.Commits, err = r.LoadCommits(db, fromBranch.Commit, intoBranch.Commit)
+	if err != nil {
+		return err
+	}
+	if _, ok = meta.Commits[fromBranch.Commit]; !ok {
+		return errors.New("Something has gone wrong.  Head commit for the branch isn't in the commit list")
+	}
+	if _, ok = meta.Commits[intoBranch.Commit]; !ok {
+		return errors.New("Something has gone wrong.  Head commit for the branch isn't in the commit list")
+	}
+
+	// If the source branch head is already part of the target branch, there's nothing to do
+	contained, err := r.IsAncestor(db, fromBranch.Commit, intoBranch.Commit)
+	if err != nil {
+		return err
+	}
+	if contained {
+		_, err = fmt.Fprintf(fOut, "Branch '%s' already contains all commits from '%s'.  Nothing to merge.\n",
+			into, mergeCmdFrom)
+		return err
+	}
+
+	// Find the commit where the branches diverged
+	base, err := r.MergeBase(db, intoBranch.Commit, fromBranch.Commit)
+	if err != nil {
+		return err
+	}
+	if base == "" {
+		return fmt.Errorf("Branches '%s' and '%s' don't have a common ancestor.  Aborting.", mergeCmdFrom,
+			into)
+	}
+	baseCommits, err := r.LoadCommits(db, base)
+	if err != nil {
+		return err
+	}
+	meta.Commits[base] = baseCommits[base]
+
+	// If the target branch hasn't changed since the branches diverged, we can just fast-forward it
+	if base == intoBranch.Commit {
+		return mergeFastForward(db, meta, into, fromBranch)
+	}
+
+	// * To get here, both branches have changed since they diverged, so a merge commit is needed *
+
+	// The working database file holds the content of the active branch, so it can only be used as the merge result
+	// for that branch
+	if into != meta.ActiveBranch {
+		return fmt.Errorf("The database file in the working directory is for branch '%s'.  Switch to branch "+
+			"'%s' before merging into it", meta.ActiveBranch, into)
+	}
+	if _, err = os.Stat(db); err != nil {
+		return err
+	}
+
+	// Merge the changes from both branches at the row level, writing the result to the working database file
+	if mergeCmdStrategy == "rows" {
+		var merged bool
+		merged, err = mergeRows(db, meta, base, into, mergeCmdFrom)
+		if err != nil || !merged {
+			return err
+		}
+	}
+
+	// Grab author name & email from the dio config file, but allow command line flags to override them
+	var authorName, authorEmail, committerName, committerEmail string
+	if z, ok := viper.Get("user.name").(string); ok {
+		authorName = z
+		committerName = z
+	}
+	if z, ok := viper.Get("user.email").(string); ok {
+		authorEmail = z
+		committerEmail = z
+	}
+	if mergeCmdAuthName != "" {
+		authorName = mergeCmdAuthName
+	}
+	if mergeCmdAuthEmail != "" {
+		authorEmail = mergeCmdAuthEmail
+	}
+
+	// Author name and email are required
+	if authorName == "" || authorEmail == "" || committerName == "" || committerEmail == "" {
+		return errors.New("Author and committer name and email addresses are required!")
+	}
+
+	// If a timestamp was provided, make sure it parses ok
+	commitTime := time.Now()
+	if mergeCmdTimestamp != "" {
+		commitTime, err = time.Parse(time.RFC3339, mergeCmdTimestamp)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Generate a commit message if none was provided
+	msg := mergeCmdMsg
+	if msg == "" {
+		msg = fmt.Sprintf("Merge branch '%s' into '%s'", mergeCmdFrom, into)
+	}
+
+	// The merge commit keeps the licence of the target branch
+	intoHead := meta.Commits[intoBranch.Commit]
+	e, err := localRepo().TreeEntryFromFile(db, intoHead.Tree.Entries[0].LicenceSHA)
+	if err != nil {
+		return err
+	}
+	var t dbTree
+	t.Entries = append(t.Entries, e)
+	t.ID = repo.CreateDBTreeID(t.Entries)
+
+	// Create the merge commit, with the head of the target branch as its first parent
+	newCom := commitEntry{
+		AuthorName:     authorName,
+		AuthorEmail:    authorEmail,
+		CommitterName:  committerName,
+		CommitterEmail: committerEmail,
+		Message:        msg,
+		OtherParents:   []string{fromBranch.Commit},
+		Parent:         intoBranch.Commit,
+		Timestamp:      commitTime.UTC(),
+		Tree:           t,
+	}
+	newCom.ID = repo.CreateCommitID(newCom)
+	meta.Commits[newCom.ID] = newCom
+	meta.Branches[into] = branchEntry{
+		Commit:      newCom.ID,
+		CommitCount: intoBranch.CommitCount + 1,
+		Description: intoBranch.Description,
+	}
+
+	// If the database file isn't already in the local cache, then copy it there
+	f, err := os.Open(db)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = localRepo().SaveDB(db, e.Sha256, f)
+	if err != nil {
+		return err
+	}
+
+	// Save the updated metadata back to disk
+	err = localRepo().SaveMetadata(db, meta, "merge")
+	if err != nil {
+		return err
+	}
+
+	// Display results to the user
+	_, err = fmt.Fprintf(fOut, "Merged branch '%s' into '%s'\n", mergeCmdFrom, into)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "  * Commit ID: %s\n", newCom.ID)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "    Parents: %s, %s\n", newCom.Parent, fromBranch.Commit)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "    Common ancestor: %s\n\n", base)
+	return err
+}
+
+// Moves the head of the target branch forward to the head of the source branch
+func mergeFastForward(db string, meta metaData, into string, fromBranch branchEntry) (err error) {
+	// If the target branch is the active one, then the working database file needs updating too
+	if into == meta.ActiveBranch {
+		// Unless --force is specified, check whether the file has changed since the last commit
+		if *mergeCmdForce == false {
+			changed, err := localRepo().Changed(db, meta)
+			if err != nil {
+				return err
+			}
+			if changed {
+				_, err = fmt.Fprintf(fOut, "%s has been changed since the last commit.  Use --force if you "+
+					"really want to overwrite it\n", db)
+				return err
+			}
+		}
+
+		// Make sure the database for the new branch head is in the local cache, then copy it into place
+		c := meta.Commits[fromBranch.Commit]
+		err = checkDBCache(db, c.ID, c.Tree.Entries[0].Sha256)
+		if err != nil {
+			return
+		}
+		err = localRepo().RestoreDB(db, c.Tree.Entries[0].Sha256, c.Tree.Entries[0].LastModified)
+		if err != nil {
+			return
+		}
+	}
+
+	// Update the branch head
+	old := meta.Branches[into]
+	meta.Branches[into] = branchEntry{
+		Commit:      fromBranch.Commit,
+		CommitCount: fromBranch.CommitCount,
+		Description: old.Description,
+	}
+
+	// Save the updated metadata back to disk
+	err = localRepo().SaveMetadata(db, meta, "merge")
+	if err != nil {
+		return
+	}
+
+	_, err = fmt.Fprintf(fOut, "Branch '%s' fast-forwarded to commit %s\n", into, fromBranch.Commit)
+	return
+}
+
+// Abandons a merge which is waiting on conflicts to be resolved, restoring the working database file from the head of
+// the target branch
+func mergeAbort(db string) (err error) {
+	state, pending, err := loadMergeState(db)
+	if err != nil {
+		return
+	}
+	if !pending {
+		return errors.New("There's no merge in progress to abort")
+	}
+	commits, err := localRepo().LoadCommits(db, state.IntoCommit)
+	if err != nil {
+		return
+	}
+	c, ok := commits[state.IntoCommit]
+	if !ok {
+		return errors.New("Something has gone wrong.  Head commit for the branch isn't in the commit list")
+	}
+	err = localRepo().RestoreDB(db, c.Tree.Entries[0].Sha256, c.Tree.Entries[0].LastModified)
+	if err != nil {
+		return
+	}
+	err = removeMergeState(db)
+	if err != nil {
+		return
+	}
+	_, err = fmt.Fprintf(fOut, "Merge of branch '%s' into '%s' aborted\n", state.From, state.Into)
+	return
+}
+
+// Merges the changes made on two branches at the row level, writing the result to the working database file.  Returns
+// true if the merge completed without conflicts.  Otherwise the conflicts are written to a report, and the merge is
+// saved as pending so the next commit can complete it
+func mergeRows(db string, meta metaData, base string, into string, from string) (merged bool, err error) {
+	// Unless --force is specified, check whether the file has changed since the last commit, as it will be overwritten
+	if *mergeCmdForce == false {
+		changed, err := localRepo().Changed(db, meta)
+		if err != nil {
+			return false, err
+		}
+		if changed {
+			return false, fmt.Errorf("%s has been changed since the last commit.  Commit the changes first, or "+
+				"use --force if you really want to overwrite them", db)
+		}
+	}
+
+	// Make sure the database for each of the base commit and the two branch heads is in the local cache
+	intoCommit := meta.Branches[into].Commit
+	fromCommit := meta.Branches[from].Commit
+	var paths []string
+	for _, id := range []string{base, intoCommit, fromCommit} {
+		shaSum := meta.Commits[id].Tree.Entries[0].Sha256
+		err = checkDBCache(db, id, shaSum)
+		if err != nil {
+			return
+		}
+		paths = append(paths, localRepo().CachePath(db, shaSum))
+	}
+
+	// Apply their changes to a copy of our version of the database
+	tmpFile := filepath.Join(".dio", db, "merge.tmp")
+	err = repo.CopyFile(paths[1], tmpFile)
+	if err != nil {
+		return
+	}
+	conflicts, stats, err := mergeDatabases(paths[0], paths[1], paths[2], tmpFile)
+	if err != nil {
+		_ = os.Remove(tmpFile)
+		return
+	}
+
+	// Move the merged database into the working directory
+	err = os.Rename(tmpFile, db)
+	if err != nil {
+		return
+	}
+	_, err = numFormat.Fprintf(fOut, "Merged changes from branch '%s': %d row(s) inserted, %d updated, %d deleted, "+
+		"%d schema change(s)\n", from, stats.Inserted, stats.Updated, stats.Deleted, stats.Schema)
+	if err != nil {
+		return
+	}
+	if len(conflicts) == 0 {
+		return true, nil
+	}
+
+	// * There are conflicts, so write them to a report for the user to resolve *
+	j, err := json.MarshalIndent(conflicts, "", "  ")
+	if err != nil {
+		return
+	}
+	report := filepath.Join(".dio", db, "conflicts.json")
+	err = ioutil.WriteFile(report, j, 0644)
+	if err != nil {
+		return
+	}
+	err = saveMergeState(db, mergeState{
+		Base:       base,
+		From:       from,
+		FromCommit: fromCommit,
+		Into:       into,
+		IntoCommit: intoCommit,
+	})
+	if err != nil {
+		return
+	}
+	_, err = fmt.Fprintf(fOut, "\n%d conflict(s) need resolving:\n\n", len(conflicts))
+	if err != nil {
+		return
+	}
+	for _, c := range conflicts {
+		if c.Kind == "row" {
+			_, err = fmt.Fprintf(fOut, "  * %s: row %s\n", c.Object, c.Key)
+		} else {
+			_, err = fmt.Fprintf(fOut, "  * %s: structure\n", c.Object)
+		}
+		if err != nil {
+			return
+		}
+	}
+	_, err = fmt.Fprintf(fOut, "\nThe details are in %s.  Fix the conflicts in %s, remove the report, then run "+
+		"'dio commit' to complete the merge.\n", report, db)
+	return
+}
+
+// Loads the details of a merge waiting to be committed, if there is one
+func loadMergeState(db string) (state mergeState, pending bool, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(".dio", db, "merge.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, false, nil
+		}
+		return
+	}
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return
+	}
+	return state, true, nil
+}
+
+// Removes the details of a pending merge, along with its conflict report
+func removeMergeState(db string) (err error) {
+	for _, f := range []string{"merge.json", "conflicts.json"} {
+		err = os.Remove(filepath.Join(".dio", db, f))
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+	return nil
+}
+
+// Saves the details of a merge waiting to be committed
+func saveMergeState(db string, state mergeState) (err error) {
+	j, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return
+	}
+	err = repo.WriteFileAtomic(filepath.Join(".dio", db, "merge.json"), j, 0644)
+	return
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The formats the read commands can display their results in
+const (
+	outputJSON = "json"
+	outputText = "text"
+	outputYAML = "yaml"
+)
+
+// The format chosen with the global --output flag
+var outputFormat = outputText
+
+// Ensures the chosen output format is one we know about
+func checkOutputFormat() error {
+	switch outputFormat {
+	case outputJSON, outputText, outputYAML:
+		return nil
+	}
+	return fmt.Errorf("Unknown output format '%s'.  It needs to be one of text, json, or yaml", outputFormat)
+}
+
+// Returns true if results should be written in a machine readable format, rather than as text for people
+func structuredOutput() bool {
+	return outputFormat != outputText
+}
+
+// Writes a result in the chosen machine readable format.  Both formats use the field names from the JSON struct tags,
+// so they stay the same no matter which one is picked
+func writeOutput(v interface{}) (err error) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return
+	}
+	if outputFormat == outputYAML {
+		// Going via JSON means the YAML keys match the JSON ones, instead of the yaml package's lower cased field names
+		var generic interface{}
+		err = json.Unmarshal(b, &generic)
+		if err != nil {
+			return
+		}
+		b, err = yaml.Marshal(generic)
+		if err != nil {
+			return
+		}
+		_, err = fOut.Write(b)
+		return
+	}
+	_, err = fmt.Fprintf(fOut, "%s\n", b)
+	return
+}
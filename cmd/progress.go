@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// How often the progress display is redrawn
+const progressInterval = 200 * time.Millisecond
+
+// Displays the progress of a transfer, as the data passes through it.  Nothing is displayed unless the output is a
+// terminal, so redirected output and the tests don't fill up with progress lines
+type progressWriter struct {
+	done     int64 // Bytes transferred so far, including any from before this transfer (eg when resuming)
+	enabled  bool
+	label    string
+	lastDraw time.Time
+	out      io.Writer
+	start    time.Time
+	startAt  int64 // Bytes already transferred before this transfer started, so they don't count towards the rate
+	total    int64 // The expected size in bytes, or -1 if unknown
+}
+
+// Creates a progress display for a transfer
+func newProgressWriter(label string, done int64, total int64) *progressWriter {
+	return &progressWriter{
+		done:    done,
+		enabled: isTerminal(fOut),
+		label:   label,
+		out:     fOut,
+		start:   time.Now(),
+		startAt: done,
+		total:   total,
+	}
+}
+
+// Records the transfer of more data, redrawing the display if it's been long enough since the last time
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if p.enabled && time.Since(p.lastDraw) >= progressInterval {
+		p.draw()
+	}
+	return len(b), nil
+}
+
+// Draws the final state of the display, and moves to the next line
+func (p *progressWriter) finish() {
+	if !p.enabled {
+		return
+	}
+	p.draw()
+	_, _ = fmt.Fprintln(p.out)
+}
+
+// Draws the progress display over the top of the previous one
+func (p *progressWriter) draw() {
+	p.lastDraw = time.Now()
+	elapsed := time.Since(p.start).Seconds()
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(p.done-p.startAt) / elapsed
+	}
+	line := fmt.Sprintf("%s: %s", p.label, byteSize(p.done))
+	if p.total > 0 {
+		pct := float64(p.done) / float64(p.total)
+		if pct > 1 {
+			pct = 1
+		}
+		bar := strings.Repeat("#", int(pct*20)) + strings.Repeat(".", 20-int(pct*20))
+		line = fmt.Sprintf("%s: [%s] %3.0f%% %s of %s", p.label, bar, pct*100, byteSize(p.done), byteSize(p.total))
+	}
+	line += fmt.Sprintf(", %s/s", byteSize(int64(rate)))
+	if p.total > 0 && rate > 0 && p.done < p.total {
+		eta := time.Duration(float64(p.total-p.done)/rate) * time.Second
+		line += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+	}
+	_, _ = fmt.Fprintf(p.out, "\r%-79s", line)
+}
+
+// Returns a size in bytes in human friendly form.  eg 12.3 MB
+func byteSize(b int64) string {
+	const unit = 1000
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit && exp < 4; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "kMGTP"[exp])
+}
+
+// Returns true if the given output goes to a terminal
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
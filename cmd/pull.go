@@ -1,65 +1,61 @@
 package cmd
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/sqlitebrowser/dio/repo"
 )
 
 var (
 	pullCmdBranch, pullCmdCommit string
-	pullForce                    *bool
+	pullCmdAll, pullForce        *bool
 )
 
 // Downloads a database from DBHub.io.
 var pullCmd = &cobra.Command{
-	Use:   "pull [database name]",
+	Use:   "pull [database name...]",
 	Short: "Download a database from DBHub.io",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return pull(args)
 	},
+	Annotations: locksDatabases,
 }
 
 func init() {
 	RootCmd.AddCommand(pullCmd)
+	pullCmdAll = pullCmd.Flags().Bool("all", false, "Pull every database tracked in the current directory")
 	pullCmd.Flags().StringVar(&pullCmdBranch, "branch", "",
 		"Remote branch the database will be downloaded from")
 	pullCmd.Flags().StringVar(&pullCmdCommit, "commit", "",
-		"Commit ID of the database to download")
+		"Revision (eg commit ID, tag, or main~2) of the database to download")
 	pullForce = pullCmd.Flags().BoolP("force", "f", false,
 		"Overwrite unsaved changes to the database?")
+	addVerifyFlag(pullCmd)
 }
 
 func pull(args []string) error {
 	// Ensure a database file was given
-	var db, defDB string
-	var err error
-	if len(args) == 0 {
-		db, err = getDefaultDatabase()
-		if err != nil {
-			return err
-		}
-		if db == "" {
-			// No database name was given on the command line, and we don't have a default database selected
-			return errors.New("No database file specified")
-		}
-	} else {
-		db = args[0]
+	dbs, err := dbsFromArgs(args, *pullCmdAll)
+	if err != nil {
+		return err
 	}
-
-	// TODO: Allow giving multiple database files on the command line.  Hopefully just needs turning this
-	// TODO  into a for loop
-	if len(args) > 1 {
-		return errors.New("Only one database can be downloaded at a time (for now)")
+	if len(dbs) > 1 && pullCmdCommit != "" {
+		return errors.New("A commit ID can't be given when pulling more than one database")
 	}
+	branch := pullCmdBranch
+	return forEachDatabase(dbs, pullDB, func() {
+		pullCmdBranch = branch
+	})
+}
+
+// Downloads a database from DBHub.io
+func pullDB(db string) (err error) {
+	var defDB string
 
 	// TODO: Add a --licence option, for automatically grabbing the licence as well
 	//       * Probably save it as <database name>-<license short name>.txt/html
@@ -71,7 +67,7 @@ func pull(args []string) error {
 
 	// Retrieve metadata for the database
 	var meta metaData
-	meta, err = updateMetadata(db, false) // Don't store the metadata to disk yet, in case the download fails
+	meta, err = updateMetadata(db, "", true) // Don't store the metadata to disk yet, in case the download fails
 	if err != nil {
 		return err
 	}
@@ -80,7 +76,7 @@ func pull(args []string) error {
 	// the user know.  The --force option on the command line overrides this
 	if _, err = os.Stat(db); err == nil {
 		if *pullForce == false {
-			changed, err := dbChanged(db, meta)
+			changed, err := localRepo().Changed(db, meta)
 			if err != nil {
 				return err
 			}
@@ -108,9 +104,28 @@ func pull(args []string) error {
 	var lastMod time.Time
 	var ok bool
 	var thisSha string
+	var commitID string
 	var thisCommit commitEntry
 	if pullCmdCommit != "" {
-		thisCommit, ok = meta.Commits[pullCmdCommit]
+		// The updated metadata only holds the commits new from the server, but a revision can refer to any commit in
+		// the history, so the stored commits are added for working it out
+		full := meta
+		if localRepo().HasMetadata(db) {
+			var stored metaData
+			stored, err = localRepo().LoadMetadata(db)
+			if err != nil {
+				return err
+			}
+			full.Commits = stored.Commits
+			for id, c := range meta.Commits {
+				full.Commits[id] = c
+			}
+		}
+		commitID, err = repo.ResolveRevision(full, pullCmdCommit)
+		if err != nil {
+			return err
+		}
+		thisCommit, ok = full.Commits[commitID]
 		if ok == false {
 			return errors.New("The requested commit doesn't exist")
 		}
@@ -119,7 +134,10 @@ func pull(args []string) error {
 	} else {
 		// Determine the sha256 of the database file
 		c := meta.Branches[pullCmdBranch].Commit
-		thisCommit, ok = meta.Commits[c]
+		thisCommit, ok, err = localRepo().FindCommit(db, meta, c)
+		if err != nil {
+			return err
+		}
 		if ok == false {
 			return errors.New("The requested commit doesn't exist")
 		}
@@ -129,18 +147,9 @@ func pull(args []string) error {
 
 	// Check if the database file already exists in local cache
 	if thisSha != "" {
-		if _, err = os.Stat(filepath.Join(".dio", db, "db", thisSha)); err == nil {
+		if localRepo().HasCached(db, thisSha) {
 			// The database is already in the local cache, so use that instead of downloading from DBHub.io
-			var b []byte
-			b, err = ioutil.ReadFile(filepath.Join(".dio", db, "db", thisSha))
-			if err != nil {
-				return err
-			}
-			err = ioutil.WriteFile(db, b, 0644)
-			if err != nil {
-				return err
-			}
-			err = os.Chtimes(db, time.Now(), lastMod)
+			err = localRepo().RestoreDB(db, thisSha, lastMod)
 			if err != nil {
 				return err
 			}
@@ -155,33 +164,26 @@ func pull(args []string) error {
 					return err
 				}
 			}
-			if pullCmdCommit != "" {
-				_, err = fmt.Fprintf(fOut, "  * Commit: %s\n", pullCmdCommit)
+			if commitID != "" {
+				_, err = fmt.Fprintf(fOut, "  * Commit: %s\n", commitID)
 				if err != nil {
 					return err
 				}
 			}
-			_, err = numFormat.Fprintf(fOut, "  * Size: %d bytes\n", len(b))
+			_, err = numFormat.Fprintf(fOut, "  * Size: %d bytes\n", thisCommit.Tree.Entries[0].Size)
 			if err != nil {
 				return err
 			}
 
-			// Update the branch metadata with the commit info
+			// Update the branch metadata with the commit info.  The commit count is filled in when it's saved
 			var oldBranch branchEntry
 			if pullCmdBranch == "" {
 				oldBranch = meta.Branches[meta.ActiveBranch]
 			} else {
 				oldBranch = meta.Branches[pullCmdBranch]
 			}
-			commitCount := 1
-			z := meta.Commits[thisCommit.ID]
-			for z.Parent != "" {
-				commitCount++
-				z = meta.Commits[z.Parent]
-			}
 			newBranch := branchEntry{
 				Commit:      thisCommit.ID,
-				CommitCount: commitCount,
 				Description: oldBranch.Description,
 			}
 			if pullCmdBranch == "" {
@@ -191,7 +193,7 @@ func pull(args []string) error {
 			}
 
 			// Save the updated metadata to disk
-			err = saveMetadata(db, meta)
+			err = localRepo().SaveMetadata(db, meta, "pull")
 			if err != nil {
 				return err
 			}
@@ -212,37 +214,18 @@ func pull(args []string) error {
 	}
 
 	// Download the database file
-	// TODO: Use a streaming download approach, so download progress can be shown.  Something like this should help:
-	//         https://stackoverflow.com/questions/22108519/how-do-i-read-a-streaming-response-body-using-golangs-net-http-package
 	_, err = fmt.Fprintf(fOut, "Downloading '%s' from %s...\n", db, cloud)
 	if err != nil {
 		return err
 	}
-	resp, body, err := retrieveDatabase(db, pullCmdBranch, pullCmdCommit)
+	resp, err := downloadToCache(db, pullCmdBranch, commitID, thisSha)
 	if err != nil {
 		return err
 	}
 
-	// Create the local database cache directory, if it doesn't yet exist
-	if _, err = os.Stat(filepath.Join(".dio", db, "db")); os.IsNotExist(err) {
-		err = os.MkdirAll(filepath.Join(".dio", db, "db"), 0770)
-		if err != nil {
-			return err
-		}
-	}
-
-	// Calculate the sha256 of the database file
-	s := sha256.Sum256(body)
-	shaSum := hex.EncodeToString(s[:])
-
-	// Write the database file to disk in the cache directory
-	err = ioutil.WriteFile(filepath.Join(".dio", db, "db", shaSum), body, 0644)
-	if err != nil {
-		return err
-	}
-
-	// Write the database file to disk again, this time in the working directory
-	err = ioutil.WriteFile(db, body, 0644)
+	// Copy the database file from the cache into the working directory
+	shaSum := thisSha
+	err = repo.CopyFile(localRepo().CachePath(db, shaSum), db)
 	if err != nil {
 		return err
 	}
@@ -268,13 +251,19 @@ func pull(args []string) error {
 		}
 	}
 
+	// The SHA256 of the new file is already known, so it won't need hashing the next time it's checked
+	err = localRepo().RecordStatIndex(db, shaSum)
+	if err != nil {
+		return err
+	}
+
 	// If the server provided a branch name, add it to the local metadata cache
 	if branch := resp.Header.Get("Branch"); branch != "" {
 		meta.ActiveBranch = branch
 	}
 
 	// The download succeeded, so save the updated metadata to disk
-	err = saveMetadata(db, meta)
+	err = localRepo().SaveMetadata(db, meta, "pull")
 	if err != nil {
 		return err
 	}
@@ -309,6 +298,6 @@ func pull(args []string) error {
 			return err
 		}
 	}
-	_, err = numFormat.Fprintf(fOut, "  * Size: %d bytes\n", len(body))
+	_, err = numFormat.Fprintf(fOut, "  * Size: %d bytes\n", thisCommit.Tree.Entries[0].Size)
 	return err
 }
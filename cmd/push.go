@@ -1,78 +1,84 @@
 package cmd
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
-	rq "github.com/parnurzeal/gorequest"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/sqlitebrowser/dio/client"
+	"github.com/sqlitebrowser/dio/repo"
 )
 
 var (
-	pushCmdBranch, pushCmdCommit, pushCmdDB  string
-	pushCmdEmail, pushCmdLicence, pushCmdMsg string
-	pushCmdName, pushCmdTimestamp            string
-	pushCmdForce, pushCmdPublic              bool
+	pushCmdBranch, pushCmdCommit, pushCmdDB string
+	pushCmdEmail, pushCmdForceLease         string
+	pushCmdLicence, pushCmdMsg              string
+	pushCmdName, pushCmdTimestamp           string
+	pushCmdAll, pushCmdForce                bool
+	pushCmdPublic, pushCmdTags              bool
 )
 
 // Uploads a database to DBHub.io.
 var pushCmd = &cobra.Command{
-	Use:   "push [database file]",
+	Use:   "push [database file...]",
 	Short: "Upload a database",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return push(args)
 	},
+	Annotations: locksDatabases,
 }
 
 func init() {
 	RootCmd.AddCommand(pushCmd)
+	pushCmd.Flags().BoolVar(&pushCmdAll, "all", false, "Push every database tracked in the current directory")
 	pushCmd.Flags().StringVar(&pushCmdName, "author", "", "Author name")
 	pushCmd.Flags().StringVar(&pushCmdBranch, "branch", "",
 		"Remote branch the database will be uploaded to")
 	pushCmd.Flags().StringVar(&pushCmdCommit, "commit", "",
-		"ID of the previous commit, for appending this new database to")
+		"Revision (eg commit ID, tag, or main~2) of the previous commit, for appending this new database to")
 	pushCmd.Flags().StringVar(&pushCmdDB, "dbname", "", "Override for the database name")
 	pushCmd.Flags().StringVar(&pushCmdEmail, "email", "", "Email address of the author")
 	pushCmd.Flags().BoolVar(&pushCmdForce, "force", false, "Overwrite existing commit history?")
+	pushCmd.Flags().StringVar(&pushCmdForceLease, "force-with-lease", "",
+		"Overwrite existing commit history, but only if the remote branch head is the given revision (eg commit ID)")
 	pushCmd.Flags().StringVar(&pushCmdLicence, "licence", "",
 		"The licence (ID) for the database, as per 'dio licence list'")
 	pushCmd.Flags().StringVar(&pushCmdMsg, "message", "",
 		"(Required) Commit message for this upload")
 	pushCmd.Flags().BoolVar(&pushCmdPublic, "public", false, "Should the database be public?")
+	pushCmd.Flags().BoolVar(&pushCmdTags, "tags", false,
+		"Send the tags and releases created and removed locally, instead of commits")
 	pushCmd.Flags().StringVar(&pushCmdTimestamp, "timestamp", "", "Timestamp to use as the commit date")
 }
 
 func push(args []string) error {
 	// Ensure a database file was given
-	var db string
-	var err error
-	if len(args) == 0 {
-		db, err = getDefaultDatabase()
-		if err != nil {
-			return err
-		}
-		if db == "" {
-			// No database name was given on the command line, and we don't have a default database selected
-			return errors.New("No database file specified")
-		}
-	} else {
-		db = args[0]
+	dbs, err := dbsFromArgs(args, pushCmdAll)
+	if err != nil {
+		return err
 	}
-	// TODO: Allow giving multiple database files on the command line.  Hopefully just needs turning this
-	// TODO  into a for loop
-	if len(args) > 1 {
-		return errors.New("Only one database can be uploaded at a time (for now)")
+	if len(dbs) > 1 && pushCmdDB != "" {
+		return errors.New("The --dbname option can't be used when pushing more than one database")
+	}
+	branch := pushCmdBranch
+	return forEachDatabase(dbs, pushDB, func() {
+		pushCmdBranch, pushCmdDB = branch, ""
+	})
+}
+
+// Uploads a database to DBHub.io
+func pushDB(db string) (err error) {
+	// If requested, send the tag and release changes instead of commits
+	if pushCmdTags {
+		return pushTagsAndReleases(db, true, true)
 	}
 
 	// Ensure the database file exists
@@ -114,8 +120,7 @@ func push(args []string) error {
 	// Then we go through a simple loop, uploading each outstanding commit to the remote server along with it's
 	// metadata (via appropriate http headers)
 	var meta metaData
-	dbURL := fmt.Sprintf("%s/%s/%s", cloud, certUser, db)
-	if _, err = os.Stat(filepath.Join(".dio", db, "metadata.json")); err == nil {
+	if localRepo().HasMetadata(db) {
 		// Load the local metadata cache, without retrieving updated metadata from the cloud
 		meta, err = localFetchMetadata(db, false)
 		if err != nil {
@@ -152,17 +157,33 @@ func push(args []string) error {
 		if err != nil {
 			return err
 		}
+
+		// DBHub.io can only move a branch on by sending it commits, so a forced push which would just move the
+		// remote branch back is refused before anything is changed on the server
+		if (pushCmdForce || pushCmdForceLease != "") && found {
+			if remote, ok := newMeta.Branches[pushCmdBranch]; ok && remote.Commit != localHead.Commit {
+				for id := remote.Commit; id != ""; id = newMeta.Commits[id].Parent {
+					if id == localHead.Commit {
+						return forceRewindError()
+					}
+				}
+			}
+		}
 		if !found {
 			// The database only exists locally, so we use the first commit to create the remote database,
 			// then loop around pushing the remaining commits
 			newCommit := meta.Commits[localCommitList[len(localCommitList)-1]].ID
-			err = sendCommit(meta, db, dbURL, newCommit, pushCmdPublic)
+			err = sendCommit(meta, db, newCommit, pushCmdPublic, false)
 			if err != nil {
 				return err
 			}
 
 			// If there was only a single commit to push, there's nothing more to do
 			if len(localCommitList) == 1 {
+				err = pushed(db, meta)
+				if err != nil {
+					return err
+				}
 				_, err = fmt.Fprintf(fOut, "Database uploaded to %s\n\n", cloud)
 				if err != nil {
 					return err
@@ -212,6 +233,22 @@ func push(args []string) error {
 
 		// * To get here, the database exists on the remote cloud and has local metadata *
 
+		// Apply any branch changes made locally to the server
+		opsSent, err := sendBranchOps(db, &meta, newMeta)
+		if err != nil {
+			return err
+		}
+
+		// Remember where the branches on the server are
+		err = setRemoteBranches(db, &meta, newMeta)
+		if err != nil {
+			return err
+		}
+		err = localRepo().SaveMetadata(db, meta, "push")
+		if err != nil {
+			return err
+		}
+
 		// Check the branch exists remotely
 		remoteHead, ok := newMeta.Branches[pushCmdBranch]
 		if !ok {
@@ -255,7 +292,11 @@ func push(args []string) error {
 
 			// Create the new (forked) branch on DBHub.io
 			newCommit := localCommitList[localCommitLength-baseBranchCounter]
-			err = sendCommit(meta, db, dbURL, newCommit, pushCmdPublic)
+			err = checkMergedParents(meta, newMeta, []string{newCommit})
+			if err != nil {
+				return err
+			}
+			err = sendCommit(meta, db, newCommit, pushCmdPublic, false)
 			if err != nil {
 				return err
 			}
@@ -281,6 +322,10 @@ func push(args []string) error {
 
 			// If this fork only had the one commit (eg no further commits to push), then finish here
 			if len(localCommitList) == forkCommitCtr {
+				err = pushed(db, meta)
+				if err != nil {
+					return err
+				}
 				_, err = fmt.Fprintf(fOut, "New branch '%s' created and all commits for it pushed to %s\n",
 					pushCmdBranch, cloud)
 				return err
@@ -313,9 +358,13 @@ func push(args []string) error {
 
 		// * Compare the local branch to the head of the remote branch, to determine which commits need sending *
 
+		// When forcing, the remote branch is rewritten to match the local one
+		if pushCmdForce || pushCmdForceLease != "" {
+			return forcePush(db, meta, newMeta, localCommitList, remoteCommitList, extraCtr)
+		}
+
 		// If there are more commits in the remote branch than in the local one, then the branches have diverged
-		// so abort (for now).
-		// TODO: Write the code to allow --force overwriting for this
+		// so abort
 		if remoteCommitLength > localCommitLength {
 			return fmt.Errorf("The remote branch has more commits than the local one.  Can't push the " +
 				"branch.  If you want to overwrite changes on the remote server, consider the --force option.")
@@ -323,6 +372,10 @@ func push(args []string) error {
 
 		// Check if the given branch is the same on the local and remote server.  If it is, nothing needs to be done
 		if remoteCommitLength == localCommitLength && remoteCommitList[0] == localCommitList[0] {
+			if opsSent > 0 {
+				_, err = fmt.Fprintf(fOut, "Branch '%s' already has all commits on %s\n", pushCmdBranch, cloud)
+				return err
+			}
 			return fmt.Errorf("The local and remote branch '%s' are identical.  Nothing to push.",
 				pushCmdBranch)
 		}
@@ -339,9 +392,7 @@ func push(args []string) error {
 				rCommit := remoteCommitList[remoteCommitLength-i]
 				if lCommit != rCommit {
 					// There are conflicting commits in this branch between the local metadata and the
-					// remote.  Abort (for now)
-					// TODO: Consider how to allow --force pushing here.  Also remember that when doing this, there
-					//       needs a check added for potentially isolated tags and releases, same as branch revert
+					// remote.  Abort, unless forcing
 					e := fmt.Sprintf("The local and remote branch have conflicting commits.\n\n")
 					e = fmt.Sprintf("%s  * local commit: %s\n", e, lCommit)
 					e = fmt.Sprintf("%s  * remote commit: %s\n\n", e, rCommit)
@@ -352,6 +403,12 @@ func push(args []string) error {
 			}
 		}
 
+		// Commits merged in from other branches need to be on the server already
+		err = checkMergedParents(meta, newMeta, pushCommits)
+		if err != nil {
+			return err
+		}
+
 		// Display useful info message to the user
 		numCommits := len(pushCommits) + extraCtr
 		if numCommits == 1 {
@@ -372,11 +429,15 @@ func push(args []string) error {
 
 		// Send the commits to the cloud
 		for _, commitID := range pushCommits {
-			err = sendCommit(meta, db, dbURL, commitID, pushCmdPublic)
+			err = sendCommit(meta, db, commitID, pushCmdPublic, false)
 			if err != nil {
 				return err
 			}
 		}
+		err = pushed(db, meta)
+		if err != nil {
+			return err
+		}
 		_, err = fmt.Fprintln(fOut, "All commits pushed.")
 		return err
 	}
@@ -396,42 +457,56 @@ func push(args []string) error {
 	}
 	committerEmail = z
 
-	b, err := ioutil.ReadFile(db)
+	shaSum, _, err := repo.FileSHA256(db)
 	if err != nil {
 		return err
 	}
-	s := sha256.Sum256(b)
-	shaSum := hex.EncodeToString(s[:])
-	req := rq.New().TLSClientConfig(&TLSConfig).Post(dbURL).
-		Type("multipart").
-		Query(fmt.Sprintf("authoremail=%s", url.QueryEscape(pushEmail))).
-		Query(fmt.Sprintf("authorname=%s", url.QueryEscape(pushAuthor))).
-		Query(fmt.Sprintf("branch=%s", url.QueryEscape(pushCmdBranch))).
-		Query(fmt.Sprintf("commit=%s", pushCmdCommit)).
-		Query(fmt.Sprintf("commitmsg=%s", url.QueryEscape(pushCmdMsg))).
-		Query(fmt.Sprintf("committeremail=%s", url.QueryEscape(committerEmail))).
-		Query(fmt.Sprintf("committername=%s", url.QueryEscape(committerName))).
-		Query(fmt.Sprintf("committimestamp=%v", pushCmdTimestamp)).
-		Query(fmt.Sprintf("dbshasum=%s", url.QueryEscape(shaSum))).
-		Query(fmt.Sprintf("force=%v", pushCmdForce)).
-		Query(fmt.Sprintf("lastmodified=%s", url.QueryEscape(fi.ModTime().UTC().Format(time.RFC3339)))).
-		Query(fmt.Sprintf("public=%v", pushCmdPublic)).
-		Set("User-Agent", fmt.Sprintf("Dio %s", DIO_VERSION)).
-		SendFile(db, "", "file1")
-	if pushCmdLicence != "" {
-		req.Query(fmt.Sprintf("licence=%s", url.QueryEscape(pushCmdLicence)))
+
+	// The previous commit can be given as any revision the server's metadata for the database knows about
+	parent := pushCmdCommit
+	if parent != "" {
+		remoteMeta, onCloud, err := retrieveMetadata(pushCmdDB)
+		if err != nil {
+			return err
+		}
+		if !onCloud {
+			return fmt.Errorf("Database '%s' isn't on the server yet, so it has no commit '%s' to append to",
+				pushCmdDB, parent)
+		}
+		parent, err = repo.ResolveRevision(remoteMeta, parent)
+		if err != nil {
+			return err
+		}
 	}
-	resp, _, errs := req.End()
-	if errs != nil {
-		log.Print("Errors when uploading database to the cloud:")
-		for _, err := range errs {
-			_, _ = fmt.Fprint(fOut, err)
+	cu := client.CommitUpload{
+		AuthorEmail:    pushEmail,
+		AuthorName:     pushAuthor,
+		Branch:         pushCmdBranch,
+		CommitterEmail: committerEmail,
+		CommitterName:  committerName,
+		DBShaSum:       shaSum,
+		Force:          pushCmdForce,
+		LastModified:   fi.ModTime(),
+		Licence:        pushCmdLicence,
+		Message:        pushCmdMsg,
+		Parent:         parent,
+		Public:         pushCmdPublic,
+	}
+	if pushCmdTimestamp != "" {
+		cu.CommitTimestamp, err = time.Parse(time.RFC3339, pushCmdTimestamp)
+		if err != nil {
+			return fmt.Errorf("Invalid commit timestamp '%s': %v", pushCmdTimestamp, err)
 		}
-		return errors.New("Error when uploading database to the cloud")
 	}
-	if resp != nil && resp.StatusCode != http.StatusCreated {
-		return errors.New(fmt.Sprintf("Upload failed with an error: HTTP status %d - '%v'\n",
-			resp.StatusCode, resp.Status))
+	_, err = uploadDatabase(db, cu, db, "")
+	if code := client.StatusCode(err); code != 0 {
+		return errors.New(fmt.Sprintf("Upload failed with an error: HTTP status %d - '%v'\n", code,
+			http.StatusText(code)))
+	}
+	if err != nil {
+		log.Print("Errors when uploading database to the cloud:")
+		_, _ = fmt.Fprint(fOut, err)
+		return errors.New("Error when uploading database to the cloud")
 	}
 
 	// Retrieve updated metadata
@@ -443,15 +518,24 @@ func push(args []string) error {
 	if pushCmdBranch == "" {
 		pushCmdBranch = meta.ActiveBranch
 	}
+	err = setRemoteBranches(db, &meta, meta)
+	if err != nil {
+		return err
+	}
 
 	// Save the updated metadata back to disk
-	err = saveMetadata(db, meta)
+	err = localRepo().SaveMetadata(db, meta, "push")
 	if err != nil {
 		return err
 	}
 
 	// If the database isn't in the local metadata cache, then copy it there
-	err = ioutil.WriteFile(filepath.Join(".dio", db, "db", shaSum), b, 0644)
+	f, err := os.Open(db)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = localRepo().SaveDB(db, shaSum, f)
 	if err != nil {
 		return err
 	}
@@ -492,70 +576,395 @@ func push(args []string) error {
 	return err
 }
 
-// Sends a commit to the cloud
-func sendCommit(meta metaData, db string, dbURL string, newCommit string, public bool) (err error) {
-	commitData, ok := meta.Commits[newCommit]
-	if !ok {
-		return fmt.Errorf("Something went wrong.  Could not retrieve data for commit '%s' from"+
-			"local metadata commit list.", newCommit)
+// Makes sure the commits merged in by the commits about to be pushed are already on the cloud.  The server only takes
+// commits which extend the branch they're sent to, so merged in commits have to be pushed with their own branch first
+func checkMergedParents(meta metaData, remoteMeta metaData, commits []string) error {
+	pushing := make(map[string]struct{}, len(commits))
+	for _, commitID := range commits {
+		for _, c := range repo.Ancestry(meta, meta.Commits[commitID].OtherParents...) {
+			if _, ok := remoteMeta.Commits[c.ID]; ok {
+				continue
+			}
+			if _, ok := pushing[c.ID]; ok {
+				continue
+			}
+
+			// Name the local branch holding the commit, if there is one, so the user knows what to push
+			var branches []string
+			for bName, b := range meta.Branches {
+				if bName == pushCmdBranch {
+					continue
+				}
+				if _, ok := repo.CommitAncestors(meta, b.Commit)[c.ID]; ok {
+					branches = append(branches, bName)
+				}
+			}
+			sort.Strings(branches)
+			if len(branches) == 0 {
+				return fmt.Errorf("Commit '%s' merged into branch '%s' isn't on %s yet, and isn't on any other local "+
+					"branch.  Create a branch for it and push that first", c.ID, pushCmdBranch, cloud)
+			}
+			return fmt.Errorf("Commit '%s' merged into branch '%s' isn't on %s yet.  Push the branch it came "+
+				"from ('%s') first", c.ID, pushCmdBranch, cloud, branches[0])
+		}
+		pushing[commitID] = struct{}{}
 	}
-	shaSum := commitData.Tree.Entries[0].Sha256
-	var otherParents string
-	for i, j := range commitData.OtherParents {
-		if i != 1 {
-			otherParents += ","
-		}
-		otherParents += j
-	}
-
-	// Push the first commit to the remote cloud, to create the database there
-	req := rq.New().TLSClientConfig(&TLSConfig).Post(dbURL).
-		Type("multipart").
-		Query(fmt.Sprintf("branch=%s", url.QueryEscape(pushCmdBranch))).
-		Query(fmt.Sprintf("commitmsg=%s", url.QueryEscape(commitData.Message))).
-		Query(fmt.Sprintf("lastmodified=%s",
-			url.QueryEscape(commitData.Tree.Entries[0].LastModified.UTC().Format(time.RFC3339)))).
-		Query(fmt.Sprintf("commit=%s", commitData.Parent)).
-		Query(fmt.Sprintf("authoremail=%s", url.QueryEscape(commitData.AuthorEmail))).
-		Query(fmt.Sprintf("authorname=%s", url.QueryEscape(commitData.AuthorName))).
-		Query(fmt.Sprintf("committeremail=%s", url.QueryEscape(commitData.CommitterEmail))).
-		Query(fmt.Sprintf("committername=%s", url.QueryEscape(commitData.CommitterName))).
-		Query(fmt.Sprintf("committimestamp=%s",
-			url.QueryEscape(commitData.Timestamp.UTC().Format(time.RFC3339)))).
-		Query(fmt.Sprintf("otherparents=%s", url.QueryEscape(otherParents))).
-		Query(fmt.Sprintf("dbshasum=%s", url.QueryEscape(shaSum))).
-		Query(fmt.Sprintf("public=%v", pushCmdPublic)).
-		Set("User-Agent", fmt.Sprintf("Dio %s", DIO_VERSION)).
-		SendFile(filepath.Join(".dio", db, "db", shaSum), db, "file1")
-	if pushCmdLicence != "" {
-		req.Query(fmt.Sprintf("licence=%s", url.QueryEscape(pushCmdLicence)))
+	return nil
+}
+
+// Returns the error for a forced push which would only move the remote branch back to an earlier commit
+func forceRewindError() error {
+	return fmt.Errorf("The local branch '%s' is behind the remote branch, with no commits which aren't already on "+
+		"it.  DBHub.io only moves a branch on when commits are pushed to it, so it can't be moved back to an earlier "+
+		"commit.  Make a new commit on the local branch, then force push that instead.", pushCmdBranch)
+}
+
+// Rewrites a remote branch to match the local one.  The local commits after the point where the branches diverged are
+// uploaded, with the first of them replacing the remote commits from that point onwards
+func forcePush(db string, meta metaData, remoteMeta metaData, localCommitList []string,
+	remoteCommitList []string, extraCtr int) (err error) {
+	// With --force-with-lease, make sure the remote branch hasn't been changed by someone else.  The expected head
+	// can be given as any revision, which is worked out using the server's metadata
+	remoteHead := remoteCommitList[0]
+	if pushCmdForceLease != "" {
+		var lease string
+		lease, err = repo.ResolveRevision(remoteMeta, pushCmdForceLease)
+		if err != nil {
+			return
+		}
+		if remoteHead != lease {
+			return fmt.Errorf("The head of remote branch '%s' is commit %s, not the expected %s.  Someone else "+
+				"may have pushed to it.  Aborting.", pushCmdBranch, remoteHead, lease)
+		}
+	}
+
+	// Find the most recent commit in both branches
+	localIdx := make(map[string]int)
+	for i, j := range localCommitList {
+		localIdx[j] = i
 	}
-	resp, body, errs := req.End()
-	if errs != nil {
-		e := fmt.Sprintln("Errors when uploading database to the cloud:")
-		for _, err := range errs {
-			e = err.Error()
+	forkRemote, forkLocal := -1, -1
+	for i, j := range remoteCommitList {
+		if k, ok := localIdx[j]; ok {
+			forkRemote, forkLocal = i, k
+			break
 		}
-		return errors.New(e)
 	}
-	if resp != nil && resp.StatusCode != http.StatusCreated {
-		return errors.New(fmt.Sprintf("Upload failed with an error: '%v'", body))
+	if forkRemote == -1 {
+		return fmt.Errorf("Local and remote branch %s don't have a common root.  Aborting.", pushCmdBranch)
+	}
+
+	// The remote commits after that point will no longer be part of the branch, and the local ones need sending
+	unreachable := remoteCommitList[:forkRemote]
+	var pushCommits []string
+	for i := forkLocal - 1; i >= 0; i-- {
+		pushCommits = append(pushCommits, localCommitList[i])
+	}
+	if len(pushCommits) == 0 {
+		if len(unreachable) == 0 {
+			return fmt.Errorf("The local and remote branch '%s' are identical.  Nothing to push.",
+				pushCmdBranch)
+		}
+		return forceRewindError()
 	}
 
-	// Process the JSON format response data
-	parsedResponse := map[string]string{}
-	err = json.Unmarshal([]byte(body), &parsedResponse)
+	// Send the commits to the cloud.  The first one replaces the existing remote history
+	err = checkMergedParents(meta, remoteMeta, pushCommits)
 	if err != nil {
-		_, errInner := fmt.Fprintf(fOut, "Error parsing server response: '%v'", err.Error())
-		if errInner != nil {
-			return fmt.Errorf("%s: %s", err, errInner)
+		return
+	}
+	_, err = fmt.Fprintf(fOut, "Force pushing %d commit(s) for branch '%s' to %s...\n",
+		len(pushCommits)+extraCtr, pushCmdBranch, cloud)
+	if err != nil {
+		return
+	}
+	for i, commitID := range pushCommits {
+		err = sendCommit(meta, db, commitID, pushCmdPublic, i == 0 && len(unreachable) > 0)
+		if err != nil {
+			return
 		}
-		return err
+	}
+	err = pushed(db, meta)
+	if err != nil {
+		return
+	}
+	_, err = fmt.Fprintln(fOut, "All commits pushed.")
+	if err != nil || len(unreachable) == 0 {
+		return
 	}
 
-	// Check that the ID for the new commit as generated by the server matches the ID generated locally
-	remoteCommitID, ok := parsedResponse["commit_id"]
+	// Let the user know which remote commits are no longer part of the branch, including any tags or releases on them
+	_, err = fmt.Fprintf(fOut, "\nThese commits are no longer part of the remote branch '%s':\n\n", pushCmdBranch)
+	if err != nil {
+		return
+	}
+	for _, commitID := range unreachable {
+		var labels []string
+		for name, t := range remoteMeta.Tags {
+			if t.Commit == commitID {
+				labels = append(labels, "tag: "+name)
+			}
+		}
+		for name, r := range remoteMeta.Releases {
+			if r.Commit == commitID {
+				labels = append(labels, "release: "+name)
+			}
+		}
+		sort.Strings(labels)
+		if len(labels) > 0 {
+			_, err = fmt.Fprintf(fOut, "  * %s (%s)\n", commitID, strings.Join(labels, ", "))
+		} else {
+			_, err = fmt.Fprintf(fOut, "  * %s\n", commitID)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Sends the tags or releases created locally to the server, and removes the ones removed locally from it.  Ones with
+// the same name but on a different commit locally and remotely are left alone, and returned as conflicts
+func pushLabels(db string, l labelChanges, remoteMeta metaData) (conflicts []string, err error) {
+	endpoint := strings.ToLower(l.Kind)
+
+	// Send the ones which aren't on the server yet
+	var names []string
+	for name := range l.Local {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		commit := l.Local[name]
+		if r, ok := l.Remote[name]; ok {
+			if r != commit {
+				conflicts = append(conflicts, fmt.Sprintf("%s '%s' is on commit %s locally, but commit %s on the "+
+					"server", l.Kind, name, commit, r))
+			}
+			continue
+		}
+		if _, ok := remoteMeta.Commits[commit]; !ok {
+			conflicts = append(conflicts, fmt.Sprintf("%s '%s' is on commit %s, which isn't on the server yet",
+				l.Kind, name, commit))
+			continue
+		}
+		err = sendChange(endpoint+"/create", db, l.Params(name))
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(fOut, "  * %s '%s' pushed\n", l.Kind, name)
+		if err != nil {
+			return
+		}
+	}
+
+	// Remove the ones which were removed locally
+	names = nil
+	for name := range l.Removed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r, ok := l.Remote[name]
+		if ok && r != l.Removed[name] {
+			conflicts = append(conflicts, fmt.Sprintf("%s '%s' was removed locally, but is on a different commit "+
+				"(%s) on the server", l.Kind, name, r))
+			continue
+		}
+		if ok {
+			err = sendChange(endpoint+"/remove", db, map[string]string{endpoint: name})
+			if err != nil {
+				return
+			}
+			_, err = fmt.Fprintf(fOut, "  * %s '%s' removed from the server\n", l.Kind, name)
+			if err != nil {
+				return
+			}
+		}
+		l.Sent(name)
+	}
+	return
+}
+
+// Sends the tags and/or releases created and removed locally to the server.  Any conflicts are displayed, and cause an
+// error to be returned after the non-conflicting changes have been sent
+func pushTagsAndReleases(db string, tags bool, releases bool) (err error) {
+	meta, err := localRepo().LoadHeads(db)
+	if err != nil {
+		return
+	}
+	remoteMeta, found, err := retrieveMetadata(db)
+	if err != nil {
+		return
+	}
+	if !found {
+		return fmt.Errorf("Database '%s' isn't on %s yet.  Push it first", db, cloud)
+	}
+	_, err = fmt.Fprintf(fOut, "Pushing changes for '%s' to %s...\n", db, cloud)
+	if err != nil {
+		return
+	}
+	var conflicts, c []string
+	if tags {
+		c, err = pushTags(db, meta, remoteMeta)
+		conflicts = append(conflicts, c...)
+	}
+	if err == nil && releases {
+		c, err = pushReleases(db, meta, remoteMeta)
+		conflicts = append(conflicts, c...)
+	}
+
+	// Save the metadata even if something went wrong, so the removals already sent aren't sent again
+	errSave := localRepo().SaveMetadata(db, meta, "push")
+	if err != nil {
+		return
+	}
+	if errSave != nil {
+		return errSave
+	}
+	if len(conflicts) == 0 {
+		_, err = fmt.Fprintln(fOut, "All changes pushed.")
+		return
+	}
+	_, err = fmt.Fprintf(fOut, "\nThese changes conflict with the server, so weren't pushed:\n\n")
+	if err != nil {
+		return
+	}
+	for _, j := range conflicts {
+		_, err = fmt.Fprintf(fOut, "  * %s\n", j)
+		if err != nil {
+			return
+		}
+	}
+	return fmt.Errorf("%d change(s) conflict with the server", len(conflicts))
+}
+
+// Records that the branch being pushed is now the same on the server as it is locally
+func pushed(db string, meta metaData) error {
+	if meta.RemoteBranches == nil {
+		meta.RemoteBranches = make(map[string]branchEntry)
+	}
+	meta.RemoteBranches[pushCmdBranch] = meta.Branches[pushCmdBranch]
+	return localRepo().SaveMetadata(db, meta, "push")
+}
+
+// Applies the queued local branch changes to the server, updating the given remote metadata to match.  Changes which
+// can't be applied yet (eg creating a branch whose commits haven't been pushed) are left queued.  Returns the number of
+// changes sent
+func sendBranchOps(db string, meta *metaData, remoteMeta metaData) (sent int, err error) {
+	if len(meta.BranchOps) == 0 {
+		return
+	}
+	var remaining []branchOp
+	for i, op := range meta.BranchOps {
+		remoteBranch, onServer := remoteMeta.Branches[op.Branch]
+		var params map[string]string
+		switch op.Action {
+		case "create":
+			if onServer {
+				// Already there, probably from pushing commits to it
+				continue
+			}
+			if _, ok := remoteMeta.Commits[op.Commit]; !ok {
+				remaining = append(remaining, op)
+				continue
+			}
+			params = map[string]string{"branch": op.Branch, "commit": op.Commit, "description": op.Description}
+			remoteMeta.Branches[op.Branch] = branchEntry{Commit: op.Commit, Description: op.Description}
+		case "update":
+			if !onServer {
+				remaining = append(remaining, op)
+				continue
+			}
+			params = map[string]string{"branch": op.Branch, "description": op.Description}
+			remoteBranch.Description = op.Description
+			remoteMeta.Branches[op.Branch] = remoteBranch
+		case "remove":
+			if !onServer {
+				continue
+			}
+			if remoteBranch.Commit != op.Commit {
+				// Someone else has added to the branch since, so don't throw their work away
+				_, err = fmt.Fprintf(fOut, "  * Branch '%s' has changed on the server since it was removed "+
+					"locally, so it wasn't removed from the server\n", op.Branch)
+				if err != nil {
+					return
+				}
+				continue
+			}
+			params = map[string]string{"branch": op.Branch}
+			delete(remoteMeta.Branches, op.Branch)
+		case "rename":
+			if !onServer {
+				if _, ok := remoteMeta.Branches[op.NewName]; !ok {
+					remaining = append(remaining, op)
+				}
+				continue
+			}
+			params = map[string]string{"branch": op.Branch, "new_name": op.NewName}
+			remoteMeta.Branches[op.NewName] = remoteBranch
+			delete(remoteMeta.Branches, op.Branch)
+		}
+		err = sendChange("branch/"+op.Action, db, params)
+		if err != nil {
+			// Keep the changes not yet sent queued for next time
+			meta.BranchOps = append(remaining, meta.BranchOps[i:]...)
+			errSave := localRepo().SaveMetadata(db, *meta, "push")
+			if errSave != nil {
+				return sent, errSave
+			}
+			return
+		}
+		_, err = fmt.Fprintf(fOut, "  * Branch change sent: %s '%s'\n", op.Action, op.Branch)
+		if err != nil {
+			return
+		}
+		sent++
+	}
+	meta.BranchOps = remaining
+	err = localRepo().SaveMetadata(db, *meta, "push")
+	return
+}
+
+// Sends a commit to the cloud.  When forcing, the commit replaces the existing head of the remote branch even if its
+// parent isn't that head
+func sendCommit(meta metaData, db string, newCommit string, public bool, force bool) (err error) {
+	commitData, ok := meta.Commits[newCommit]
 	if !ok {
+		return fmt.Errorf("Something went wrong.  Could not retrieve data for commit '%s' from"+
+			"local metadata commit list.", newCommit)
+	}
+	shaSum := commitData.Tree.Entries[0].Sha256
+
+	// Push the commit to the remote cloud, along with its database file
+	cu := client.CommitUpload{
+		AuthorEmail:     commitData.AuthorEmail,
+		AuthorName:      commitData.AuthorName,
+		Branch:          pushCmdBranch,
+		CommitterEmail:  commitData.CommitterEmail,
+		CommitterName:   commitData.CommitterName,
+		CommitTimestamp: commitData.Timestamp,
+		DBShaSum:        shaSum,
+		Force:           force,
+		LastModified:    commitData.Tree.Entries[0].LastModified,
+		Licence:         pushCmdLicence,
+		Message:         commitData.Message,
+		OtherParents:    commitData.OtherParents,
+		Parent:          commitData.Parent,
+		Public:          public,
+	}
+	res, err := uploadDatabase(db, cu, localRepo().CachePath(db, shaSum), db)
+	var e *client.Error
+	if errors.As(err, &e) && e.StatusCode != 0 {
+		return errors.New(fmt.Sprintf("Upload failed with an error: '%v'", e.Message))
+	}
+	if err != nil {
+		return fmt.Errorf("Errors when uploading database to the cloud: %s", err)
+	}
+
+	// Check that the ID for the new commit as generated by the server matches the ID generated locally
+	remoteCommitID := res.CommitID
+	if remoteCommitID == "" {
 		return errors.New("Unexpected response from server, doesn't contain new commit ID.")
 	}
 	if remoteCommitID != newCommit {
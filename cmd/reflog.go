@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Displays the moves of the branch heads of a database
+var reflogCmd = &cobra.Command{
+	Use:   "reflog [database name]",
+	Short: "Displays the history of branch head moves for a database",
+	Long: `Displays the history of branch head moves for a database, newest first.
+
+Every command which moves a branch head or changes the active branch (commit,
+pull, branch revert, branch create, branch remove, branch active set, and so
+on) adds an entry.  A branch move or removal can be undone with:
+
+  dio branch revert --to-reflog N`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return reflog(args)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(reflogCmd)
+}
+
+func reflog(args []string) error {
+	// Ensure a database file was given
+	dbs, err := dbsFromArgs(args, false)
+	if err != nil {
+		return err
+	}
+	if len(dbs) > 1 {
+		return errors.New("Only one database can be worked with at a time (for now)")
+	}
+	db := dbs[0]
+
+	entries, err := localRepo().Reflog(db)
+	if err != nil {
+		return err
+	}
+	if structuredOutput() {
+		return writeOutput(reflogOutput{Database: db, Entries: entries})
+	}
+	if len(entries) == 0 {
+		_, err = fmt.Fprintf(fOut, "Database %s has no reflog entries\n", db)
+		return err
+	}
+
+	_, err = fmt.Fprintf(fOut, "Reflog for %s:\n\n", db)
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		_, err = fmt.Fprintf(fOut, "  %d: %s %s: %s\n", i, e.Timestamp.Local().Format(time.RFC1123), e.Action,
+			reflogText(e))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Describes the change recorded in a reflog entry
+func reflogText(e reflogEntry) string {
+	switch {
+	case e.PrevActive != "":
+		return fmt.Sprintf("active branch changed from %s to %s", e.PrevActive, e.Branch)
+	case e.From == "":
+		return fmt.Sprintf("%s created at %s", e.Branch, shortID(e.To))
+	case e.To == "":
+		return fmt.Sprintf("%s removed (was at %s)", e.Branch, shortID(e.From))
+	}
+	return fmt.Sprintf("%s moved from %s to %s", e.Branch, shortID(e.From), shortID(e.To))
+}
+
+// Returns the shortened form of a commit ID shown to people
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
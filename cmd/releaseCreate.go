@@ -22,11 +22,12 @@ var releaseCreateCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return releaseCreate(args)
 	},
+	Annotations: locksDatabases,
 }
 
 func init() {
 	releaseCmd.AddCommand(releaseCreateCmd)
-	releaseCreateCmd.Flags().StringVar(&releaseCreateCommit, "commit", "", "Commit ID for the new release")
+	releaseCreateCmd.Flags().StringVar(&releaseCreateCommit, "commit", "", "Revision (eg commit ID, tag, or main~2) for the new release")
 	releaseCreateCmd.Flags().StringVar(&releaseCreateCreatorEmail, "email", "", "Email address of release creator")
 	releaseCreateCmd.Flags().StringVar(&releaseCreateCreatorName, "name", "", "Name of release creator")
 	releaseCreateCmd.Flags().StringVar(&releaseCreateMsg, "message", "", "Description / message for the release")
@@ -38,7 +39,6 @@ func releaseCreate(args []string) error {
 	// Ensure a database file was given
 	var db string
 	var err error
-	var meta metaData
 	if len(args) == 0 {
 		db, err = getDefaultDatabase()
 		if err != nil {
@@ -95,32 +95,19 @@ func releaseCreate(args []string) error {
 		}
 	}
 
-	// Load the metadata
-	meta, err = loadMetadata(db)
+	// Add the new release to the local metadata cache
+	commitID, err := resolveLocalRevision(db, releaseCreateCommit)
 	if err != nil {
 		return err
 	}
-
-	// Ensure a release with the same name doesn't already exist
-	if _, ok := meta.Releases[releaseCreateRelease]; ok == true {
-		return errors.New("A release with that name already exists")
-	}
-
-	// Generate the new release info locally
-	newRelease := releaseEntry{
-		Commit:        releaseCreateCommit,
+	err = localRepo().CreateRelease(db, releaseCreateRelease, releaseEntry{
+		Commit:        commitID,
 		Date:          releaseTimeStamp,
 		Description:   releaseCreateMsg,
 		ReleaserEmail: releaseCreateCreatorEmail,
 		ReleaserName:  releaseCreateCreatorName,
 		Size:          size,
-	}
-
-	// Add the new release to the local metadata cache
-	meta.Releases[releaseCreateRelease] = newRelease
-
-	// Save the updated metadata back to disk
-	err = saveMetadata(db, meta)
+	})
 	if err != nil {
 		return err
 	}
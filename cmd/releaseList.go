@@ -50,6 +50,13 @@ func releaseList(args []string) error {
 		return err
 	}
 
+	if structuredOutput() {
+		if meta.Releases == nil {
+			meta.Releases = make(map[string]releaseEntry)
+		}
+		return writeOutput(releaseListOutput{Database: db, Releases: meta.Releases})
+	}
+
 	if len(meta.Releases) == 0 {
 		_, err = fmt.Fprintf(fOut, "Database %s has no releases\n", db)
 		return err
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Sends the local release changes for a database to DBHub.io
+var releasePushCmd = &cobra.Command{
+	Use:   "push [database name...]",
+	Short: "Send the releases created and removed locally to DBHub.io",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return releasePush(args)
+	},
+	Annotations: locksDatabases,
+}
+
+func init() {
+	releaseCmd.AddCommand(releasePushCmd)
+}
+
+func releasePush(args []string) error {
+	// Ensure a database file was given
+	dbs, err := dbsFromArgs(args, false)
+	if err != nil {
+		return err
+	}
+	return forEachDatabase(dbs, func(db string) error {
+		return pushTagsAndReleases(db, false, true)
+	}, nil)
+}
+
+// Sends the releases created locally to the server, and removes the releases removed locally from it.  Releases with
+// the same name but on a different commit locally and remotely are left alone, and returned as conflicts
+func pushReleases(db string, meta metaData, remoteMeta metaData) (conflicts []string, err error) {
+	l := labelChanges{
+		Kind:    "Release",
+		Local:   make(map[string]string),
+		Remote:  make(map[string]string),
+		Removed: make(map[string]string),
+		Params: func(name string) map[string]string {
+			rel := meta.Releases[name]
+			return map[string]string{
+				"commit":        rel.Commit,
+				"date":          rel.Date.UTC().Format(time.RFC3339),
+				"msg":           rel.Description,
+				"release":       name,
+				"releaseremail": rel.ReleaserEmail,
+				"releasername":  rel.ReleaserName,
+				"size":          strconv.FormatInt(rel.Size, 10),
+			}
+		},
+		Sent: func(name string) {
+			delete(meta.DeletedReleases, name)
+		},
+	}
+	for name, rel := range meta.Releases {
+		l.Local[name] = rel.Commit
+	}
+	for name, rel := range remoteMeta.Releases {
+		l.Remote[name] = rel.Commit
+	}
+	for name, rel := range meta.DeletedReleases {
+		l.Removed[name] = rel.Commit
+	}
+	return pushLabels(db, l, remoteMeta)
+}
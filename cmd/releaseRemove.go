@@ -16,6 +16,7 @@ var releaseRemoveCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return releaseRemove(args)
 	},
+	Annotations: locksDatabases,
 }
 
 func init() {
@@ -27,7 +28,6 @@ func releaseRemove(args []string) error {
 	// Ensure a database file was given
 	var db string
 	var err error
-	var meta metaData
 	if len(args) == 0 {
 		db, err = getDefaultDatabase()
 		if err != nil {
@@ -49,22 +49,8 @@ func releaseRemove(args []string) error {
 		return errors.New("No release name given")
 	}
 
-	// Load the metadata
-	meta, err = loadMetadata(db)
-	if err != nil {
-		return err
-	}
-
-	// Check if the release exists
-	if _, ok := meta.Releases[releaseRemoveRelease]; ok != true {
-		return errors.New("A release with that name doesn't exist")
-	}
-
-	// Remove the release
-	delete(meta.Releases, releaseRemoveRelease)
-
-	// Save the updated metadata back to disk
-	err = saveMetadata(db, meta)
+	// Remove the release, remembering it was removed so the removal can be pushed to the server
+	err = localRepo().RemoveRelease(db, releaseRemoveRelease)
 	if err != nil {
 		return err
 	}
@@ -36,6 +36,12 @@ var RootCmd = &cobra.Command{
 
 With dio you can send and receive database files to a DBHub.io cloud,
 and manipulate its tags and branches.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkOutputFormat(); err != nil {
+			return err
+		}
+		return lockDatabases(cmd, args)
+	},
 	SilenceErrors: true,
 	SilenceUsage:  true,
 }
@@ -43,7 +49,9 @@ and manipulate its tags and branches.`,
 // Execute adds all child commands to the root command & sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	if err := RootCmd.Execute(); err != nil {
+	err := RootCmd.Execute()
+	unlockDatabases()
+	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
@@ -58,6 +66,8 @@ func init() {
 		fmt.Sprintf("config file (default is %s)", filepath.Join("$HOME", ".dio", "config.toml")))
 	RootCmd.PersistentFlags().StringVar(&cloud, "cloud", "https://db4s.dbhub.io",
 		"Address of the DBHub.io cloud")
+	RootCmd.PersistentFlags().StringVar(&outputFormat, "output", outputText,
+		"Format for the results of commands which display information: text, json, or yaml")
 
 	// Read all of our configuration data now
 	if cfgFile != "" {
@@ -0,0 +1,475 @@
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A change which couldn't be merged automatically, as both sides of the merge changed the same thing differently
+type mergeConflict struct {
+	Base   map[string]string `json:"base,omitempty"`
+	Key    string            `json:"key,omitempty"`
+	Kind   string            `json:"kind"`
+	Object string            `json:"object"`
+	Ours   map[string]string `json:"ours,omitempty"`
+	Theirs map[string]string `json:"theirs,omitempty"`
+}
+
+// Counts of the changes applied when merging databases
+type mergeStats struct {
+	Deleted  int
+	Inserted int
+	Schema   int
+	Updated  int
+}
+
+// Performs a three-way merge of SQLite databases at the row level.  The "out" database must start out as a copy of
+// the "ours" database, and has the non-conflicting changes made in the "theirs" database (compared to the common
+// "base" database) applied to it.  Rows are matched by primary key, or by rowid for tables without one, and are read
+// a row at a time in primary key order.  Changes which conflict are left as per the "ours" database, and returned for
+// the user to resolve
+func mergeDatabases(basePath, oursPath, theirsPath, outPath string) (conflicts []mergeConflict, stats mergeStats,
+	err error) {
+	var baseDB, oursDB, theirsDB, outDB *sql.DB
+	if baseDB, err = openSQLite(basePath, false); err != nil {
+		return
+	}
+	defer baseDB.Close()
+	if oursDB, err = openSQLite(oursPath, false); err != nil {
+		return
+	}
+	defer oursDB.Close()
+	if theirsDB, err = openSQLite(theirsPath, false); err != nil {
+		return
+	}
+	defer theirsDB.Close()
+	if outDB, err = openSQLite(outPath, true); err != nil {
+		return
+	}
+	defer outDB.Close()
+
+	// Read the schema of each database
+	var baseSchema, oursSchema, theirsSchema map[string]schemaObject
+	if baseSchema, err = readSchema(baseDB); err != nil {
+		return
+	}
+	if oursSchema, err = readSchema(oursDB); err != nil {
+		return
+	}
+	if theirsSchema, err = readSchema(theirsDB); err != nil {
+		return
+	}
+
+	// All changes are made inside a single transaction, so a failure part way through leaves nothing half merged
+	tx, err := outDB.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	// * Merge the tables first, as the other schema objects depend upon them *
+	var conflictedVirtual []string
+	for _, name := range schemaNames("table", baseSchema, oursSchema, theirsSchema) {
+		b, inBase := baseSchema[name]
+		o, inOurs := oursSchema[name]
+		t, inTheirs := theirsSchema[name]
+		tableName := strings.TrimPrefix(name, "table ")
+
+		// Virtual tables keep their content in shadow tables, which are merged like any other table.  So only the
+		// definition of the virtual table itself is merged here.  Creating or dropping a virtual table creates or
+		// drops its shadow tables too
+		if isVirtualTable(b) || isVirtualTable(o) || isVirtualTable(t) {
+			switch {
+			case inOurs == inTheirs && o.SQL == t.SQL, inBase == inTheirs && b.SQL == t.SQL:
+				// Both sides agree, or only our side changed it.  Nothing to do
+			case inBase == inOurs && b.SQL == o.SQL:
+				// Only their side added, changed, or removed it, so use their version
+				if inOurs {
+					_, err = tx.Exec(fmt.Sprintf("DROP TABLE %s", quoteIdent(tableName)))
+					if err != nil {
+						return
+					}
+				}
+				if inTheirs {
+					if _, err = tx.Exec(t.SQL); err != nil {
+						return
+					}
+				}
+				stats.Schema++
+			default:
+				// Both sides changed it differently.  Its shadow tables are left as per our side too, so they
+				// stay consistent with it
+				conflicts = append(conflicts, schemaConflict(name, b, inBase, o, inOurs, t, inTheirs))
+				conflictedVirtual = append(conflictedVirtual, tableName+"_")
+			}
+			continue
+		}
+
+		// The shadow tables of conflicting virtual tables are left as they are
+		shadow := false
+		for _, prefix := range conflictedVirtual {
+			if strings.HasPrefix(tableName, prefix) {
+				shadow = true
+			}
+		}
+		if shadow {
+			continue
+		}
+
+		if inOurs && inTheirs && o.SQL == t.SQL {
+			// Both sides have the same table structure, so merge the rows.  If the structure was changed (the same
+			// way) on both sides, the base rows can't be compared with so each row is treated as new
+			var c []mergeConflict
+			c, err = mergeTableRows(tx, tableName, baseDB, inBase && b.SQL == o.SQL, oursDB, theirsDB, &stats)
+			if err != nil {
+				return
+			}
+			conflicts = append(conflicts, c...)
+			continue
+		}
+
+		// Work out which sides changed the table
+		oursChanged := inOurs != inBase || o.SQL != b.SQL
+		if !oursChanged && inOurs {
+			if oursChanged, err = tableChanged(baseDB, oursDB, tableName); err != nil {
+				return
+			}
+		}
+		theirsChanged := inTheirs != inBase || t.SQL != b.SQL
+		if !theirsChanged && inTheirs {
+			if theirsChanged, err = tableChanged(baseDB, theirsDB, tableName); err != nil {
+				return
+			}
+		}
+		switch {
+		case !inOurs && !inTheirs, !theirsChanged:
+			// Either the table was removed on both sides, or only our side changed it.  Nothing to do
+
+		case !oursChanged:
+			// Only their side changed the table structure, added it, or removed it, so use their version.  The
+			// table may already be gone if it belonged to a virtual table which was removed
+			if inOurs {
+				_, err = tx.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteIdent(tableName)))
+				if err != nil {
+					return
+				}
+			}
+			if inTheirs {
+				err = copyTable(tx, t, theirsDB, &stats)
+				if err != nil {
+					return
+				}
+			}
+			stats.Schema++
+
+		default:
+			// Both sides changed the table in incompatible ways
+			conflicts = append(conflicts, schemaConflict(name, b, inBase, o, inOurs, t, inTheirs))
+		}
+	}
+
+	// * Merge the indexes, views and triggers *
+
+	// Changing a table can remove the indexes and triggers on it, so we compare the desired end result with what's
+	// in the output database now, rather than with the "ours" database
+	var outSchema map[string]schemaObject
+	outSchema, err = readSchema(tx)
+	if err != nil {
+		return
+	}
+	for _, objType := range []string{"index", "view", "trigger"} {
+		for _, name := range schemaNames(objType, baseSchema, oursSchema, theirsSchema) {
+			b, inBase := baseSchema[name]
+			o, inOurs := oursSchema[name]
+			t, inTheirs := theirsSchema[name]
+
+			// Work out what the object should look like after the merge
+			want, wanted := o, inOurs
+			switch {
+			case inOurs == inTheirs && o.SQL == t.SQL:
+				// Both sides agree
+			case inBase == inOurs && b.SQL == o.SQL:
+				// Only their side changed it
+				want, wanted = t, inTheirs
+			case inBase == inTheirs && b.SQL == t.SQL:
+				// Only our side changed it
+			default:
+				// Both sides changed it differently
+				conflicts = append(conflicts, schemaConflict(name, b, inBase, o, inOurs, t, inTheirs))
+			}
+
+			// Objects created automatically by SQLite (eg for UNIQUE constraints) have no SQL of their own
+			if wanted && want.SQL == "" {
+				continue
+			}
+
+			// Bring the output database in line with what's wanted
+			cur, inOut := outSchema[name]
+			if inOut == wanted && (!wanted || cur.SQL == want.SQL) {
+				continue
+			}
+			if inOut {
+				_, err = tx.Exec(fmt.Sprintf("DROP %s %s", strings.ToUpper(objType), quoteIdent(cur.Name)))
+				if err != nil {
+					return
+				}
+			}
+			if wanted {
+				if _, err = tx.Exec(want.SQL); err != nil {
+					return
+				}
+			}
+			stats.Schema++
+		}
+	}
+	return
+}
+
+// Merges the rows of a table which has the same structure on both sides of a merge.  The rows of each side are read
+// in primary key order, and compared a row at a time.  When useBase is false, the base rows aren't compared with, so
+// every row is treated as new
+func mergeTableRows(tx *sql.Tx, table string, baseDB sqlQuerier, useBase bool, oursDB sqlQuerier,
+	theirsDB sqlQuerier, stats *mergeStats) (conflicts []mergeConflict, err error) {
+	cols, err := readTableColumns(oursDB, table)
+	if err != nil {
+		return
+	}
+	var base, ours, theirs *rowReader
+	if base, err = newRowReader(baseDB, table, cols, useBase); err != nil {
+		return
+	}
+	defer base.close()
+	if ours, err = newRowReader(oursDB, table, cols, true); err != nil {
+		return
+	}
+	defer ours.close()
+	if theirs, err = newRowReader(theirsDB, table, cols, true); err != nil {
+		return
+	}
+	defer theirs.close()
+
+	for !base.Done || !ours.Done || !theirs.Done {
+		// Take the rows with the lowest primary key not yet looked at
+		var key []interface{}
+		for _, r := range []*rowReader{base, ours, theirs} {
+			if !r.Done && (key == nil || compareKeys(r.Row.raw, key) < 0) {
+				key = r.Row.raw
+			}
+		}
+		var b, o, t tableRow
+		var inBase, inOurs, inTheirs bool
+		if b, inBase, err = base.take(key); err != nil {
+			return
+		}
+		if o, inOurs, err = ours.take(key); err != nil {
+			return
+		}
+		if t, inTheirs, err = theirs.take(key); err != nil {
+			return
+		}
+
+		// If both sides agree, nothing needs doing
+		if inOurs == inTheirs && rowsEqual(o.Vals, t.Vals) {
+			continue
+		}
+
+		// If our side is unchanged from the base, apply their change
+		if inOurs == inBase && rowsEqual(o.Vals, b.Vals) {
+			switch {
+			case !inTheirs:
+				err = deleteRow(tx, table, cols, o)
+				stats.Deleted++
+			case !inOurs:
+				err = insertRow(tx, table, cols, t)
+				stats.Inserted++
+			default:
+				err = updateRow(tx, table, cols, t)
+				stats.Updated++
+			}
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		// If their side is unchanged from the base, keep our version
+		if inTheirs == inBase && rowsEqual(t.Vals, b.Vals) {
+			continue
+		}
+
+		// Both sides changed the row in different ways
+		c := mergeConflict{Kind: "row", Object: "table " + table}
+		if inBase {
+			c.Base = cols.rowValues(b)
+		}
+		if inOurs {
+			c.Key, c.Ours = cols.keyDescription(o.Key), cols.rowValues(o)
+		}
+		if inTheirs {
+			c.Theirs = cols.rowValues(t)
+			if !inOurs {
+				c.Key = cols.keyDescription(t.Key)
+			}
+		}
+		conflicts = append(conflicts, c)
+	}
+	return
+}
+
+// Creates a table using the given schema, and fills it with the rows from the given database.  If the table already
+// exists, as the shadow table of a virtual table created during the merge, its rows are replaced instead
+func copyTable(tx *sql.Tx, obj schemaObject, src sqlQuerier, stats *mergeStats) (err error) {
+	var exists int
+	err = tx.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, obj.Name).Scan(&exists)
+	if err != nil {
+		return
+	}
+	if exists > 0 {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s", quoteIdent(obj.Name)))
+	} else {
+		_, err = tx.Exec(obj.SQL)
+	}
+	if err != nil {
+		return
+	}
+	cols, err := readTableColumns(src, obj.Name)
+	if err != nil {
+		return
+	}
+	rows, err := newRowReader(src, obj.Name, cols, true)
+	if err != nil {
+		return
+	}
+	defer rows.close()
+	for !rows.Done {
+		err = insertRow(tx, obj.Name, cols, rows.Row)
+		if err != nil {
+			return
+		}
+		stats.Inserted++
+		if err = rows.next(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Deletes a row from a table
+func deleteRow(tx *sql.Tx, table string, cols tableColumns, row tableRow) (err error) {
+	_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s", quoteIdent(table), keyWhere(cols, row)))
+	return
+}
+
+// Inserts a row into a table
+func insertRow(tx *sql.Tx, table string, cols tableColumns, row tableRow) (err error) {
+	var names []string
+	for _, c := range cols.KeyCols {
+		names = append(names, cols.ident(c))
+	}
+	for _, c := range cols.Columns {
+		names = append(names, quoteIdent(c))
+	}
+	vals := append(append([]string{}, row.Key...), row.Vals...)
+	_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quoteIdent(table), strings.Join(names, ", "),
+		strings.Join(vals, ", ")))
+	return
+}
+
+// Returns true if the given table is a virtual table
+func isVirtualTable(obj schemaObject) bool {
+	return strings.HasPrefix(strings.ToUpper(obj.SQL), "CREATE VIRTUAL")
+}
+
+// Updates the (non primary key) values of a row in a table
+func updateRow(tx *sql.Tx, table string, cols tableColumns, row tableRow) (err error) {
+	if len(cols.Columns) == 0 {
+		return
+	}
+	var set []string
+	for i, c := range cols.Columns {
+		set = append(set, fmt.Sprintf("%s = %s", quoteIdent(c), row.Vals[i]))
+	}
+	_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET %s WHERE %s", quoteIdent(table), strings.Join(set, ", "),
+		keyWhere(cols, row)))
+	return
+}
+
+// Returns the WHERE clause matching a row by its primary key
+func keyWhere(cols tableColumns, row tableRow) string {
+	var w []string
+	for i, c := range cols.KeyCols {
+		w = append(w, fmt.Sprintf("%s IS %s", cols.ident(c), row.Key[i]))
+	}
+	return strings.Join(w, " AND ")
+}
+
+// Creates the conflict entry for a schema object changed in different ways on both sides of a merge
+func schemaConflict(name string, b schemaObject, inBase bool, o schemaObject, inOurs bool, t schemaObject,
+	inTheirs bool) (c mergeConflict) {
+	c = mergeConflict{Kind: "schema", Object: name}
+	if inBase {
+		c.Base = map[string]string{"sql": b.SQL}
+	}
+	if inOurs {
+		c.Ours = map[string]string{"sql": o.SQL}
+	}
+	if inTheirs {
+		c.Theirs = map[string]string{"sql": t.SQL}
+	}
+	return
+}
+
+// Returns the sorted names of all schema objects of the given type, across all of the given schemas
+func schemaNames(objType string, schemas ...map[string]schemaObject) []string {
+	names := make(map[string]struct{})
+	for _, s := range schemas {
+		for name, obj := range s {
+			if obj.Type == objType {
+				names[name] = struct{}{}
+			}
+		}
+	}
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// Returns true if a table holds different rows in two databases.  The table must have the same structure in both
+func tableChanged(aDB sqlQuerier, bDB sqlQuerier, table string) (changed bool, err error) {
+	cols, err := readTableColumns(aDB, table)
+	if err != nil {
+		return
+	}
+	var a, b *rowReader
+	if a, err = newRowReader(aDB, table, cols, true); err != nil {
+		return
+	}
+	defer a.close()
+	if b, err = newRowReader(bDB, table, cols, true); err != nil {
+		return
+	}
+	defer b.close()
+	for !a.Done && !b.Done {
+		if compareKeys(a.Row.raw, b.Row.raw) != 0 || !rowsEqual(a.Row.Vals, b.Row.Vals) {
+			return true, nil
+		}
+		if err = a.next(); err != nil {
+			return
+		}
+		if err = b.next(); err != nil {
+			return
+		}
+	}
+	return a.Done != b.Done, nil
+}
@@ -14,6 +14,7 @@ var selectCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return selectDefault(args)
 	},
+	Annotations: locksNamedDatabases,
 }
 
 func init() {
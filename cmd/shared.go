@@ -1,177 +1,220 @@
 package cmd
 
 import (
-	"bytes"
-	"crypto/sha256"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/mitchellh/go-homedir"
 	rq "github.com/parnurzeal/gorequest"
+	"github.com/sqlitebrowser/dio/client"
+	"github.com/sqlitebrowser/dio/repo"
 )
 
-// Check if the database with the given SHA256 checksum is in local cache.  If it's not then download and cache it
-func checkDBCache(db, shaSum string) (err error) {
-	if _, err = os.Stat(filepath.Join(".dio", db, "db", shaSum)); os.IsNotExist(err) {
-		var body []byte
-		_, body, err = retrieveDatabase(db, pullCmdBranch, pullCmdCommit)
-		if err != nil {
-			return
-		}
+var (
+	dbhubClient     *client.Client
+	dbhubClientOnce sync.Once
+)
 
-		// Verify the SHA256 checksum of the new download
-		s := sha256.Sum256(body)
-		thisSum := hex.EncodeToString(s[:])
-		if thisSum != shaSum {
-			// The newly downloaded database file doesn't have the expected checksum.  Abort.
-			return errors.New(fmt.Sprintf("Aborting: newly downloaded database file should have "+
-				"checksum '%s', but data with checksum '%s' received\n", shaSum, thisSum))
-		}
+// Returns the DBHub.io API client for the user's certificate and server.  It's created on first use, after the config
+// has been read, then reused so its connections to the server are too
+func apiClient() *client.Client {
+	dbhubClientOnce.Do(func() {
+		dbhubClient = client.New(cloud, certUser, &TLSConfig, fmt.Sprintf("Dio %s", DIO_VERSION))
+	})
+	return dbhubClient
+}
 
-		// Write the database file to disk in the cache directory
-		err = ioutil.WriteFile(filepath.Join(".dio", db, "db", shaSum), body, 0644)
+// Returns true if a branch has been removed or renamed locally, and that change hasn't yet been pushed to the server
+func branchRemovedLocally(ops []branchOp, name string) (removed bool) {
+	for _, op := range ops {
+		switch {
+		case op.Branch == name && (op.Action == "remove" || op.Action == "rename"):
+			removed = true
+		case op.Branch == name && op.Action == "create", op.Action == "rename" && op.NewName == name:
+			removed = false
+		}
 	}
 	return
 }
 
-// Generate a stable SHA256 for a commit.
-func createCommitID(c commitEntry) string {
-	var b bytes.Buffer
-	b.WriteString(fmt.Sprintf("tree %s\n", c.Tree.ID))
-	if c.Parent != "" {
-		b.WriteString(fmt.Sprintf("parent %s\n", c.Parent))
-	}
-	for _, j := range c.OtherParents {
-		b.WriteString(fmt.Sprintf("parent %s\n", j))
-	}
-	b.WriteString(fmt.Sprintf("author %s <%s> %v\n", c.AuthorName, c.AuthorEmail,
-		c.Timestamp.UTC().Format(time.UnixDate)))
-	if c.CommitterEmail != "" {
-		b.WriteString(fmt.Sprintf("committer %s <%s> %v\n", c.CommitterName, c.CommitterEmail,
-			c.Timestamp.UTC().Format(time.UnixDate)))
-	}
-	b.WriteString("\n" + c.Message)
-	b.WriteByte(0)
-	s := sha256.Sum256(b.Bytes())
-	return hex.EncodeToString(s[:])
+// Check if the database with the given SHA256 checksum is in local cache.  If it's not then download (the version
+// from the given commit) and cache it
+func checkDBCache(db, commitID, shaSum string) (err error) {
+	if !localRepo().HasCached(db, shaSum) {
+		_, err = downloadToCache(db, "", commitID, shaSum)
+	}
+	return
 }
 
-// Generate the SHA256 for a tree.
-// Tree entry structure is:
-// * [ entry type ] [ licence sha256] [ file sha256 ] [ file name ] [ last modified (timestamp) ] [ file size (bytes) ]
-func createDBTreeID(entries []dbTreeEntry) string {
-	var b bytes.Buffer
-	for _, j := range entries {
-		b.WriteString(string(j.EntryType))
-		b.WriteByte(0)
-		b.WriteString(string(j.LicenceSHA))
-		b.WriteByte(0)
-		b.WriteString(j.Sha256)
-		b.WriteByte(0)
-		b.WriteString(j.Name)
-		b.WriteByte(0)
-		b.WriteString(j.LastModified.Format(time.RFC3339))
-		b.WriteByte(0)
-		b.WriteString(fmt.Sprintf("%d\n", j.Size))
-	}
-	s := sha256.Sum256(b.Bytes())
-	return hex.EncodeToString(s[:])
+// Works out which databases a command should work on.  Either every database tracked in the current directory, the
+// ones given on the command line, or the default database
+func dbsFromArgs(args []string, all bool) (dbs []string, err error) {
+	if all {
+		if len(args) > 0 {
+			return nil, errors.New("Either database names or --all can be given.  Not both!")
+		}
+		dbs, err = localRepo().Tracked()
+		if err != nil {
+			return
+		}
+		if len(dbs) == 0 {
+			return nil, errors.New("No databases are being tracked in this directory")
+		}
+		return
+	}
+	if len(args) > 0 {
+		return args, nil
+	}
+	db, err := getDefaultDatabase()
+	if err != nil {
+		return
+	}
+	if db == "" {
+		// No database name was given on the command line, and we don't have a default database selected
+		return nil, errors.New("No database file specified")
+	}
+	return []string{db}, nil
 }
 
-// Returns true if a database has been changed on disk since the last commit
-func dbChanged(db string, meta metaData) (changed bool, err error) {
-	// Retrieve the sha256, file size, and last modified date from the head commit of the active branch
-	head, ok := meta.Branches[meta.ActiveBranch]
-	if !ok {
-		err = errors.New("Aborting: info for the active branch isn't found in the local branch cache")
+// Downloads a database from DBHub.io into the local cache.  The download goes into a partial file in the database's
+// tmp directory first, so if it's interrupted the next attempt picks up from where it stopped.  Once complete, the
+// SHA256 of the file is checked before it's moved into the cache.  The response is returned (with its body already
+// closed) so the caller can use the headers
+func downloadToCache(db string, branch string, commit string, shaSum string) (resp *http.Response, err error) {
+	tmpDir := filepath.Join(".dio", db, "tmp")
+	if err = os.MkdirAll(tmpDir, 0770); err != nil {
 		return
 	}
-	c, ok := meta.Commits[head.Commit]
-	if !ok {
-		err = errors.New("Aborting: info for the head commit isn't found in the local commit cache")
+	r := localRepo()
+	if err = os.MkdirAll(filepath.Dir(r.CachePath(db, shaSum)), 0770); err != nil {
 		return
 	}
-	metaSHASum := c.Tree.Entries[0].Sha256
-	metaFileSize := c.Tree.Entries[0].Size
-	metaLastModified := c.Tree.Entries[0].LastModified.Truncate(time.Second).UTC()
+	partFile := filepath.Join(tmpDir, shaSum+".part")
+	var offset int64
+	if fi, errStat := os.Stat(partFile); errStat == nil {
+		offset = fi.Size()
+	}
+	resp, err = retrieveDatabase(db, branch, commit, offset)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
 
-	// If the file size or last modified date in the metadata are different from the current file info, then the
-	// local file has probably changed.  Well, "probably" for the last modified day, but "definitely" if the file
-	// size is different
-	fi, err := os.Stat(db)
+	// If the server sent the whole database rather than just the missing part, start again from the beginning
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if resp.StatusCode != http.StatusPartialContent {
+		flags |= os.O_TRUNC
+		offset = 0
+	}
+	f, err := os.OpenFile(partFile, flags, 0644)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return false, nil
-		}
 		return
 	}
-	fileSize := fi.Size()
-	lastModified := fi.ModTime().Truncate(time.Second).UTC()
-	if metaFileSize != fileSize || !metaLastModified.Equal(lastModified) {
-		changed = true
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	progress := newProgressWriter(fmt.Sprintf("Downloading '%s'", db), offset, total)
+	n, err := io.Copy(io.MultiWriter(f, progress), resp.Body)
+	progress.finish()
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		// The partial file is kept, so the download can be resumed
+		err = errors.New(numFormat.Sprintf("Download of '%s' interrupted after %d bytes (%v).  Run the command "+
+			"again to resume it", db, offset+n, err))
 		return
 	}
 
-	// * If the file size and last modified date are still the same, we SHA256 checksum and compare the file *
-
-	// TODO: Should we only do this for smaller files (below some TBD threshold)?
-
-	// Read the database from disk, and calculate it's sha256
-	b, err := ioutil.ReadFile(db)
+	// Make sure the database is the one expected, then move it into the cache
+	thisSum, _, err := repo.FileSHA256(partFile)
 	if err != nil {
 		return
 	}
-	if int64(len(b)) != fileSize {
-		err = errors.New(numFormat.Sprintf("Aborting: # of bytes read (%d) when reading the database "+
-			"doesn't match the database file size (%d)", len(b), fileSize))
+	if thisSum != shaSum {
+		// The partial file is no use, so remove it so the next attempt starts from scratch
+		_ = os.Remove(partFile)
+		err = errors.New(fmt.Sprintf("Aborting: newly downloaded database file should have checksum '%s', but "+
+			"data with checksum '%s' received", shaSum, thisSum))
 		return
 	}
-	s := sha256.Sum256(b)
-	shaSum := hex.EncodeToString(s[:])
-
-	// Check if a change has been made
-	if metaSHASum != shaSum {
-		changed = true
-	}
+	err = os.Rename(partFile, r.CachePath(db, shaSum))
 	return
 }
 
-// Retrieves the list of databases available to the user
-var getDatabases = func(url string, user string) (dbList []dbListEntry, err error) {
-	resp, body, errs := rq.New().TLSClientConfig(&TLSConfig).
-		Get(fmt.Sprintf("%s/%s", url, user)).
-		Set("User-Agent", fmt.Sprintf("Dio %s", DIO_VERSION)).
-		EndBytes()
-	if errs != nil {
-		e := fmt.Sprintln("Errors when retrieving the database list:")
-		for _, err := range errs {
-			e += fmt.Sprintf(err.Error())
+// Runs a command for each of the given databases.  A failure for one database doesn't stop the others from being
+// processed, and a summary of the results is displayed at the end.  The reset function is called before each
+// database, so any command options changed while processing one database don't affect the next
+func forEachDatabase(dbs []string, fn func(db string) error, reset func()) (err error) {
+	if len(dbs) == 1 {
+		return fn(dbs[0])
+	}
+	results := make([]error, len(dbs))
+	failed := 0
+	for i, db := range dbs {
+		if reset != nil {
+			reset()
+		}
+		_, err = fmt.Fprintf(fOut, "Database '%s':\n", db)
+		if err != nil {
+			return
+		}
+		results[i] = fn(db)
+		if results[i] != nil {
+			failed++
+			_, err = fmt.Fprintf(fOut, "  Error: %s\n", results[i])
+			if err != nil {
+				return
+			}
+		}
+		_, err = fmt.Fprintln(fOut)
+		if err != nil {
+			return
 		}
-		err = errors.New(e)
-		return
 	}
-	defer resp.Body.Close()
-	err = json.Unmarshal(body, &dbList)
+
+	// Display the summary
+	_, err = fmt.Fprintln(fOut, "Summary:")
 	if err != nil {
-		_, errInner := fmt.Fprintf(fOut, "Error retrieving database list: '%v'\n", err.Error())
-		if errInner != nil {
-			err = fmt.Errorf("%s: %s", err, errInner)
+		return
+	}
+	for i, db := range dbs {
+		if results[i] == nil {
+			_, err = fmt.Fprintf(fOut, "  * '%s': ok\n", db)
+		} else {
+			_, err = fmt.Fprintf(fOut, "  * '%s': failed - %s\n", db, results[i])
+		}
+		if err != nil {
 			return
 		}
 	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d databases failed", failed, len(dbs))
+	}
+	return
+}
+
+// Retrieves the list of databases available to the user
+var getDatabases = func(url string, user string) (dbList []dbListEntry, err error) {
+	c := client.New(url, user, &TLSConfig, fmt.Sprintf("Dio %s", DIO_VERSION))
+	dbList, err = c.ListDatabases(context.Background())
+	if err != nil {
+		err = fmt.Errorf("Errors when retrieving the database list: %v", err)
+	}
 	return
 }
 
@@ -259,25 +302,11 @@ func getDefaultDatabase() (db string, err error) {
 
 // Returns a map with the list of licences available on the remote server
 var getLicences = func() (list map[string]licenceEntry, err error) {
-	// Retrieve the database list from the cloud
-	resp, body, errs := rq.New().TLSClientConfig(&TLSConfig).Get(cloud+"/licence/list").
-		Set("User-Agent", fmt.Sprintf("Dio %s", DIO_VERSION)).
-		End()
-	if errs != nil {
-		e := fmt.Sprintln("errors when retrieving the licence list:")
-		for _, err := range errs {
-			e += fmt.Sprintf(err.Error())
-		}
-		return list, errors.New(e)
-	}
-	defer resp.Body.Close()
-
-	// Convert the JSON response to our licence entry structure
-	err = json.Unmarshal([]byte(body), &list)
+	list, err = apiClient().LicenceList(context.Background())
 	if err != nil {
-		return list, errors.New(fmt.Sprintf("error retrieving licence list: '%v'\n", err.Error()))
+		err = fmt.Errorf("errors when retrieving the licence list: %v", err)
 	}
-	return list, err
+	return
 }
 
 // getUserAndServer() returns the user name and server from a DBHub.io client certificate
@@ -317,37 +346,28 @@ func getUserAndServer() (userAcc string, email string, certServer string, err er
 	return
 }
 
-// Loads the local metadata from disk (if present).  If not, then grab it from the remote server, storing it locally.
-//     Note - This is subtly different than calling updateMetadata() itself.  This function
-//     (loadMetadata()) is for use by commands which can use a local metadata cache all by itself
-//     (eg branch creation), but only if it already exists.  For those, it only calls the
-//     remote server when a local metadata cache doesn't exist.
-func loadMetadata(db string) (meta metaData, err error) {
-	// Check if the local metadata exists.  If not, pull it from the remote server
-	if _, err = os.Stat(filepath.Join(".dio", db, "metadata.json")); os.IsNotExist(err) {
-		_, err = updateMetadata(db, true)
-		if err != nil {
-			return
-		}
-	}
-
-	// Read and parse the metadata
-	var md []byte
-	md, err = ioutil.ReadFile(filepath.Join(".dio", db, "metadata.json"))
+// Returns true if the given file is a SQLite database, going by the header at the start of it
+func isSQLiteFile(path string) bool {
+	f, err := os.Open(path)
 	if err != nil {
-		return
+		return false
 	}
-	err = json.Unmarshal([]byte(md), &meta)
-
-	// If the tag or release maps are missing, create initial empty ones.
-	// This is a safety check, not sure if it's really needed
-	if meta.Tags == nil {
-		meta.Tags = make(map[string]tagEntry)
+	defer f.Close()
+	header := make([]byte, 16)
+	if _, err = io.ReadFull(f, header); err != nil {
+		return false
 	}
-	if meta.Releases == nil {
-		meta.Releases = make(map[string]releaseEntry)
+	return string(header) == "SQLite format 3\x00"
+}
+
+// Loads the local metadata for a database apart from its commits, for when only the branches, tags, etc are needed.
+// When there's no local metadata, the metadata on DBHub.io is used instead if getRemote is set
+func localFetchHeads(db string, getRemote bool) (meta metaData, err error) {
+	r := localRepo()
+	if r.HasMetadata(db) {
+		return r.LoadHeads(db)
 	}
-	return
+	return localFetchMetadata(db, getRemote)
 }
 
 // Loads the local metadata cache for the requested database, if present.  Otherwise, (optionally) retrieve it from
@@ -355,15 +375,14 @@ func loadMetadata(db string) (meta metaData, err error) {
 //   Note - this is suitable for use by read-only functions (eg: branch/tag list, log)
 //   as it doesn't store or change any metadata on disk
 var localFetchMetadata = func(db string, getRemote bool) (meta metaData, err error) {
-	md, err := ioutil.ReadFile(filepath.Join(".dio", db, "metadata.json"))
-	if err == nil {
-		err = json.Unmarshal([]byte(md), &meta)
-		return
+	r := localRepo()
+	if r.HasMetadata(db) {
+		return r.LoadMetadata(db)
 	}
 
 	// Can't read local metadata, and we're requested to not grab remote metadata.  So, nothing to do but exit
 	if !getRemote {
-		err = errors.New("No local metadata for the database exists")
+		err = repo.ErrNoMetadata
 		return
 	}
 
@@ -372,284 +391,294 @@ var localFetchMetadata = func(db string, getRemote bool) (meta metaData, err err
 	return
 }
 
-// Merges old and new metadata
-func mergeMetadata(origMeta metaData, newMeta metaData) (mergedMeta metaData, err error) {
+// Returns the local version history for the databases in the current directory.  Database versions and metadata
+// missing from it are retrieved from DBHub.io
+func localRepo() *repo.Repo {
+	r := repo.Open(".")
+	r.FetchDB = func(db string, commitID string, shaSum string) (err error) {
+		_, err = downloadToCache(db, "", commitID, shaSum)
+		return
+	}
+	r.FetchMetadata = func(db string) (err error) {
+		_, err = updateMetadata(db, "fetch", true)
+		return
+	}
+	r.VerifyHashes = verifyHashes
+	r.Warn = func(msg string) {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+	return r
+}
+
+// Merges old and new metadata.  The old metadata only needs the branches, tags, etc, not the commits, as those are
+// looked up in the local store when needed.  The merged metadata holds just the commits from the server which aren't
+// stored locally yet.  Unless moveBranches is set, local branches are left where they are, and only the commits and
+// the branch heads on the server are brought in
+func mergeMetadata(db string, origMeta metaData, newMeta metaData, moveBranches bool) (mergedMeta metaData,
+	err error) {
+	r := localRepo()
 	mergedMeta.Branches = make(map[string]branchEntry)
 	mergedMeta.Commits = make(map[string]commitEntry)
 	mergedMeta.Tags = make(map[string]tagEntry)
 	mergedMeta.Releases = make(map[string]releaseEntry)
-	if len(origMeta.Commits) > 0 {
-		// Start by check branches which exist locally
-		// TODO: Change sort order to be by alphabetical branch name, as the current unordered approach leads to
-		//       inconsistent output across runs
-		for brName, brData := range origMeta.Branches {
-			matchFound := false
-			for newBranch, newData := range newMeta.Branches {
-				if brName == newBranch {
-					// A branch with this name exists on both the local and remote server
-					matchFound = true
-					skipFurtherChecks := false
-
-					// Rewind back to the local root commit, making a list of the local commits IDs we pass through
-					var localList []string
-					localCommit := origMeta.Commits[brData.Commit]
-					localList = append(localList, localCommit.ID)
-					for localCommit.Parent != "" {
-						localCommit = origMeta.Commits[localCommit.Parent]
-						localList = append(localList, localCommit.ID)
-					}
-					localLength := len(localList) - 1
-
-					// Rewind back to the remote root commit, making a list of the remote commit IDs we pass through
-					var remoteList []string
-					remoteCommit := newMeta.Commits[newData.Commit]
-					remoteList = append(remoteList, remoteCommit.ID)
-					for remoteCommit.Parent != "" {
-						remoteCommit = newMeta.Commits[remoteCommit.Parent]
-						remoteList = append(remoteList, remoteCommit.ID)
-					}
-					remoteLength := len(remoteList) - 1
-
-					// Make sure the local and remote commits start out with the same commit ID
-					if localCommit.ID != remoteCommit.ID {
-						// The local and remote branches don't have a common root, so abort
-						err = errors.New(fmt.Sprintf("Local and remote branch %s don't have a common root.  "+
-							"Aborting.", brName))
-						return
-					}
-
-					// If there are more commits in the local branch than in the remote one, we keep the local branch
-					// as it probably means the user is adding stuff locally (prior to pushing to the server)
-					if localLength > remoteLength {
-						c := origMeta.Commits[brData.Commit]
-						mergedMeta.Commits[c.ID] = origMeta.Commits[c.ID]
-						for c.Parent != "" {
-							c = origMeta.Commits[c.Parent]
-							mergedMeta.Commits[c.ID] = origMeta.Commits[c.ID]
-						}
-
-						// Copy the local branch data
-						mergedMeta.Branches[brName] = brData
-					}
-
-					// We've wound back to the root commit for both the local and remote branch, and the root commit
-					// IDs match.  Now we walk forwards through the commits, comparing them.
-					branchesSame := true
-					for i := 0; i <= localLength; i++ {
-						lCommit := localList[localLength-i]
-						if i > remoteLength {
-							branchesSame = false
-						} else {
-							if lCommit != remoteList[remoteLength-i] {
-								// There are conflicting commits in this branch between the local metadata and the
-								// remote.  This will probably need to be resolved by user action.
-								branchesSame = false
-							}
-						}
-					}
-
-					// If the local branch commits are in the remote branch already, then we only need to check for
-					// newer commits in the remote branch
-					if branchesSame {
-						if remoteLength > localLength {
-							_, err = fmt.Fprintf(fOut, "  * Remote branch '%s' has %d new commit(s)... merged\n",
-								brName, remoteLength-localLength)
-							if err != nil {
-								return
-							}
-							for _, j := range remoteList {
-								mergedMeta.Commits[j] = newMeta.Commits[j]
-							}
-							mergedMeta.Branches[brName] = newMeta.Branches[brName]
-						} else {
-							// The local and remote branches are the same, so copy the local branch commits across to
-							// the merged data structure
-							_, err = fmt.Fprintf(fOut, "  * Branch '%s' is unchanged\n", brName)
-							if err != nil {
-								return
-							}
-							for _, j := range localList {
-								mergedMeta.Commits[j] = origMeta.Commits[j]
-							}
-							mergedMeta.Branches[brName] = brData
-						}
-						// No need to do further checks on this branch
-						skipFurtherChecks = true
-					}
-
-					if skipFurtherChecks == false && brData.Commit != newData.Commit {
-						_, err = fmt.Fprintf(fOut, "  * Branch '%s' has local changes, not on the server\n",
-							brName)
-						if err != nil {
-							return
-						}
-
-						// Copy across the commits from the local branch
-						localCommit := origMeta.Commits[brData.Commit]
-						mergedMeta.Commits[localCommit.ID] = origMeta.Commits[localCommit.ID]
-						for localCommit.Parent != "" {
-							localCommit = origMeta.Commits[localCommit.Parent]
-							mergedMeta.Commits[localCommit.ID] = origMeta.Commits[localCommit.ID]
-						}
-
-						// Copy across the branch data entry for the local branch
-						mergedMeta.Branches[brName] = brData
-					}
-					if skipFurtherChecks == false && brData.Description != newData.Description {
-						_, err = fmt.Fprintf(fOut, "  * Description for branch %s differs between the local "+
-							"and remote\n"+
-							"    * Local: '%s'\n"+
-							"    * Remote: '%s'\n", brName, brData.Description, newData.Description)
-						if err != nil {
-							return
-						}
-					}
-				}
+
+	// Bring in the commits from the server which aren't stored locally, and remember where the branches there are
+	if err = setRemoteBranches(db, &mergedMeta, newMeta); err != nil {
+		return
+	}
+
+	// Start by check branches which exist locally
+	// TODO: Change sort order to be by alphabetical branch name, as the current unordered approach leads to
+	//       inconsistent output across runs
+	for brName, brData := range origMeta.Branches {
+		newData, ok := newMeta.Branches[brName]
+		if !ok {
+			// This seems to be a branch that's not on the server, so we keep it as-is
+			_, err = fmt.Fprintf(fOut, "  * Branch '%s' is local only, not on the server\n", brName)
+			if err != nil {
+				return
+			}
+			mergedMeta.Branches[brName] = brData
+			continue
+		}
+
+		// A branch with this name exists on both the local and remote server
+		if brData.Commit == newData.Commit {
+			_, err = fmt.Fprintf(fOut, "  * Branch '%s' is unchanged\n", brName)
+			if err != nil {
+				return
 			}
-			if !matchFound {
-				// This seems to be a branch that's not on the server, so we keep it as-is
-				_, err = fmt.Fprintf(fOut, "  * Branch '%s' is local only, not on the server\n", brName)
+			mergedMeta.Branches[brName] = brData
+			continue
+		}
+
+		// If the local branch head is in the history of the remote branch, including through merged in parents, the
+		// remote branch only adds newer commits to the local one
+		remoteHistory := repo.CommitAncestors(newMeta, newData.Commit)
+		if _, fastForward := remoteHistory[brData.Commit]; fastForward {
+			newCommits := len(remoteHistory) - len(repo.CommitAncestors(newMeta, brData.Commit))
+			if moveBranches {
+				_, err = fmt.Fprintf(fOut, "  * Remote branch '%s' has %d new commit(s)... merged\n", brName,
+					newCommits)
 				if err != nil {
 					return
 				}
-				mergedMeta.Branches[brName] = brData
-
-				// Copy across the commits from the local branch
-				localCommit := origMeta.Commits[brData.Commit]
-				mergedMeta.Commits[localCommit.ID] = origMeta.Commits[localCommit.ID]
-				for localCommit.Parent != "" {
-					localCommit = origMeta.Commits[localCommit.Parent]
-					mergedMeta.Commits[localCommit.ID] = origMeta.Commits[localCommit.ID]
+				mergedMeta.Branches[brName] = newData
+			} else {
+				// Only the commits are wanted, so the local branch stays where it is
+				_, err = fmt.Fprintf(fOut, "  * Remote branch '%s' has %d new commit(s)... fetched\n", brName,
+					newCommits)
+				if err != nil {
+					return
 				}
-
-				// Copy across the branch data entry for the local branch
 				mergedMeta.Branches[brName] = brData
 			}
+			continue
 		}
 
-		// Add new branches
-		for remoteName, remoteData := range newMeta.Branches {
-			if _, ok := origMeta.Branches[remoteName]; ok == false {
-				// Copy their commit data
-				newCommit := newMeta.Commits[remoteData.Commit]
-				mergedMeta.Commits[newCommit.ID] = newMeta.Commits[newCommit.ID]
-				for newCommit.Parent != "" {
-					newCommit = newMeta.Commits[newCommit.Parent]
-					mergedMeta.Commits[newCommit.ID] = newMeta.Commits[newCommit.ID]
-				}
+		// Make sure the local and remote branches share history, which they don't if the root commit of the remote
+		// branch isn't stored locally (so is amongst the commits brought in from the server) or isn't in the history
+		// of the local branch
+		root := newData.Commit
+		for newMeta.Commits[root].Parent != "" {
+			root = newMeta.Commits[root].Parent
+		}
+		shared := false
+		if _, found := mergedMeta.Commits[root]; !found {
+			shared, err = r.IsAncestor(db, root, brData.Commit)
+			if err != nil {
+				return
+			}
+		}
+		if !shared {
+			// The local and remote branches don't have a common root, so abort
+			err = errors.New(fmt.Sprintf("Local and remote branch %s don't have a common root.  Aborting.",
+				brName))
+			return
+		}
 
-				// Copy their branch data
-				mergedMeta.Branches[remoteName] = remoteData
+		// The local branch has commits which aren't on the server.  This will probably need to be resolved by user
+		// action, so the local branch is kept
+		_, err = fmt.Fprintf(fOut, "  * Branch '%s' has local changes, not on the server\n", brName)
+		if err != nil {
+			return
+		}
+		mergedMeta.Branches[brName] = brData
+		if brData.Description != newData.Description {
+			_, err = fmt.Fprintf(fOut, "  * Description for branch %s differs between the local and remote\n"+
+				"    * Local: '%s'\n"+
+				"    * Remote: '%s'\n", brName, brData.Description, newData.Description)
+			if err != nil {
+				return
+			}
+		}
+	}
 
-				_, err = fmt.Fprintf(fOut, "  * New remote branch '%s' merged\n", remoteName)
+	// Add new branches, skipping those removed or renamed locally
+	for remoteName, remoteData := range newMeta.Branches {
+		if branchRemovedLocally(origMeta.BranchOps, remoteName) {
+			continue
+		}
+		if _, ok := origMeta.Branches[remoteName]; ok == false {
+			if !moveBranches {
+				_, err = fmt.Fprintf(fOut, "  * New remote branch '%s' fetched\n", remoteName)
 				if err != nil {
 					return
 				}
+				continue
 			}
-		}
 
-		// Preserve existing tags
-		for tagName, tagData := range origMeta.Tags {
-			mergedMeta.Tags[tagName] = tagData
+			// Copy their branch data
+			mergedMeta.Branches[remoteName] = remoteData
+
+			_, err = fmt.Fprintf(fOut, "  * New remote branch '%s' merged\n", remoteName)
+			if err != nil {
+				return
+			}
 		}
+	}
 
-		// Add new tags
-		for tagName, tagData := range newMeta.Tags {
-			// Only add tags which aren't already in the merged metadata structure
-			if _, tagFound := mergedMeta.Tags[tagName]; tagFound == false {
-				// Also make sure its commit is in the commit list.  If it's not, then skip adding the tag
-				if _, commitFound := mergedMeta.Commits[tagData.Commit]; commitFound == true {
-					_, err = fmt.Fprintf(fOut, "  * New tag '%s' merged\n", tagName)
-					if err != nil {
-						return
-					}
-					mergedMeta.Tags[tagName] = tagData
-				}
+	// Preserve existing tags, letting the user know about any pointing to a different commit on the server
+	for tagName, tagData := range origMeta.Tags {
+		mergedMeta.Tags[tagName] = tagData
+		if remoteTag, ok := newMeta.Tags[tagName]; ok && remoteTag.Commit != tagData.Commit {
+			_, err = fmt.Fprintf(fOut, "  * Tag '%s' is on commit %s locally, but commit %s on the server\n",
+				tagName, tagData.Commit, remoteTag.Commit)
+			if err != nil {
+				return
 			}
 		}
+	}
+
+	// Preserve the branch changes, and the tags and releases removed locally, which haven't yet been pushed to the
+	// server
+	mergedMeta.BranchOps = origMeta.BranchOps
+	mergedMeta.DeletedTags = origMeta.DeletedTags
+	mergedMeta.DeletedReleases = origMeta.DeletedReleases
+
+	// Branches renamed locally keep tracking their branch on the server under the new name, until the rename is pushed
+	for _, op := range origMeta.BranchOps {
+		if remote, ok := mergedMeta.RemoteBranches[op.Branch]; ok && op.Action == "rename" {
+			mergedMeta.RemoteBranches[op.NewName] = remote
+			delete(mergedMeta.RemoteBranches, op.Branch)
+		}
+	}
 
-		// Preserve existing releases
-		for relName, relData := range origMeta.Releases {
-			mergedMeta.Releases[relName] = relData
+	// Add new tags
+	for tagName, tagData := range newMeta.Tags {
+		// Skip tags which have been removed locally
+		if _, deleted := origMeta.DeletedTags[tagName]; deleted {
+			continue
 		}
 
-		// Add new releases
-		for relName, relData := range newMeta.Releases {
-			// Only add releases which aren't already in the merged metadata structure
-			if _, relFound := mergedMeta.Releases[relName]; relFound == false {
-				// Also make sure its commit is in the commit list.  If it's not, then skip adding the release
-				if _, commitFound := mergedMeta.Commits[relData.Commit]; commitFound == true {
-					_, err = fmt.Fprintf(fOut, "  * New release '%s' merged\n", relName)
-					if err != nil {
-						return
-					}
-					mergedMeta.Releases[relName] = relData
+		// Only add tags which aren't already in the merged metadata structure
+		if _, tagFound := mergedMeta.Tags[tagName]; tagFound == false {
+			// Also make sure its commit is known.  If it's not, then skip adding the tag
+			var commitFound bool
+			_, commitFound, err = r.FindCommit(db, mergedMeta, tagData.Commit)
+			if err != nil {
+				return
+			}
+			if commitFound {
+				_, err = fmt.Fprintf(fOut, "  * New tag '%s' merged\n", tagName)
+				if err != nil {
+					return
 				}
+				mergedMeta.Tags[tagName] = tagData
 			}
 		}
+	}
 
-		// Copy the default branch name from the remote server
-		mergedMeta.DefBranch = newMeta.DefBranch
+	// Preserve existing releases, letting the user know about any pointing to a different commit on the server
+	for relName, relData := range origMeta.Releases {
+		mergedMeta.Releases[relName] = relData
+		if remoteRel, ok := newMeta.Releases[relName]; ok && remoteRel.Commit != relData.Commit {
+			_, err = fmt.Fprintf(fOut, "  * Release '%s' is on commit %s locally, but commit %s on the "+
+				"server\n", relName, relData.Commit, remoteRel.Commit)
+			if err != nil {
+				return
+			}
+		}
+	}
 
-		// If an active (local) branch has been set, then copy it to the merged metadata.  Otherwise use the default
-		// branch as given by the remote server
-		if origMeta.ActiveBranch != "" {
-			mergedMeta.ActiveBranch = origMeta.ActiveBranch
-		} else {
-			mergedMeta.ActiveBranch = newMeta.DefBranch
+	// Add new releases
+	for relName, relData := range newMeta.Releases {
+		// Skip releases which have been removed locally
+		if _, deleted := origMeta.DeletedReleases[relName]; deleted {
+			continue
 		}
 
-		_, err = fmt.Fprintln(fOut)
-		if err != nil {
-			return
+		// Only add releases which aren't already in the merged metadata structure
+		if _, relFound := mergedMeta.Releases[relName]; relFound == false {
+			// Also make sure its commit is known.  If it's not, then skip adding the release
+			var commitFound bool
+			_, commitFound, err = r.FindCommit(db, mergedMeta, relData.Commit)
+			if err != nil {
+				return
+			}
+			if commitFound {
+				_, err = fmt.Fprintf(fOut, "  * New release '%s' merged\n", relName)
+				if err != nil {
+					return
+				}
+				mergedMeta.Releases[relName] = relData
+			}
 		}
-	} else {
-		// No existing metadata, so just copy across the remote metadata
-		mergedMeta = newMeta
+	}
 
-		// Use the remote default branch as the initial active (local) branch
+	// Copy the default branch name from the remote server
+	mergedMeta.DefBranch = newMeta.DefBranch
+
+	// If an active (local) branch has been set, then copy it to the merged metadata.  Otherwise use the default
+	// branch as given by the remote server
+	if origMeta.ActiveBranch != "" {
+		mergedMeta.ActiveBranch = origMeta.ActiveBranch
+	} else {
 		mergedMeta.ActiveBranch = newMeta.DefBranch
 	}
+
+	_, err = fmt.Fprintln(fOut)
 	return
 }
 
-// Retrieves a database from DBHub.io
-func retrieveDatabase(db string, branch string, commit string) (resp rq.Response, body []byte, err error) {
-	dbURL := fmt.Sprintf("%s/%s/%s", cloud, certUser, db)
-	req := rq.New().TLSClientConfig(&TLSConfig).Get(dbURL).
-		Set("User-Agent", fmt.Sprintf("Dio %s", DIO_VERSION))
-	if branch != "" {
-		req.Query(fmt.Sprintf("branch=%s", url.QueryEscape(branch)))
-	} else {
-		req.Query(fmt.Sprintf("commit=%s", url.QueryEscape(commit)))
-	}
-	var errs []error
-	resp, body, errs = req.EndBytes()
-	if errs != nil {
-		log.Print("Errors when downloading database:")
-		for _, err := range errs {
-			log.Print(err.Error())
-		}
-		err = errors.New("Error when downloading database")
+// Works out which commit a revision given on the command line refers to, using the local metadata for a database.  See
+// repo.ResolveRevision for the forms a revision can take
+func resolveLocalRevision(db string, rev string) (commitID string, err error) {
+	meta, err := localRepo().LoadMetadata(db)
+	if err != nil {
 		return
 	}
-	if resp.StatusCode != http.StatusOK {
-		if resp.StatusCode == http.StatusNotFound {
-			if branch != "" {
-				err = errors.New(fmt.Sprintf("That database & branch '%s' aren't known on DBHub.io",
-					branch))
-				return
-			}
-			if commit != "" {
-				err = errors.New(fmt.Sprintf("Requested database not found with commit %s.",
-					commit))
-				return
-			}
-			err = errors.New("Requested database not found")
+	return repo.ResolveRevision(meta, rev)
+}
+
+// Retrieves a database from DBHub.io.  On success, the database is streamed from the body of the returned response,
+// which the caller needs to close.  When offset is above zero, only the part of the database after it is requested.
+// Servers which don't support that send the whole database instead, with a status of 200 rather than 206
+func retrieveDatabase(db string, branch string, commit string, offset int64) (resp *http.Response, err error) {
+	resp, err = apiClient().Download(context.Background(), db, branch, commit, offset)
+	if client.IsNotFound(err) {
+		if branch != "" {
+			err = errors.New(fmt.Sprintf("That database & branch '%s' aren't known on DBHub.io",
+				branch))
 			return
 		}
-		err = errors.New(fmt.Sprintf("Download failed with an error: HTTP status %d - '%v'\n",
-			resp.StatusCode, resp.Status))
+		if commit != "" {
+			err = errors.New(fmt.Sprintf("Requested database not found with commit %s.",
+				commit))
+			return
+		}
+		err = errors.New("Requested database not found")
+		return
+	}
+	if code := client.StatusCode(err); code != 0 {
+		err = errors.New(fmt.Sprintf("Download failed with an error: HTTP status %d - '%v'\n", code,
+			http.StatusText(code)))
+		return
+	}
+	if err != nil {
+		log.Print("Errors when downloading database:")
+		log.Print(err.Error())
+		err = errors.New("Error when downloading database")
 	}
 	return
 }
@@ -657,31 +686,27 @@ func retrieveDatabase(db string, branch string, commit string) (resp rq.Response
 // Retrieves database metadata from DBHub.io
 var retrieveMetadata = func(db string) (meta metaData, onCloud bool, err error) {
 	// Download the database metadata
-	resp, md, errs := rq.New().TLSClientConfig(&TLSConfig).Get(cloud+"/metadata/get").
-		Query(fmt.Sprintf("username=%s", url.QueryEscape(certUser))).
-		Query(fmt.Sprintf("folder=%s", "/")).
-		Query(fmt.Sprintf("dbname=%s", url.QueryEscape(db))).
-		Set("User-Agent", fmt.Sprintf("Dio %s", DIO_VERSION)).
-		End()
-
-	if errs != nil {
-		log.Print("Errors when downloading database metadata:")
-		for _, err := range errs {
-			log.Print(err.Error())
-		}
-		return metaData{}, false, errors.New("Error when downloading database metadata")
-	}
-	if resp.StatusCode == http.StatusNotFound {
+	m, err := apiClient().GetMetadata(context.Background(), db)
+	if client.IsNotFound(err) {
 		return metaData{}, false, nil
 	}
-	if resp.StatusCode != http.StatusOK {
+	if code := client.StatusCode(err); code != 0 {
 		return metaData{}, false,
-			errors.New(fmt.Sprintf("Metadata download failed with an error: HTTP status %d - '%v'\n",
-				resp.StatusCode, resp.Status))
+			errors.New(fmt.Sprintf("Metadata download failed with an error: HTTP status %d - '%v'\n", code,
+				http.StatusText(code)))
 	}
-	err = json.Unmarshal([]byte(md), &meta)
 	if err != nil {
-		return
+		log.Print("Errors when downloading database metadata:")
+		log.Print(err.Error())
+		return metaData{}, false, errors.New("Error when downloading database metadata")
+	}
+	meta = metaData{
+		ActiveBranch: m.ActiveBranch,
+		Branches:     m.Branches,
+		Commits:      m.Commits,
+		DefBranch:    m.DefBranch,
+		Releases:     m.Releases,
+		Tags:         m.Tags,
 	}
 	return meta, true, nil
 }
@@ -708,61 +733,120 @@ func saveDefaultDatabase(db string) (err error) {
 	if err != nil {
 		return
 	}
-	err = ioutil.WriteFile(filepath.Join(".dio", "defaults.json"), j, 0644)
+	err = repo.WriteFileAtomic(filepath.Join(".dio", "defaults.json"), j, 0644)
 	return
 }
 
-// Saves the metadata to a local cache
-func saveMetadata(db string, meta metaData) (err error) {
-	// Create the metadata directory if needed
-	if _, err = os.Stat(filepath.Join(".dio", db)); os.IsNotExist(err) {
-		// We create the "db" directory instead, as that'll be needed anyway and MkdirAll() ensures the .dio/<db>
-		// directory will be created on the way through
-		err = os.MkdirAll(filepath.Join(".dio", db, "db"), 0770)
-		if err != nil {
-			return
-		}
+// Sends a change for a database (eg a new tag) to the given DBHub.io API end point
+func sendChange(endpoint string, db string, params map[string]string) (err error) {
+	err = apiClient().SendChange(context.Background(), endpoint, db, params)
+	if errors.Is(err, client.ErrUnsupported) {
+		return fmt.Errorf("%s doesn't support '%s' changes yet, as it needs a newer version of DBHub.io.  The "+
+			"change has been kept locally, so it can be sent once the server has been upgraded", cloud, endpoint)
+	}
+	var e *client.Error
+	if errors.As(err, &e) && e.StatusCode != 0 {
+		return fmt.Errorf("Server rejected the change with HTTP status %d: %s", e.StatusCode, e.Message)
 	}
+	if err != nil {
+		log.Print("Errors when sending change to the server:")
+		log.Print(err.Error())
+		return errors.New("Error when sending change to the server")
+	}
+	return
+}
 
-	// Serialise the metadata to JSON
-	var jsonString []byte
-	jsonString, err = json.MarshalIndent(meta, "", "  ")
+// Records the branch heads on the server as the remote tracking branches, adding the commits for them which aren't
+// stored locally yet to the commit list
+func setRemoteBranches(db string, meta *metaData, remoteMeta metaData) (err error) {
+	meta.RemoteBranches = make(map[string]branchEntry)
+	if meta.Commits == nil {
+		meta.Commits = make(map[string]commitEntry)
+	}
+	var heads []string
+	for name, br := range remoteMeta.Branches {
+		meta.RemoteBranches[name] = br
+		heads = append(heads, br.Commit)
+	}
+	missing, err := localRepo().MissingCommits(db, remoteMeta, heads...)
 	if err != nil {
 		return
 	}
+	for id := range missing {
+		if _, ok := meta.Commits[id]; !ok {
+			meta.Commits[id] = remoteMeta.Commits[id]
+		}
+	}
+	return
+}
 
-	// Write the updated metadata to disk
-	mdFile := filepath.Join(".dio", db, "metadata.json")
-	err = ioutil.WriteFile(mdFile, jsonString, 0644)
-	return err
+// Returns how a local branch compares to the same branch on the server, as last seen.  If nothing is known about the
+// branches on the server, nil is returned
+func trackingInfo(db string, meta metaData, branch string) (t *branchTracking, err error) {
+	if meta.RemoteBranches == nil {
+		return
+	}
+	remote, ok := meta.RemoteBranches[branch]
+	if !ok {
+		return &branchTracking{}, nil
+	}
+	t = &branchTracking{OnServer: true}
+	t.Ahead, t.Behind, err = localRepo().AheadBehind(db, meta.Branches[branch].Commit, remote.Commit)
+	return
 }
 
-// Saves metadata to the local cache, merging in with any existing metadata
-func updateMetadata(db string, saveMeta bool) (mergedMeta metaData, err error) {
-	// Check for existing metadata file, loading it if present
-	var md []byte
+// Returns a description of how a local branch compares to the same branch on the server, as last seen.  If nothing
+// is known about the branches on the server, an empty string is returned
+func trackingText(db string, meta metaData, branch string) (string, error) {
+	t, err := trackingInfo(db, meta, branch)
+	if err != nil || t == nil {
+		return "", err
+	}
+	if !t.OnServer {
+		return "not on the server", nil
+	}
+	if t.Ahead == 0 && t.Behind == 0 {
+		return "up to date with the server", nil
+	}
+	return numFormat.Sprintf("ahead %d, behind %d", t.Ahead, t.Behind), nil
+}
+
+// Saves metadata to the local cache, merging in with any existing metadata.  Local branches are only moved to match the
+// server when moveBranches is set.  The merged metadata is only saved when an action is given (eg "fetch"), which is
+// what the reflog records any branch moves as
+func updateMetadata(db string, action string, moveBranches bool) (mergedMeta metaData, err error) {
+	// Check for existing metadata, loading the branches, tags, etc if present.  The commits are left in the local
+	// store, as only the new ones from the server need adding
 	origMeta := metaData{}
-	md, err = ioutil.ReadFile(filepath.Join(".dio", db, "metadata.json"))
-	if err == nil {
-		err = json.Unmarshal([]byte(md), &origMeta)
+	r := localRepo()
+	hasLocal := r.HasMetadata(db)
+	if hasLocal {
+		origMeta, err = r.LoadHeads(db)
 		if err != nil {
 			return
 		}
 	}
 
-	// Download the latest database metadata
-	_, err = fmt.Fprintln(fOut, "Updating metadata")
+	// Download the latest database metadata.  The notice is left out of machine readable output, so it stays parseable
+	if !structuredOutput() {
+		_, err = fmt.Fprintln(fOut, "Updating metadata")
+		if err != nil {
+			return
+		}
+	}
+	newMeta, onCloud, err := retrieveMetadata(db)
 	if err != nil {
 		return
 	}
-	newMeta, _, err := retrieveMetadata(db)
-	if err != nil {
+	if !onCloud && (!hasLocal || !moveBranches) {
+		// There's nothing to work from, or only the server's metadata was wanted
+		err = fmt.Errorf("Database '%s' wasn't found on %s", db, cloud)
 		return
 	}
 
 	// If we have existing local metadata, then merge the metadata from DBHub.io with it
-	if len(origMeta.Commits) > 0 {
-		mergedMeta, err = mergeMetadata(origMeta, newMeta)
+	if hasLocal {
+		mergedMeta, err = mergeMetadata(db, origMeta, newMeta, moveBranches)
 		if err != nil {
 			return
 		}
@@ -772,27 +856,16 @@ func updateMetadata(db string, saveMeta bool) (mergedMeta metaData, err error) {
 
 		// Use the remote default branch as the initial active (local) branch
 		mergedMeta.ActiveBranch = newMeta.DefBranch
-	}
 
-	// Serialise the updated metadata to JSON
-	var jsonString []byte
-	jsonString, err = json.MarshalIndent(mergedMeta, "", "  ")
-	if err != nil {
-		errMsg := fmt.Sprintf("Error when JSON marshalling the merged metadata: %v\n", err)
-		log.Print(errMsg)
-		return
+		// Remember where the branches on the server are
+		if err = setRemoteBranches(db, &mergedMeta, newMeta); err != nil {
+			return
+		}
 	}
 
 	// If requested, write the updated metadata to disk
-	if saveMeta {
-		if _, err = os.Stat(filepath.Join(".dio", db)); os.IsNotExist(err) {
-			err = os.MkdirAll(filepath.Join(".dio", db), 0770)
-			if err != nil {
-				return
-			}
-		}
-		mdFile := filepath.Join(".dio", db, "metadata.json")
-		err = ioutil.WriteFile(mdFile, []byte(jsonString), 0644)
+	if action != "" {
+		err = r.SaveMetadata(db, mergedMeta, action)
 	}
 	return
 }
@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/sqlitebrowser/dio/repo"
+)
+
+// Displays the details of a single commit
+var showCmd = &cobra.Command{
+	Use:   "show [database name] <revision>",
+	Short: "Displays the details of a single commit, tag, or release",
+	Long: `Displays the details of a single commit, tag, or release.
+
+The revision can be a commit ID (or a unique prefix of one), or the name of a
+branch, tag, or release, optionally followed by ~N, ^N, or @{date} (eg main~2).
+The commit is shown along with the files in its tree, and the branches, tags,
+and releases which contain it.  If that version of the database is in the local
+cache, its tables and row counts are shown too.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return show(args)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(showCmd)
+}
+
+func show(args []string) error {
+	// Ensure a revision was given, along with the database if there's no default one
+	var db, rev string
+	var err error
+	switch len(args) {
+	case 0:
+		return errors.New("No revision specified")
+	case 1:
+		rev = args[0]
+		db, err = getDefaultDatabase()
+		if err != nil {
+			return err
+		}
+		if db == "" {
+			// No database name was given on the command line, and we don't have a default database selected
+			return errors.New("No database file specified")
+		}
+	case 2:
+		db, rev = args[0], args[1]
+	default:
+		return errors.New("Only one revision of one database can be shown at a time")
+	}
+
+	// If there is a local metadata cache for the requested database, use that.  Otherwise, retrieve it from the
+	// server first (without storing it)
+	meta, err := localFetchMetadata(db, true)
+	if err != nil {
+		return err
+	}
+	id, err := repo.ResolveRevision(meta, rev)
+	if err != nil {
+		return err
+	}
+	c, ok := meta.Commits[id]
+	if !ok {
+		return fmt.Errorf("Commit '%s' isn't in the local commit list", id)
+	}
+
+	// Work out which branches, tags, and releases contain the commit.  For databases tracked locally, the store's
+	// generation numbers mean only the commits newer than it need checking
+	r := localRepo()
+	tracked := r.HasMetadata(db)
+	out := showOutput{Branches: []string{}, Commit: c, Database: db, Releases: []string{}, Tags: []string{}}
+	contains := func(head string) (bool, error) {
+		if tracked {
+			return r.IsAncestor(db, id, head)
+		}
+		_, ok := repo.CommitAncestors(meta, head)[id]
+		return ok, nil
+	}
+	for name, b := range meta.Branches {
+		found, err := contains(b.Commit)
+		if err != nil {
+			return err
+		}
+		if found {
+			out.Branches = append(out.Branches, name)
+		}
+	}
+	for name, t := range meta.Tags {
+		found, err := contains(t.Commit)
+		if err != nil {
+			return err
+		}
+		if found {
+			out.Tags = append(out.Tags, name)
+		}
+	}
+	for name, rel := range meta.Releases {
+		found, err := contains(rel.Commit)
+		if err != nil {
+			return err
+		}
+		if found {
+			out.Releases = append(out.Releases, name)
+		}
+	}
+	sort.Strings(out.Branches)
+	sort.Strings(out.Tags)
+	sort.Strings(out.Releases)
+
+	// If that version of the database is in the local cache, summarise its tables
+	if len(c.Tree.Entries) > 0 && r.HasCached(db, c.Tree.Entries[0].Sha256) {
+		out.Tables, err = readTableSummary(r.CachePath(db, c.Tree.Entries[0].Sha256))
+		if err != nil {
+			return err
+		}
+	}
+
+	if structuredOutput() {
+		return writeOutput(out)
+	}
+	return printShow(out)
+}
+
+// Displays the details of a commit for the user
+func printShow(out showOutput) (err error) {
+	// Retrieve the list of known licences, so their names can be shown
+	l, err := getLicences()
+	if err != nil {
+		return
+	}
+	licList := make(map[string]string)
+	for _, j := range l {
+		licList[j.Sha256] = j.FullName
+	}
+
+	// The commit itself
+	c := out.Commit
+	s := fmt.Sprintf("Commit: %s\n", c.ID)
+	s += fmt.Sprintf("Author: %s <%s>\n", c.AuthorName, c.AuthorEmail)
+	if c.CommitterEmail != "" {
+		s += fmt.Sprintf("Committer: %s <%s>\n", c.CommitterName, c.CommitterEmail)
+	}
+	s += fmt.Sprintf("Date: %s\n", c.Timestamp.Local().Format(time.RFC1123))
+	if c.Parent != "" {
+		s += fmt.Sprintf("Parent: %s\n", c.Parent)
+	} else {
+		s += "Parent: none (initial commit)\n"
+	}
+	for _, p := range c.OtherParents {
+		s += fmt.Sprintf("Merged parent: %s\n", p)
+	}
+	if c.Message != "" {
+		s += fmt.Sprintf("\n    %s\n", strings.Replace(c.Message, "\n", "\n    ", -1))
+	}
+	_, err = fmt.Fprintln(fOut, s)
+	if err != nil {
+		return
+	}
+
+	// The files in its tree
+	_, err = fmt.Fprintf(fOut, "Tree %s:\n", c.Tree.ID)
+	if err != nil {
+		return
+	}
+	for _, e := range c.Tree.Entries {
+		lic := "Not specified"
+		if e.LicenceSHA != "" {
+			lic = e.LicenceSHA
+			if n, ok := licList[e.LicenceSHA]; ok {
+				lic = n
+			}
+		}
+		_, err = numFormat.Fprintf(fOut, "  * %s\n      Size: %d bytes\n      SHA256: %s\n      Last modified: %s\n"+
+			"      Licence: %s\n", e.Name, e.Size, e.Sha256, e.LastModified.Local().Format(time.RFC1123), lic)
+		if err != nil {
+			return
+		}
+	}
+
+	// Where it's found
+	for _, j := range []struct {
+		kind  string
+		names []string
+	}{{"branches", out.Branches}, {"tags", out.Tags}, {"releases", out.Releases}} {
+		names := "none"
+		if len(j.names) > 0 {
+			names = strings.Join(j.names, ", ")
+		}
+		_, err = fmt.Fprintf(fOut, "\nContained in %s: %s", j.kind, names)
+		if err != nil {
+			return
+		}
+	}
+	_, err = fmt.Fprintln(fOut)
+	if err != nil {
+		return
+	}
+
+	// And what the database holds, if we have it
+	if out.Tables == nil {
+		_, err = fmt.Fprintf(fOut, "\nThis version of the database isn't in the local cache, so its tables aren't "+
+			"shown.  'dio fetch' retrieves it\n")
+		return
+	}
+	_, err = fmt.Fprintln(fOut, "\nTables:")
+	if err != nil {
+		return
+	}
+	if len(out.Tables) == 0 {
+		_, err = fmt.Fprintln(fOut, "  none")
+		return
+	}
+	for _, t := range out.Tables {
+		_, err = numFormat.Fprintf(fOut, "  * %s: %d rows\n", t.Name, t.Rows)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
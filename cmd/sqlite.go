@@ -0,0 +1,421 @@
+package cmd
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// A schema object (table, index, view or trigger) from the sqlite_master table of a database
+type schemaObject struct {
+	Name    string `json:"name"`
+	SQL     string `json:"sql"`
+	TblName string `json:"table"`
+	Type    string `json:"type"`
+}
+
+// The columns of a table, split into the ones identifying each row and the rest
+type tableColumns struct {
+	Columns []string // The non key columns
+	KeyCols []string // The primary key columns, or a rowid alias (eg "rowid") for tables without an explicit one
+	rowid   bool     // True when the rows are identified by their rowid
+}
+
+// The rows of a table, keyed by the (SQL literal form of the) primary key.  Every value is stored as the SQL literal
+// returned by the SQLite quote() function, so values can be compared as strings and written back out losslessly
+type tableData struct {
+	tableColumns
+	Rows map[string][]string // Primary key -> column values (in the same order as Columns)
+	Keys map[string][]string // Primary key -> primary key values (in the same order as KeyCols)
+}
+
+// A single row of a table, with its values in the same SQL literal form as tableData
+type tableRow struct {
+	Key  []string      // The primary key values (in the same order as KeyCols)
+	Vals []string      // The other column values (in the same order as Columns)
+	raw  []interface{} // The primary key values as stored, for working out the order of rows
+}
+
+// Reads the rows of a table one at a time, in primary key order, so tables don't need to fit in memory.  Readers for
+// tables which don't exist are done from the start
+type rowReader struct {
+	Done bool
+	Row  tableRow // The current row
+	cols tableColumns
+	rows *sql.Rows
+}
+
+// A table of a database, and how many rows it holds
+type tableSummary struct {
+	Name string `json:"name"`
+	Rows int64  `json:"rows"`
+}
+
+// Implemented by both sql.DB and sql.Tx, so queries can be run either inside or outside of a transaction
+type sqlQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Opens a SQLite database file.  Databases not opened for writing are opened in read only mode
+func openSQLite(path string, writable bool) (*sql.DB, error) {
+	mode := "ro"
+	if writable {
+		mode = "rw"
+	}
+	return sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=%s", url.PathEscape(path), mode))
+}
+
+// Quotes a SQLite identifier (eg table or column name)
+func quoteIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+// Reads the user visible schema objects of a database, keyed by "<type> <name>"
+func readSchema(q sqlQuerier) (objects map[string]schemaObject, err error) {
+	rows, err := q.Query(`SELECT type, name, tbl_name, coalesce(sql, '') FROM sqlite_master
+		WHERE name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	objects = make(map[string]schemaObject)
+	for rows.Next() {
+		var o schemaObject
+		err = rows.Scan(&o.Type, &o.Name, &o.TblName, &o.SQL)
+		if err != nil {
+			return
+		}
+		objects[o.Type+" "+o.Name] = o
+	}
+	err = rows.Err()
+	return
+}
+
+// Returns the tables of a database along with how many rows each holds, sorted by name
+func readTableSummary(path string) (tables []tableSummary, err error) {
+	sdb, err := openSQLite(path, false)
+	if err != nil {
+		return
+	}
+	defer sdb.Close()
+	objects, err := readSchema(sdb)
+	if err != nil {
+		return
+	}
+	tables = []tableSummary{}
+	for _, o := range objects {
+		if o.Type != "table" {
+			continue
+		}
+		t := tableSummary{Name: o.Name}
+		err = sdb.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s", quoteIdent(o.Name))).Scan(&t.Rows)
+		if err != nil {
+			return
+		}
+		tables = append(tables, t)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Name < tables[j].Name })
+	return
+}
+
+// Orders two primary keys the same way SQLite orders them with the BINARY collation
+func compareKeys(a []interface{}, b []interface{}) int {
+	for i := range a {
+		if c := compareValues(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// Orders two values the same way SQLite orders them with the BINARY collation: NULLs first, then numbers, then text,
+// then blobs
+func compareValues(a interface{}, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case int64, float64:
+			return 1
+		case string:
+			return 2
+		}
+		return 3
+	}
+	ra, rb := rank(a), rank(b)
+	switch {
+	case ra != rb:
+		return ra - rb
+	case ra == 0:
+		return 0
+	case ra == 2:
+		return strings.Compare(a.(string), b.(string))
+	case ra == 3:
+		return bytes.Compare(a.([]byte), b.([]byte))
+	}
+
+	// Numbers are compared by value, whether they're stored as integers or reals
+	x, xInt := a.(int64)
+	y, yInt := b.(int64)
+	if xInt && yInt {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	toFloat := func(v interface{}) float64 {
+		if i, ok := v.(int64); ok {
+			return float64(i)
+		}
+		return v.(float64)
+	}
+	fx, fy := toFloat(a), toFloat(b)
+	switch {
+	case fx < fy:
+		return -1
+	case fx > fy:
+		return 1
+	}
+	return 0
+}
+
+// Starts reading the rows of a table in primary key order.  If the table isn't in the database, no rows are returned
+func newRowReader(q sqlQuerier, table string, cols tableColumns, inDB bool) (r *rowReader, err error) {
+	r = &rowReader{Done: true, cols: cols}
+	if !inDB {
+		return
+	}
+
+	// The primary key values are retrieved twice: as SQL literals, and as stored (without the column's declared type,
+	// so the SQLite driver doesn't convert them) for ordering the rows
+	sel := cols.selectList()
+	var order []string
+	for _, c := range cols.KeyCols {
+		sel = append(sel, "+"+cols.ident(c))
+		order = append(order, cols.ident(c)+" COLLATE BINARY")
+	}
+	r.rows, err = q.Query(fmt.Sprintf("SELECT %s FROM %s ORDER BY %s", strings.Join(sel, ", "), quoteIdent(table),
+		strings.Join(order, ", ")))
+	if err != nil {
+		return
+	}
+	r.Done = false
+	err = r.next()
+	return
+}
+
+// Reads every row of a table
+func readTable(q sqlQuerier, table string) (data tableData, err error) {
+	data.tableColumns, err = readTableColumns(q, table)
+	if err != nil {
+		return
+	}
+
+	// Retrieve the rows, with every value converted to its SQL literal form
+	sel := data.selectList()
+	rows, err := q.Query(fmt.Sprintf("SELECT %s FROM %s", strings.Join(sel, ", "), quoteIdent(table)))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	data.Rows = make(map[string][]string)
+	data.Keys = make(map[string][]string)
+	vals := make([]string, len(sel))
+	ptrs := make([]interface{}, len(sel))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	for rows.Next() {
+		err = rows.Scan(ptrs...)
+		if err != nil {
+			return
+		}
+		key := make([]string, len(data.KeyCols))
+		copy(key, vals[:len(data.KeyCols)])
+		row := make([]string, len(data.Columns))
+		copy(row, vals[len(data.KeyCols):])
+		k := strings.Join(key, "\x1f")
+		data.Keys[k] = key
+		data.Rows[k] = row
+	}
+	err = rows.Err()
+	return
+}
+
+// Works out the columns of a table, and which of them form the primary key
+func readTableColumns(q sqlQuerier, table string) (cols tableColumns, err error) {
+	rows, err := q.Query(fmt.Sprintf("PRAGMA table_info(%s)", quoteIdent(table)))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	type keyCol struct {
+		name string
+		pos  int
+	}
+	var keys []keyCol
+	names := make(map[string]struct{})
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var def sql.NullString
+		err = rows.Scan(&cid, &name, &colType, &notNull, &def, &pk)
+		if err != nil {
+			return
+		}
+		names[strings.ToLower(name)] = struct{}{}
+		if pk > 0 {
+			keys = append(keys, keyCol{name: name, pos: pk})
+		} else {
+			cols.Columns = append(cols.Columns, name)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].pos < keys[j].pos })
+	for _, k := range keys {
+		cols.KeyCols = append(cols.KeyCols, k.name)
+	}
+	if len(cols.KeyCols) > 0 {
+		return
+	}
+
+	// Tables without an explicit primary key are identified by their rowid, using whichever of its names isn't taken
+	// by a real column
+	for _, alias := range []string{"rowid", "_rowid_", "oid"} {
+		if _, ok := names[alias]; !ok {
+			cols.KeyCols, cols.rowid = []string{alias}, true
+			return
+		}
+	}
+	err = fmt.Errorf("Table '%s' has no primary key, and has columns called rowid, _rowid_ and oid, so its rows "+
+		"can't be told apart", table)
+	return
+}
+
+// Returns how a column is referred to in queries.  The rowid is referred to by its bare name, as it isn't a real column
+func (t tableColumns) ident(col string) string {
+	if t.rowid && col == t.KeyCols[0] {
+		return col
+	}
+	return quoteIdent(col)
+}
+
+// Returns the key columns followed by the other columns, each converted to its SQL literal form, for use in a SELECT
+func (t tableColumns) selectList() (sel []string) {
+	for _, c := range t.KeyCols {
+		sel = append(sel, fmt.Sprintf("quote(%s)", t.ident(c)))
+	}
+	for _, c := range t.Columns {
+		sel = append(sel, fmt.Sprintf("quote(%s)", quoteIdent(c)))
+	}
+	return
+}
+
+// Returns a human friendly description of a row's primary key.  eg: id=5
+func (t tableColumns) keyDescription(key []string) string {
+	var s []string
+	for i, j := range key {
+		s = append(s, fmt.Sprintf("%s=%s", t.KeyCols[i], j))
+	}
+	return strings.Join(s, ", ")
+}
+
+// Returns the values of a row as a column name -> SQL literal map
+func (t tableColumns) rowValues(row tableRow) map[string]string {
+	m := make(map[string]string)
+	for i, j := range t.KeyCols {
+		m[j] = row.Key[i]
+	}
+	for i, j := range t.Columns {
+		m[j] = row.Vals[i]
+	}
+	return m
+}
+
+// Returns a human friendly description of a row's primary key.  eg: id=5
+func (t tableData) keyText(key string) string {
+	return t.keyDescription(t.Keys[key])
+}
+
+// Returns the values of a row as a column name -> SQL literal map
+func (t tableData) rowMap(key string) map[string]string {
+	row, ok := t.Rows[key]
+	if !ok {
+		return nil
+	}
+	return t.rowValues(tableRow{Key: t.Keys[key], Vals: row})
+}
+
+// Stops reading rows
+func (r *rowReader) close() {
+	if r.rows != nil {
+		_ = r.rows.Close()
+	}
+}
+
+// Moves on to the next row, setting Done once there are no more
+func (r *rowReader) next() (err error) {
+	if r.Done {
+		return
+	}
+	if !r.rows.Next() {
+		r.Done = true
+		return r.rows.Err()
+	}
+
+	// Each row gets its own slices, so rows which have been taken aren't overwritten
+	row := tableRow{
+		Key:  make([]string, len(r.cols.KeyCols)),
+		Vals: make([]string, len(r.cols.Columns)),
+		raw:  make([]interface{}, len(r.cols.KeyCols)),
+	}
+	var ptrs []interface{}
+	for i := range row.Key {
+		ptrs = append(ptrs, &row.Key[i])
+	}
+	for i := range row.Vals {
+		ptrs = append(ptrs, &row.Vals[i])
+	}
+	for i := range row.raw {
+		ptrs = append(ptrs, &row.raw[i])
+	}
+	err = r.rows.Scan(ptrs...)
+	if err != nil {
+		return
+	}
+	r.Row = row
+	return
+}
+
+// Returns the current row if it has the given primary key, and moves on to the next one
+func (r *rowReader) take(key []interface{}) (row tableRow, ok bool, err error) {
+	if r.Done || compareKeys(r.Row.raw, key) != 0 {
+		return
+	}
+	row, ok = r.Row, true
+	err = r.next()
+	return
+}
+
+// Returns true if two rows have identical values
+func rowsEqual(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
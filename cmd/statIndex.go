@@ -0,0 +1,12 @@
+package cmd
+
+import "github.com/spf13/cobra"
+
+// When true, the stat index isn't trusted and database files are always hashed in full
+var verifyHashes bool
+
+// Adds the --verify flag to a command which checks whether a database has changed
+func addVerifyFlag(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&verifyHashes, "verify", false,
+		"Calculate the SHA256 of the database file, even if the stat index says it hasn't changed")
+}
@@ -1,68 +1,200 @@
 package cmd
 
 import (
-	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
 
 	"github.com/spf13/cobra"
 )
 
+var statusCmdAll *bool
+
 // Displays whether a database has been modified since the last commit
 var statusCmd = &cobra.Command{
-	Use:   "status [database name]",
+	Use:   "status [database name...]",
 	Short: "Displays whether a database has been modified since the last commit",
+	Long: `Displays whether a database has been modified since the last commit.
+
+When no database name is given, a summary of every database tracked in the
+current directory is shown instead, along with any SQLite databases in the
+directory which aren't being tracked yet.
+
+With --output json or yaml, the list of untracked databases is only filled
+in for the summary.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return status(args)
 	},
+	Annotations: locksAllDatabases,
 }
 
 func init() {
 	RootCmd.AddCommand(statusCmd)
+	statusCmdAll = statusCmd.Flags().Bool("all", false,
+		"Show the status of every database tracked in the current directory")
+	addVerifyFlag(statusCmd)
 }
 
 func status(args []string) error {
-	var db string
-	var err error
-	if len(args) == 0 {
-		// TODO: If no database name is given, we should show the status for all known databases (eg in local .dio cache)
-		//       in the current directory instead
-		db, err = getDefaultDatabase()
-		if err != nil {
-			return err
-		}
-		if db == "" {
-			// No database name was given on the command line, and we don't have a default database selected
-			return errors.New("No database file specified")
+	// With no database names given, summarise everything in the current directory
+	if len(args) == 0 && !*statusCmdAll {
+		return statusSummary()
+	}
+	dbs, err := dbsFromArgs(args, *statusCmdAll)
+	if err != nil {
+		return err
+	}
+	if structuredOutput() {
+		out := statusOutput{Tracked: []statusEntry{}, Untracked: []string{}}
+		for _, db := range dbs {
+			meta, err := localFetchHeads(db, true)
+			if err != nil {
+				return err
+			}
+			e, err := dbStatus(db, meta)
+			if err != nil {
+				return err
+			}
+			out.Tracked = append(out.Tracked, e)
 		}
-	} else {
-		db = args[0]
+		return writeOutput(out)
+	}
+	return forEachDatabase(dbs, statusDB, nil)
+}
+
+// Returns the state of a tracked database, and how its active branch compares to the server
+func dbStatus(db string, meta metaData) (e statusEntry, err error) {
+	e = statusEntry{
+		ActiveBranch: meta.ActiveBranch,
+		Database:     db,
+		State:        "unchanged",
+	}
+	if e.Tracking, err = trackingInfo(db, meta, meta.ActiveBranch); err != nil {
+		return
+	}
+	if _, err = os.Stat(db); os.IsNotExist(err) {
+		e.State = "missing"
+		return e, nil
 	}
-	// TODO: Allow giving multiple database files on the command line.  Hopefully just needs turning this
-	// TODO  into a for loop
-	if len(args) > 1 {
-		return errors.New("Only one database can be worked with at a time (for now)")
+	changed, err := localRepo().Changed(db, meta)
+	if err != nil {
+		return
+	}
+	if changed {
+		e.State = "changed"
 	}
+	return
+}
 
+// Displays whether a database has been modified since the last commit
+func statusDB(db string) (err error) {
 	// If there is a local metadata cache for the requested database, use that.  Otherwise, retrieve it from the
 	// server first (without storing it)
 	var meta metaData
-	meta, err = localFetchMetadata(db, true)
+	meta, err = localFetchHeads(db, true)
 	if err != nil {
 		return err
 	}
 
 	// Check if the file has changed, and let the user know
-	changed, err := dbChanged(db, meta)
+	changed, err := localRepo().Changed(db, meta)
 	if err != nil {
 		return err
 	}
 	if changed {
 		_, err = fmt.Fprintf(fOut, "  * '%s': has been changed\n", db)
+	} else {
+		_, err = fmt.Fprintf(fOut, "  * '%s': unchanged\n", db)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Show how the active branch compares to the server, as of the last fetch, pull, or push
+	t, err := trackingText(db, meta, meta.ActiveBranch)
+	if err != nil {
+		return err
+	}
+	if t != "" {
+		_, err = fmt.Fprintf(fOut, "    Branch %s: %s\n", meta.ActiveBranch, t)
+	}
+	return err
+}
+
+// Displays a summary of every database tracked in the current directory, plus any untracked SQLite databases
+func statusSummary() (err error) {
+	dbs, err := localRepo().Tracked()
+	if err != nil {
+		return
+	}
+	out := statusOutput{Tracked: []statusEntry{}, Untracked: []string{}}
+	tracked := make(map[string]struct{})
+	for _, db := range dbs {
+		tracked[db] = struct{}{}
+		var meta metaData
+		meta, err = localRepo().LoadHeads(db)
+		if err != nil {
+			return
+		}
+		var e statusEntry
+		e, err = dbStatus(db, meta)
 		if err != nil {
-			return err
+			return
 		}
-		return nil
+		out.Tracked = append(out.Tracked, e)
 	}
-	_, err = fmt.Fprintf(fOut, "  * '%s': unchanged\n", db)
-	return err
+
+	// Look for SQLite databases which aren't being tracked yet
+	files, err := ioutil.ReadDir(".")
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		if _, ok := tracked[f.Name()]; ok {
+			continue
+		}
+		if isSQLiteFile(f.Name()) {
+			out.Untracked = append(out.Untracked, f.Name())
+		}
+	}
+	if structuredOutput() {
+		return writeOutput(out)
+	}
+
+	// Display the summary
+	if len(out.Tracked) > 0 {
+		_, err = fmt.Fprintf(fOut, "Tracked databases:\n")
+		if err != nil {
+			return
+		}
+	}
+	for _, e := range out.Tracked {
+		state := e.State
+		if state == "changed" {
+			state = "has been changed"
+		}
+		_, err = fmt.Fprintf(fOut, "  * '%s' on branch '%s': %s\n", e.Database, e.ActiveBranch, state)
+		if err != nil {
+			return
+		}
+	}
+	if len(out.Untracked) > 0 {
+		_, err = fmt.Fprintf(fOut, "Untracked databases:\n")
+		if err != nil {
+			return
+		}
+		for _, db := range out.Untracked {
+			_, err = fmt.Fprintf(fOut, "  * '%s'\n", db)
+			if err != nil {
+				return
+			}
+		}
+	}
+	if len(out.Tracked) == 0 && len(out.Untracked) == 0 {
+		_, err = fmt.Fprintf(fOut, "No databases found in this directory\n")
+	}
+	return
 }
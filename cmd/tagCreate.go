@@ -21,11 +21,12 @@ var tagCreateCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return tagCreate(args)
 	},
+	Annotations: locksDatabases,
 }
 
 func init() {
 	tagCmd.AddCommand(tagCreateCmd)
-	tagCreateCmd.Flags().StringVar(&tagCreateCommit, "commit", "", "Commit ID for the new tag")
+	tagCreateCmd.Flags().StringVar(&tagCreateCommit, "commit", "", "Revision (eg commit ID, branch, or main~2) for the new tag")
 	tagCreateCmd.Flags().StringVar(&tagCreateDate, "date", "", "Custom timestamp (RFC3339 format) for tag")
 	tagCreateCmd.Flags().StringVar(&tagCreateEmail, "email", "", "Email address of tagger")
 	tagCreateCmd.Flags().StringVar(&tagCreateMsg, "message", "", "Description / message for the tag")
@@ -37,7 +38,6 @@ func tagCreate(args []string) error {
 	// Ensure a database file was given
 	var db string
 	var err error
-	var meta metaData
 	if len(args) == 0 {
 		db, err = getDefaultDatabase()
 		if err != nil {
@@ -87,31 +87,18 @@ func tagCreate(args []string) error {
 		}
 	}
 
-	// Load the metadata
-	meta, err = loadMetadata(db)
+	// Add the new tag to the local metadata cache
+	commitID, err := resolveLocalRevision(db, tagCreateCommit)
 	if err != nil {
 		return err
 	}
-
-	// Ensure a tag with the same name doesn't already exist
-	if _, ok := meta.Tags[tagCreateTag]; ok == true {
-		return errors.New("A tag with that name already exists")
-	}
-
-	// Generate the new tag info locally
-	newTag := tagEntry{
-		Commit:      tagCreateCommit,
+	err = localRepo().CreateTag(db, tagCreateTag, tagEntry{
+		Commit:      commitID,
 		Date:        tagTimeStamp,
 		Description: tagCreateMsg,
 		TaggerEmail: tagCreateEmail,
 		TaggerName:  tagCreateName,
-	}
-
-	// Add the new tag to the local metadata cache
-	meta.Tags[tagCreateTag] = newTag
-
-	// Save the updated metadata back to disk
-	err = saveMetadata(db, meta)
+	})
 	if err != nil {
 		return err
 	}
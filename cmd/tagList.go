@@ -50,6 +50,13 @@ func tagList(args []string) error {
 		return err
 	}
 
+	if structuredOutput() {
+		if meta.Tags == nil {
+			meta.Tags = make(map[string]tagEntry)
+		}
+		return writeOutput(tagListOutput{Database: db, Tags: meta.Tags})
+	}
+
 	if len(meta.Tags) == 0 {
 		_, err = fmt.Fprintf(fOut, "Database %s has no tags\n", db)
 		return err
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Sends the local tag changes for a database to DBHub.io
+var tagPushCmd = &cobra.Command{
+	Use:   "push [database name...]",
+	Short: "Send the tags created and removed locally to DBHub.io",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tagPush(args)
+	},
+	Annotations: locksDatabases,
+}
+
+func init() {
+	tagCmd.AddCommand(tagPushCmd)
+}
+
+func tagPush(args []string) error {
+	// Ensure a database file was given
+	dbs, err := dbsFromArgs(args, false)
+	if err != nil {
+		return err
+	}
+	return forEachDatabase(dbs, func(db string) error {
+		return pushTagsAndReleases(db, true, false)
+	}, nil)
+}
+
+// Sends the tags created locally to the server, and removes the tags removed locally from it.  Tags with the same name
+// but on a different commit locally and remotely are left alone, and returned as conflicts
+func pushTags(db string, meta metaData, remoteMeta metaData) (conflicts []string, err error) {
+	l := labelChanges{
+		Kind:    "Tag",
+		Local:   make(map[string]string),
+		Remote:  make(map[string]string),
+		Removed: make(map[string]string),
+		Params: func(name string) map[string]string {
+			t := meta.Tags[name]
+			return map[string]string{
+				"commit":      t.Commit,
+				"date":        t.Date.UTC().Format(time.RFC3339),
+				"msg":         t.Description,
+				"tag":         name,
+				"taggeremail": t.TaggerEmail,
+				"taggername":  t.TaggerName,
+			}
+		},
+		Sent: func(name string) {
+			delete(meta.DeletedTags, name)
+		},
+	}
+	for name, t := range meta.Tags {
+		l.Local[name] = t.Commit
+	}
+	for name, t := range remoteMeta.Tags {
+		l.Remote[name] = t.Commit
+	}
+	for name, t := range meta.DeletedTags {
+		l.Removed[name] = t.Commit
+	}
+	return pushLabels(db, l, remoteMeta)
+}
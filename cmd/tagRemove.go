@@ -16,6 +16,7 @@ var tagRemoveCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return tagRemove(args)
 	},
+	Annotations: locksDatabases,
 }
 
 func init() {
@@ -27,7 +28,6 @@ func tagRemove(args []string) error {
 	// Ensure a database file was given
 	var db string
 	var err error
-	var meta metaData
 	if len(args) == 0 {
 		db, err = getDefaultDatabase()
 		if err != nil {
@@ -49,22 +49,8 @@ func tagRemove(args []string) error {
 		return errors.New("No tag name given")
 	}
 
-	// Load the metadata
-	meta, err = loadMetadata(db)
-	if err != nil {
-		return err
-	}
-
-	// Check if the tag exists
-	if _, ok := meta.Tags[tagRemoveTag]; ok != true {
-		return errors.New("A tag with that name doesn't exist")
-	}
-
-	// Remove the tag
-	delete(meta.Tags, tagRemoveTag)
-
-	// Save the updated metadata back to disk
-	err = saveMetadata(db, meta)
+	// Remove the tag, remembering it was removed so the removal can be pushed to the server
+	err = localRepo().RemoveTag(db, tagRemoveTag)
 	if err != nil {
 		return err
 	}
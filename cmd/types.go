@@ -1,42 +1,40 @@
 package cmd
 
-import "time"
+import (
+	"github.com/sqlitebrowser/dio/client"
+	"github.com/sqlitebrowser/dio/repo"
+)
 
-type branchEntry struct {
-	Commit      string `json:"commit"`
-	CommitCount int    `json:"commit_count"`
-	Description string `json:"description"`
+// The active branch of a database, as written by "branch active get" for --output json or yaml
+type activeBranchOutput struct {
+	ActiveBranch string `json:"active_branch"`
+	Database     string `json:"database"`
 }
 
-type commitEntry struct {
-	AuthorEmail    string    `json:"author_email"`
-	AuthorName     string    `json:"author_name"`
-	CommitterEmail string    `json:"committer_email"`
-	CommitterName  string    `json:"committer_name"`
-	ID             string    `json:"id"`
-	Message        string    `json:"message"`
-	OtherParents   []string  `json:"other_parents"`
-	Parent         string    `json:"parent"`
-	Timestamp      time.Time `json:"timestamp"`
-	Tree           dbTree    `json:"tree"`
+type branchOp = repo.BranchOp
+
+type branchEntry = client.BranchEntry
+
+// The branches of a database, as written by "branch list" for --output json or yaml
+type branchListOutput struct {
+	ActiveBranch string                     `json:"active_branch"`
+	Branches     map[string]branchEntry     `json:"branches"`
+	Database     string                     `json:"database"`
+	Tracking     map[string]*branchTracking `json:"tracking,omitempty"`
 }
 
-type dbListEntry struct {
-	CommitID     string `json:"commit_id"`
-	DefBranch    string `json:"default_branch"`
-	LastModified string `json:"last_modified"`
-	Licence      string `json:"licence"`
-	Name         string `json:"name"`
-	OneLineDesc  string `json:"one_line_description"`
-	Public       bool   `json:"public"`
-	RepoModified string `json:"repo_modified"`
-	SHA256       string `json:"sha256"`
-	Size         int64  `json:"size"`
-	Type         string `json:"type"`
-	URL          string `json:"url"`
+// How a local branch compares to the same branch on the server, as of the last fetch, pull, or push
+type branchTracking struct {
+	Ahead    int  `json:"ahead"`
+	Behind   int  `json:"behind"`
+	OnServer bool `json:"on_server"`
 }
 
-type dbTreeEntryType string
+type commitEntry = client.CommitEntry
+
+type dbListEntry = client.DatabaseListEntry
+
+type dbTreeEntryType = client.DBTreeEntryType
 
 const (
 	TREE     dbTreeEntryType = "tree"
@@ -44,53 +42,102 @@ const (
 	LICENCE                  = "licence"
 )
 
-type dbTree struct {
-	ID      string        `json:"id"`
-	Entries []dbTreeEntry `json:"entries"`
-}
-type dbTreeEntry struct {
-	EntryType    dbTreeEntryType `json:"entry_type"`
-	LastModified time.Time       `json:"last_modified"`
-	LicenceSHA   string          `json:"licence"`
-	Name         string          `json:"name"`
-	Sha256       string          `json:"sha256"`
-	Size         int64           `json:"size"`
-}
+type dbTree = client.DBTree
+
+type dbTreeEntry = client.DBTreeEntry
 
 type defaultSettings struct {
 	SelectedDatabase string `json:"selected_database"`
 }
 
-type licenceEntry struct {
-	FileFormat string `json:"file_format"`
-	FullName   string `json:"full_name"`
-	Order      int    `json:"order"`
-	Sha256     string `json:"sha256"`
-	URL        string `json:"url"`
+// The dio installation details, as written by "info" for --output json or yaml
+type infoOutput struct {
+	CAChain    string `json:"ca_chain"`
+	Cert       string `json:"cert"`
+	Cloud      string `json:"cloud"`
+	ConfigFile string `json:"config_file"`
+	UserEmail  string `json:"user_email"`
+	UserName   string `json:"user_name"`
+	Version    string `json:"version"`
+}
+
+// The tags or releases of a database, as needed by pushLabels to send the ones changed locally to the server.  Each
+// map goes from the name of a tag or release to the commit it's on
+type labelChanges struct {
+	Kind    string                              // "Tag" or "Release"
+	Local   map[string]string                   // The tags or releases in the local metadata
+	Params  func(name string) map[string]string // The fields to send the server when creating one of them
+	Remote  map[string]string                   // The tags or releases on the server
+	Removed map[string]string                   // The tags or releases removed locally
+	Sent    func(name string)                   // Forgets a local removal, once the server no longer has it
 }
 
-type metaData struct {
-	ActiveBranch string                  `json:"active_branch"` // The local branch
-	Branches     map[string]branchEntry  `json:"branches"`
-	Commits      map[string]commitEntry  `json:"commits"`
-	DefBranch    string                  `json:"default_branch"` // The default branch *on the server*
-	Releases     map[string]releaseEntry `json:"releases"`
-	Tags         map[string]tagEntry     `json:"tags"`
+type licenceEntry = client.LicenceEntry
+
+// The history of a database branch, newest commit first, as written by "log" for --output json or yaml
+type logOutput struct {
+	Branch   string        `json:"branch"`
+	Commits  []commitEntry `json:"commits"`
+	Database string        `json:"database"`
 }
 
-type releaseEntry struct {
-	Commit        string    `json:"commit"`
-	Date          time.Time `json:"date"`
-	Description   string    `json:"description"`
-	ReleaserEmail string    `json:"email"`
-	ReleaserName  string    `json:"name"`
-	Size          int64     `json:"size"`
+// Details of a merge which is waiting on the user to resolve conflicts, before it can be committed
+type mergeState struct {
+	Base       string `json:"base"`
+	From       string `json:"from"`
+	FromCommit string `json:"from_commit"`
+	Into       string `json:"into"`
+	IntoCommit string `json:"into_commit"`
 }
 
-type tagEntry struct {
-	Commit      string    `json:"commit"`
-	Date        time.Time `json:"date"`
-	Description string    `json:"description"`
-	TaggerEmail string    `json:"email"`
-	TaggerName  string    `json:"name"`
+type metaData = repo.Metadata
+
+type reflogEntry = repo.ReflogEntry
+
+// The reflog of a database, newest entry first, as written by "reflog" for --output json or yaml
+type reflogOutput struct {
+	Database string        `json:"database"`
+	Entries  []reflogEntry `json:"entries"`
+}
+
+type releaseEntry = client.ReleaseEntry
+
+// The releases of a database, as written by "releases" for --output json or yaml
+type releaseListOutput struct {
+	Database string                  `json:"database"`
+	Releases map[string]releaseEntry `json:"releases"`
+}
+
+// The details of a single commit, as written by "show" for --output json or yaml.  Tables is null unless the database
+// for the commit is in the local cache
+type showOutput struct {
+	Branches []string       `json:"branches"`
+	Commit   commitEntry    `json:"commit"`
+	Database string         `json:"database"`
+	Releases []string       `json:"releases"`
+	Tables   []tableSummary `json:"tables"`
+	Tags     []string       `json:"tags"`
+}
+
+// The state of a tracked database, as written by "status" for --output json or yaml.  State is one of "changed",
+// "unchanged", or "missing"
+type statusEntry struct {
+	ActiveBranch string          `json:"active_branch"`
+	Database     string          `json:"database"`
+	State        string          `json:"state"`
+	Tracking     *branchTracking `json:"tracking,omitempty"`
+}
+
+// The databases in the current directory, as written by "status" for --output json or yaml
+type statusOutput struct {
+	Tracked   []statusEntry `json:"tracked"`
+	Untracked []string      `json:"untracked"`
+}
+
+type tagEntry = client.TagEntry
+
+// The tags of a database, as written by "tags" for --output json or yaml
+type tagListOutput struct {
+	Database string              `json:"database"`
+	Tags     map[string]tagEntry `json:"tags"`
 }
@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/sqlitebrowser/dio/client"
+)
+
+// Uploads a database file to DBHub.io, along with the details of the commit for it, displaying the progress as it's
+// sent.  Interrupted chunked uploads are resumed the next time, without sending again the chunks the server already
+// has
+func uploadDatabase(db string, cu client.CommitUpload, path string, fileName string) (res client.UploadResult,
+	err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	progress := newProgressWriter(fmt.Sprintf("Uploading '%s'", db), 0, fi.Size())
+	res, err = apiClient().UploadCommit(context.Background(), db, cu, path, fileName, progress)
+	progress.finish()
+	var e *client.Error
+	if errors.As(err, &e) && e.Op == "upload chunk" {
+		err = fmt.Errorf("Upload of '%s' interrupted: %v.  Run the command again to resume it", db, err)
+	}
+	return
+}
@@ -0,0 +1,34 @@
+package repo
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes data to a file so it's either fully replaced or left as it was, even if dio is interrupted or
+// the machine crashes part way through.  The data is written to a temporary file in the same directory and flushed to
+// disk, then renamed over the original
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	dir := filepath.Dir(path)
+	tmpFile, _, _, err := writeTempFile(dir, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	if err = os.Chmod(tmpFile, perm); err != nil {
+		_ = os.Remove(tmpFile)
+		return
+	}
+	if err = os.Rename(tmpFile, path); err != nil {
+		_ = os.Remove(tmpFile)
+		return
+	}
+
+	// Flush the rename itself to disk too.  Not every platform can sync a directory (eg Windows), so that's allowed
+	// to fail
+	if d, errOpen := os.Open(dir); errOpen == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	return
+}
@@ -0,0 +1,306 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/sqlitebrowser/dio/client"
+)
+
+// CreateBranch creates a new branch for a database, with its head at the given commit.  The creation is queued for
+// the server, to be sent on the next push
+func (r *Repo) CreateBranch(db string, name string, commitID string, description string) (err error) {
+	meta, err := r.LoadHeads(db)
+	if err != nil {
+		return
+	}
+
+	// Ensure a branch with the same name doesn't already exist
+	if _, ok := meta.Branches[name]; ok {
+		return errors.New("A branch with that name already exists")
+	}
+
+	// Make sure the target commit exists in our commit list
+	if _, ok, err := r.FindCommit(db, meta, commitID); err != nil {
+		return err
+	} else if !ok {
+		return errors.New("That commit isn't in the database commit list")
+	}
+
+	// Add the new branch, and queue its creation on the server.  Its commit count is filled in from the store when
+	// it's saved
+	meta.Branches[name] = client.BranchEntry{
+		Commit:      commitID,
+		Description: description,
+	}
+	meta.BranchOps = append(meta.BranchOps, BranchOp{
+		Action:      "create",
+		Branch:      name,
+		Commit:      commitID,
+		Description: description,
+	})
+	return r.SaveMetadata(db, meta, "branch create")
+}
+
+// RemoveBranch removes a branch of a database.  The active branch can't be removed.  The removal is queued for the
+// server, to be sent on the next push
+func (r *Repo) RemoveBranch(db string, name string) (err error) {
+	meta, err := r.LoadHeads(db)
+	if err != nil {
+		return
+	}
+	if _, ok := meta.Branches[name]; !ok {
+		return errors.New("A branch with that name doesn't exist")
+	}
+	if name == meta.ActiveBranch {
+		return errors.New("Can't remove the currently active branch.  You need to switch branches first")
+	}
+
+	// Remove the branch, and queue its removal from the server
+	meta.BranchOps = append(meta.BranchOps, BranchOp{
+		Action: "remove",
+		Branch: name,
+		Commit: meta.Branches[name].Commit,
+	})
+	delete(meta.Branches, name)
+	return r.SaveMetadata(db, meta, "branch remove")
+}
+
+// RenameBranch renames a branch of a database.  The rename is queued for the server, to be sent on the next push
+func (r *Repo) RenameBranch(db string, name string, newName string) (err error) {
+	meta, err := r.LoadHeads(db)
+	if err != nil {
+		return
+	}
+
+	// Check the branch exists, and the new name isn't already taken
+	branch, ok := meta.Branches[name]
+	if !ok {
+		return errors.New("A branch with that name doesn't exist")
+	}
+	if _, ok = meta.Branches[newName]; ok {
+		return errors.New("A branch with the new name already exists")
+	}
+
+	// Rename the branch, and queue the rename on the server.  The branch on the server is tracked under the new name
+	// too, as that's what it'll be called there once the rename is pushed
+	meta.Branches[newName] = branch
+	delete(meta.Branches, name)
+	if remote, ok := meta.RemoteBranches[name]; ok {
+		meta.RemoteBranches[newName] = remote
+		delete(meta.RemoteBranches, name)
+	}
+	if meta.ActiveBranch == name {
+		meta.ActiveBranch = newName
+	}
+	meta.BranchOps = append(meta.BranchOps, BranchOp{
+		Action:  "rename",
+		Branch:  name,
+		NewName: newName,
+	})
+	return r.SaveMetadata(db, meta, "branch rename")
+}
+
+// Revert moves the head of a branch of a database back to an earlier commit on it, and restores the database file
+// from that commit.  Unless forced, ErrChanged is returned if the database file has been changed since the last
+// commit.  Reverting is refused if it would leave any tags or releases unreachable from every branch
+func (r *Repo) Revert(db string, branch string, commitID string, force bool) (err error) {
+	meta, err := r.LoadMetadata(db)
+	if err != nil {
+		return
+	}
+
+	// Unless forced, make sure no changes to the database file would be lost
+	if !force {
+		changed, err := r.Changed(db, meta)
+		if err != nil {
+			return err
+		}
+		if changed {
+			return ErrChanged
+		}
+	}
+
+	// If no branch name was passed, use the active branch
+	if branch == "" {
+		branch = meta.ActiveBranch
+	}
+	if _, ok := meta.Branches[branch]; !ok {
+		return errors.New("That branch doesn't exist")
+	}
+
+	// Make sure the requested commit exists on the selected branch
+	history, err := History(meta, branch)
+	if err != nil {
+		return
+	}
+	found := false
+	for _, c := range history {
+		if c.ID == commitID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.New("The given commit or tag doesn't seem to exist on the selected branch")
+	}
+	return r.moveBranch(db, meta, branch, commitID, true, "branch revert")
+}
+
+// Moves the head of a branch of a database to a commit, optionally restoring the database file from that commit as
+// well.  Moving is refused if it would leave any tags or releases unreachable from every branch
+func (r *Repo) moveBranch(db string, meta Metadata, branch string, commitID string, restore bool,
+	action string) (err error) {
+	head := meta.Branches[branch]
+
+	// Work out the commits which would be removed from the branch, following merged in parents as well as first ones
+	if _, ok := meta.Commits[head.Commit]; !ok {
+		return errors.New("Something has gone wrong.  Head commit for the branch isn't in the commit list")
+	}
+	if _, ok := meta.Commits[commitID]; !ok {
+		return fmt.Errorf("Commit '%s' isn't in the local commit list", commitID)
+	}
+	kept := CommitAncestors(meta, commitID)
+	delList := map[string]struct{}{}
+	for id := range CommitAncestors(meta, head.Commit) {
+		if _, ok := kept[id]; !ok {
+			delList[id] = struct{}{}
+		}
+	}
+
+	// Make sure the database from the target commit is in the local cache
+	entry := meta.Commits[commitID].Tree.Entries[0]
+	err = r.ensureCached(db, commitID, entry.Sha256)
+	if err != nil {
+		return
+	}
+
+	// Check if removing the commits would leave isolated tags or releases.  Those on commits which are also on other
+	// branches are fine, as they can still be reached from there
+	otherBranches := make(map[string]struct{})
+	for bName, bEntry := range meta.Branches {
+		if bName == branch {
+			continue
+		}
+		for id := range CommitAncestors(meta, bEntry.Commit) {
+			otherBranches[id] = struct{}{}
+		}
+	}
+	isolated := func(c string) bool {
+		_, deleted := delList[c]
+		_, elsewhere := otherBranches[c]
+		return deleted && !elsewhere
+	}
+	var isolatedTags, isolatedReleases []string
+	for tName, tEntry := range meta.Tags {
+		if isolated(tEntry.Commit) {
+			isolatedTags = append(isolatedTags, tName)
+		}
+	}
+	for rName, rEntry := range meta.Releases {
+		if isolated(rEntry.Commit) {
+			isolatedReleases = append(isolatedReleases, rName)
+		}
+	}
+	if len(isolatedTags) > 0 || len(isolatedReleases) > 0 {
+		sort.Strings(isolatedTags)
+		sort.Strings(isolatedReleases)
+		e := fmt.Sprint("You need to remove the following tags and releases before reverting to this " +
+			"commit:\n\n")
+		for _, j := range isolatedTags {
+			e = fmt.Sprintf("%s  * tag '%s'\n", e, j)
+		}
+		for _, j := range isolatedReleases {
+			e = fmt.Sprintf("%s  * release '%s'\n", e, j)
+		}
+		return errors.New(e)
+	}
+
+	// Move the branch.  The commits no longer on it are left in the commit list, for "dio gc" to clean up their
+	// cached databases later.  Its commit count is filled in from the store when it's saved
+	meta.Branches[branch] = client.BranchEntry{
+		Commit:      commitID,
+		Description: head.Description,
+	}
+
+	// Copy the file from local cache to the working directory
+	if restore {
+		err = r.RestoreDB(db, entry.Sha256, entry.LastModified)
+		if err != nil {
+			return
+		}
+	}
+	return r.SaveMetadata(db, meta, action)
+}
+
+// SetActiveBranch switches the active branch of a database, restoring the database file from the head commit of the
+// branch.  Unless forced, ErrChanged is returned if the database file has been changed since the last commit
+func (r *Repo) SetActiveBranch(db string, name string, force bool) (err error) {
+	meta, err := r.LoadHeads(db)
+	if err != nil {
+		return
+	}
+
+	// Make sure the given branch name exists
+	head, ok := meta.Branches[name]
+	if !ok {
+		return errors.New("That branch name doesn't exist for this database")
+	}
+
+	// Unless forced, make sure no changes to the database file would be lost
+	if !force {
+		changed, err := r.Changed(db, meta)
+		if err != nil {
+			return err
+		}
+		if changed {
+			return ErrChanged
+		}
+	}
+
+	// Get the details of the head commit for the target branch
+	commit, ok, err := r.FindCommit(db, meta, head.Commit)
+	if err != nil {
+		return
+	}
+	if !ok {
+		return errors.New("Something has gone wrong.  Head commit for the branch isn't in the commit list")
+	}
+	entry := commit.Tree.Entries[0]
+
+	// Copy the database from the local cache, so it matches the new branch head commit
+	err = r.ensureCached(db, head.Commit, entry.Sha256)
+	if err != nil {
+		return
+	}
+	err = r.RestoreDB(db, entry.Sha256, entry.LastModified)
+	if err != nil {
+		return
+	}
+
+	// Set the active branch
+	meta.ActiveBranch = name
+	return r.SaveMetadata(db, meta, "branch active set")
+}
+
+// UpdateBranch changes the description of a branch of a database.  The change is queued for the server, to be sent
+// on the next push
+func (r *Repo) UpdateBranch(db string, name string, description string) (err error) {
+	meta, err := r.LoadHeads(db)
+	if err != nil {
+		return
+	}
+	branch, ok := meta.Branches[name]
+	if !ok {
+		return errors.New("That branch doesn't exist")
+	}
+	branch.Description = description
+	meta.Branches[name] = branch
+	meta.BranchOps = append(meta.BranchOps, BranchOp{
+		Action:      "update",
+		Branch:      name,
+		Description: description,
+	})
+	return r.SaveMetadata(db, meta, "branch update")
+}
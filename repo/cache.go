@@ -0,0 +1,137 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CopyFile copies a file, without reading the whole thing into memory.  The copy is written to a temporary file
+// first, then renamed into place, so an interrupted copy doesn't leave a partially written file behind
+func CopyFile(src string, dst string) (err error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	tmpFile, _, _, err := writeTempFile(filepath.Dir(dst), f)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmpFile, dst)
+	if err != nil {
+		_ = os.Remove(tmpFile)
+	}
+	return
+}
+
+// FileSHA256 returns the SHA256 of a file's contents, and the number of bytes read.  The file is read in small
+// pieces, so even very large databases don't need much memory
+func FileSHA256(path string) (shaSum string, size int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := sha256.New()
+	if size, err = io.Copy(h, f); err != nil {
+		return
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// HasCached returns true if the version of a database with the given SHA256 is in the local cache
+func (r *Repo) HasCached(db string, shaSum string) bool {
+	_, err := os.Stat(r.CachePath(db, shaSum))
+	return err == nil
+}
+
+// RestoreDB copies a version of a database from the local cache into the working directory, setting its last
+// modified time to match the commit it's from
+func (r *Repo) RestoreDB(db string, shaSum string, lastMod time.Time) (err error) {
+	err = CopyFile(r.CachePath(db, shaSum), r.DBPath(db))
+	if err != nil {
+		return
+	}
+	err = os.Chtimes(r.DBPath(db), time.Now(), lastMod)
+	if err != nil {
+		return
+	}
+
+	// The SHA256 of the restored file is already known, so it won't need hashing the next time it's checked
+	err = r.RecordStatIndex(db, shaSum)
+	return
+}
+
+// SaveDB writes a version of a database into the local cache, unless it's already there.  The data is checked to
+// have the given SHA256 checksum as it's written, and is only moved into place in the cache once it's been fully
+// written.  Until then it's kept in the database's tmp directory, so a partly written file is never mistaken for a
+// cached version
+func (r *Repo) SaveDB(db string, shaSum string, rd io.Reader) (err error) {
+	if r.HasCached(db, shaSum) {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(r.CachePath(db, shaSum)), 0770); err != nil {
+		return
+	}
+	if err = os.MkdirAll(r.tmpDir(db), 0770); err != nil {
+		return
+	}
+	tmpFile, thisSum, _, err := writeTempFile(r.tmpDir(db), rd)
+	if err != nil {
+		return
+	}
+	if thisSum != shaSum {
+		// The database file doesn't have the expected checksum.  Abort.
+		_ = os.Remove(tmpFile)
+		return fmt.Errorf("Aborting: database file should have checksum '%s', but data with checksum '%s' "+
+			"received\n", shaSum, thisSum)
+	}
+	err = os.Rename(tmpFile, r.CachePath(db, shaSum))
+	if err != nil {
+		_ = os.Remove(tmpFile)
+	}
+	return
+}
+
+// Makes sure the version of a database from a commit is in the local cache, using FetchDB to retrieve it if it isn't
+func (r *Repo) ensureCached(db string, commitID string, shaSum string) (err error) {
+	if r.HasCached(db, shaSum) {
+		return
+	}
+	if r.FetchDB == nil {
+		return fmt.Errorf("The database file for commit '%s' isn't in the local cache", commitID)
+	}
+	return r.FetchDB(db, commitID, shaSum)
+}
+
+// Writes data to a new temporary file in the given directory, returning the name of the file along with the SHA256
+// and size of the data written.  The caller is responsible for renaming or removing the file afterwards
+func writeTempFile(dir string, r io.Reader) (tmpFile string, shaSum string, size int64, err error) {
+	f, err := ioutil.TempFile(dir, ".dio-tmp-")
+	if err != nil {
+		return
+	}
+	tmpFile = f.Name()
+	h := sha256.New()
+	size, err = io.Copy(io.MultiWriter(f, h), r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Chmod(tmpFile, 0644)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile)
+		return "", "", 0, err
+	}
+	return tmpFile, hex.EncodeToString(h.Sum(nil)), size, nil
+}
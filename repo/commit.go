@@ -0,0 +1,159 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sqlitebrowser/dio/client"
+)
+
+// Changed returns true if a database file has been changed since the head commit of the active branch
+func (r *Repo) Changed(db string, meta Metadata) (changed bool, err error) {
+	// Retrieve the sha256, file size, and last modified date from the head commit of the active branch
+	head, ok := meta.Branches[meta.ActiveBranch]
+	if !ok {
+		err = errors.New("Aborting: info for the active branch isn't found in the local branch cache")
+		return
+	}
+	c, ok, err := r.FindCommit(db, meta, head.Commit)
+	if err != nil {
+		return
+	}
+	if !ok {
+		err = errors.New("Aborting: info for the head commit isn't found in the local commit cache")
+		return
+	}
+	metaSHASum := c.Tree.Entries[0].Sha256
+	metaFileSize := c.Tree.Entries[0].Size
+	metaLastModified := c.Tree.Entries[0].LastModified.Truncate(time.Second).UTC()
+
+	// If the file size or last modified date in the metadata are different from the current file info, then the
+	// local file has probably changed.  Well, "probably" for the last modified day, but "definitely" if the file
+	// size is different
+	fi, err := os.Stat(r.DBPath(db))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return
+	}
+	fileSize := fi.Size()
+	lastModified := fi.ModTime().Truncate(time.Second).UTC()
+	if metaFileSize != fileSize || !metaLastModified.Equal(lastModified) {
+		changed = true
+		return
+	}
+
+	// * If the file size and last modified date are still the same, we SHA256 checksum and compare the file *
+
+	// The stat index means the file only needs reading when it may have changed since it was last hashed
+	shaSum, err := r.IndexedSHA256(db)
+	if err != nil {
+		return
+	}
+
+	// Check if a change has been made
+	if metaSHASum != shaSum {
+		changed = true
+	}
+	return
+}
+
+// Commit creates a new commit for a database, from the file in the working directory.  The file is added to the
+// local cache, and the branch moved on to the new commit.  Databases without local metadata are started off with new
+// metadata, making the commit their first one
+func (r *Repo) Commit(db string, opts CommitOptions) (c client.CommitEntry, err error) {
+	meta := NewMetadata(opts.Branch)
+	if r.HasMetadata(db) {
+		meta, err = r.LoadHeads(db)
+		if err != nil {
+			return
+		}
+	}
+
+	// If no branch name was passed, use the active branch
+	branch := opts.Branch
+	if branch == "" {
+		branch = meta.ActiveBranch
+	}
+
+	// Get the current head commit for the selected branch, as that will be the parent commit for this new one
+	head, ok := meta.Branches[branch]
+	if !ok {
+		err = fmt.Errorf("That branch ('%s') doesn't exist", branch)
+		return
+	}
+
+	// Create a new tree with an entry for the database file
+	e, err := r.TreeEntryFromFile(db, opts.LicenceSHA)
+	if err != nil {
+		return
+	}
+	var t client.DBTree
+	t.Entries = append(t.Entries, e)
+	t.ID = CreateDBTreeID(t.Entries)
+
+	// Create a new commit for the new tree
+	commitTime := opts.Timestamp
+	if commitTime.IsZero() {
+		commitTime = time.Now()
+	}
+	c = client.CommitEntry{
+		AuthorEmail:    opts.AuthorEmail,
+		AuthorName:     opts.AuthorName,
+		CommitterEmail: opts.CommitterEmail,
+		CommitterName:  opts.CommitterName,
+		Message:        opts.Message,
+		OtherParents:   opts.OtherParents,
+		Parent:         head.Commit,
+		Timestamp:      commitTime.UTC(),
+		Tree:           t,
+	}
+
+	// Calculate the new commit ID, which incorporates the updated tree ID (and thus the new licence sha256)
+	c.ID = CreateCommitID(c)
+
+	// Add the new commit to the commit list, and move the branch head on to it
+	meta.Commits[c.ID] = c
+	meta.Branches[branch] = client.BranchEntry{
+		Commit:      c.ID,
+		CommitCount: head.CommitCount + 1,
+		Description: head.Description,
+	}
+
+	// If the database file isn't already in the local cache, then copy it there
+	f, err := os.Open(r.DBPath(db))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	err = r.SaveDB(db, e.Sha256, f)
+	if err != nil {
+		return
+	}
+
+	// Save the updated metadata back to disk
+	err = r.SaveMetadata(db, meta, "commit")
+	return
+}
+
+// TreeEntryFromFile creates a tree entry for a database file in the working directory
+func (r *Repo) TreeEntryFromFile(db string, licSHA string) (e client.DBTreeEntry, err error) {
+	fi, err := os.Stat(r.DBPath(db))
+	if err != nil {
+		return
+	}
+	shaSum, err := r.IndexedSHA256(db)
+	if err != nil {
+		return
+	}
+	e.EntryType = client.EntryDatabase
+	e.LastModified = fi.ModTime().UTC()
+	e.LicenceSHA = licSHA
+	e.Name = db
+	e.Sha256 = shaSum
+	e.Size = fi.Size()
+	return
+}
@@ -0,0 +1,107 @@
+package repo
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// MetadataFormatVersion is the version of the metadata format written by this version of dio.  It goes up by one
+// whenever the format changes in a way older versions of dio wouldn't understand, with a migration added to upgrade
+// metadata in the previous format.  Version 2 moved the metadata from metadata.json into the metadata.db store.
+// Version 3 records commit parents which aren't stored yet, so commits added after their children are linked up
+const MetadataFormatVersion = 3
+
+// The last format version kept in metadata.json files
+const lastJSONFormatVersion = 1
+
+// FormatError is returned when a metadata file was written by a newer version of dio, in a format this one doesn't
+// know how to read
+type FormatError struct {
+	DB      string
+	Version int
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("The metadata for '%s' is in format version %d, but this version of dio only understands up "+
+		"to version %d.  It was probably written by a newer version of dio, which you'll need to use instead", e.DB,
+		e.Version, MetadataFormatVersion)
+}
+
+// The metadata file, as the JSON object it's stored as.  Migrations work on this rather than Metadata, so they can
+// handle fields which have since been renamed or removed
+type rawMetadata map[string]json.RawMessage
+
+// The changes needed to upgrade the metadata.json file format, where migrations[n] upgrades format version n to n+1.
+// Once up to date, the files are imported into the store
+var migrations = []func(m rawMetadata) error{
+	migrateToVersion1,
+}
+
+// The changes needed to upgrade the metadata store format, where storeMigrations[n] upgrades a store at format
+// version n to n+1.  Stores at a version without a migration here can't be upgraded, so are treated as damaged
+var storeMigrations = map[int]func(tx *sql.Tx) error{
+	1: migrateStoreToVersion2,
+	2: migrateStoreToVersion3,
+}
+
+// Version 1 stores hold the metadata as imported from a version 1 metadata.json file, without the commit parents,
+// generation numbers, and depths the queries on the store rely on.  Those are worked out from the commits
+func migrateStoreToVersion2(tx *sql.Tx) error {
+	return rebuildCommitGraph(tx)
+}
+
+// Version 2 stores left out the parents of commits which weren't stored yet, so commits added after their children
+// were never linked to them, and the children kept generation numbers and depths worked out without them.  Those are
+// all worked out again from the commits
+func migrateStoreToVersion3(tx *sql.Tx) error {
+	return rebuildCommitGraph(tx)
+}
+
+// Version 0 is the format from before the version number was added.  Files from then can be missing their "tags"
+// and "releases" maps, or have them set to null
+func migrateToVersion1(m rawMetadata) error {
+	for _, field := range []string{"releases", "tags"} {
+		if v, ok := m[field]; !ok || string(v) == "null" {
+			m[field] = json.RawMessage("{}")
+		}
+	}
+	return nil
+}
+
+// Parses the contents of a metadata.json file, upgrading it from older format versions as needed.  Files claiming to
+// be from newer versions of dio are refused with a FormatError, as they could hold changes this version would lose
+func parseMetadata(db string, data []byte) (meta Metadata, err error) {
+	var m rawMetadata
+	if err = json.Unmarshal(data, &m); err != nil {
+		return
+	}
+	if m == nil {
+		return meta, fmt.Errorf("The metadata for '%s' is empty", db)
+	}
+	version := 0
+	if v, ok := m["format_version"]; ok {
+		if err = json.Unmarshal(v, &version); err != nil {
+			return meta, fmt.Errorf("The metadata for '%s' has an invalid format version: %v", db, err)
+		}
+	}
+	if version > lastJSONFormatVersion {
+		return meta, &FormatError{DB: db, Version: version}
+	}
+
+	// Upgrade the file one format version at a time
+	if version < lastJSONFormatVersion {
+		for ; version < lastJSONFormatVersion; version++ {
+			if err = migrations[version](m); err != nil {
+				return meta, fmt.Errorf("Couldn't upgrade the metadata for '%s' from format version %d: %v", db,
+					version, err)
+			}
+		}
+		m["format_version"] = json.RawMessage(fmt.Sprint(version))
+		if data, err = json.Marshal(m); err != nil {
+			return
+		}
+	}
+	err = json.Unmarshal(data, &meta)
+	return
+}
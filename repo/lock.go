@@ -0,0 +1,60 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrLocked is returned by TryLock when another process holds the lock for a database
+var ErrLocked = errors.New("The database is locked by another dio process")
+
+// Lock is an advisory lock on the local metadata and cache of a database, held until Unlock is called.  It stops two
+// dio processes changing a database's metadata at the same time, and losing one of the updates
+type Lock struct {
+	f *os.File
+}
+
+// Lock takes the lock for a database, waiting for any other process holding it to finish first.  ErrNoMetadata is
+// returned for databases which have nothing in the .dio directory yet
+func (r *Repo) Lock(db string) (*Lock, error) {
+	return r.lock(db, true)
+}
+
+// TryLock takes the lock for a database if it's free, returning ErrLocked if another process holds it
+func (r *Repo) TryLock(db string) (*Lock, error) {
+	return r.lock(db, false)
+}
+
+// Unlock releases a database lock
+func (l *Lock) Unlock() (err error) {
+	err = unlockFile(l.f)
+	if errClose := l.f.Close(); err == nil {
+		err = errClose
+	}
+	return
+}
+
+// Opens the lock file for a database, then locks it.  Only databases which already have a directory in .dio can be
+// locked, so a mistyped database name doesn't leave a new directory behind
+func (r *Repo) lock(db string, wait bool) (l *Lock, err error) {
+	if _, err = os.Stat(r.dbDir(db)); os.IsNotExist(err) {
+		return nil, ErrNoMetadata
+	} else if err != nil {
+		return
+	}
+	if !fileLocking && r.Warn != nil {
+		r.Warn(fmt.Sprintf("Databases can't be locked on this platform, so make sure no other dio process is "+
+			"working with '%s'", db))
+	}
+	f, err := os.OpenFile(filepath.Join(r.dbDir(db), "lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return
+	}
+	if err = lockFile(f, wait); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Lock{f: f}, nil
+}
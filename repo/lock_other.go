@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !windows
+// +build !linux,!darwin,!freebsd,!netbsd,!windows
+
+package repo
+
+import "os"
+
+// Whether lockFile really locks the file on this platform
+const fileLocking = false
+
+// Other platforms don't have flock() or LockFileEx(), so the lock file is only created there, and a warning is given
+// when it's taken.  The atomic metadata writes still stop an interrupted dio from leaving a half written file behind
+func lockFile(f *os.File, wait bool) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build windows
+// +build windows
+
+package repo
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Whether lockFile really locks the file on this platform
+const fileLocking = true
+
+// Takes an exclusive LockFileEx() lock on the first byte of a file.  Without waiting, ErrLocked is returned if someone
+// else has it
+func lockFile(f *os.File, wait bool) error {
+	flags := uint32(windows.LOCKFILE_EXCLUSIVE_LOCK)
+	if !wait {
+		flags |= windows.LOCKFILE_FAIL_IMMEDIATELY
+	}
+	err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, &windows.Overlapped{})
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return ErrLocked
+	}
+	return err
+}
+
+// Releases a LockFileEx() lock on a file
+func unlockFile(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
@@ -0,0 +1,328 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sqlitebrowser/dio/client"
+)
+
+// Ancestry returns every commit reachable from the given head commits, following both the first parent and any other
+// (merge) parents.  Commits always come before their parents, and are otherwise ordered newest first
+func Ancestry(meta Metadata, heads ...string) (commits []client.CommitEntry) {
+	// Gather the reachable commits, counting how many children each has amongst them
+	reachable := make(map[string]struct{})
+	for _, h := range heads {
+		for id := range CommitAncestors(meta, h) {
+			if _, ok := meta.Commits[id]; ok {
+				reachable[id] = struct{}{}
+			}
+		}
+	}
+	children := make(map[string]int, len(reachable))
+	for id := range reachable {
+		for _, p := range parentIDs(meta.Commits[id]) {
+			if _, ok := reachable[p]; ok {
+				children[p]++
+			}
+		}
+	}
+
+	// Repeatedly take the newest commit whose children have all been taken already
+	var ready []string
+	for id := range reachable {
+		if children[id] == 0 {
+			ready = append(ready, id)
+		}
+	}
+	for len(ready) > 0 {
+		n := 0
+		for i := range ready {
+			a, b := meta.Commits[ready[i]], meta.Commits[ready[n]]
+			if a.Timestamp.After(b.Timestamp) || (a.Timestamp.Equal(b.Timestamp) && a.ID < b.ID) {
+				n = i
+			}
+		}
+		c := meta.Commits[ready[n]]
+		ready = append(ready[:n], ready[n+1:]...)
+		commits = append(commits, c)
+		for _, p := range parentIDs(c) {
+			if _, ok := reachable[p]; !ok {
+				continue
+			}
+			children[p]--
+			if children[p] == 0 {
+				ready = append(ready, p)
+			}
+		}
+	}
+	return
+}
+
+// CommitAncestors returns the IDs of every commit reachable from the given one, including the commit itself.  Both
+// the first parent and any other (merge) parents are followed
+func CommitAncestors(meta Metadata, id string) map[string]struct{} {
+	list := make(map[string]struct{})
+	queue := []string{id}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if c == "" {
+			continue
+		}
+		if _, ok := list[c]; ok {
+			continue
+		}
+		list[c] = struct{}{}
+		com, ok := meta.Commits[c]
+		if !ok {
+			continue
+		}
+		queue = append(queue, com.Parent)
+		queue = append(queue, com.OtherParents...)
+	}
+	return list
+}
+
+// CreateCommitID generates a stable SHA256 for a commit
+func CreateCommitID(c client.CommitEntry) string {
+	var b bytes.Buffer
+	b.WriteString(fmt.Sprintf("tree %s\n", c.Tree.ID))
+	if c.Parent != "" {
+		b.WriteString(fmt.Sprintf("parent %s\n", c.Parent))
+	}
+	for _, j := range c.OtherParents {
+		b.WriteString(fmt.Sprintf("parent %s\n", j))
+	}
+	b.WriteString(fmt.Sprintf("author %s <%s> %v\n", c.AuthorName, c.AuthorEmail,
+		c.Timestamp.UTC().Format(time.UnixDate)))
+	if c.CommitterEmail != "" {
+		b.WriteString(fmt.Sprintf("committer %s <%s> %v\n", c.CommitterName, c.CommitterEmail,
+			c.Timestamp.UTC().Format(time.UnixDate)))
+	}
+	b.WriteString("\n" + c.Message)
+	b.WriteByte(0)
+	s := sha256.Sum256(b.Bytes())
+	return hex.EncodeToString(s[:])
+}
+
+// CreateDBTreeID generates the SHA256 for a tree.
+// Tree entry structure is:
+// * [ entry type ] [ licence sha256] [ file sha256 ] [ file name ] [ last modified (timestamp) ] [ file size (bytes) ]
+func CreateDBTreeID(entries []client.DBTreeEntry) string {
+	var b bytes.Buffer
+	for _, j := range entries {
+		b.WriteString(string(j.EntryType))
+		b.WriteByte(0)
+		b.WriteString(string(j.LicenceSHA))
+		b.WriteByte(0)
+		b.WriteString(j.Sha256)
+		b.WriteByte(0)
+		b.WriteString(j.Name)
+		b.WriteByte(0)
+		b.WriteString(j.LastModified.Format(time.RFC3339))
+		b.WriteByte(0)
+		b.WriteString(fmt.Sprintf("%d\n", j.Size))
+	}
+	s := sha256.Sum256(b.Bytes())
+	return hex.EncodeToString(s[:])
+}
+
+// History returns the commits of a branch, newest first, following the first parent of each commit
+func History(meta Metadata, branch string) (commits []client.CommitEntry, err error) {
+	head, ok := meta.Branches[branch]
+	if !ok {
+		return nil, errors.New("That branch doesn't exist for the database")
+	}
+	for id := head.Commit; id != ""; {
+		c, ok := meta.Commits[id]
+		if !ok {
+			return nil, fmt.Errorf("Broken commit history: commit '%s' isn't in the commit list", id)
+		}
+		commits = append(commits, c)
+		id = c.Parent
+	}
+	return
+}
+
+// NewMetadata creates the metadata for a database which isn't being tracked yet, with a single (empty) branch.  The
+// branch is called "main" unless another name is given
+func NewMetadata(branch string) (meta Metadata) {
+	if branch == "" {
+		branch = "main"
+	}
+	meta = Metadata{
+		ActiveBranch:  branch,
+		Branches:      map[string]client.BranchEntry{branch: {}},
+		Commits:       map[string]client.CommitEntry{},
+		DefBranch:     branch,
+		FormatVersion: MetadataFormatVersion,
+		Releases:      map[string]client.ReleaseEntry{},
+		Tags:          map[string]client.TagEntry{},
+	}
+	return
+}
+
+// FindCommit returns a commit of a database, looking in the given metadata first and then in the local store.  This
+// lets it find commits whether the metadata was loaded with its commits, eg by LoadMetadata, or without, eg by
+// LoadHeads
+func (r *Repo) FindCommit(db string, meta Metadata, id string) (c client.CommitEntry, ok bool, err error) {
+	if c, ok = meta.Commits[id]; ok {
+		return
+	}
+	if !r.HasMetadata(db) {
+		return
+	}
+	commits, err := r.LoadCommits(db, id)
+	if err != nil {
+		return
+	}
+	c, ok = commits[id]
+	return
+}
+
+// LoadHeads loads the local metadata for a database apart from its commits, leaving the commit list empty.  This is
+// much quicker than LoadMetadata for databases with a long history, and is enough for anything only needing the
+// branches, tags, releases, and settings.  Use FindCommit, LoadCommits, etc for any commits needed.  If there isn't
+// any metadata, FetchMetadata is used to retrieve it first
+func (r *Repo) LoadHeads(db string) (meta Metadata, err error) {
+	return r.loadMetadata(db, false)
+}
+
+// LoadMetadata loads the local metadata for a database.  If there isn't any, FetchMetadata is used to retrieve it
+// first
+func (r *Repo) LoadMetadata(db string) (meta Metadata, err error) {
+	return r.loadMetadata(db, true)
+}
+
+// Log returns the commits of a branch of a database, newest first.  The active branch is used when no branch is given
+func (r *Repo) Log(db string, branch string) (commits []client.CommitEntry, err error) {
+	meta, err := r.LoadMetadata(db)
+	if err != nil {
+		return
+	}
+	if branch == "" {
+		branch = meta.ActiveBranch
+	}
+	return History(meta, branch)
+}
+
+// SaveMetadata saves the local metadata for a database.  Any branch heads it moves, and any change of the active
+// branch, are recorded in the reflog against the action making the change.  eg "commit".  Only the commits which
+// haven't been saved before are written, in a single transaction.  Commits left out of the metadata stay in the
+// store, so metadata from LoadHeads can be saved too.  PruneCommits removes the ones no longer needed
+func (r *Repo) SaveMetadata(db string, meta Metadata, action string) (err error) {
+	// Create the metadata directory if needed.  We create the "db" directory instead, as that'll be needed anyway and
+	// MkdirAll() ensures the .dio/<db> directory will be created on the way through
+	if err = os.MkdirAll(filepath.Join(r.dbDir(db), "db"), 0770); err != nil {
+		return
+	}
+
+	// Nothing is stored for a new database yet, so a store is created with everything in it.  As with changes to an
+	// existing store below, the reflog entries are written first
+	if !r.HasMetadata(db) {
+		var size int64
+		if size, err = r.appendReflog(db, reflogChanges(Metadata{}, meta, false, action)); err != nil {
+			return
+		}
+		if err = r.createStore(db, meta); err != nil {
+			_ = os.Truncate(r.reflogPath(db), size)
+		}
+		return
+	}
+
+	// Write the changes, grabbing the branch heads being replaced so the moves can be added to the reflog
+	sdb, err := r.openStore(db)
+	if err != nil {
+		return
+	}
+	defer sdb.Close()
+	tx, err := sdb.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	old, err := readHeads(tx)
+	if err != nil {
+		return
+	}
+	if err = writeMetadata(tx, meta); err != nil {
+		return
+	}
+
+	// The reflog entries are written before the changes are committed, so a crash in between can't leave a branch
+	// move without its reflog entry.  If committing fails, the entries are removed again
+	size, err := r.appendReflog(db, reflogChanges(old, meta, true, action))
+	if err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		_ = os.Truncate(r.reflogPath(db), size)
+	}
+	return
+}
+
+// Loads the local metadata for a database, with or without its commits.  If there isn't any, FetchMetadata is used to
+// retrieve it first
+func (r *Repo) loadMetadata(db string, withCommits bool) (meta Metadata, err error) {
+	if !r.HasMetadata(db) {
+		if r.FetchMetadata == nil {
+			return meta, ErrNoMetadata
+		}
+		if err = r.FetchMetadata(db); err != nil {
+			return
+		}
+	}
+
+	// Read the metadata from the store.  Metadata still in a metadata.json file from an older version of dio is
+	// moved into a new store first
+	sdb, err := r.openStore(db)
+	if err != nil {
+		return
+	}
+	defer sdb.Close()
+	if meta, err = readMetadata(sdb); err != nil || !withCommits {
+		return
+	}
+	err = readCommits(sdb, meta.Commits)
+	return
+}
+
+// Replaces the damaged metadata.json file of a database with the backup from the previous save by an older version
+// of dio, returning its contents
+func (r *Repo) recoverMetadata(db string, loadErr error) (meta Metadata, err error) {
+	bak, err := ioutil.ReadFile(r.metadataBackupPath(db))
+	if err != nil {
+		return meta, fmt.Errorf("The metadata for '%s' is damaged (%v), and there's no backup of it to recover "+
+			"from", db, loadErr)
+	}
+	if meta, err = parseMetadata(db, bak); err != nil {
+		if _, newer := err.(*FormatError); newer {
+			return
+		}
+		return meta, fmt.Errorf("The metadata for '%s' and its backup are both damaged: %v", db, loadErr)
+	}
+	if err = WriteFileAtomic(r.metadataPath(db), bak, 0644); err != nil {
+		return
+	}
+	if r.Warn != nil {
+		r.Warn(fmt.Sprintf("The metadata for '%s' was damaged, so it has been recovered from its backup.  The most "+
+			"recent change to it may have been lost", db))
+	}
+	return
+}
+
+// Returns the IDs of the parents of a commit, first parent first.  The first parent is left out for initial commits
+func parentIDs(c client.CommitEntry) (ids []string) {
+	if c.Parent != "" {
+		ids = append(ids, c.Parent)
+	}
+	return append(ids, c.OtherParents...)
+}
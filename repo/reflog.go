@@ -0,0 +1,210 @@
+package repo
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sqlitebrowser/dio/client"
+)
+
+// Reflog returns the moves of the branch heads of a database, and the changes of its active branch, newest first
+func (r *Repo) Reflog(db string) (entries []ReflogEntry, err error) {
+	f, err := os.Open(r.reflogPath(db))
+	if os.IsNotExist(err) {
+		return []ReflogEntry{}, nil
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	// The file holds one entry per line, oldest first
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		var e ReflogEntry
+		if err = json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("Corrupt reflog entry for '%s': %v", db, err)
+		}
+		entries = append(entries, e)
+	}
+	if err = s.Err(); err != nil {
+		return
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if entries == nil {
+		entries = []ReflogEntry{}
+	}
+	return
+}
+
+// ReflogCommits returns the commits the reflog of a database refers to.  Those are kept in the metadata and the local
+// cache, so every entry can still be undone
+func (r *Repo) ReflogCommits(db string) (ids []string, err error) {
+	entries, err := r.Reflog(db)
+	if err != nil {
+		return
+	}
+	seen := make(map[string]struct{})
+	for _, e := range entries {
+		for _, id := range []string{e.From, e.To} {
+			if _, ok := seen[id]; id != "" && !ok {
+				seen[id] = struct{}{}
+				ids = append(ids, id)
+			}
+		}
+	}
+	return
+}
+
+// UndoReflog puts a branch head back to where it was before the move recorded in a reflog entry, with 0 being the
+// newest entry.  If it's the active branch, the database file is restored from the commit too.  A removed branch is
+// created again where it was.  Unless forced, ErrChanged is returned if the database file has been changed since the
+// last commit
+func (r *Repo) UndoReflog(db string, n int, force bool) (err error) {
+	entries, err := r.Reflog(db)
+	if err != nil {
+		return
+	}
+	if n < 0 || n >= len(entries) {
+		return fmt.Errorf("There's no reflog entry %d.  The reflog for '%s' has %d entries", n, db, len(entries))
+	}
+	e := entries[n]
+	switch {
+	case e.PrevActive != "":
+		return fmt.Errorf("Reflog entry %d changed the active branch.  Use 'dio branch active set' to change it back",
+			n)
+	case e.From == "":
+		return fmt.Errorf("Reflog entry %d created branch '%s', so there's no earlier head to go back to", n, e.Branch)
+	case e.To == "":
+		return r.undoBranchRemove(db, e.Branch, e.From)
+	}
+	meta, err := r.LoadMetadata(db)
+	if err != nil {
+		return
+	}
+
+	// Unless forced, make sure no changes to the database file would be lost
+	if !force {
+		changed, err := r.Changed(db, meta)
+		if err != nil {
+			return err
+		}
+		if changed {
+			return ErrChanged
+		}
+	}
+	if _, ok := meta.Branches[e.Branch]; !ok {
+		return fmt.Errorf("Branch '%s' doesn't exist any more.  Create it again with 'dio branch create' at "+
+			"commit %s", e.Branch, e.From)
+	}
+	return r.moveBranch(db, meta, e.Branch, e.From, e.Branch == meta.ActiveBranch, "reflog undo")
+}
+
+// Adds entries to the reflog of a database, returning the size the reflog was before they were added.  The reflog can
+// be truncated back to that size to remove them again
+func (r *Repo) appendReflog(db string, entries []ReflogEntry) (size int64, err error) {
+	if fi, errStat := os.Stat(r.reflogPath(db)); errStat == nil {
+		size = fi.Size()
+	}
+	if len(entries) == 0 {
+		return
+	}
+	f, err := os.OpenFile(r.reflogPath(db), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range entries {
+		if err = enc.Encode(e); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		_ = os.Truncate(r.reflogPath(db), size)
+	}
+	return
+}
+
+// Creates a branch again at the commit it was at when it was removed.  If the removal hasn't been sent to the server
+// yet, it's dropped from the queue, otherwise the branch's creation is queued
+func (r *Repo) undoBranchRemove(db string, name string, commitID string) (err error) {
+	meta, err := r.LoadHeads(db)
+	if err != nil {
+		return
+	}
+	if _, ok := meta.Branches[name]; ok {
+		return fmt.Errorf("Branch '%s' has been created again since it was removed", name)
+	}
+	if _, ok, err := r.FindCommit(db, meta, commitID); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("Commit '%s' isn't in the local commit list", commitID)
+	}
+	meta.Branches[name] = client.BranchEntry{Commit: commitID}
+	queued := -1
+	for i, op := range meta.BranchOps {
+		if op.Action == "remove" && op.Branch == name {
+			queued = i
+		}
+	}
+	if queued != -1 {
+		meta.BranchOps = append(meta.BranchOps[:queued], meta.BranchOps[queued+1:]...)
+	} else {
+		meta.BranchOps = append(meta.BranchOps, BranchOp{Action: "create", Branch: name, Commit: commitID})
+	}
+	return r.SaveMetadata(db, meta, "reflog undo")
+}
+
+// Returns the reflog entries for the differences in the branch heads and active branch between two versions of the
+// metadata for a database.  When there's no earlier metadata, the active branch being set isn't counted as a change
+func reflogChanges(old Metadata, meta Metadata, hadOld bool, action string) (entries []ReflogEntry) {
+	now := time.Now().UTC()
+	names := make(map[string]struct{})
+	for name := range old.Branches {
+		names[name] = struct{}{}
+	}
+	for name := range meta.Branches {
+		names[name] = struct{}{}
+	}
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		from, to := old.Branches[name].Commit, meta.Branches[name].Commit
+		if from != to {
+			entries = append(entries, ReflogEntry{Action: action, Branch: name, From: from, Timestamp: now, To: to})
+		}
+	}
+	if hadOld && old.ActiveBranch != meta.ActiveBranch && meta.ActiveBranch != "" {
+		entries = append(entries, ReflogEntry{
+			Action:     action,
+			Branch:     meta.ActiveBranch,
+			From:       old.Branches[old.ActiveBranch].Commit,
+			PrevActive: old.ActiveBranch,
+			Timestamp:  now,
+			To:         meta.Branches[meta.ActiveBranch].Commit,
+		})
+	}
+	return
+}
+
+// Returns the path to the reflog file for a database
+func (r *Repo) reflogPath(db string) string {
+	return filepath.Join(r.dbDir(db), "reflog")
+}
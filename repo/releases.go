@@ -0,0 +1,40 @@
+package repo
+
+import (
+	"errors"
+
+	"github.com/sqlitebrowser/dio/client"
+)
+
+// CreateRelease adds a release to a database.  This replaces any earlier removal of a release with the same name,
+// which hasn't been pushed yet
+func (r *Repo) CreateRelease(db string, name string, rel client.ReleaseEntry) (err error) {
+	meta, err := r.LoadHeads(db)
+	if err != nil {
+		return
+	}
+	if _, ok := meta.Releases[name]; ok {
+		return errors.New("A release with that name already exists")
+	}
+	meta.Releases[name] = rel
+	delete(meta.DeletedReleases, name)
+	return r.SaveMetadata(db, meta, "release create")
+}
+
+// RemoveRelease removes a release from a database.  The removal is remembered, so it can be sent to the server on the
+// next push
+func (r *Repo) RemoveRelease(db string, name string) (err error) {
+	meta, err := r.LoadHeads(db)
+	if err != nil {
+		return
+	}
+	if _, ok := meta.Releases[name]; !ok {
+		return errors.New("A release with that name doesn't exist")
+	}
+	if meta.DeletedReleases == nil {
+		meta.DeletedReleases = make(map[string]client.ReleaseEntry)
+	}
+	meta.DeletedReleases[name] = meta.Releases[name]
+	delete(meta.Releases, name)
+	return r.SaveMetadata(db, meta, "release remove")
+}
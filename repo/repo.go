@@ -0,0 +1,107 @@
+// Package repo works with the local version history dio keeps for databases, in the .dio directory alongside them.
+// It's used by the dio command line tool, and can be used directly by other Go code which needs to commit, branch,
+// tag, revert, or read the history of databases without running dio.
+package repo
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ErrChanged is returned by operations which would overwrite a database file that has been changed since its last
+// commit, unless they're forced
+var ErrChanged = errors.New("The database has been changed since the last commit")
+
+// ErrNoMetadata is returned when a database has no local metadata, and it can't be fetched from elsewhere
+var ErrNoMetadata = errors.New("No local metadata for the database exists")
+
+// Repo is a directory of database files, with their version history kept in its .dio subdirectory
+type Repo struct {
+	// Dir is the directory holding the database files
+	Dir string
+
+	// FetchDB is called when a version of a database is needed from the local cache, but isn't there.  It should
+	// retrieve the version (eg from DBHub.io) and save it to CachePath.  When nil, an error is returned instead
+	FetchDB func(db string, commitID string, shaSum string) error
+
+	// FetchMetadata is called by LoadMetadata when a database has no local metadata.  It should retrieve the metadata
+	// (eg from DBHub.io) and save it.  When nil, ErrNoMetadata is returned instead
+	FetchMetadata func(db string) error
+
+	// VerifyHashes stops the stat index being trusted, so database files are always hashed in full when checking
+	// whether they've changed
+	VerifyHashes bool
+
+	// Warn is called with a message for the user when something unexpected is found and dealt with.  eg damaged
+	// metadata being recovered from its backup.  When nil, the messages are dropped
+	Warn func(msg string)
+}
+
+// Open returns a Repo for the database files in a directory
+func Open(dir string) *Repo {
+	return &Repo{Dir: dir}
+}
+
+// CachePath returns the path to a version of a database in the local cache, going by its SHA256
+func (r *Repo) CachePath(db string, shaSum string) string {
+	return filepath.Join(r.Dir, ".dio", db, "db", shaSum)
+}
+
+// DBPath returns the path to a database file in the working directory
+func (r *Repo) DBPath(db string) string {
+	return filepath.Join(r.Dir, db)
+}
+
+// HasMetadata returns true if a database has local metadata.  eg it's being tracked
+func (r *Repo) HasMetadata(db string) bool {
+	if _, err := os.Stat(r.storePath(db)); err == nil {
+		return true
+	}
+	_, err := os.Stat(r.metadataPath(db))
+	return err == nil
+}
+
+// Tracked returns the (sorted) names of the databases with local metadata
+func (r *Repo) Tracked() (dbs []string, err error) {
+	found := make(map[string]bool)
+	for _, name := range []string{"metadata.db", "metadata.json"} {
+		var matches []string
+		matches, err = filepath.Glob(filepath.Join(r.Dir, ".dio", "*", name))
+		if err != nil {
+			return
+		}
+		for _, m := range matches {
+			db := filepath.Base(filepath.Dir(m))
+			if !found[db] {
+				found[db] = true
+				dbs = append(dbs, db)
+			}
+		}
+	}
+	sort.Strings(dbs)
+	return
+}
+
+// Returns the path to the directory holding the metadata and cache for a database
+func (r *Repo) dbDir(db string) string {
+	return filepath.Join(r.Dir, ".dio", db)
+}
+
+// Returns the path to the backup of the previous metadata.json file for a database, from older versions of dio
+func (r *Repo) metadataBackupPath(db string) string {
+	return filepath.Join(r.Dir, ".dio", db, "metadata.json.bak")
+}
+
+// Returns the path to the metadata.json file for a database.  Older versions of dio kept the metadata there, before
+// the store was added
+func (r *Repo) metadataPath(db string) string {
+	return filepath.Join(r.Dir, ".dio", db, "metadata.json")
+}
+
+// Returns the path to the directory for files being written for a database, before they're moved into place.  eg
+// cached versions of the database while they're being saved or downloaded
+func (r *Repo) tmpDir(db string) string {
+	return filepath.Join(r.Dir, ".dio", db, "tmp")
+}
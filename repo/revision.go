@@ -0,0 +1,181 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResolveRevision works out which commit a revision refers to.  A revision starts with a commit ID (or a unique prefix
+// of one), or the name of a branch, tag, or release.  That can be followed by:
+//
+//	@{date}  The commit the branch pointed at as of the date, going by the commit timestamps.  eg main@{2024-05-01}.
+//	         With no name in front, the active branch is used
+//	~N       The commit N first parents back.  eg main~3.  A ~ on its own is the same as ~1
+//	^N       The Nth parent of the commit, where ^1 is the first parent and ^2 is the first merged in parent.  A ^ on
+//	         its own is the same as ^1
+//
+// The ~ and ^ parts can be repeated.  eg main~2^2
+func ResolveRevision(meta Metadata, rev string) (commitID string, err error) {
+	// Names and IDs matching the whole revision are used as is, before looking for any of the special characters
+	if commitID, ok := resolveName(meta, rev); ok {
+		return commitID, nil
+	}
+	end := strings.IndexAny(rev, "~^")
+	if i := strings.Index(rev, "@{"); i != -1 && (end == -1 || i < end) {
+		end = i
+	}
+	if end == -1 {
+		end = len(rev)
+	}
+	base, rest := rev[:end], rev[end:]
+
+	// Work out the starting commit
+	if strings.HasPrefix(rest, "@{") {
+		closing := strings.Index(rest, "}")
+		if closing == -1 {
+			return "", fmt.Errorf("Revision '%s' is missing the closing '}' of its date", rev)
+		}
+		branch := base
+		if branch == "" {
+			branch = meta.ActiveBranch
+		}
+		commitID, err = commitAsOf(meta, branch, rest[2:closing])
+		if err != nil {
+			return
+		}
+		rest = rest[closing+1:]
+	} else {
+		commitID, err = resolveBase(meta, base)
+		if err != nil {
+			return
+		}
+	}
+
+	// Follow the parents
+	for rest != "" {
+		op := rest[0]
+		if op != '~' && op != '^' {
+			return "", fmt.Errorf("Revision '%s' isn't valid.  Unexpected '%s'", rev, rest)
+		}
+		digits := 1
+		for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+			digits++
+		}
+		n := 1
+		if digits > 1 {
+			n, err = strconv.Atoi(rest[1:digits])
+			if err != nil {
+				return "", fmt.Errorf("Revision '%s' isn't valid: %v", rev, err)
+			}
+		}
+		rest = rest[digits:]
+		if op == '~' {
+			for i := 0; i < n; i++ {
+				commitID, err = nthParent(meta, commitID, 1)
+				if err != nil {
+					return
+				}
+			}
+		} else {
+			commitID, err = nthParent(meta, commitID, n)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Returns the commit a branch pointed at as of a date, going back along its first parents until a commit made at or
+// before then is found.  Dates without a time are taken to be the start of that day, in local time
+func commitAsOf(meta Metadata, branch string, date string) (commitID string, err error) {
+	head, ok := meta.Branches[branch]
+	if !ok {
+		return "", fmt.Errorf("Unknown branch '%s'", branch)
+	}
+	when, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		when, err = time.ParseInLocation("2006-01-02", date, time.Local)
+		if err != nil {
+			return "", fmt.Errorf("Invalid date '%s'.  Use a date like 2006-01-02 or 2006-01-02T15:04:05Z", date)
+		}
+	}
+	for id := head.Commit; id != ""; {
+		c, ok := meta.Commits[id]
+		if !ok {
+			return "", fmt.Errorf("Broken commit history: commit '%s' isn't in the commit list", id)
+		}
+		if !c.Timestamp.After(when) {
+			return id, nil
+		}
+		id = c.Parent
+	}
+	return "", fmt.Errorf("Branch '%s' has no commits as of %s", branch, date)
+}
+
+// Returns the Nth parent of a commit, where 1 is the first parent and 2 onwards are the merged in parents.  The 0th
+// parent is the commit itself
+func nthParent(meta Metadata, commitID string, n int) (string, error) {
+	c, ok := meta.Commits[commitID]
+	if !ok {
+		return "", fmt.Errorf("Broken commit history: commit '%s' isn't in the commit list", commitID)
+	}
+	if n == 0 {
+		return commitID, nil
+	}
+	parents := parentIDs(c)
+	if n > len(parents) {
+		if len(parents) == 0 {
+			return "", fmt.Errorf("Commit '%s' has no parents", commitID)
+		}
+		return "", fmt.Errorf("Commit '%s' has no parent number %d", commitID, n)
+	}
+	return parents[n-1], nil
+}
+
+// Resolves the start of a revision, before any of the special characters.  This is a name, or a commit ID or unique
+// prefix of one
+func resolveBase(meta Metadata, base string) (commitID string, err error) {
+	if base == "" {
+		return "", errors.New("No revision given")
+	}
+	if commitID, ok := resolveName(meta, base); ok {
+		return commitID, nil
+	}
+	var candidates []string
+	for id := range meta.Commits {
+		if strings.HasPrefix(id, base) {
+			candidates = append(candidates, id)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return "", fmt.Errorf("Unknown revision '%s'", base)
+	case 1:
+		return candidates[0], nil
+	}
+	sort.Strings(candidates)
+	return "", fmt.Errorf("Revision '%s' is ambiguous.  It matches these commits:\n  * %s", base,
+		strings.Join(candidates, "\n  * "))
+}
+
+// Returns the commit for a full commit ID, or for the name of a branch, tag, or release, in that order
+func resolveName(meta Metadata, name string) (commitID string, ok bool) {
+	if _, ok := meta.Commits[name]; ok {
+		return name, true
+	}
+	if b, ok := meta.Branches[name]; ok {
+		return b.Commit, true
+	}
+	if t, ok := meta.Tags[name]; ok {
+		return t.Commit, true
+	}
+	if r, ok := meta.Releases[name]; ok {
+		return r.Commit, true
+	}
+	return "", false
+}
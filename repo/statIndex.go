@@ -0,0 +1,114 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// IndexedSHA256 returns the SHA256 of a database file in the working directory.  If the file doesn't look to have
+// changed since the stat index for it was written, the SHA256 from there is used rather than reading the whole file
+// again
+func (r *Repo) IndexedSHA256(db string) (shaSum string, err error) {
+	fi, err := os.Stat(r.DBPath(db))
+	if err != nil {
+		return
+	}
+	idx := statIndexFromFile(fi)
+	if !r.VerifyHashes {
+		var old StatIndex
+		old, err = r.LoadStatIndex(db)
+		if err != nil {
+			return
+		}
+		if old.Sha256 != "" && old.CTime == idx.CTime && old.Inode == idx.Inode && old.ModTime == idx.ModTime &&
+			old.Size == idx.Size {
+			return old.Sha256, nil
+		}
+	}
+
+	// Calculate the SHA256 of the file, then update the index
+	var bytesRead int64
+	shaSum, bytesRead, err = FileSHA256(r.DBPath(db))
+	if err != nil {
+		return
+	}
+	if bytesRead != fi.Size() {
+		err = fmt.Errorf("Aborting: # of bytes read (%d) when reading the database doesn't match the database "+
+			"file size (%d)", bytesRead, fi.Size())
+		return
+	}
+	idx.Sha256 = shaSum
+	err = r.SaveStatIndex(db, idx)
+	return
+}
+
+// LoadStatIndex loads the stat index for a database.  If there isn't one, an empty index is returned
+func (r *Repo) LoadStatIndex(db string) (idx StatIndex, err error) {
+	b, err := ioutil.ReadFile(r.statIndexPath(db))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	err = json.Unmarshal(b, &idx)
+	return
+}
+
+// RecordStatIndex records the SHA256 of a database file in the working directory, along with the file info used to
+// tell if it has changed since.  Used when the SHA256 of the file is already known, eg after restoring it from the
+// local cache
+func (r *Repo) RecordStatIndex(db string, shaSum string) (err error) {
+	fi, err := os.Stat(r.DBPath(db))
+	if err != nil {
+		return
+	}
+	idx := statIndexFromFile(fi)
+	idx.Sha256 = shaSum
+	return r.SaveStatIndex(db, idx)
+}
+
+// RemoveStatIndex removes the stat index for a database, if it has one
+func (r *Repo) RemoveStatIndex(db string) (err error) {
+	err = os.Remove(r.statIndexPath(db))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+// SaveStatIndex saves the stat index for a database
+func (r *Repo) SaveStatIndex(db string, idx StatIndex) (err error) {
+	// A file modified in the last couple of seconds could be changed again without its last modified time changing
+	// (on file systems with coarse timestamps), so the index isn't written for it until it has settled down
+	if time.Since(time.Unix(0, idx.ModTime)) < 2*time.Second {
+		return r.RemoveStatIndex(db)
+	}
+	if _, err = os.Stat(r.dbDir(db)); os.IsNotExist(err) {
+		// Nothing is tracked for this database yet, so there's nowhere to keep an index
+		return nil
+	}
+	j, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return
+	}
+	err = WriteFileAtomic(r.statIndexPath(db), j, 0644)
+	return
+}
+
+// Returns the path to the stat index file for a database
+func (r *Repo) statIndexPath(db string) string {
+	return filepath.Join(r.dbDir(db), "index.json")
+}
+
+// Returns the stat index entry (without the SHA256) for a file
+func statIndexFromFile(fi os.FileInfo) (idx StatIndex) {
+	idx.Inode, idx.CTime = fileInodeAndCTime(fi)
+	idx.ModTime = fi.ModTime().UnixNano()
+	idx.Size = fi.Size()
+	return
+}
@@ -0,0 +1,19 @@
+//go:build darwin || freebsd || netbsd
+// +build darwin freebsd netbsd
+
+package repo
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns the inode number and status change time (in nanoseconds) of a file, when the platform provides them
+func fileInodeAndCTime(fi os.FileInfo) (inode uint64, cTime int64) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	sec, nsec := st.Ctimespec.Unix()
+	return uint64(st.Ino), sec*1e9 + nsec
+}
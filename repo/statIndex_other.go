@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !netbsd
+// +build !linux,!darwin,!freebsd,!netbsd
+
+package repo
+
+import "os"
+
+// Other platforms (eg Windows) don't provide the inode number and status change time in a consistent way, so only
+// the file size and last modified time are used there
+func fileInodeAndCTime(fi os.FileInfo) (inode uint64, cTime int64) {
+	return
+}
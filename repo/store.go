@@ -0,0 +1,986 @@
+package repo
+
+import (
+	"container/heap"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sqlitebrowser/dio/client"
+)
+
+// The tables of the metadata store.  Along with its details, each commit has its generation number (one more than
+// the highest generation of its parents) and depth (the number of commits in its first parent history, including
+// itself), so ancestry checks and commit counts don't need to walk the whole history
+const storeSchema = `
+CREATE TABLE branches (name TEXT PRIMARY KEY, commit_id TEXT NOT NULL, commit_count INTEGER NOT NULL,
+	description TEXT NOT NULL);
+CREATE TABLE commit_parents (commit_id TEXT NOT NULL, parent TEXT NOT NULL, position INTEGER NOT NULL,
+	PRIMARY KEY (commit_id, position));
+CREATE INDEX commit_parents_parent ON commit_parents (parent);
+CREATE TABLE commits (id TEXT PRIMARY KEY, generation INTEGER NOT NULL, depth INTEGER NOT NULL, data TEXT NOT NULL);
+CREATE TABLE releases (name TEXT PRIMARY KEY, commit_id TEXT NOT NULL, data TEXT NOT NULL);
+CREATE TABLE settings (name TEXT PRIMARY KEY, value TEXT NOT NULL);
+CREATE TABLE tags (name TEXT PRIMARY KEY, commit_id TEXT NOT NULL, data TEXT NOT NULL);`
+
+// Marks for the commits walked by paintHistory, saying which of the two starting commits they can be reached from
+const (
+	reachableFromA = 1 << iota
+	reachableFromB
+	reachableFromBoth = reachableFromA | reachableFromB
+)
+
+// A commit waiting to be walked by paintHistory
+type queuedCommit struct {
+	generation int
+	id         string
+}
+
+// The commits waiting to be walked by paintHistory, highest generation number first.  Commits with the same
+// generation number come out in ID order, so walks are repeatable
+type generationQueue []queuedCommit
+
+func (q generationQueue) Len() int { return len(q) }
+func (q generationQueue) Less(i, j int) bool {
+	if q[i].generation != q[j].generation {
+		return q[i].generation > q[j].generation
+	}
+	return q[i].id < q[j].id
+}
+func (q generationQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *generationQueue) Push(x interface{}) { *q = append(*q, x.(queuedCommit)) }
+func (q *generationQueue) Pop() interface{} {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// AheadBehind returns the number of commits reachable from one commit but not the other, in each direction.  eg the
+// number of commits a local branch is ahead of, and behind, the same branch on the server.  Only the commits back to
+// where the two histories meet are looked at
+func (r *Repo) AheadBehind(db string, local string, remote string) (ahead int, behind int, err error) {
+	sdb, err := r.openStore(db)
+	if err != nil {
+		return
+	}
+	defer sdb.Close()
+	marks, _, err := paintHistory(sdb, local, remote)
+	if err != nil {
+		return
+	}
+	for _, m := range marks {
+		switch m {
+		case reachableFromA:
+			ahead++
+		case reachableFromB:
+			behind++
+		}
+	}
+	return
+}
+
+// CommitCount returns the number of commits in the first parent history of a commit, including the commit itself.
+// eg the commit count of a branch with its head there
+func (r *Repo) CommitCount(db string, commitID string) (count int, err error) {
+	sdb, err := r.openStore(db)
+	if err != nil {
+		return
+	}
+	defer sdb.Close()
+	err = sdb.QueryRow(`SELECT depth FROM commits WHERE id = ?`, commitID).Scan(&count)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("Commit '%s' isn't in the local commit list", commitID)
+	}
+	return
+}
+
+// IsAncestor returns true if a commit can be reached from another by following their parents.  A commit counts as its
+// own ancestor.  Only the commits with a higher generation number than the ancestor are looked at, so checks against
+// recent commits stay quick however long the history is
+func (r *Repo) IsAncestor(db string, ancestor string, commitID string) (found bool, err error) {
+	sdb, err := r.openStore(db)
+	if err != nil {
+		return
+	}
+	defer sdb.Close()
+	var gen int
+	err = sdb.QueryRow(`SELECT generation FROM commits WHERE id = ?`, ancestor).Scan(&gen)
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("Commit '%s' isn't in the local commit list", ancestor)
+	}
+	if err != nil {
+		return
+	}
+	parents, err := sdb.Prepare(`
+		SELECT p.parent, c.generation
+		FROM commit_parents AS p, commits AS c
+		WHERE p.commit_id = ? AND c.id = p.parent`)
+	if err != nil {
+		return
+	}
+	defer parents.Close()
+	seen := map[string]struct{}{commitID: {}}
+	for queue := []string{commitID}; len(queue) > 0; {
+		id := queue[0]
+		queue = queue[1:]
+		if id == ancestor {
+			return true, nil
+		}
+		rows, err := parents.Query(id)
+		if err != nil {
+			return false, err
+		}
+		for rows.Next() {
+			var p string
+			var pGen int
+			if err = rows.Scan(&p, &pGen); err != nil {
+				rows.Close()
+				return false, err
+			}
+			if _, ok := seen[p]; !ok && pGen >= gen {
+				seen[p] = struct{}{}
+				queue = append(queue, p)
+			}
+		}
+		if err = rows.Close(); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// KeptCommits returns the commits of a database which are in the history of any of its branches, either local or as
+// last seen on the server, tags, releases, or reflog entries.  Those are the commits PruneCommits keeps
+func (r *Repo) KeptCommits(db string) (commits map[string]client.CommitEntry, err error) {
+	meta, err := r.LoadHeads(db)
+	if err != nil {
+		return
+	}
+	heads, err := r.ReflogCommits(db)
+	if err != nil {
+		return
+	}
+	for _, b := range meta.Branches {
+		heads = append(heads, b.Commit)
+	}
+	for _, b := range meta.RemoteBranches {
+		heads = append(heads, b.Commit)
+	}
+	for _, rel := range meta.Releases {
+		heads = append(heads, rel.Commit)
+	}
+	for _, t := range meta.Tags {
+		heads = append(heads, t.Commit)
+	}
+	return r.ReachableCommits(db, heads...)
+}
+
+// LoadCommits reads the given commits of a database from its store.  Commits which aren't in the store are left out
+func (r *Repo) LoadCommits(db string, ids ...string) (commits map[string]client.CommitEntry, err error) {
+	sdb, err := r.openStore(db)
+	if err != nil {
+		return
+	}
+	defer sdb.Close()
+	lookup, err := sdb.Prepare(`SELECT data FROM commits WHERE id = ?`)
+	if err != nil {
+		return
+	}
+	defer lookup.Close()
+	commits = make(map[string]client.CommitEntry)
+	for _, id := range ids {
+		var data string
+		err = lookup.QueryRow(id).Scan(&data)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		var c client.CommitEntry
+		if err = json.Unmarshal([]byte(data), &c); err != nil {
+			return
+		}
+		commits[id] = c
+	}
+	return commits, nil
+}
+
+// MergeBase returns the best common ancestor of two commits, which is the one with the highest generation number.  No
+// other common ancestor can be reached from it.  An empty string is returned if the commits don't share any history
+func (r *Repo) MergeBase(db string, a string, b string) (base string, err error) {
+	sdb, err := r.openStore(db)
+	if err != nil {
+		return
+	}
+	defer sdb.Close()
+	_, base, err = paintHistory(sdb, a, b)
+	return
+}
+
+// MissingCommits returns the commits reachable from the given heads in some metadata (eg from the server) which aren't
+// in the local store for a database.  The walk back through the history stops at commits already stored, as their
+// ancestors are stored too
+func (r *Repo) MissingCommits(db string, meta Metadata, heads ...string) (missing map[string]struct{}, err error) {
+	missing = make(map[string]struct{})
+	var lookup *sql.Stmt
+	if r.HasMetadata(db) {
+		var sdb *sql.DB
+		if sdb, err = r.openStore(db); err != nil {
+			return
+		}
+		defer sdb.Close()
+		if lookup, err = sdb.Prepare(`SELECT count(*) FROM commits WHERE id = ?`); err != nil {
+			return
+		}
+		defer lookup.Close()
+	}
+	seen := make(map[string]struct{})
+	for queue := heads; len(queue) > 0; {
+		id := queue[0]
+		queue = queue[1:]
+		if _, ok := seen[id]; ok || id == "" {
+			continue
+		}
+		seen[id] = struct{}{}
+		c, ok := meta.Commits[id]
+		if !ok {
+			continue
+		}
+		if lookup != nil {
+			var n int
+			if err = lookup.QueryRow(id).Scan(&n); err != nil {
+				return
+			}
+			if n > 0 {
+				continue
+			}
+		}
+		missing[id] = struct{}{}
+		queue = append(queue, parentIDs(c)...)
+	}
+	return
+}
+
+// PruneCommits removes the commits of a database which aren't in the history of anything KeptCommits looks at, eg
+// after a branch has been removed.  Saving metadata never removes commits, so this is the only way they go.  The
+// number of commits removed, or which would be removed for a dry run, is returned
+func (r *Repo) PruneCommits(db string, dryRun bool) (pruned int, err error) {
+	kept, err := r.KeptCommits(db)
+	if err != nil {
+		return
+	}
+	sdb, err := r.openStore(db)
+	if err != nil {
+		return
+	}
+	defer sdb.Close()
+	tx, err := sdb.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	var gone []string
+	rows, err := tx.Query(`SELECT id FROM commits`)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return
+		}
+		if _, ok := kept[id]; !ok {
+			gone = append(gone, id)
+		}
+	}
+	if err = rows.Close(); err != nil {
+		return
+	}
+	if dryRun || len(gone) == 0 {
+		return len(gone), nil
+	}
+	for _, id := range gone {
+		if _, err = tx.Exec(`DELETE FROM commits WHERE id = ?`, id); err != nil {
+			return
+		}
+		if _, err = tx.Exec(`DELETE FROM commit_parents WHERE commit_id = ?`, id); err != nil {
+			return
+		}
+	}
+	return len(gone), tx.Commit()
+}
+
+// ReachableCommits returns every commit of a database reachable from the given ones, including those commits
+// themselves.  Both the first parent and any other (merge) parents are followed
+func (r *Repo) ReachableCommits(db string, heads ...string) (commits map[string]client.CommitEntry, err error) {
+	commits = make(map[string]client.CommitEntry)
+	if len(heads) == 0 {
+		return
+	}
+	sdb, err := r.openStore(db)
+	if err != nil {
+		return
+	}
+	defer sdb.Close()
+	args := make([]interface{}, len(heads))
+	for i, h := range heads {
+		args[i] = h
+	}
+	query := `
+		WITH RECURSIVE reachable (id) AS (
+			VALUES ` + strings.TrimSuffix(strings.Repeat("(?), ", len(heads)), ", ") + `
+			UNION
+			SELECT p.parent FROM commit_parents AS p, reachable AS r WHERE p.commit_id = r.id)
+		SELECT c.id, c.data FROM commits AS c, reachable AS r WHERE c.id = r.id`
+	rows, err := sdb.Query(query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, data string
+		if err = rows.Scan(&id, &data); err != nil {
+			return
+		}
+		var c client.CommitEntry
+		if err = json.Unmarshal([]byte(data), &c); err != nil {
+			return
+		}
+		commits[id] = c
+	}
+	return commits, rows.Err()
+}
+
+// Works out the generation number and depth of a commit from those of its parents.  Parents which aren't stored (yet)
+// are skipped, so the rest still works
+func commitPosition(lookup *sql.Stmt, c client.CommitEntry) (gen int, depth int, err error) {
+	gen, depth = 1, 1
+	for i, p := range parentIDs(c) {
+		var pGen, pDepth int
+		err = lookup.QueryRow(p).Scan(&pGen, &pDepth)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if pGen+1 > gen {
+			gen = pGen + 1
+		}
+		if i == 0 && p == c.Parent {
+			depth = pDepth + 1
+		}
+	}
+	return gen, depth, nil
+}
+
+// Writes metadata to a new store for a database, replacing any existing one.  The store is built in a temporary
+// file, then renamed into place
+func (r *Repo) createStore(db string, meta Metadata) (err error) {
+	f, err := ioutil.TempFile(r.dbDir(db), "metadata.db.tmp-")
+	if err != nil {
+		return
+	}
+	tmpFile := f.Name()
+	f.Close()
+	err = func() (err error) {
+		sdb, err := openStoreFile(tmpFile)
+		if err != nil {
+			return
+		}
+		defer sdb.Close()
+		tx, err := sdb.Begin()
+		if err != nil {
+			return
+		}
+		defer tx.Rollback()
+		if _, err = tx.Exec(storeSchema); err != nil {
+			return
+		}
+		if _, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, MetadataFormatVersion)); err != nil {
+			return
+		}
+		if err = writeMetadata(tx, meta); err != nil {
+			return
+		}
+		return tx.Commit()
+	}()
+	if err == nil {
+		err = os.Rename(tmpFile, r.storePath(db))
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile)
+	}
+	return
+}
+
+// Moves the metadata of a database from the metadata.json file used by older versions of dio into a new store.  The
+// JSON file is kept, renamed to metadata.json.imported
+func (r *Repo) importMetadata(db string) (err error) {
+	md, err := ioutil.ReadFile(r.metadataPath(db))
+	if os.IsNotExist(err) {
+		return ErrNoMetadata
+	}
+	if err != nil {
+		return
+	}
+	meta, err := parseMetadata(db, md)
+	if _, newer := err.(*FormatError); err != nil && !newer {
+		meta, err = r.recoverMetadata(db, err)
+	}
+	if err != nil {
+		return
+	}
+	if err = r.createStore(db, meta); err != nil {
+		return
+	}
+
+	// Another dio process may have imported the file at the same time, and already moved it out of the way
+	err = os.Rename(r.metadataPath(db), r.metadataPath(db)+".imported")
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+// Adds commits from a commit list to a store, parents first so their generation numbers and depths are known.  Every
+// parent is recorded, even ones which aren't stored yet, so they're linked up if they're added later
+func insertCommits(tx *sql.Tx, meta Metadata, ids []string) (err error) {
+	lookup, err := tx.Prepare(`SELECT generation, depth FROM commits WHERE id = ?`)
+	if err != nil {
+		return
+	}
+	defer lookup.Close()
+	for _, id := range parentsFirst(meta, ids) {
+		c := meta.Commits[id]
+		gen, depth, err := commitPosition(lookup, c)
+		if err != nil {
+			return err
+		}
+		for i, p := range parentIDs(c) {
+			if _, err = tx.Exec(`INSERT INTO commit_parents (commit_id, parent, position) VALUES (?, ?, ?)`, id, p,
+				i); err != nil {
+				return err
+			}
+		}
+		var data []byte
+		if data, err = json.Marshal(c); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`INSERT INTO commits (id, generation, depth, data) VALUES (?, ?, ?, ?)`, id, gen, depth,
+			string(data)); err != nil {
+			return err
+		}
+	}
+
+	// Commits can be added after their children, eg a merged in parent only fetched later, leaving the children with
+	// generation numbers and depths worked out without them.  Those are worked out again, and then the ones of their
+	// own children in turn, until nothing more changes
+	type child struct {
+		id         string
+		gen, depth int
+		commit     client.CommitEntry
+	}
+	for queue := append([]string(nil), ids...); len(queue) > 0; {
+		id := queue[0]
+		queue = queue[1:]
+		var children []child
+		err = func() error {
+			rows, err := tx.Query(`
+				SELECT c.id, c.generation, c.depth, c.data
+				FROM commit_parents AS p, commits AS c
+				WHERE p.parent = ? AND c.id = p.commit_id`, id)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var ch child
+				var data string
+				if err = rows.Scan(&ch.id, &ch.gen, &ch.depth, &data); err != nil {
+					return err
+				}
+				if err = json.Unmarshal([]byte(data), &ch.commit); err != nil {
+					return err
+				}
+				children = append(children, ch)
+			}
+			return rows.Err()
+		}()
+		if err != nil {
+			return
+		}
+		for _, ch := range children {
+			gen, depth, err := commitPosition(lookup, ch.commit)
+			if err != nil {
+				return err
+			}
+			if gen == ch.gen && depth == ch.depth {
+				continue
+			}
+			if _, err = tx.Exec(`UPDATE commits SET generation = ?, depth = ? WHERE id = ?`, gen, depth,
+				ch.id); err != nil {
+				return err
+			}
+			queue = append(queue, ch.id)
+		}
+	}
+
+	// Branch commit counts come from the depths, so those need updating too
+	_, err = tx.Exec(`
+		UPDATE branches
+		SET commit_count = coalesce((SELECT depth FROM commits WHERE id = branches.commit_id), commit_count)`)
+	return
+}
+
+// Upgrades the metadata store for a database from an older format version, one version at a time in a single
+// transaction.  The version is read again inside the transaction, as another dio process may have upgraded the store
+// in the meantime
+func migrateStore(sdb *sql.DB, db string) (err error) {
+	tx, err := sdb.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	var version int
+	if err = tx.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return
+	}
+	if version >= MetadataFormatVersion {
+		return nil
+	}
+	for ; version < MetadataFormatVersion; version++ {
+		migrate, ok := storeMigrations[version]
+		if !ok {
+			return fmt.Errorf("The metadata store for '%s' is damaged.  It has format version %d", db, version)
+		}
+		if err = migrate(tx); err != nil {
+			return fmt.Errorf("Couldn't upgrade the metadata store for '%s' from format version %d: %v", db,
+				version, err)
+		}
+	}
+	if _, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version)); err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+// Opens the metadata store for a database, first importing its metadata.json file if that hasn't been done yet.
+// Stores from older versions of dio are upgraded, while those from newer versions are refused with a FormatError
+func (r *Repo) openStore(db string) (sdb *sql.DB, err error) {
+	if _, err = os.Stat(r.storePath(db)); os.IsNotExist(err) {
+		if err = r.importMetadata(db); err != nil {
+			return
+		}
+	}
+	sdb, err = openStoreFile(r.storePath(db))
+	if err != nil {
+		return
+	}
+	var version int
+	err = sdb.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if err == nil && version > MetadataFormatVersion {
+		err = &FormatError{DB: db, Version: version}
+	}
+	if err == nil && version < MetadataFormatVersion {
+		err = migrateStore(sdb, db)
+	}
+	if err != nil {
+		sdb.Close()
+		return nil, err
+	}
+	return
+}
+
+// Opens a metadata store file.  Other dio processes may be reading or writing it at the same time, so a busy store
+// is waited on for a while rather than failing straight away.  Transactions take the write lock when they start, as
+// ones reading before they write could otherwise fail part way through when another process writes first
+func openStoreFile(path string) (*sql.DB, error) {
+	return sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=10000&_txlock=immediate", url.PathEscape(path)))
+}
+
+// Walks back through the history of two commits, highest generation number first, marking each commit with which of
+// the two it can be reached from.  Every child of a commit has a higher generation number, so a commit has all of its
+// marks by the time it's walked.  The walk stops once every commit left to walk can be reached from both, as all of
+// their ancestors can be too.  The common ancestor with the highest generation number is returned as the base
+func paintHistory(sdb *sql.DB, a string, b string) (marks map[string]int, base string, err error) {
+	lookup, err := sdb.Prepare(`SELECT generation FROM commits WHERE id = ?`)
+	if err != nil {
+		return
+	}
+	defer lookup.Close()
+	parents, err := sdb.Prepare(`
+		SELECT p.parent, c.generation
+		FROM commit_parents AS p, commits AS c
+		WHERE p.commit_id = ? AND c.id = p.parent`)
+	if err != nil {
+		return
+	}
+	defer parents.Close()
+
+	// Queues a commit to be walked, or adds to the marks of one already queued.  The number of queued commits which
+	// can't yet be reached from both is kept track of, as the walk stops once there are none
+	marks = make(map[string]int)
+	walked := make(map[string]bool)
+	var queue generationQueue
+	pending := 0
+	add := func(id string, gen int, m int) {
+		old, seen := marks[id]
+		if walked[id] {
+			return
+		}
+		marks[id] = old | m
+		switch {
+		case !seen:
+			heap.Push(&queue, queuedCommit{generation: gen, id: id})
+			if marks[id] != reachableFromBoth {
+				pending++
+			}
+		case old != reachableFromBoth && marks[id] == reachableFromBoth:
+			pending--
+		}
+	}
+	for _, start := range []struct {
+		id   string
+		mark int
+	}{{a, reachableFromA}, {b, reachableFromB}} {
+		var gen int
+		err = lookup.QueryRow(start.id).Scan(&gen)
+		if err == sql.ErrNoRows {
+			return nil, "", fmt.Errorf("Commit '%s' isn't in the local commit list", start.id)
+		}
+		if err != nil {
+			return
+		}
+		add(start.id, gen, start.mark)
+	}
+	for pending > 0 {
+		c := heap.Pop(&queue).(queuedCommit)
+		walked[c.id] = true
+		m := marks[c.id]
+		if m != reachableFromBoth {
+			pending--
+		} else if base == "" {
+			base = c.id
+		}
+		var rows *sql.Rows
+		if rows, err = parents.Query(c.id); err != nil {
+			return
+		}
+		for rows.Next() {
+			var p string
+			var pGen int
+			if err = rows.Scan(&p, &pGen); err != nil {
+				rows.Close()
+				return
+			}
+			add(p, pGen, m)
+		}
+		if err = rows.Close(); err != nil {
+			return
+		}
+	}
+
+	// If no common ancestor has been walked yet, the best one is the next in line
+	if base == "" && len(queue) > 0 {
+		base = queue[0].id
+	}
+	return
+}
+
+// Returns the commits from a list in an order where each one comes after any of its parents also in the list
+func parentsFirst(meta Metadata, ids []string) (order []string) {
+	inList := make(map[string]bool)
+	for _, id := range ids {
+		inList[id] = true
+	}
+	done := make(map[string]bool)
+	for _, start := range ids {
+		// A depth first walk, adding each commit once all of its parents have been added.  Parents already on the
+		// stack are skipped, so a loop in damaged metadata can't make it go forever
+		stack := []string{start}
+		onStack := map[string]bool{start: true}
+		for len(stack) > 0 {
+			id := stack[len(stack)-1]
+			if done[id] {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			pending := false
+			for _, p := range parentIDs(meta.Commits[id]) {
+				if inList[p] && !done[p] && !onStack[p] {
+					stack = append(stack, p)
+					onStack[p] = true
+					pending = true
+				}
+			}
+			if !pending {
+				done[id] = true
+				order = append(order, id)
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	return
+}
+
+// Reads the branch heads and active branch from a store, for working out what a save changes
+func readHeads(tx *sql.Tx) (meta Metadata, err error) {
+	meta.Branches = make(map[string]client.BranchEntry)
+	rows, err := tx.Query(`SELECT name, commit_id FROM branches`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var b client.BranchEntry
+		if err = rows.Scan(&name, &b.Commit); err != nil {
+			return
+		}
+		meta.Branches[name] = b
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	var active string
+	err = tx.QueryRow(`SELECT value FROM settings WHERE name = 'active_branch'`).Scan(&active)
+	if err == sql.ErrNoRows {
+		return meta, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(active), &meta.ActiveBranch)
+	return
+}
+
+// Reads every commit from a store into a commit list
+func readCommits(sdb *sql.DB, commits map[string]client.CommitEntry) (err error) {
+	return readRows(sdb, `SELECT id, data FROM commits`, func(id string, data string) error {
+		var c client.CommitEntry
+		if err := json.Unmarshal([]byte(data), &c); err != nil {
+			return err
+		}
+		commits[id] = c
+		return nil
+	})
+}
+
+// Reads the metadata from a store, apart from the commits.  The commit list is left empty
+func readMetadata(sdb *sql.DB) (meta Metadata, err error) {
+	meta.Branches = make(map[string]client.BranchEntry)
+	meta.Commits = make(map[string]client.CommitEntry)
+	meta.Releases = make(map[string]client.ReleaseEntry)
+	meta.Tags = make(map[string]client.TagEntry)
+	if err = sdb.QueryRow(`PRAGMA user_version`).Scan(&meta.FormatVersion); err != nil {
+		return
+	}
+
+	// The settings
+	fields := settingsFields(&meta)
+	err = readRows(sdb, `SELECT name, value FROM settings`, func(name string, value string) error {
+		if f, ok := fields[name]; ok {
+			return json.Unmarshal([]byte(value), f)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// The branches, releases, and tags
+	rows, err := sdb.Query(`SELECT name, commit_id, commit_count, description FROM branches`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var b client.BranchEntry
+		if err = rows.Scan(&name, &b.Commit, &b.CommitCount, &b.Description); err != nil {
+			return
+		}
+		meta.Branches[name] = b
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	err = readRows(sdb, `SELECT name, data FROM releases`, func(name string, data string) error {
+		var rel client.ReleaseEntry
+		if err := json.Unmarshal([]byte(data), &rel); err != nil {
+			return err
+		}
+		meta.Releases[name] = rel
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	err = readRows(sdb, `SELECT name, data FROM tags`, func(name string, data string) error {
+		var t client.TagEntry
+		if err := json.Unmarshal([]byte(data), &t); err != nil {
+			return err
+		}
+		meta.Tags[name] = t
+		return nil
+	})
+	return
+}
+
+// Runs a query returning rows of two strings, calling a function for each row
+func readRows(sdb *sql.DB, query string, f func(a string, b string) error) (err error) {
+	rows, err := sdb.Query(query)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a, b string
+		if err = rows.Scan(&a, &b); err != nil {
+			return
+		}
+		if err = f(a, b); err != nil {
+			return
+		}
+	}
+	return rows.Err()
+}
+
+// Works out the parents, generation numbers, and depths of every stored commit again from the commits themselves,
+// along with the commit counts of the branches
+func rebuildCommitGraph(tx *sql.Tx) (err error) {
+	meta := Metadata{Commits: make(map[string]client.CommitEntry)}
+	rows, err := tx.Query(`SELECT id, data FROM commits`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id, data string
+		if err = rows.Scan(&id, &data); err != nil {
+			return
+		}
+		var c client.CommitEntry
+		if err = json.Unmarshal([]byte(data), &c); err != nil {
+			return
+		}
+		meta.Commits[id] = c
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	for _, table := range []string{"commit_parents", "commits"} {
+		if _, err = tx.Exec(`DELETE FROM ` + table); err != nil {
+			return
+		}
+	}
+	sort.Strings(ids)
+	return insertCommits(tx, meta, ids)
+}
+
+// Returns the fields of the metadata kept in the settings table, by name.  Their values are stored as JSON
+func settingsFields(meta *Metadata) map[string]interface{} {
+	return map[string]interface{}{
+		"active_branch":    &meta.ActiveBranch,
+		"branch_ops":       &meta.BranchOps,
+		"default_branch":   &meta.DefBranch,
+		"deleted_releases": &meta.DeletedReleases,
+		"deleted_tags":     &meta.DeletedTags,
+		"remote_branches":  &meta.RemoteBranches,
+	}
+}
+
+// Returns the path to the metadata store for a database
+func (r *Repo) storePath(db string) string {
+	return filepath.Join(r.dbDir(db), "metadata.db")
+}
+
+// Writes metadata to a store.  Commits never change once made, so only the ones not already stored are added, with
+// the rest left as they are.  Commits missing from the metadata aren't removed, so metadata loaded without its
+// commits can be saved, leaving PruneCommits to remove the ones no longer needed.  The much smaller branch, release,
+// tag, and settings tables are written out in full.  Branch commit counts are taken from the depth of their head
+// commit
+func writeMetadata(tx *sql.Tx, meta Metadata) (err error) {
+	lookup, err := tx.Prepare(`SELECT count(*) FROM commits WHERE id = ?`)
+	if err != nil {
+		return
+	}
+	defer lookup.Close()
+
+	// Work out which commits aren't stored yet
+	var added []string
+	for id := range meta.Commits {
+		var n int
+		if err = lookup.QueryRow(id).Scan(&n); err != nil {
+			return
+		}
+		if n == 0 {
+			added = append(added, id)
+		}
+	}
+
+	// Add the new commits
+	sort.Strings(added)
+	if err = insertCommits(tx, meta, added); err != nil {
+		return
+	}
+
+	// Replace the branches, releases, tags, and settings
+	for _, table := range []string{"branches", "releases", "settings", "tags"} {
+		if _, err = tx.Exec(`DELETE FROM ` + table); err != nil {
+			return
+		}
+	}
+	for name, b := range meta.Branches {
+		_, err = tx.Exec(`
+			INSERT INTO branches (name, commit_id, commit_count, description)
+			VALUES (?, ?, coalesce((SELECT depth FROM commits WHERE id = ?), ?), ?)`,
+			name, b.Commit, b.Commit, b.CommitCount, b.Description)
+		if err != nil {
+			return
+		}
+	}
+	for name, rel := range meta.Releases {
+		var data []byte
+		if data, err = json.Marshal(rel); err != nil {
+			return
+		}
+		if _, err = tx.Exec(`INSERT INTO releases (name, commit_id, data) VALUES (?, ?, ?)`, name, rel.Commit,
+			string(data)); err != nil {
+			return
+		}
+	}
+	for name, t := range meta.Tags {
+		var data []byte
+		if data, err = json.Marshal(t); err != nil {
+			return
+		}
+		if _, err = tx.Exec(`INSERT INTO tags (name, commit_id, data) VALUES (?, ?, ?)`, name, t.Commit,
+			string(data)); err != nil {
+			return
+		}
+	}
+	for name, f := range settingsFields(&meta) {
+		var value []byte
+		if value, err = json.Marshal(f); err != nil {
+			return
+		}
+		if _, err = tx.Exec(`INSERT INTO settings (name, value) VALUES (?, ?)`, name, string(value)); err != nil {
+			return
+		}
+	}
+	return
+}
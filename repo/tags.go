@@ -0,0 +1,40 @@
+package repo
+
+import (
+	"errors"
+
+	"github.com/sqlitebrowser/dio/client"
+)
+
+// CreateTag adds a tag to a database.  This replaces any earlier removal of a tag with the same name, which hasn't
+// been pushed yet
+func (r *Repo) CreateTag(db string, name string, tag client.TagEntry) (err error) {
+	meta, err := r.LoadHeads(db)
+	if err != nil {
+		return
+	}
+	if _, ok := meta.Tags[name]; ok {
+		return errors.New("A tag with that name already exists")
+	}
+	meta.Tags[name] = tag
+	delete(meta.DeletedTags, name)
+	return r.SaveMetadata(db, meta, "tag create")
+}
+
+// RemoveTag removes a tag from a database.  The removal is remembered, so it can be sent to the server on the next
+// push
+func (r *Repo) RemoveTag(db string, name string) (err error) {
+	meta, err := r.LoadHeads(db)
+	if err != nil {
+		return
+	}
+	if _, ok := meta.Tags[name]; !ok {
+		return errors.New("A tag with that name doesn't exist")
+	}
+	if meta.DeletedTags == nil {
+		meta.DeletedTags = make(map[string]client.TagEntry)
+	}
+	meta.DeletedTags[name] = meta.Tags[name]
+	delete(meta.Tags, name)
+	return r.SaveMetadata(db, meta, "tag remove")
+}
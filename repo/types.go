@@ -0,0 +1,90 @@
+package repo
+
+import (
+	"time"
+
+	"github.com/sqlitebrowser/dio/client"
+)
+
+// BranchOp is a change to a branch made locally, which is waiting to be applied to the server on the next push
+type BranchOp struct {
+	Action      string `json:"action"` // One of "create", "update", "remove", or "rename"
+	Branch      string `json:"branch"`
+	Commit      string `json:"commit,omitempty"`
+	Description string `json:"description,omitempty"`
+	NewName     string `json:"new_name,omitempty"`
+}
+
+// CommitOptions holds the details of a new commit, for Commit
+type CommitOptions struct {
+	AuthorEmail    string
+	AuthorName     string
+	Branch         string // The branch the commit is added to.  The active branch is used when empty
+	CommitterEmail string
+	CommitterName  string
+	LicenceSHA     string // The SHA256 of the licence text for the database
+	Message        string
+	OtherParents   []string  // The heads of any other branches merged by the commit
+	Timestamp      time.Time // The current time is used when zero
+}
+
+// Metadata is the local version history of a database.  Besides the branches, commits, releases, and tags, it holds
+// the local changes not yet sent to the server, and the branch heads last seen there
+type Metadata struct {
+	// The local branch
+	ActiveBranch string `json:"active_branch"`
+
+	// Local branch changes not yet on the server
+	BranchOps []BranchOp `json:"branch_ops,omitempty"`
+
+	Branches map[string]client.BranchEntry `json:"branches"`
+	Commits  map[string]client.CommitEntry `json:"commits"`
+
+	// The default branch *on the server*
+	DefBranch string `json:"default_branch"`
+
+	// Releases and tags removed locally, not yet removed on the server
+	DeletedReleases map[string]client.ReleaseEntry `json:"deleted_releases,omitempty"`
+	DeletedTags     map[string]client.TagEntry     `json:"deleted_tags,omitempty"`
+
+	// The version of the format the metadata was stored in.  See MetadataFormatVersion
+	FormatVersion int `json:"format_version"`
+
+	Releases map[string]client.ReleaseEntry `json:"releases"`
+
+	// Branch heads last seen on the server
+	RemoteBranches map[string]client.BranchEntry `json:"remote_branches,omitempty"`
+
+	Tags map[string]client.TagEntry `json:"tags"`
+}
+
+// ReflogEntry records a branch head moving, or the active branch changing, in the local metadata of a database
+type ReflogEntry struct {
+	// What made the change.  eg "commit", "pull", or "branch revert"
+	Action string `json:"action"`
+
+	// The branch whose head moved, or which became the active branch
+	Branch string `json:"branch"`
+
+	// The commit the branch head was at before.  Empty for new branches
+	From string `json:"from,omitempty"`
+
+	// When the active branch changed, the branch which was active before.  From and To are then the head commits of
+	// the old and new active branches
+	PrevActive string `json:"prev_active,omitempty"`
+
+	Timestamp time.Time `json:"timestamp"`
+
+	// The commit the branch head moved to.  Empty for removed branches
+	To string `json:"to,omitempty"`
+}
+
+// StatIndex is the file info and SHA256 of a database file in the working directory, as of the last time it was
+// hashed.  If the file info still matches, the file is assumed to be unchanged, so it doesn't need hashing again
+type StatIndex struct {
+	CTime   int64  `json:"ctime"` // Status change time in nanoseconds, on platforms which provide it
+	Inode   uint64 `json:"inode"`
+	ModTime int64  `json:"mtime"` // Last modified time in nanoseconds
+	Sha256  string `json:"sha256"`
+	Size    int64  `json:"size"`
+}